@@ -1,6 +1,7 @@
 package api
 
 import (
+	"GDHost/internal/config"
 	"GDHost/internal/database"
 	"GDHost/internal/deployment"
 	"context"
@@ -15,35 +16,43 @@ import (
 )
 
 type Server interface {
-	SetUpRouter(db database.Database) error
+	SetUpRouter(db database.Database, ctr deployment.ContainerRuntime, dial deployment.NodeDialer, portFree deployment.PortChecker) error
 	Run() error
 	Shutdown(ctx context.Context, cancel context.CancelFunc, sig chan os.Signal)
 }
 
 type server struct {
-	path     string
-	srv      *http.Server
-	host     string
-	logger   *zerolog.Logger
-	location string
+	path        string
+	srv         *http.Server
+	host        string
+	logger      *zerolog.Logger
+	conf        *config.Config
+	dcontroller deployment.Deployment
 }
 
-func NewServer(path, host, location string, logger *zerolog.Logger) Server {
+func NewServer(host string, conf *config.Config, logger *zerolog.Logger) Server {
 	return &server{
-		path:     path,
-		host:     host,
-		logger:   logger,
-		location: location,
+		path:   conf.APIPath,
+		host:   host,
+		logger: logger,
+		conf:   conf,
 	}
 }
 
-func (s *server) SetUpRouter(db database.Database) error {
+func (s *server) SetUpRouter(db database.Database, ctr deployment.ContainerRuntime, dial deployment.NodeDialer,
+	portFree deployment.PortChecker) error {
 	r := gin.New()
 	r.Use(requestid.New())
 	r.Use(logger.SetLogger())
 	r.Use(gin.Recovery())
 
-	dcontroller, err := deployment.NewDeploymentController(s.location, db, s.logger)
+	dcontroller, err := deployment.NewDeploymentController(s.conf, db, ctr, dial, portFree, s.logger)
+	if err != nil {
+		return err
+	}
+	s.dcontroller = dcontroller
+
+	tcontroller, err := deployment.NewTemplateRegistry(db, s.logger)
 	if err != nil {
 		return err
 	}
@@ -52,7 +61,39 @@ func (s *server) SetUpRouter(db database.Database) error {
 	{
 		dep.POST("/create", dcontroller.CreateDeployment)
 		dep.POST("/:id/dockerfile/go", dcontroller.GenerateGoDockerfile)
-		dep.POST("/:id/image", dcontroller.CreateDeploymentImage)
+		dep.POST("/:id/dockerfile/node", dcontroller.GenerateNodeDockerfile)
+		dep.POST("/:id/dockerfile/python", dcontroller.GeneratePythonDockerfile)
+		dep.POST("/:id/dockerfile/auto", dcontroller.GenerateAutoDockerfile)
+		dep.POST("/:id/dockerfile/template", dcontroller.GenerateTemplateDockerfile)
+		dep.GET("/:id/detect", dcontroller.DetectDeployment)
+		dep.POST("/:id/image", dcontroller.CreateBuild)
+		dep.POST("/:id/builds", dcontroller.CreateBuild)
+		dep.GET("/:id/releases", dcontroller.GetReleases)
+		dep.GET("/:id/releases/:version", dcontroller.GetRelease)
+		dep.POST("/:id/rollback", dcontroller.RollbackDeployment)
+		dep.POST("/:id/deploy", dcontroller.DeployDeployment)
+		dep.GET("/:id/env", dcontroller.GetEnv)
+		dep.PUT("/:id/env", dcontroller.UpdateEnv)
+		dep.GET("/:id/secrets", dcontroller.GetSecrets)
+		dep.PUT("/:id/secrets/:name", dcontroller.SetSecret)
+		dep.DELETE("/:id/secrets/:name", dcontroller.DeleteSecret)
+		dep.PUT("/:id/resources", dcontroller.UpdateResources)
+		dep.PUT("/:id/restart-policy", dcontroller.UpdateRestartPolicy)
+		dep.PUT("/:id/health-check", dcontroller.UpdateHealthCheck)
+		dep.DELETE("/:id/health-check", dcontroller.DeleteHealthCheck)
+		dep.POST("/:id/volumes", dcontroller.CreateVolume)
+		dep.GET("/:id/volumes", dcontroller.GetVolumes)
+		dep.DELETE("/:id/volumes/:name", dcontroller.DeleteVolume)
+		dep.PUT("/:id/route", dcontroller.UpdateRoute)
+		dep.DELETE("/:id/route", dcontroller.DeleteRoute)
+		dep.POST("/:id/domains", dcontroller.CreateDomain)
+		dep.GET("/:id/domains", dcontroller.GetDomains)
+		dep.GET("/:id/domains/:name", dcontroller.GetDomain)
+		dep.POST("/:id/domains/:name/verify", dcontroller.VerifyDomain)
+		dep.DELETE("/:id/domains/:name", dcontroller.DeleteDomain)
+		dep.POST("/:id/links", dcontroller.CreateLink)
+		dep.GET("/:id/links", dcontroller.GetLinks)
+		dep.DELETE("/:id/links/:link", dcontroller.DeleteLink)
 		dep.POST("/:id/run", dcontroller.RunDeployment)
 		dep.POST("/:id/stop", dcontroller.StopDeployment)
 		dep.DELETE("/:id/container", dcontroller.DeleteDeploymentContainer)
@@ -64,6 +105,32 @@ func (s *server) SetUpRouter(db database.Database) error {
 		dep.POST("/:id/dockerfile", dcontroller.UploadDockerfile)
 	}
 
+	build := r.Group(s.path + "/builds")
+	{
+		build.GET("/:id", dcontroller.GetBuild)
+		build.GET("/:id/logs", dcontroller.GetBuildLogs)
+	}
+
+	r.GET(s.path+"/ca", dcontroller.GetCACertificate)
+
+	node := r.Group(s.path + "/nodes")
+	{
+		node.POST("", dcontroller.CreateNode)
+		node.GET("", dcontroller.GetNodes)
+		node.GET("/:name", dcontroller.GetNode)
+		node.PUT("/:name", dcontroller.UpdateNode)
+		node.DELETE("/:name", dcontroller.DeleteNode)
+	}
+
+	tmpl := r.Group(s.path + "/templates")
+	{
+		tmpl.POST("", tcontroller.CreateTemplate)
+		tmpl.GET("", tcontroller.GetTemplates)
+		tmpl.GET("/:name", tcontroller.GetTemplate)
+		tmpl.PUT("/:name", tcontroller.UpdateTemplate)
+		tmpl.DELETE("/:name", tcontroller.DeleteTemplate)
+	}
+
 	s.srv = &http.Server{
 		Addr:              s.host,
 		Handler:           r,
@@ -73,7 +140,11 @@ func (s *server) SetUpRouter(db database.Database) error {
 	return nil
 }
 
+// Run serves https when a certificate is configured
 func (s *server) Run() error {
+	if s.conf.TLSCertFile != "" {
+		return s.srv.ListenAndServeTLS(s.conf.TLSCertFile, s.conf.TLSKeyFile)
+	}
 	return s.srv.ListenAndServe()
 }
 
@@ -90,4 +161,5 @@ func (s *server) Shutdown(ctx context.Context, cancel context.CancelFunc, sig ch
 	if err := s.srv.Shutdown(ctx); err != nil {
 		s.logger.Fatal().Err(err).Msg("failed to shutdown server")
 	}
+	s.dcontroller.Close()
 }
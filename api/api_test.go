@@ -0,0 +1,895 @@
+package api
+
+import (
+	"GDHost/internal/config"
+	"GDHost/internal/database"
+	"GDHost/internal/deployment"
+	"GDHost/internal/deployment/fakedocker"
+	"GDHost/internal/model"
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/gin-gonic/gin"
+	"github.com/rs/zerolog"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const testNetwork = "gdhost-test"
+
+func init() {
+	gin.SetMode(gin.TestMode)
+}
+
+type testServer struct {
+	t       *testing.T
+	handler http.Handler
+	engine  *fakedocker.Engine
+	// nodes are the engines of the registered nodes by endpoint, dials counts the connections by endpoint
+	nodes   map[string]*fakedocker.Engine
+	dials   map[string]int
+	nodesMu sync.Mutex
+	// bound are the host ports taken outside GDHost, the host itself is never checked
+	bound   map[int]bool
+	boundMu sync.Mutex
+}
+
+// newTestServer serves the API on an in-memory database and a fake docker engine
+func newTestServer(t *testing.T) *testServer {
+	t.Helper()
+	return newEngineServer(t, fakedocker.New(testNetwork))
+}
+
+// newEngineServer serves the API on an in-memory database and the engine
+func newEngineServer(t *testing.T, engine *fakedocker.Engine) *testServer {
+	t.Helper()
+	return newDatabaseServer(t, engine, database.NewMemoryDatabase())
+}
+
+// newDatabaseServer serves the API on the database and the engine
+func newDatabaseServer(t *testing.T, engine *fakedocker.Engine, db database.Database) *testServer {
+	t.Helper()
+	conf := &config.Config{
+		APIPath:           "/v1",
+		Location:          t.TempDir(),
+		BuildWorkers:      1,
+		ReleaseRetention:  3,
+		CrashLoopRestarts: 3,
+		CrashLoopWindow:   60,
+		PortRangeStart:    39100,
+		PortRangeEnd:      39199,
+		DockerNetwork:     testNetwork,
+	}
+	ts := &testServer{t: t, engine: engine, nodes: map[string]*fakedocker.Engine{}, dials: map[string]int{}, bound: map[int]bool{}}
+	logger := zerolog.Nop()
+	s := NewServer(":0", conf, &logger).(*server)
+	if err := s.SetUpRouter(db, engine, ts.dial, ts.portFree); err != nil {
+		t.Fatalf("failed to set up the router: %v", err)
+	}
+	t.Cleanup(s.dcontroller.Close)
+	ts.handler = s.srv.Handler
+	return ts
+}
+
+// dial connects to the fake engine started for the endpoint of the node
+func (ts *testServer) dial(ctx context.Context, node model.Node) (deployment.ContainerRuntime, error) {
+	ts.nodesMu.Lock()
+	defer ts.nodesMu.Unlock()
+	ts.dials[node.Endpoint]++
+	engine, ok := ts.nodes[node.Endpoint]
+	if !ok {
+		return nil, errors.New("connection refused")
+	}
+	return engine, nil
+}
+
+// startNode starts a fake engine answering on the endpoint
+func (ts *testServer) startNode(endpoint string) *fakedocker.Engine {
+	ts.nodesMu.Lock()
+	defer ts.nodesMu.Unlock()
+	engine := fakedocker.New(testNetwork)
+	ts.nodes[endpoint] = engine
+	return engine
+}
+
+// dialed returns the number of connections to the endpoint
+func (ts *testServer) dialed(endpoint string) int {
+	ts.nodesMu.Lock()
+	defer ts.nodesMu.Unlock()
+	return ts.dials[endpoint]
+}
+
+// portFree reports the host ports which are not bound by bind as free
+func (ts *testServer) portFree(port model.Port) bool {
+	ts.boundMu.Lock()
+	defer ts.boundMu.Unlock()
+	return !ts.bound[port.HostPort]
+}
+
+// bind takes the host port outside GDHost
+func (ts *testServer) bind(port int) {
+	ts.boundMu.Lock()
+	defer ts.boundMu.Unlock()
+	ts.bound[port] = true
+}
+
+// do sends the request and decodes the json response
+func (ts *testServer) do(req *http.Request) (int, map[string]interface{}) {
+	ts.t.Helper()
+	rec := httptest.NewRecorder()
+	ts.handler.ServeHTTP(rec, req)
+
+	body := map[string]interface{}{}
+	if rec.Body.Len() != 0 {
+		if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+			ts.t.Fatalf("%s %s: invalid response %q: %v", req.Method, req.URL, rec.Body.String(), err)
+		}
+	}
+	return rec.Code, body
+}
+
+func (ts *testServer) request(method string, path string, payload interface{}) (int, map[string]interface{}) {
+	ts.t.Helper()
+	var body io.Reader
+	if payload != nil {
+		b, err := json.Marshal(payload)
+		if err != nil {
+			ts.t.Fatal(err)
+		}
+		body = bytes.NewReader(b)
+	}
+	req := httptest.NewRequest(method, "/v1"+path, body)
+	req.Header.Set("Content-Type", "application/json")
+	return ts.do(req)
+}
+
+// expect sends the request and fails the test on another status
+func (ts *testServer) expect(status int, method string, path string, payload interface{}) map[string]interface{} {
+	ts.t.Helper()
+	code, body := ts.request(method, path, payload)
+	if code != status {
+		ts.t.Fatalf("%s %s: got status %d, want %d: %v", method, path, code, status, body)
+	}
+	return body
+}
+
+// create uploads a zipped go application and returns the deployment id
+func (ts *testServer) create(name string) string {
+	ts.t.Helper()
+	var archive bytes.Buffer
+	zw := zip.NewWriter(&archive)
+	for fname, content := range map[string]string{
+		"go.mod":  "module example\n\ngo 1.22\n",
+		"main.go": "package main\n\nfunc main() {}\n",
+	} {
+		w, err := zw.Create(fname)
+		if err != nil {
+			ts.t.Fatal(err)
+		}
+		if _, err = w.Write([]byte(content)); err != nil {
+			ts.t.Fatal(err)
+		}
+	}
+	if err := zw.Close(); err != nil {
+		ts.t.Fatal(err)
+	}
+
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	if err := mw.WriteField("name", name); err != nil {
+		ts.t.Fatal(err)
+	}
+	fw, err := mw.CreateFormFile("file", name+".zip")
+	if err != nil {
+		ts.t.Fatal(err)
+	}
+	if _, err = fw.Write(archive.Bytes()); err != nil {
+		ts.t.Fatal(err)
+	}
+	if err = mw.Close(); err != nil {
+		ts.t.Fatal(err)
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "/v1/deployments/create", &body)
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	code, resp := ts.do(req)
+	if code != http.StatusOK {
+		ts.t.Fatalf("create %s: got status %d: %v", name, code, resp)
+	}
+	return resp["message"].(string)
+}
+
+// build queues a build of the deployment and waits until it finished
+func (ts *testServer) build(depId string) map[string]interface{} {
+	ts.t.Helper()
+	buildId := ts.expect(http.StatusAccepted, http.MethodPost, "/deployments/"+depId+"/builds", nil)["message"].(string)
+
+	deadline := time.Now().Add(10 * time.Second)
+	for time.Now().Before(deadline) {
+		build := ts.expect(http.StatusOK, http.MethodGet, "/builds/"+buildId, nil)["build"].(map[string]interface{})
+		if status := build["status"]; status == "Succeeded" || status == "Failed" {
+			return build
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	ts.t.Fatalf("build %s did not finish", buildId)
+	return nil
+}
+
+func (ts *testServer) containerId(depId string) string {
+	ts.t.Helper()
+	var id string
+	// the container id is not part of the api, the fake engine knows it by the deployment label
+	for _, cid := range ts.engine.Containers(depId) {
+		id = cid
+	}
+	return id
+}
+
+func (ts *testServer) deployment(depId string) map[string]interface{} {
+	ts.t.Helper()
+	return ts.expect(http.StatusOK, http.MethodGet, "/deployments/"+depId, nil)["deployment"].(map[string]interface{})
+}
+
+func (ts *testServer) stage(depId string) string {
+	ts.t.Helper()
+	return ts.deployment(depId)["stage"].(string)
+}
+
+func TestDeploymentLifecycle(t *testing.T) {
+	ts := newTestServer(t)
+
+	depId := ts.create("lifecycle")
+	if stage := ts.stage(depId); stage != "File Uploaded" {
+		t.Fatalf("got stage %q after create", stage)
+	}
+
+	ts.expect(http.StatusOK, http.MethodPost, "/deployments/"+depId+"/dockerfile/go", map[string]string{"version": "1.22"})
+	if stage := ts.stage(depId); stage != "Dockerfile Uploaded/Created" {
+		t.Fatalf("got stage %q after dockerfile", stage)
+	}
+
+	build := ts.build(depId)
+	if build["status"] != "Succeeded" {
+		t.Fatalf("build failed: %v", build)
+	}
+	if build["release"].(float64) != 1 {
+		t.Fatalf("got release %v, want 1", build["release"])
+	}
+	imageId := build["image_id"].(string)
+	if !ts.engine.HasImage(imageId) {
+		t.Fatalf("image %s was not built", imageId)
+	}
+	logs := ts.expect(http.StatusOK, http.MethodGet, "/builds/"+build["ID"].(string)+"/logs", nil)["logs"].([]interface{})
+	if len(logs) == 0 {
+		t.Fatal("build output was not stored")
+	}
+	dep := ts.deployment(depId)
+	if dep["stage"] != "ImageId Created" || dep["release"].(float64) != 1 {
+		t.Fatalf("deployment not updated by the build: %v", dep)
+	}
+
+	ts.expect(http.StatusOK, http.MethodPost, "/deployments/"+depId+"/run", map[string]int{"container_port": 8080})
+	cid := ts.containerId(depId)
+	if exists, running := ts.engine.HasContainer(cid); !exists || !running {
+		t.Fatalf("container %q exists %v running %v after run", cid, exists, running)
+	}
+	if !ts.engine.HasNetwork(depId) {
+		t.Fatal("network of the deployment was not created")
+	}
+	dep = ts.deployment(depId)
+	if dep["stage"] != "Container Created" || dep["host_port"].(float64) < 39100 {
+		t.Fatalf("deployment not updated by run: %v", dep)
+	}
+
+	// a running container is not removed
+	ts.expect(http.StatusUnprocessableEntity, http.MethodDelete, "/deployments/"+depId+"/container", nil)
+
+	ts.expect(http.StatusOK, http.MethodPost, "/deployments/"+depId+"/stop", nil)
+	if _, running := ts.engine.HasContainer(cid); running {
+		t.Fatal("container still running after stop")
+	}
+
+	// the limits of the created container are not changed by run
+	payload := map[string]interface{}{"resources": map[string]int{"memory_mb": 128}}
+	ts.expect(http.StatusUnprocessableEntity, http.MethodPost, "/deployments/"+depId+"/run", payload)
+	ts.expect(http.StatusOK, http.MethodPut, "/deployments/"+depId+"/resources", map[string]int{"memory_mb": 128, "pids_limit": 64})
+	if dep = ts.deployment(depId); dep["recreate_required"] != false {
+		t.Fatalf("got deployment %v after limits updated in place", dep)
+	}
+	// a removed memory limit is kept by the container until it is recreated
+	ts.expect(http.StatusOK, http.MethodPut, "/deployments/"+depId+"/resources", map[string]int{"pids_limit": 64})
+	if dep = ts.deployment(depId); dep["recreate_required"] != true {
+		t.Fatalf("got deployment %v after the memory limit was removed", dep)
+	}
+
+	// the stopped container is started again
+	ts.expect(http.StatusOK, http.MethodPost, "/deployments/"+depId+"/run", map[string]int{})
+	if _, running := ts.engine.HasContainer(cid); !running {
+		t.Fatal("container not restarted")
+	}
+	ts.expect(http.StatusOK, http.MethodPost, "/deployments/"+depId+"/stop", nil)
+
+	ts.expect(http.StatusOK, http.MethodDelete, "/deployments/"+depId+"/container", nil)
+	if exists, _ := ts.engine.HasContainer(cid); exists {
+		t.Fatal("container not removed")
+	}
+
+	ts.expect(http.StatusOK, http.MethodDelete, "/deployments/"+depId, nil)
+	if ts.engine.HasImage(imageId) {
+		t.Fatal("image not removed with the deployment")
+	}
+	ts.expect(http.StatusNotFound, http.MethodGet, "/deployments/"+depId, nil)
+}
+
+func TestDeleteRunningDeployment(t *testing.T) {
+	ts := newTestServer(t)
+
+	depId := ts.create("running")
+	ts.expect(http.StatusOK, http.MethodPost, "/deployments/"+depId+"/dockerfile/go", map[string]string{"version": "1.22"})
+	if build := ts.build(depId); build["status"] != "Succeeded" {
+		t.Fatalf("build failed: %v", build)
+	}
+	ts.expect(http.StatusOK, http.MethodPost, "/deployments/"+depId+"/run", map[string]int{"container_port": 8080})
+	cid := ts.containerId(depId)
+
+	ts.expect(http.StatusOK, http.MethodDelete, "/deployments/"+depId, nil)
+	if exists, _ := ts.engine.HasContainer(cid); exists {
+		t.Fatal("running container not removed with the deployment")
+	}
+	ts.expect(http.StatusNotFound, http.MethodGet, "/deployments/"+depId, nil)
+}
+
+func TestPurgeVolumes(t *testing.T) {
+	ts := newTestServer(t)
+
+	depId := ts.create("stateful")
+	ts.expect(http.StatusOK, http.MethodPost, "/deployments/"+depId+"/dockerfile/go", map[string]string{"version": "1.22"})
+	build := ts.build(depId)
+	if build["status"] != "Succeeded" {
+		t.Fatalf("build failed: %v", build)
+	}
+	imageId := build["image_id"].(string)
+	ts.expect(http.StatusOK, http.MethodPost, "/deployments/"+depId+"/volumes", map[string]string{"name": "data", "target": "/data"})
+	vols := ts.expect(http.StatusOK, http.MethodGet, "/deployments/"+depId+"/volumes", nil)["volumes"].([]interface{})
+	source := vols[0].(map[string]interface{})["source"].(string)
+
+	ts.expect(http.StatusOK, http.MethodPost, "/deployments/"+depId+"/run", map[string]int{"container_port": 8080})
+
+	// the data is kept while the deployment is not deleted
+	ts.engine.Fail("RemoveContainer", errors.New("device or resource busy"))
+	ts.expect(http.StatusInternalServerError, http.MethodDelete, "/deployments/"+depId+"?purge_volumes=true", nil)
+	ts.engine.Fail("RemoveContainer", nil)
+	if !ts.engine.HasVolume(source) {
+		t.Fatal("volume removed by a failed delete")
+	}
+	ts.deployment(depId)
+
+	// the objects left on the engine do not keep the deployment once it is deleted
+	ts.engine.Fail("DeleteImage", errors.New("image is in use"))
+	ts.expect(http.StatusOK, http.MethodDelete, "/deployments/"+depId+"?purge_volumes=true", nil)
+	ts.engine.Fail("DeleteImage", nil)
+	if ts.engine.HasVolume(source) || ts.engine.HasNetwork(depId) {
+		t.Fatal("volume or network not removed with the deployment")
+	}
+	if !ts.engine.HasImage(imageId) {
+		t.Fatal("image removed while the engine failed")
+	}
+	ts.expect(http.StatusNotFound, http.MethodGet, "/deployments/"+depId, nil)
+}
+
+func TestBuildFailure(t *testing.T) {
+	ts := newTestServer(t)
+
+	depId := ts.create("broken")
+
+	// nothing to build without a dockerfile
+	ts.expect(http.StatusBadRequest, http.MethodPost, "/deployments/"+depId+"/builds", nil)
+
+	ts.expect(http.StatusOK, http.MethodPost, "/deployments/"+depId+"/dockerfile/go", map[string]string{"version": "1.22"})
+
+	ts.engine.FailBuild("go: cannot find main module")
+	build := ts.build(depId)
+	if build["status"] != "Failed" || build["error"] != "go: cannot find main module" {
+		t.Fatalf("got build %v", build)
+	}
+	logs := ts.expect(http.StatusOK, http.MethodGet, "/builds/"+build["ID"].(string)+"/logs", nil)["logs"].([]interface{})
+	last := logs[len(logs)-1].(map[string]interface{})
+	if last["type"] != "error" {
+		t.Fatalf("build error not stored in the output: %v", last)
+	}
+	dep := ts.deployment(depId)
+	if dep["stage"] != "Dockerfile Uploaded/Created" || dep["build_error"] != "go: cannot find main module" {
+		t.Fatalf("got deployment %v after a failed build", dep)
+	}
+	ts.expect(http.StatusInternalServerError, http.MethodPost, "/deployments/"+depId+"/run", map[string]int{"container_port": 8080})
+
+	ts.engine.FailBuild("")
+	if build = ts.build(depId); build["status"] != "Succeeded" {
+		t.Fatalf("build failed after the fix: %v", build)
+	}
+}
+
+func TestPodmanBuildOutput(t *testing.T) {
+	engine := fakedocker.New(testNetwork)
+	engine.SetInfo(deployment.RuntimeInfo{Engine: "podman", Version: "4.9.3"})
+	ts := newEngineServer(t, engine)
+
+	depId := ts.create("podman")
+	ts.expect(http.StatusOK, http.MethodPost, "/deployments/"+depId+"/dockerfile/go", map[string]string{"version": "1.22"})
+
+	lines := func(build map[string]interface{}) []map[string]interface{} {
+		logs := ts.expect(http.StatusOK, http.MethodGet, "/builds/"+build["ID"].(string)+"/logs", nil)["logs"].([]interface{})
+		var lines []map[string]interface{}
+		for _, l := range logs {
+			lines = append(lines, l.(map[string]interface{}))
+		}
+		return lines
+	}
+
+	ts.engine.FailBuild("building at STEP \"RUN go build\": exit status 1")
+	build := ts.build(depId)
+	if build["status"] != "Failed" || build["error"] != "building at STEP \"RUN go build\": exit status 1" {
+		t.Fatalf("got build %v", build)
+	}
+	logs := lines(build)
+	if first := logs[0]["line"].(string); !strings.HasPrefix(first, "STEP 1/") || !strings.Contains(first, "FROM") {
+		t.Fatalf("step split over two messages not joined: %q", first)
+	}
+	if last := logs[len(logs)-1]; last["type"] != "error" {
+		t.Fatalf("plain error line not stored as the error: %v", last)
+	}
+
+	ts.engine.FailBuild("")
+	if build = ts.build(depId); build["status"] != "Succeeded" {
+		t.Fatalf("build failed: %v", build)
+	}
+	for _, l := range lines(build) {
+		if l["type"] != "stream" {
+			t.Fatalf("got %v in a successful podman build", l)
+		}
+	}
+}
+
+func TestEngineFailures(t *testing.T) {
+	ts := newTestServer(t)
+
+	depId := ts.create("flaky")
+	ts.expect(http.StatusOK, http.MethodPost, "/deployments/"+depId+"/dockerfile/go", map[string]string{"version": "1.22"})
+
+	ts.engine.Fail("BuildImage", errors.New("docker daemon unavailable"))
+	if build := ts.build(depId); build["status"] != "Failed" {
+		t.Fatalf("got build %v with the engine down", build)
+	}
+	ts.engine.Fail("BuildImage", nil)
+	if build := ts.build(depId); build["status"] != "Succeeded" {
+		t.Fatalf("build failed: %v", build)
+	}
+
+	ts.engine.Fail("CreateContainer", errors.New("no space left on device"))
+	ts.expect(http.StatusInternalServerError, http.MethodPost, "/deployments/"+depId+"/run", map[string]int{"container_port": 8080})
+	if cid := ts.containerId(depId); cid != "" {
+		t.Fatalf("container %s created", cid)
+	}
+	if stage := ts.stage(depId); stage != "ImageId Created" {
+		t.Fatalf("got stage %q after a failed create", stage)
+	}
+	ts.engine.Fail("CreateContainer", nil)
+
+	ts.engine.Fail("StartContainer", errors.New("port is already allocated"))
+	ts.expect(http.StatusInternalServerError, http.MethodPost, "/deployments/"+depId+"/run", map[string]int{"container_port": 8080})
+	cid := ts.containerId(depId)
+	if exists, running := ts.engine.HasContainer(cid); !exists || running {
+		t.Fatalf("container %q exists %v running %v after a failed start", cid, exists, running)
+	}
+	ts.engine.Fail("StartContainer", nil)
+
+	// the created container is reused
+	ts.expect(http.StatusOK, http.MethodPost, "/deployments/"+depId+"/run", map[string]int{})
+	if _, running := ts.engine.HasContainer(cid); !running {
+		t.Fatal("container not started")
+	}
+
+	ts.engine.Fail("StopContainer", errors.New("timeout"))
+	ts.expect(http.StatusInternalServerError, http.MethodPost, "/deployments/"+depId+"/stop", nil)
+	ts.engine.Fail("StopContainer", nil)
+	ts.expect(http.StatusOK, http.MethodPost, "/deployments/"+depId+"/stop", nil)
+
+	ts.engine.Fail("RemoveContainer", errors.New("device or resource busy"))
+	ts.expect(http.StatusInternalServerError, http.MethodDelete, "/deployments/"+depId+"/container", nil)
+	if exists, _ := ts.engine.HasContainer(cid); !exists {
+		t.Fatal("container removed")
+	}
+	// the deployment keeps the container it could not remove
+	if stage := ts.stage(depId); stage != "Container Created" {
+		t.Fatalf("got stage %q", stage)
+	}
+	ts.engine.Fail("RemoveContainer", nil)
+	ts.expect(http.StatusOK, http.MethodDelete, "/deployments/"+depId+"/container", nil)
+}
+
+func TestUDPHealthCheck(t *testing.T) {
+	ts := newTestServer(t)
+
+	depId := ts.create("resolver")
+	ts.expect(http.StatusOK, http.MethodPost, "/deployments/"+depId+"/dockerfile/go", map[string]string{"version": "1.22"})
+	if build := ts.build(depId); build["status"] != "Succeeded" {
+		t.Fatalf("build failed: %v", build)
+	}
+	ts.expect(http.StatusOK, http.MethodPut, "/deployments/"+depId+"/health-check", map[string]string{"type": "tcp"})
+
+	// the tcp check has no port to fall back to with udp mappings only
+	udp := map[string]interface{}{"ports": []map[string]interface{}{{"container_port": 53, "protocol": "udp"}}}
+	ts.expect(http.StatusBadRequest, http.MethodPost, "/deployments/"+depId+"/run", udp)
+	ts.expect(http.StatusOK, http.MethodPut, "/deployments/"+depId+"/health-check", map[string]interface{}{"type": "tcp", "port": 53})
+	ts.expect(http.StatusOK, http.MethodPost, "/deployments/"+depId+"/run", udp)
+
+	ts.expect(http.StatusBadRequest, http.MethodPut, "/deployments/"+depId+"/health-check", map[string]string{"type": "http", "path": "/"})
+	ts.expect(http.StatusOK, http.MethodPut, "/deployments/"+depId+"/health-check", map[string]string{"type": "command", "command": "dig"})
+}
+
+func TestCrashLoopingFilter(t *testing.T) {
+	ts := newTestServer(t)
+
+	var depIds []string
+	for _, name := range []string{"steady", "crashing"} {
+		depId := ts.create(name)
+		ts.expect(http.StatusOK, http.MethodPost, "/deployments/"+depId+"/dockerfile/go", map[string]string{"version": "1.22"})
+		if build := ts.build(depId); build["status"] != "Succeeded" {
+			t.Fatalf("build failed: %v", build)
+		}
+		ts.expect(http.StatusOK, http.MethodPost, "/deployments/"+depId+"/run", map[string]int{"container_port": 8080})
+		depIds = append(depIds, depId)
+	}
+	code, _ := ts.request(http.MethodGet, "/deployments/?crash_looping=true", nil)
+	if code != http.StatusNoContent {
+		t.Fatalf("got status %d with no crash looping deployment", code)
+	}
+
+	// the restart policy starts the container again after each crash
+	cid := ts.containerId(depIds[1])
+	for i := 0; i < 3; i++ {
+		if err := ts.engine.Crash(cid, 1); err != nil {
+			t.Fatal(err)
+		}
+		if err := ts.engine.StartContainer(context.Background(), cid); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		code, body := ts.request(http.MethodGet, "/deployments/?crash_looping=true", nil)
+		if code == http.StatusOK {
+			deps := body["deployments"].([]interface{})
+			if len(deps) != 1 {
+				t.Fatalf("got crash looping deployments %v", deps)
+			}
+			if dep := deps[0].(map[string]interface{}); dep["ID"] != depIds[1] || dep["crash_looping"] != true {
+				t.Fatalf("got crash looping deployment %v", dep)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("crash looping deployment not found")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	ts.expect(http.StatusBadRequest, http.MethodGet, "/deployments/?crash_looping=maybe", nil)
+}
+
+func TestRollbackFailure(t *testing.T) {
+	ts := newTestServer(t)
+
+	depId := ts.create("rollback")
+	ts.expect(http.StatusOK, http.MethodPost, "/deployments/"+depId+"/dockerfile/go", map[string]string{"version": "1.22"})
+	for i := 0; i < 2; i++ {
+		if build := ts.build(depId); build["status"] != "Succeeded" {
+			t.Fatalf("build failed: %v", build)
+		}
+	}
+	ts.expect(http.StatusOK, http.MethodPost, "/deployments/"+depId+"/run", map[string]int{"container_port": 8080})
+	cid := ts.containerId(depId)
+
+	// the previous container is kept when the rolled back one can not take its place
+	for _, op := range []string{"StopContainer", "StartContainer"} {
+		ts.engine.Fail(op, errors.New("device or resource busy"))
+		ts.expect(http.StatusInternalServerError, http.MethodPost, "/deployments/"+depId+"/rollback", map[string]int{"version": 1})
+		ts.engine.Fail(op, nil)
+		if ids := ts.engine.Containers(depId); len(ids) != 1 || ids[0] != cid {
+			t.Fatalf("got containers %v after a failed %s, want %s", ids, op, cid)
+		}
+		if dep := ts.deployment(depId); dep["release"] != float64(2) || dep["stage"] != "Container Created" {
+			t.Fatalf("got deployment %v after a failed %s", dep, op)
+		}
+		if _, running := ts.engine.HasContainer(cid); op == "StopContainer" && !running {
+			t.Fatal("previous container not running after a failed rollback")
+		}
+	}
+
+	ts.expect(http.StatusOK, http.MethodPost, "/deployments/"+depId+"/rollback", map[string]int{"version": 1})
+	ids := ts.engine.Containers(depId)
+	if len(ids) != 1 || ids[0] == cid {
+		t.Fatalf("got containers %v after the rollback", ids)
+	}
+	if _, running := ts.engine.HasContainer(ids[0]); !running {
+		t.Fatal("rolled back container not running")
+	}
+	if dep := ts.deployment(depId); dep["release"] != float64(1) {
+		t.Fatalf("got release %v after the rollback", dep["release"])
+	}
+}
+
+func TestPortConflicts(t *testing.T) {
+	ts := newTestServer(t)
+
+	var depIds []string
+	for _, name := range []string{"first", "second"} {
+		depId := ts.create(name)
+		ts.expect(http.StatusOK, http.MethodPost, "/deployments/"+depId+"/dockerfile/go", map[string]string{"version": "1.22"})
+		if build := ts.build(depId); build["status"] != "Succeeded" {
+			t.Fatalf("build failed: %v", build)
+		}
+		depIds = append(depIds, depId)
+	}
+
+	// a port bound on the host is skipped by the allocation and rejected without an owner
+	ts.bind(39100)
+	ts.expect(http.StatusOK, http.MethodPost, "/deployments/"+depIds[0]+"/run", map[string]int{"container_port": 8080})
+	if port := ts.deployment(depIds[0])["host_port"]; port != float64(39101) {
+		t.Fatalf("got host port %v, want the first free port 39101", port)
+	}
+	body := ts.expect(http.StatusConflict, http.MethodPost, "/deployments/"+depIds[1]+"/run", map[string]int{"host_port": 39100, "container_port": 8080})
+	if _, ok := body["deployment_id"]; ok {
+		t.Fatalf("got an owner of a port bound on the host: %v", body)
+	}
+
+	// the reservation holds the port on every interface
+	ports := []map[string]interface{}{{"host_ip": "10.0.0.2", "host_port": 39101, "container_port": 8080}}
+	body = ts.expect(http.StatusConflict, http.MethodPost, "/deployments/"+depIds[1]+"/run", map[string]interface{}{"ports": ports})
+	if body["deployment_id"] != depIds[0] {
+		t.Fatalf("got owner %v, want %s", body["deployment_id"], depIds[0])
+	}
+}
+
+func TestRootlessPrivilegedPort(t *testing.T) {
+	engine := fakedocker.New(testNetwork)
+	engine.SetInfo(deployment.RuntimeInfo{Engine: "podman", Version: "4.9.3", Rootless: true, UnprivilegedPortStart: 1024})
+	ts := newEngineServer(t, engine)
+
+	depId := ts.create("rootless")
+	ts.expect(http.StatusOK, http.MethodPost, "/deployments/"+depId+"/dockerfile/go", map[string]string{"version": "1.22"})
+	if build := ts.build(depId); build["status"] != "Succeeded" {
+		t.Fatalf("build failed: %v", build)
+	}
+
+	body := ts.expect(http.StatusBadRequest, http.MethodPost, "/deployments/"+depId+"/run", map[string]int{"host_port": 80, "container_port": 8080})
+	if msg := body["message"].(string); !strings.Contains(msg, "rootless podman") {
+		t.Fatalf("got message %q", msg)
+	}
+	if cid := ts.containerId(depId); cid != "" {
+		t.Fatalf("container %s created", cid)
+	}
+
+	// the ports of the range are published
+	ts.expect(http.StatusOK, http.MethodPost, "/deployments/"+depId+"/run", map[string]int{"container_port": 8080})
+}
+
+func TestDeploymentNotFound(t *testing.T) {
+	ts := newTestServer(t)
+
+	const depId = "00000000-0000-0000-0000-000000000000"
+	ts.expect(http.StatusNotFound, http.MethodGet, "/deployments/"+depId, nil)
+	ts.expect(http.StatusNotFound, http.MethodPost, "/deployments/"+depId+"/dockerfile/go", map[string]string{"version": "1.22"})
+	ts.expect(http.StatusNotFound, http.MethodPost, "/deployments/"+depId+"/builds", nil)
+	ts.expect(http.StatusNotFound, http.MethodPost, "/deployments/"+depId+"/run", map[string]int{"container_port": 8080})
+	ts.expect(http.StatusNotFound, http.MethodPost, "/deployments/"+depId+"/stop", nil)
+	ts.expect(http.StatusNotFound, http.MethodDelete, "/deployments/"+depId+"/container", nil)
+	ts.expect(http.StatusNotFound, http.MethodDelete, "/deployments/"+depId, nil)
+	ts.expect(http.StatusNotFound, http.MethodGet, "/builds/"+depId, nil)
+}
+
+func TestDuplicateName(t *testing.T) {
+	ts := newTestServer(t)
+
+	ts.create("twin")
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	_ = mw.WriteField("name", "twin")
+	fw, _ := mw.CreateFormFile("file", "twin.zip")
+	_, _ = fw.Write([]byte("PK"))
+	_ = mw.Close()
+
+	req := httptest.NewRequest(http.MethodPost, "/v1/deployments/create", &body)
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	if code, resp := ts.do(req); code != http.StatusConflict {
+		t.Fatalf("got status %d for a duplicated name: %v", code, resp)
+	}
+}
+
+// built creates a deployment with a released image on the local engine
+func (ts *testServer) built(name string) string {
+	ts.t.Helper()
+	depId := ts.create(name)
+	ts.expect(http.StatusOK, http.MethodPost, "/deployments/"+depId+"/dockerfile/go", map[string]string{"version": "1.22"})
+	if build := ts.build(depId); build["status"] != "Succeeded" {
+		ts.t.Fatalf("build failed: %v", build)
+	}
+	return depId
+}
+
+func TestNodeRegistry(t *testing.T) {
+	ts := newTestServer(t)
+	edge := ts.startNode("tcp://10.0.0.5:2376")
+
+	node := map[string]interface{}{
+		"name":     "edge-1",
+		"endpoint": "tcp://10.0.0.5:2376",
+		"labels":   map[string]string{"region": "eu"},
+		"capacity": 1,
+	}
+	created := ts.expect(http.StatusOK, http.MethodPost, "/nodes", node)["node"].(map[string]interface{})
+	if created["available"] != true || created["address"] != "10.0.0.5" {
+		t.Fatalf("got node %v", created)
+	}
+	ts.expect(http.StatusConflict, http.MethodPost, "/nodes", node)
+
+	// the engine is reached before the node is registered
+	ts.expect(http.StatusUnprocessableEntity, http.MethodPost, "/nodes", map[string]string{"name": "edge-2", "endpoint": "tcp://10.0.0.6:2376"})
+	ts.expect(http.StatusNotFound, http.MethodGet, "/nodes/edge-2", nil)
+	ts.expect(http.StatusBadRequest, http.MethodPost, "/nodes", map[string]string{"name": "local", "endpoint": "tcp://10.0.0.5:2376"})
+	ts.expect(http.StatusBadRequest, http.MethodPost, "/nodes", map[string]string{"name": "edge-3", "endpoint": "ssh://edge-3"})
+	// a tls key is encrypted with the secret key, which is not configured
+	ts.expect(http.StatusUnprocessableEntity, http.MethodPost, "/nodes", map[string]string{
+		"name": "edge-4", "endpoint": "tcp://10.0.0.5:2376", "tls_cert": "cert", "tls_key": "key",
+	})
+	// the engine dialled for a node which is not registered is closed
+	if closed := edge.Closed(); closed != 1 {
+		t.Fatalf("engine closed %d times after a failed registration, want 1", closed)
+	}
+
+	nodes := ts.expect(http.StatusOK, http.MethodGet, "/nodes", nil)["nodes"].([]interface{})
+	if len(nodes) != 2 || nodes[0].(map[string]interface{})["name"] != "local" {
+		t.Fatalf("got nodes %v", nodes)
+	}
+
+	node["capacity"] = 2
+	updated := ts.expect(http.StatusOK, http.MethodPut, "/nodes/edge-1", node)["node"].(map[string]interface{})
+	if updated["capacity"].(float64) != 2 {
+		t.Fatalf("got node %v after update", updated)
+	}
+	// the replaced engine stays open for the requests still using it
+	if closed := edge.Closed(); closed != 1 {
+		t.Fatalf("engine closed %d times right after update, want 1", closed)
+	}
+	ts.expect(http.StatusUnprocessableEntity, http.MethodPut, "/nodes/local", node)
+
+	ts.expect(http.StatusOK, http.MethodDelete, "/nodes/edge-1", nil)
+	ts.expect(http.StatusNotFound, http.MethodDelete, "/nodes/edge-1", nil)
+	if closed := edge.Closed(); closed != 1 {
+		t.Fatalf("engine closed %d times right after delete, want 1", closed)
+	}
+}
+
+func TestUnavailableNode(t *testing.T) {
+	// the node is registered and down when GDHost starts
+	db := database.NewMemoryDatabase()
+	endpoint := "tcp://10.0.0.7:2376"
+	err := db.CreateNode(context.Background(), &model.Node{Name: "edge-1", Endpoint: endpoint, Address: "10.0.0.7"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := newDatabaseServer(t, fakedocker.New(testNetwork), db)
+
+	// the failed connection is reported without dialling the node on every request
+	for i := 0; i < 3; i++ {
+		node := ts.expect(http.StatusOK, http.MethodGet, "/nodes/edge-1", nil)["node"].(map[string]interface{})
+		if node["available"] != false || node["error"] == "" {
+			t.Fatalf("got node %v", node)
+		}
+	}
+	depId := ts.built("app")
+	ts.expect(http.StatusUnprocessableEntity, http.MethodPost, "/deployments/"+depId+"/run", map[string]interface{}{
+		"container_port": 8080,
+		"placement":      map[string]string{"policy": "pinned", "node": "edge-1"},
+	})
+	// the dial at start up may still run when the first request comes in
+	if dials := ts.dialed(endpoint); dials > 2 {
+		t.Fatalf("node dialled %d times", dials)
+	}
+
+	// the node is connected again when it is updated
+	ts.startNode(endpoint)
+	ts.expect(http.StatusOK, http.MethodPut, "/nodes/edge-1", map[string]string{"endpoint": endpoint})
+	if node := ts.expect(http.StatusOK, http.MethodGet, "/nodes/edge-1", nil)["node"].(map[string]interface{}); node["available"] != true {
+		t.Fatalf("got node %v after update", node)
+	}
+}
+
+func TestNodePlacement(t *testing.T) {
+	ts := newTestServer(t)
+	edge := ts.startNode("tcp://10.0.0.5:2376")
+	ts.expect(http.StatusOK, http.MethodPost, "/nodes", map[string]interface{}{
+		"name":     "edge-1",
+		"endpoint": "tcp://10.0.0.5:2376",
+		"labels":   map[string]string{"region": "eu"},
+		"capacity": 1,
+	})
+
+	// the ports are checked before the nodes are dialled
+	depId := ts.built("edge-app")
+	ts.expect(http.StatusBadRequest, http.MethodPost, "/deployments/"+depId+"/run", map[string]interface{}{
+		"placement": map[string]string{"policy": "pinned", "node": "edge-2"},
+	})
+
+	// the image built on the local engine is copied to the node
+	ts.expect(http.StatusOK, http.MethodPost, "/deployments/"+depId+"/run", map[string]interface{}{
+		"container_port": 8080,
+		"placement":      map[string]interface{}{"policy": "labels", "labels": map[string]string{"region": "eu"}},
+	})
+	if dep := ts.deployment(depId); dep["node"] != "edge-1" {
+		t.Fatalf("got deployment %v, want it on edge-1", dep)
+	}
+	cids := edge.Containers(depId)
+	if len(cids) != 1 || len(ts.engine.Containers(depId)) != 0 {
+		t.Fatalf("got containers %v on the node and %v on the local engine", cids, ts.engine.Containers(depId))
+	}
+	if !edge.HasImage("edge-app:v1") || !edge.HasNetwork(depId) {
+		t.Fatal("image or network missing on the node")
+	}
+
+	// the operations of the deployment reach the engine of its node
+	ts.expect(http.StatusOK, http.MethodPost, "/deployments/"+depId+"/stop", nil)
+	if _, running := edge.HasContainer(cids[0]); running {
+		t.Fatal("container on the node still running after stop")
+	}
+	// the container is not moved by a placement
+	ts.expect(http.StatusUnprocessableEntity, http.MethodPost, "/deployments/"+depId+"/run", map[string]interface{}{
+		"placement": map[string]string{"policy": "least-loaded"},
+	})
+	ts.expect(http.StatusOK, http.MethodPost, "/deployments/"+depId+"/run", map[string]int{})
+	if _, running := edge.HasContainer(cids[0]); !running {
+		t.Fatal("container on the node not restarted")
+	}
+	// the proxy of a zero-downtime deploy only reaches the local engine
+	resp := ts.expect(http.StatusUnprocessableEntity, http.MethodPost, "/deployments/"+depId+"/deploy", map[string]int{})
+	if msg := resp["message"].(string); !strings.Contains(msg, "edge-1") {
+		t.Fatalf("got message %q for a deploy on a node", msg)
+	}
+
+	// the node is full
+	pinned := ts.built("pinned-app")
+	ts.expect(http.StatusUnprocessableEntity, http.MethodPost, "/deployments/"+pinned+"/run", map[string]interface{}{
+		"container_port": 8080,
+		"placement":      map[string]string{"policy": "pinned", "node": "edge-1"},
+	})
+	ts.expect(http.StatusUnprocessableEntity, http.MethodPost, "/deployments/"+pinned+"/run", map[string]interface{}{
+		"container_port": 8080,
+		"placement":      map[string]interface{}{"policy": "labels", "labels": map[string]string{"region": "us"}},
+	})
+	// linked deployments run on the same node
+	ts.expect(http.StatusOK, http.MethodPost, "/deployments/"+pinned+"/links", map[string]string{"deployment_id": depId})
+	ts.expect(http.StatusUnprocessableEntity, http.MethodPost, "/deployments/"+pinned+"/run", map[string]int{"container_port": 8080})
+	ts.expect(http.StatusOK, http.MethodDelete, "/deployments/"+pinned+"/links/"+depId, nil)
+
+	// the least loaded engine is the local one
+	ts.expect(http.StatusOK, http.MethodPost, "/deployments/"+pinned+"/run", map[string]int{"container_port": 8080})
+	if dep := ts.deployment(pinned); dep["node"] != "local" || len(ts.engine.Containers(pinned)) != 1 {
+		t.Fatalf("got deployment %v, want it on the local engine", dep)
+	}
+
+	ts.expect(http.StatusConflict, http.MethodDelete, "/nodes/edge-1", nil)
+	ts.expect(http.StatusOK, http.MethodDelete, "/deployments/"+depId, nil)
+	if exists, _ := edge.HasContainer(cids[0]); exists || edge.HasImage("edge-app:v1") {
+		t.Fatal("container or image left on the node")
+	}
+	ts.expect(http.StatusOK, http.MethodDelete, "/nodes/edge-1", nil)
+}
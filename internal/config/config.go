@@ -5,12 +5,27 @@ import (
 	"github.com/go-playground/validator/v10"
 	logs "github.com/rs/zerolog/log"
 	"github.com/spf13/viper"
+	"path/filepath"
 )
 
 const (
 	defaultVersion  = "/v1"
 	defaultPort     = 8080
 	defaultLocation = "data"
+	defaultWorkers  = 2
+	defaultRetain   = 5
+
+	defaultCrashLoopRestarts = 5
+	defaultCrashLoopWindow   = 300
+
+	defaultPortRangeStart = 20000
+	defaultPortRangeEnd   = 29999
+
+	defaultDockerNetwork = "gdhost"
+
+	defaultDatabaseDriver = "mongodb"
+	defaultDatabaseFile   = "gdhost.db"
+	demoDatabaseDriver    = "memory"
 )
 
 type Config struct {
@@ -19,8 +34,55 @@ type Config struct {
 
 	LogLevel string `json:"log_level"`
 
-	DatabaseHost string `json:"database_host" validate:"required"`
-	Location     string `json:"location"`
+	// DatabaseDriver is mongodb, which needs a replica set for transactions, bolt which stores everything in the
+	// DatabasePath file, <location>/gdhost.db by default, or memory which keeps nothing after a restart.
+	// Demo, set with the --demo flag, always uses memory.
+	Demo           bool   `json:"demo"`
+	DatabaseDriver string `json:"database_driver" validate:"oneof=mongodb bolt memory"`
+	DatabaseHost   string `json:"database_host" validate:"required_if=DatabaseDriver mongodb"`
+	DatabasePath   string `json:"database_path"`
+	Location       string `json:"location"`
+
+	BuildWorkers     int `json:"build_workers" validate:"min=1"`
+	ReleaseRetention int `json:"release_retention" validate:"min=1"`
+
+	SecretKey string `json:"secret_key" validate:"omitempty,base64"`
+
+	// Resource limits applied when a deployment does not request one. The maximums cap the requests, 0 is no cap.
+	DefaultMemoryMB  int64 `json:"default_memory_mb" validate:"min=0"`
+	MaxMemoryMB      int64 `json:"max_memory_mb" validate:"min=0"`
+	DefaultCPUQuota  int64 `json:"default_cpu_quota" validate:"min=0"`
+	MaxCPUQuota      int64 `json:"max_cpu_quota" validate:"min=0"`
+	DefaultPidsLimit int64 `json:"default_pids_limit" validate:"min=0"`
+	MaxPidsLimit     int64 `json:"max_pids_limit" validate:"min=0"`
+
+	// A deployment is crash looping when its container restarts CrashLoopRestarts times within CrashLoopWindow seconds
+	CrashLoopRestarts int `json:"crash_loop_restarts" validate:"min=1"`
+	CrashLoopWindow   int `json:"crash_loop_window" validate:"min=1"`
+
+	// Host ports are allocated from this range when a deployment does not ask for one
+	PortRangeStart int `json:"port_range_start" validate:"min=1,max=65535"`
+	PortRangeEnd   int `json:"port_range_end" validate:"gtefield=PortRangeStart,max=65535"`
+
+	// The http proxy routes <deployment-name>.<base_domain> to the containers, 0 disables it
+	HTTPProxyPort int    `json:"http_proxy_port" validate:"min=0,max=65535"`
+	BaseDomain    string `json:"base_domain" validate:"required_unless=HTTPProxyPort 0,omitempty,hostname_rfc1123"`
+	// Every deployment runs on its own docker network named <docker_network>-<deployment-id>
+	DockerNetwork string `json:"docker_network" validate:"required"`
+	// RuntimeHost is the docker api endpoint of the engine: the docker socket, the podman socket
+	// (unix:///run/user/<uid>/podman/podman.sock when rootless) or tcp://<host>:<port>. DOCKER_HOST is used when it
+	// is empty. A tcp endpoint is secured with the CA certificate and the client certificate and key.
+	RuntimeHost      string `json:"runtime_host" validate:"omitempty,uri"`
+	RuntimeTLSCACert string `json:"runtime_tls_ca_cert" validate:"omitempty,file"`
+	RuntimeTLSCert   string `json:"runtime_tls_cert" validate:"required_with=RuntimeTLSKey,omitempty,file"`
+	RuntimeTLSKey    string `json:"runtime_tls_key" validate:"required_with=RuntimeTLSCert,omitempty,file"`
+
+	// TLSCertFile and TLSKeyFile serve the API over https, the https proxy falls back to them for unknown hosts.
+	// With LocalCA GDHost is its own certificate authority and issues the certificates of the deployment hostnames.
+	TLSCertFile    string `json:"tls_cert_file" validate:"required_with=TLSKeyFile,omitempty,file"`
+	TLSKeyFile     string `json:"tls_key_file" validate:"required_with=TLSCertFile,omitempty,file"`
+	HTTPSProxyPort int    `json:"https_proxy_port" validate:"min=0,max=65535"`
+	LocalCA        bool   `json:"local_ca"`
 }
 
 func getConfigValueAsString(key string) (value string) {
@@ -31,10 +93,26 @@ func getConfigValueAsInt(key string) (value int) {
 	return viper.GetInt(key)
 }
 
+func getConfigValueAsInt64(key string) (value int64) {
+	return viper.GetInt64(key)
+}
+
+func getConfigValueAsBool(key string) (value bool) {
+	return viper.GetBool(key)
+}
+
 func configureViperDefaults() {
 	viper.SetDefault("api_path", defaultVersion)
 	viper.SetDefault("port", defaultPort)
 	viper.SetDefault("location", defaultLocation)
+	viper.SetDefault("build_workers", defaultWorkers)
+	viper.SetDefault("release_retention", defaultRetain)
+	viper.SetDefault("crash_loop_restarts", defaultCrashLoopRestarts)
+	viper.SetDefault("crash_loop_window", defaultCrashLoopWindow)
+	viper.SetDefault("port_range_start", defaultPortRangeStart)
+	viper.SetDefault("port_range_end", defaultPortRangeEnd)
+	viper.SetDefault("docker_network", defaultDockerNetwork)
+	viper.SetDefault("database_driver", defaultDatabaseDriver)
 	viper.AutomaticEnv()
 }
 
@@ -44,8 +122,48 @@ func populateConfigurations(conf *Config) {
 
 	conf.LogLevel = getConfigValueAsString("log_level")
 
+	conf.Demo = getConfigValueAsBool("demo")
+	conf.DatabaseDriver = getConfigValueAsString("database_driver")
+	if conf.Demo {
+		conf.DatabaseDriver = demoDatabaseDriver
+	}
 	conf.DatabaseHost = getConfigValueAsString("database_host")
+	conf.DatabasePath = getConfigValueAsString("database_path")
 	conf.Location = getConfigValueAsString("location")
+	if conf.DatabasePath == "" {
+		conf.DatabasePath = filepath.Join(conf.Location, defaultDatabaseFile)
+	}
+
+	conf.BuildWorkers = getConfigValueAsInt("build_workers")
+	conf.ReleaseRetention = getConfigValueAsInt("release_retention")
+
+	conf.SecretKey = getConfigValueAsString("secret_key")
+
+	conf.DefaultMemoryMB = getConfigValueAsInt64("default_memory_mb")
+	conf.MaxMemoryMB = getConfigValueAsInt64("max_memory_mb")
+	conf.DefaultCPUQuota = getConfigValueAsInt64("default_cpu_quota")
+	conf.MaxCPUQuota = getConfigValueAsInt64("max_cpu_quota")
+	conf.DefaultPidsLimit = getConfigValueAsInt64("default_pids_limit")
+	conf.MaxPidsLimit = getConfigValueAsInt64("max_pids_limit")
+
+	conf.CrashLoopRestarts = getConfigValueAsInt("crash_loop_restarts")
+	conf.CrashLoopWindow = getConfigValueAsInt("crash_loop_window")
+
+	conf.PortRangeStart = getConfigValueAsInt("port_range_start")
+	conf.PortRangeEnd = getConfigValueAsInt("port_range_end")
+
+	conf.HTTPProxyPort = getConfigValueAsInt("http_proxy_port")
+	conf.BaseDomain = getConfigValueAsString("base_domain")
+	conf.DockerNetwork = getConfigValueAsString("docker_network")
+	conf.RuntimeHost = getConfigValueAsString("runtime_host")
+	conf.RuntimeTLSCACert = getConfigValueAsString("runtime_tls_ca_cert")
+	conf.RuntimeTLSCert = getConfigValueAsString("runtime_tls_cert")
+	conf.RuntimeTLSKey = getConfigValueAsString("runtime_tls_key")
+
+	conf.TLSCertFile = getConfigValueAsString("tls_cert_file")
+	conf.TLSKeyFile = getConfigValueAsString("tls_key_file")
+	conf.HTTPSProxyPort = getConfigValueAsInt("https_proxy_port")
+	conf.LocalCA = getConfigValueAsBool("local_ca")
 }
 
 func GetConfig() (*Config, error) {
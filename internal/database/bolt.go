@@ -0,0 +1,79 @@
+package database
+
+import (
+	"fmt"
+	bolt "go.etcd.io/bbolt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// boltStore keeps the buckets in a single bbolt file, it needs no database server
+type boltStore struct {
+	db *bolt.DB
+}
+
+type boltTx struct {
+	tx *bolt.Tx
+}
+
+type boltBucket struct {
+	*bolt.Bucket
+}
+
+func NewBoltDatabase(path string) (Database, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, fmt.Errorf("failed to create database directory: %w", err)
+	}
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("failed to open database: %w", err)
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, name := range buckets {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		_ = db.Close()
+		return nil, fmt.Errorf("failed to create buckets: %w", err)
+	}
+	return &kvDatabase{store: &boltStore{db: db}}, nil
+}
+
+func (s *boltStore) update(fn func(tx storeTx) error) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return fn(&boltTx{tx: tx})
+	})
+}
+
+func (s *boltStore) view(fn func(tx storeTx) error) error {
+	return s.db.View(func(tx *bolt.Tx) error {
+		return fn(&boltTx{tx: tx})
+	})
+}
+
+func (s *boltStore) close() error {
+	return s.db.Close()
+}
+
+func (t *boltTx) bucket(name []byte) bucket {
+	return boltBucket{t.tx.Bucket(name)}
+}
+
+func (b boltBucket) ForEach(start []byte, fn func(key []byte, value []byte) (bool, error)) error {
+	cursor := b.Cursor()
+	k, v := cursor.First()
+	if start != nil {
+		k, v = cursor.Seek(start)
+	}
+	for ; k != nil; k, v = cursor.Next() {
+		if next, err := fn(k, v); err != nil || !next {
+			return err
+		}
+	}
+	return nil
+}
@@ -3,93 +3,209 @@ package database
 import (
 	"GDHost/internal/model"
 	"context"
-	"fmt"
-	"go.mongodb.org/mongo-driver/bson"
-	"go.mongodb.org/mongo-driver/mongo"
-	"go.mongodb.org/mongo-driver/mongo/options"
-	"go.mongodb.org/mongo-driver/mongo/readpref"
-	"go.mongodb.org/mongo-driver/mongo/writeconcern"
+	"errors"
+	"sort"
+	"time"
 )
 
+// Drivers of the Database, see config.Config
+const (
+	DriverMongo  = "mongodb"
+	DriverBolt   = "bolt"
+	DriverMemory = "memory"
+)
+
+var (
+	ErrNotFound  = errors.New("record not found")
+	ErrDuplicate = errors.New("record already exists")
+)
+
+// Database stores the records of GDHost. A record which is not found is ErrNotFound, a record which would break
+// a unique key is ErrDuplicate, as a route path prefix used by another deployment. Deleted deployments are never
+// returned.
+//
+// The Update methods read the record, apply fn and write it back atomically, nothing is written when fn fails
+// and its error is returned. fn may be called more than once and must only change the record.
 type Database interface {
 	CloseConnection() error
+	// WithTx runs fn in a transaction, the records must be read and written with the context passed to fn
+	WithTx(ctx context.Context, fn func(ctx context.Context) error) error
+
 	CreateDeployment(ctx context.Context, deployment *model.Deployment) error
-	FindDeployment(ctx context.Context, filter *bson.D, opts *options.FindOneOptions) (*model.Deployment, error)
-	UpdateDeployment(ctx context.Context, filter *bson.D, update *bson.D) error
-	CreateSession() (mongo.Session, *options.TransactionOptions, error)
-	FindDeployments(ctx context.Context, filter *bson.D, opts *options.FindOptions) (*[]model.Deployment, error)
-}
-type database struct {
-	client      *mongo.Client
-	deployments *mongo.Collection
+	GetDeployment(ctx context.Context, id string) (*model.Deployment, error)
+	ListDeployments(ctx context.Context, query DeploymentQuery) ([]model.Deployment, error)
+	UpdateDeployment(ctx context.Context, id string, fn func(dep *model.Deployment) error) (*model.Deployment, error)
+
+	CreateTemplate(ctx context.Context, template *model.Template) error
+	GetTemplate(ctx context.Context, name string) (*model.Template, error)
+	ListTemplates(ctx context.Context) ([]model.Template, error)
+	UpdateTemplate(ctx context.Context, name string, fn func(tmpl *model.Template) error) (*model.Template, error)
+	DeleteTemplate(ctx context.Context, name string) error
+
+	CreateBuild(ctx context.Context, build *model.Build) error
+	GetBuild(ctx context.Context, id string) (*model.Build, error)
+	// ClaimBuild marks the oldest queued build as running and returns it
+	ClaimBuild(ctx context.Context) (*model.Build, error)
+	// FailRunningBuilds marks the running builds as failed with the reason
+	FailRunningBuilds(ctx context.Context, reason string) error
+	UpdateBuild(ctx context.Context, id string, fn func(build *model.Build) error) (*model.Build, error)
+	CreateBuildLog(ctx context.Context, log *model.BuildLog) error
+	// ListBuildLogs returns the lines of the build after the sequence number since in order
+	ListBuildLogs(ctx context.Context, buildId string, since int) ([]model.BuildLog, error)
+
+	CreateRelease(ctx context.Context, release *model.Release) error
+	GetRelease(ctx context.Context, deploymentId string, version int) (*model.Release, error)
+	// ListReleases returns the releases of the deployment, the latest first
+	ListReleases(ctx context.Context, deploymentId string) ([]model.Release, error)
+	UpdateRelease(ctx context.Context, id string, fn func(release *model.Release) error) (*model.Release, error)
+
+	CreatePortReservation(ctx context.Context, reservation *model.PortReservation) error
+	GetPortReservation(ctx context.Context, id string) (*model.PortReservation, error)
+	ListPortReservations(ctx context.Context, query PortQuery) ([]model.PortReservation, error)
+	// DeletePortReservations deletes the reservations of the deployment but the ones in keep
+	DeletePortReservations(ctx context.Context, deploymentId string, keep []string) error
+
+	CreateDomain(ctx context.Context, domain *model.Domain) error
+	GetDomain(ctx context.Context, name string) (*model.Domain, error)
+	ListDomains(ctx context.Context, query DomainQuery) ([]model.Domain, error)
+	UpdateDomain(ctx context.Context, name string, fn func(domain *model.Domain) error) (*model.Domain, error)
+	DeleteDomain(ctx context.Context, name string) error
+	DeleteDomains(ctx context.Context, deploymentId string) error
+
+	CreateNode(ctx context.Context, node *model.Node) error
+	GetNode(ctx context.Context, name string) (*model.Node, error)
+	// ListNodes returns the nodes sorted by name
+	ListNodes(ctx context.Context) ([]model.Node, error)
+	UpdateNode(ctx context.Context, name string, fn func(node *model.Node) error) (*model.Node, error)
+	DeleteNode(ctx context.Context, name string) error
 }
 
-func NewDatabaseConnection(host string) (Database, error) {
-	db := database{}
-	if err := db.connectDatabase(host); err != nil {
-		return nil, err
-	}
-	return &db, nil
+// DeploymentQuery selects the deployments matching all of its set fields, the zero query selects every deployment.
+// The deployments are sorted by creation time.
+type DeploymentQuery struct {
+	Ids         []string
+	Name        string
+	ContainerId string
+	PathPrefix  string
+	// LinkedTo selects the deployments linked to this deployment id
+	LinkedTo string
+	// Proxied selects the deployments whose host port is served by the proxy
+	Proxied bool
+	// HealthChecked selects the deployments with a container and a health check
+	HealthChecked bool
+	// Node selects the deployments placed on the node
+	Node string
+	// CrashLooping selects the deployments the crash watcher found crash looping
+	CrashLooping bool
+	Skip         int
+	Limit        int
 }
 
-func (d *database) connectDatabase(host string) error {
-	var err error
-	ctx := context.Background()
-	if d.client, err = mongo.Connect(ctx, options.Client().ApplyURI(host)); err != nil {
-		return fmt.Errorf("failed to connect to database: %w", err)
+func (q *DeploymentQuery) matches(dep *model.Deployment) bool {
+	if !dep.DeletedAt.IsZero() {
+		return false
 	}
-	if err = d.client.Ping(ctx, readpref.Primary()); err != nil {
-		return fmt.Errorf("failed to ping to database: %w", err)
+	if q.Ids != nil && !contains(q.Ids, dep.Id) {
+		return false
 	}
-	d.deployments = d.client.Database("gdhost").Collection("deployments")
-
-	indexModel := mongo.IndexModel{
-		Keys: bson.M{"deleted_at": 1},
+	if q.Name != "" && dep.Name != q.Name {
+		return false
+	}
+	if q.ContainerId != "" && dep.ContainerId != q.ContainerId {
+		return false
 	}
-	if _, err = d.deployments.Indexes().CreateOne(ctx, indexModel); err != nil {
-		return fmt.Errorf("failed to create index: %w", err)
+	if q.PathPrefix != "" && (dep.Route == nil || dep.Route.PathPrefix != q.PathPrefix) {
+		return false
 	}
+	if q.LinkedTo != "" && !contains(dep.Links, q.LinkedTo) {
+		return false
+	}
+	if q.Proxied && dep.ProxyPort <= 0 {
+		return false
+	}
+	if q.HealthChecked && (dep.HealthCheck == nil || dep.ContainerId == "") {
+		return false
+	}
+	if q.Node != "" && dep.Node != q.Node {
+		return false
+	}
+	if q.CrashLooping && dep.CrashLoop == nil {
+		return false
+	}
+	return true
+}
 
-	return nil
+// PortQuery selects the reservations of the deployment, or of the protocol from host port From to To
+type PortQuery struct {
+	DeploymentId string
+	Protocol     string
+	From         int
+	To           int
 }
 
-func (d *database) CloseConnection() error {
-	return d.client.Disconnect(context.Background())
+func (q *PortQuery) matches(r *model.PortReservation) bool {
+	if q.DeploymentId != "" && r.DeploymentId != q.DeploymentId {
+		return false
+	}
+	if q.Protocol != "" && r.Protocol != q.Protocol {
+		return false
+	}
+	if q.From != 0 && r.HostPort < q.From {
+		return false
+	}
+	if q.To != 0 && r.HostPort > q.To {
+		return false
+	}
+	return true
 }
 
-func (d *database) CreateDeployment(ctx context.Context, deployment *model.Deployment) error {
-	_, err := d.deployments.InsertOne(ctx, deployment)
-	return err
+// DomainQuery selects the domains of the deployment, Verified selects the verified or the pending ones.
+// The domains are sorted by name.
+type DomainQuery struct {
+	DeploymentId string
+	Verified     *bool
 }
 
-func (d *database) FindDeployments(ctx context.Context, filter *bson.D, opts *options.FindOptions) (*[]model.Deployment, error) {
-	deployments := &[]model.Deployment{}
-	cursor, err := d.deployments.Find(ctx, filter, opts)
-	if err != nil {
-		return nil, fmt.Errorf("find error: %w", err)
+func (q *DomainQuery) matches(domain *model.Domain) bool {
+	if q.DeploymentId != "" && domain.DeploymentId != q.DeploymentId {
+		return false
 	}
-	defer cursor.Close(ctx)
-	if err = cursor.All(ctx, deployments); err != nil {
-		return nil, fmt.Errorf("parse error: %w", err)
+	if q.Verified != nil && domain.Verified() != *q.Verified {
+		return false
 	}
-	return deployments, nil
-
+	return true
 }
 
-func (d *database) FindDeployment(ctx context.Context, filter *bson.D, opts *options.FindOneOptions) (*model.Deployment, error) {
-	deployment := &model.Deployment{}
-	err := d.deployments.FindOne(ctx, filter, opts).Decode(deployment)
-	return deployment, err
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
 }
 
-func (d *database) UpdateDeployment(ctx context.Context, filter *bson.D, update *bson.D) error {
-	_, err := d.deployments.UpdateOne(ctx, filter, update)
-	return err
+// page sorts the deployments by creation time and applies the skip and limit of the query
+func page(deps []model.Deployment, query DeploymentQuery) []model.Deployment {
+	sort.SliceStable(deps, func(i, j int) bool {
+		return deps[i].CreatedAt.Before(deps[j].CreatedAt)
+	})
+	if query.Skip > 0 {
+		if query.Skip >= len(deps) {
+			return nil
+		}
+		deps = deps[query.Skip:]
+	}
+	if query.Limit > 0 && query.Limit < len(deps) {
+		deps = deps[:query.Limit]
+	}
+	return deps
 }
 
-func (d *database) CreateSession() (mongo.Session, *options.TransactionOptions, error) {
-	wc := writeconcern.Majority()
-	txnOptions := options.Transaction().SetWriteConcern(wc)
-	session, err := d.client.StartSession()
-	return session, txnOptions, err
+// failBuild marks the build as failed with the reason
+func failBuild(build *model.Build, reason string) {
+	build.UpdatedAt = time.Now()
+	build.FinishedAt = time.Now()
+	build.Status = model.BuildFailed
+	build.Error = reason
 }
@@ -0,0 +1,670 @@
+package database
+
+import (
+	"GDHost/internal/model"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+)
+
+var (
+	deploymentsBucket = []byte("deployments")
+	templatesBucket   = []byte("templates")
+	buildsBucket      = []byte("builds")
+	buildLogsBucket   = []byte("build_logs")
+	releasesBucket    = []byte("releases")
+	portsBucket       = []byte("ports")
+	domainsBucket     = []byte("domains")
+	nodesBucket       = []byte("nodes")
+
+	buckets = [][]byte{deploymentsBucket, templatesBucket, buildsBucket, buildLogsBucket, releasesBucket, portsBucket, domainsBucket,
+		nodesBucket}
+)
+
+// bucket holds the json records of a kind sorted by key
+type bucket interface {
+	Get(key []byte) []byte
+	Put(key []byte, value []byte) error
+	Delete(key []byte) error
+	// ForEach calls fn with the records from the first key not before start in key order until fn returns false,
+	// a nil start is the first key. The bucket must not be changed by fn.
+	ForEach(start []byte, fn func(key []byte, value []byte) (bool, error)) error
+}
+
+type storeTx interface {
+	bucket(name []byte) bucket
+}
+
+// store is a key value store with transactions, nothing fn changed is kept when it fails
+type store interface {
+	update(fn func(tx storeTx) error) error
+	view(fn func(tx storeTx) error) error
+	close() error
+}
+
+// kvDatabase stores the records as json in the buckets of a key value store.
+// The records are found by scanning their bucket, which is fine for the size of a single host install.
+type kvDatabase struct {
+	store store
+}
+
+// txKey holds the transaction of WithTx in the context
+type txKey struct{}
+
+func (d *kvDatabase) CloseConnection() error {
+	return d.store.close()
+}
+
+// WithTx runs fn in a write transaction, the other writers wait until it ends
+func (d *kvDatabase) WithTx(ctx context.Context, fn func(ctx context.Context) error) error {
+	if _, ok := ctx.Value(txKey{}).(storeTx); ok {
+		return fn(ctx)
+	}
+	return d.store.update(func(tx storeTx) error {
+		return fn(context.WithValue(ctx, txKey{}, tx))
+	})
+}
+
+// update runs fn in the transaction of ctx or in a new write transaction
+func (d *kvDatabase) update(ctx context.Context, fn func(tx storeTx) error) error {
+	if tx, ok := ctx.Value(txKey{}).(storeTx); ok {
+		return fn(tx)
+	}
+	return d.store.update(fn)
+}
+
+// view runs fn in the transaction of ctx or in a new read transaction
+func (d *kvDatabase) view(ctx context.Context, fn func(tx storeTx) error) error {
+	if tx, ok := ctx.Value(txKey{}).(storeTx); ok {
+		return fn(tx)
+	}
+	return d.store.view(fn)
+}
+
+func get[T any](b bucket, key string) (*T, error) {
+	data := b.Get([]byte(key))
+	if data == nil {
+		return nil, ErrNotFound
+	}
+	record := new(T)
+	if err := json.Unmarshal(data, record); err != nil {
+		return nil, fmt.Errorf("parse error: %w", err)
+	}
+	return record, nil
+}
+
+func put(b bucket, key string, record interface{}) error {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	return b.Put([]byte(key), data)
+}
+
+func insert(b bucket, key string, record interface{}) error {
+	if b.Get([]byte(key)) != nil {
+		return ErrDuplicate
+	}
+	return put(b, key, record)
+}
+
+// scan returns the records of the bucket matching match in key order
+func scan[T any](b bucket, match func(*T) bool) ([]T, error) {
+	records := []T{}
+	err := b.ForEach(nil, func(_, data []byte) (bool, error) {
+		var record T
+		if err := json.Unmarshal(data, &record); err != nil {
+			return false, fmt.Errorf("parse error: %w", err)
+		}
+		if match == nil || match(&record) {
+			records = append(records, record)
+		}
+		return true, nil
+	})
+	return records, err
+}
+
+// updateRecord applies fn to the record stored at key, a record which is not visible is not found
+func updateRecord[T any](ctx context.Context, d *kvDatabase, bucket []byte, key string, visible func(*T) bool, fn func(*T) error) (*T, error) {
+	var record *T
+	err := d.update(ctx, func(tx storeTx) error {
+		b := tx.bucket(bucket)
+		var err error
+		if record, err = get[T](b, key); err != nil {
+			return err
+		}
+		if visible != nil && !visible(record) {
+			return ErrNotFound
+		}
+		if err = fn(record); err != nil {
+			return err
+		}
+		return put(b, key, record)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return record, nil
+}
+
+func activeDeployment(dep *model.Deployment) bool {
+	return dep.DeletedAt.IsZero()
+}
+
+func (d *kvDatabase) CreateDeployment(ctx context.Context, deployment *model.Deployment) error {
+	return d.update(ctx, func(tx storeTx) error {
+		return insert(tx.bucket(deploymentsBucket), deployment.Id, deployment)
+	})
+}
+
+func (d *kvDatabase) GetDeployment(ctx context.Context, id string) (*model.Deployment, error) {
+	var deployment *model.Deployment
+	err := d.view(ctx, func(tx storeTx) error {
+		var err error
+		if deployment, err = get[model.Deployment](tx.bucket(deploymentsBucket), id); err != nil {
+			return err
+		}
+		if !activeDeployment(deployment) {
+			return ErrNotFound
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return deployment, nil
+}
+
+func (d *kvDatabase) ListDeployments(ctx context.Context, query DeploymentQuery) ([]model.Deployment, error) {
+	var deployments []model.Deployment
+	err := d.view(ctx, func(tx storeTx) error {
+		var err error
+		deployments, err = scan(tx.bucket(deploymentsBucket), query.matches)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return page(deployments, query), nil
+}
+
+// routePrefix returns the path prefix of the route of the deployment, empty without a route
+func routePrefix(dep *model.Deployment) string {
+	if dep.Route == nil {
+		return ""
+	}
+	return dep.Route.PathPrefix
+}
+
+func (d *kvDatabase) UpdateDeployment(ctx context.Context, id string, fn func(dep *model.Deployment) error) (*model.Deployment, error) {
+	var deployment *model.Deployment
+	err := d.update(ctx, func(tx storeTx) error {
+		b := tx.bucket(deploymentsBucket)
+		var err error
+		if deployment, err = get[model.Deployment](b, id); err != nil {
+			return err
+		}
+		if !activeDeployment(deployment) {
+			return ErrNotFound
+		}
+		prefix := routePrefix(deployment)
+		if err = fn(deployment); err != nil {
+			return err
+		}
+		if p := routePrefix(deployment); p != "" && p != prefix && activeDeployment(deployment) {
+			owners, err := scan(b, func(other *model.Deployment) bool {
+				return other.Id != id && activeDeployment(other) && routePrefix(other) == p
+			})
+			if err != nil {
+				return err
+			}
+			if len(owners) != 0 {
+				return ErrDuplicate
+			}
+		}
+		return put(b, id, deployment)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return deployment, nil
+}
+
+// templateByName returns the template with the name, templates are stored by id
+func templateByName(b bucket, name string) (*model.Template, error) {
+	tmpls, err := scan(b, func(tmpl *model.Template) bool {
+		return tmpl.Name == name
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(tmpls) == 0 {
+		return nil, ErrNotFound
+	}
+	return &tmpls[0], nil
+}
+
+func (d *kvDatabase) CreateTemplate(ctx context.Context, template *model.Template) error {
+	return d.update(ctx, func(tx storeTx) error {
+		b := tx.bucket(templatesBucket)
+		if _, err := templateByName(b, template.Name); err != ErrNotFound {
+			if err == nil {
+				return ErrDuplicate
+			}
+			return err
+		}
+		return insert(b, template.Id, template)
+	})
+}
+
+func (d *kvDatabase) GetTemplate(ctx context.Context, name string) (*model.Template, error) {
+	var template *model.Template
+	err := d.view(ctx, func(tx storeTx) error {
+		var err error
+		template, err = templateByName(tx.bucket(templatesBucket), name)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return template, nil
+}
+
+func (d *kvDatabase) ListTemplates(ctx context.Context) ([]model.Template, error) {
+	var templates []model.Template
+	err := d.view(ctx, func(tx storeTx) error {
+		var err error
+		templates, err = scan[model.Template](tx.bucket(templatesBucket), nil)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(templates, func(i, j int) bool {
+		return templates[i].Name < templates[j].Name
+	})
+	return templates, nil
+}
+
+func (d *kvDatabase) UpdateTemplate(ctx context.Context, name string, fn func(tmpl *model.Template) error) (*model.Template, error) {
+	var template *model.Template
+	err := d.update(ctx, func(tx storeTx) error {
+		b := tx.bucket(templatesBucket)
+		var err error
+		if template, err = templateByName(b, name); err != nil {
+			return err
+		}
+		if err = fn(template); err != nil {
+			return err
+		}
+		if template.Name != name {
+			if _, err = templateByName(b, template.Name); err != ErrNotFound {
+				if err == nil {
+					return ErrDuplicate
+				}
+				return err
+			}
+		}
+		return put(b, template.Id, template)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return template, nil
+}
+
+func (d *kvDatabase) DeleteTemplate(ctx context.Context, name string) error {
+	return d.update(ctx, func(tx storeTx) error {
+		b := tx.bucket(templatesBucket)
+		template, err := templateByName(b, name)
+		if err != nil {
+			return err
+		}
+		return b.Delete([]byte(template.Id))
+	})
+}
+
+// CreateBuild allows only one queued or running build per deployment
+func (d *kvDatabase) CreateBuild(ctx context.Context, build *model.Build) error {
+	return d.update(ctx, func(tx storeTx) error {
+		b := tx.bucket(buildsBucket)
+		active, err := scan(b, func(other *model.Build) bool {
+			return other.DeploymentId == build.DeploymentId && other.Status <= model.BuildRunning
+		})
+		if err != nil {
+			return err
+		}
+		if len(active) != 0 && build.Status <= model.BuildRunning {
+			return ErrDuplicate
+		}
+		return insert(b, build.Id, build)
+	})
+}
+
+func (d *kvDatabase) GetBuild(ctx context.Context, id string) (*model.Build, error) {
+	var build *model.Build
+	err := d.view(ctx, func(tx storeTx) error {
+		var err error
+		build, err = get[model.Build](tx.bucket(buildsBucket), id)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return build, nil
+}
+
+func (d *kvDatabase) ClaimBuild(ctx context.Context) (*model.Build, error) {
+	var build *model.Build
+	err := d.update(ctx, func(tx storeTx) error {
+		b := tx.bucket(buildsBucket)
+		queued, err := scan(b, func(build *model.Build) bool {
+			return build.Status == model.BuildQueued
+		})
+		if err != nil {
+			return err
+		}
+		if len(queued) == 0 {
+			return ErrNotFound
+		}
+		build = &queued[0]
+		for i := range queued {
+			if queued[i].CreatedAt.Before(build.CreatedAt) {
+				build = &queued[i]
+			}
+		}
+		build.UpdatedAt = time.Now()
+		build.StartedAt = time.Now()
+		build.Status = model.BuildRunning
+		return put(b, build.Id, build)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return build, nil
+}
+
+func (d *kvDatabase) FailRunningBuilds(ctx context.Context, reason string) error {
+	return d.update(ctx, func(tx storeTx) error {
+		b := tx.bucket(buildsBucket)
+		running, err := scan(b, func(build *model.Build) bool {
+			return build.Status == model.BuildRunning
+		})
+		if err != nil {
+			return err
+		}
+		for i := range running {
+			failBuild(&running[i], reason)
+			if err = put(b, running[i].Id, &running[i]); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (d *kvDatabase) UpdateBuild(ctx context.Context, id string, fn func(build *model.Build) error) (*model.Build, error) {
+	return updateRecord(ctx, d, buildsBucket, id, nil, fn)
+}
+
+// buildLogKey orders the lines of a build by their sequence number
+func buildLogKey(buildId string, seq int) []byte {
+	key := make([]byte, len(buildId)+9)
+	copy(key, buildId)
+	key[len(buildId)] = '/'
+	binary.BigEndian.PutUint64(key[len(buildId)+1:], uint64(seq))
+	return key
+}
+
+func (d *kvDatabase) CreateBuildLog(ctx context.Context, log *model.BuildLog) error {
+	data, err := json.Marshal(log)
+	if err != nil {
+		return err
+	}
+	return d.update(ctx, func(tx storeTx) error {
+		return tx.bucket(buildLogsBucket).Put(buildLogKey(log.BuildId, log.Seq), data)
+	})
+}
+
+func (d *kvDatabase) ListBuildLogs(ctx context.Context, buildId string, since int) ([]model.BuildLog, error) {
+	logs := []model.BuildLog{}
+	prefix := []byte(buildId + "/")
+	err := d.view(ctx, func(tx storeTx) error {
+		return tx.bucket(buildLogsBucket).ForEach(buildLogKey(buildId, since+1), func(k, data []byte) (bool, error) {
+			if !bytes.HasPrefix(k, prefix) {
+				return false, nil
+			}
+			var log model.BuildLog
+			if err := json.Unmarshal(data, &log); err != nil {
+				return false, fmt.Errorf("parse error: %w", err)
+			}
+			logs = append(logs, log)
+			return true, nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return logs, nil
+}
+
+// CreateRelease allows a version only once per deployment
+func (d *kvDatabase) CreateRelease(ctx context.Context, release *model.Release) error {
+	return d.update(ctx, func(tx storeTx) error {
+		b := tx.bucket(releasesBucket)
+		same, err := scan(b, func(other *model.Release) bool {
+			return other.DeploymentId == release.DeploymentId && other.Version == release.Version
+		})
+		if err != nil {
+			return err
+		}
+		if len(same) != 0 {
+			return ErrDuplicate
+		}
+		return insert(b, release.Id, release)
+	})
+}
+
+func (d *kvDatabase) GetRelease(ctx context.Context, deploymentId string, version int) (*model.Release, error) {
+	var releases []model.Release
+	err := d.view(ctx, func(tx storeTx) error {
+		var err error
+		releases, err = scan(tx.bucket(releasesBucket), func(release *model.Release) bool {
+			return release.DeploymentId == deploymentId && release.Version == version
+		})
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(releases) == 0 {
+		return nil, ErrNotFound
+	}
+	return &releases[0], nil
+}
+
+func (d *kvDatabase) ListReleases(ctx context.Context, deploymentId string) ([]model.Release, error) {
+	var releases []model.Release
+	err := d.view(ctx, func(tx storeTx) error {
+		var err error
+		releases, err = scan(tx.bucket(releasesBucket), func(release *model.Release) bool {
+			return release.DeploymentId == deploymentId
+		})
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(releases, func(i, j int) bool {
+		return releases[i].Version > releases[j].Version
+	})
+	return releases, nil
+}
+
+func (d *kvDatabase) UpdateRelease(ctx context.Context, id string, fn func(release *model.Release) error) (*model.Release, error) {
+	return updateRecord(ctx, d, releasesBucket, id, nil, fn)
+}
+
+func (d *kvDatabase) CreatePortReservation(ctx context.Context, reservation *model.PortReservation) error {
+	return d.update(ctx, func(tx storeTx) error {
+		return insert(tx.bucket(portsBucket), reservation.Id, reservation)
+	})
+}
+
+func (d *kvDatabase) GetPortReservation(ctx context.Context, id string) (*model.PortReservation, error) {
+	var reservation *model.PortReservation
+	err := d.view(ctx, func(tx storeTx) error {
+		var err error
+		reservation, err = get[model.PortReservation](tx.bucket(portsBucket), id)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return reservation, nil
+}
+
+func (d *kvDatabase) ListPortReservations(ctx context.Context, query PortQuery) ([]model.PortReservation, error) {
+	var reservations []model.PortReservation
+	err := d.view(ctx, func(tx storeTx) error {
+		var err error
+		reservations, err = scan(tx.bucket(portsBucket), query.matches)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return reservations, nil
+}
+
+func (d *kvDatabase) DeletePortReservations(ctx context.Context, deploymentId string, keep []string) error {
+	return d.update(ctx, func(tx storeTx) error {
+		b := tx.bucket(portsBucket)
+		reservations, err := scan(b, func(r *model.PortReservation) bool {
+			return r.DeploymentId == deploymentId && !contains(keep, r.Id)
+		})
+		if err != nil {
+			return err
+		}
+		for _, r := range reservations {
+			if err = b.Delete([]byte(r.Id)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (d *kvDatabase) CreateDomain(ctx context.Context, domain *model.Domain) error {
+	return d.update(ctx, func(tx storeTx) error {
+		return insert(tx.bucket(domainsBucket), domain.Name, domain)
+	})
+}
+
+func (d *kvDatabase) GetDomain(ctx context.Context, name string) (*model.Domain, error) {
+	var domain *model.Domain
+	err := d.view(ctx, func(tx storeTx) error {
+		var err error
+		domain, err = get[model.Domain](tx.bucket(domainsBucket), name)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return domain, nil
+}
+
+func (d *kvDatabase) ListDomains(ctx context.Context, query DomainQuery) ([]model.Domain, error) {
+	var domains []model.Domain
+	err := d.view(ctx, func(tx storeTx) error {
+		var err error
+		domains, err = scan(tx.bucket(domainsBucket), query.matches)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return domains, nil
+}
+
+func (d *kvDatabase) UpdateDomain(ctx context.Context, name string, fn func(domain *model.Domain) error) (*model.Domain, error) {
+	return updateRecord(ctx, d, domainsBucket, name, nil, fn)
+}
+
+func (d *kvDatabase) DeleteDomain(ctx context.Context, name string) error {
+	return d.update(ctx, func(tx storeTx) error {
+		b := tx.bucket(domainsBucket)
+		if b.Get([]byte(name)) == nil {
+			return ErrNotFound
+		}
+		return b.Delete([]byte(name))
+	})
+}
+
+func (d *kvDatabase) DeleteDomains(ctx context.Context, deploymentId string) error {
+	return d.update(ctx, func(tx storeTx) error {
+		b := tx.bucket(domainsBucket)
+		domains, err := scan(b, func(domain *model.Domain) bool {
+			return domain.DeploymentId == deploymentId
+		})
+		if err != nil {
+			return err
+		}
+		for _, domain := range domains {
+			if err = b.Delete([]byte(domain.Name)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (d *kvDatabase) CreateNode(ctx context.Context, node *model.Node) error {
+	return d.update(ctx, func(tx storeTx) error {
+		return insert(tx.bucket(nodesBucket), node.Name, node)
+	})
+}
+
+func (d *kvDatabase) GetNode(ctx context.Context, name string) (*model.Node, error) {
+	var node *model.Node
+	err := d.view(ctx, func(tx storeTx) error {
+		var err error
+		node, err = get[model.Node](tx.bucket(nodesBucket), name)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return node, nil
+}
+
+func (d *kvDatabase) ListNodes(ctx context.Context) ([]model.Node, error) {
+	var nodes []model.Node
+	err := d.view(ctx, func(tx storeTx) error {
+		var err error
+		nodes, err = scan[model.Node](tx.bucket(nodesBucket), nil)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return nodes, nil
+}
+
+func (d *kvDatabase) UpdateNode(ctx context.Context, name string, fn func(node *model.Node) error) (*model.Node, error) {
+	return updateRecord(ctx, d, nodesBucket, name, nil, fn)
+}
+
+func (d *kvDatabase) DeleteNode(ctx context.Context, name string) error {
+	return d.update(ctx, func(tx storeTx) error {
+		b := tx.bucket(nodesBucket)
+		if b.Get([]byte(name)) == nil {
+			return ErrNotFound
+		}
+		return b.Delete([]byte(name))
+	})
+}
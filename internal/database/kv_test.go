@@ -0,0 +1,424 @@
+package database
+
+import (
+	"GDHost/internal/model"
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+var errAbort = errors.New("abort")
+
+// kvBackends opens an empty database of every key value store
+var kvBackends = map[string]func(t *testing.T) Database{
+	"memory": func(t *testing.T) Database {
+		return NewMemoryDatabase()
+	},
+	"bolt": func(t *testing.T) Database {
+		db, err := NewBoltDatabase(filepath.Join(t.TempDir(), "gdhost.db"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return db
+	},
+}
+
+// kept returns an error when the record was found, it should have been rolled back
+func kept(err error) error {
+	if errors.Is(err, ErrNotFound) {
+		return nil
+	}
+	if err == nil {
+		return errors.New("record kept")
+	}
+	return err
+}
+
+// rollbackCase writes a bucket in a transaction which fails afterwards
+type rollbackCase struct {
+	name string
+	// seed stores the records before the transaction
+	seed func(ctx context.Context, db Database) error
+	// write runs in the transaction
+	write func(ctx context.Context, db Database) error
+	// check returns an error when a write of the transaction was kept
+	check func(ctx context.Context, db Database) error
+}
+
+var rollbackCases = []rollbackCase{
+	{
+		name: "deployments/create",
+		write: func(ctx context.Context, db Database) error {
+			return db.CreateDeployment(ctx, &model.Deployment{Id: "dep", Name: "app"})
+		},
+		check: func(ctx context.Context, db Database) error {
+			_, err := db.GetDeployment(ctx, "dep")
+			return kept(err)
+		},
+	},
+	{
+		name: "deployments/update",
+		seed: func(ctx context.Context, db Database) error {
+			return db.CreateDeployment(ctx, &model.Deployment{Id: "dep", Name: "app"})
+		},
+		write: func(ctx context.Context, db Database) error {
+			_, err := db.UpdateDeployment(ctx, "dep", func(dep *model.Deployment) error {
+				dep.ContainerId = "container"
+				return nil
+			})
+			return err
+		},
+		check: func(ctx context.Context, db Database) error {
+			dep, err := db.GetDeployment(ctx, "dep")
+			if err == nil && dep.ContainerId != "" {
+				err = fmt.Errorf("got container id %q", dep.ContainerId)
+			}
+			return err
+		},
+	},
+	{
+		name: "deployments/delete",
+		seed: func(ctx context.Context, db Database) error {
+			return db.CreateDeployment(ctx, &model.Deployment{Id: "dep", Name: "app"})
+		},
+		write: func(ctx context.Context, db Database) error {
+			_, err := db.UpdateDeployment(ctx, "dep", func(dep *model.Deployment) error {
+				dep.DeletedAt = time.Now()
+				return nil
+			})
+			return err
+		},
+		check: func(ctx context.Context, db Database) error {
+			_, err := db.GetDeployment(ctx, "dep")
+			return err
+		},
+	},
+	{
+		name: "templates/create",
+		write: func(ctx context.Context, db Database) error {
+			return db.CreateTemplate(ctx, &model.Template{Id: "tmpl", Name: "go"})
+		},
+		check: func(ctx context.Context, db Database) error {
+			_, err := db.GetTemplate(ctx, "go")
+			return kept(err)
+		},
+	},
+	{
+		name: "templates/update",
+		seed: func(ctx context.Context, db Database) error {
+			return db.CreateTemplate(ctx, &model.Template{Id: "tmpl", Name: "go", Data: "FROM golang"})
+		},
+		write: func(ctx context.Context, db Database) error {
+			_, err := db.UpdateTemplate(ctx, "go", func(tmpl *model.Template) error {
+				tmpl.Data = "FROM scratch"
+				return nil
+			})
+			return err
+		},
+		check: func(ctx context.Context, db Database) error {
+			tmpl, err := db.GetTemplate(ctx, "go")
+			if err == nil && tmpl.Data != "FROM golang" {
+				err = fmt.Errorf("got data %q", tmpl.Data)
+			}
+			return err
+		},
+	},
+	{
+		name: "templates/delete",
+		seed: func(ctx context.Context, db Database) error {
+			return db.CreateTemplate(ctx, &model.Template{Id: "tmpl", Name: "go"})
+		},
+		write: func(ctx context.Context, db Database) error {
+			return db.DeleteTemplate(ctx, "go")
+		},
+		check: func(ctx context.Context, db Database) error {
+			_, err := db.GetTemplate(ctx, "go")
+			return err
+		},
+	},
+	{
+		name: "builds/create",
+		write: func(ctx context.Context, db Database) error {
+			return db.CreateBuild(ctx, &model.Build{Id: "build", DeploymentId: "dep"})
+		},
+		check: func(ctx context.Context, db Database) error {
+			_, err := db.GetBuild(ctx, "build")
+			return kept(err)
+		},
+	},
+	{
+		name: "builds/update",
+		seed: func(ctx context.Context, db Database) error {
+			return db.CreateBuild(ctx, &model.Build{Id: "build", DeploymentId: "dep"})
+		},
+		write: func(ctx context.Context, db Database) error {
+			_, err := db.UpdateBuild(ctx, "build", func(build *model.Build) error {
+				build.Status = model.BuildFailed
+				return nil
+			})
+			return err
+		},
+		check: func(ctx context.Context, db Database) error {
+			build, err := db.GetBuild(ctx, "build")
+			if err == nil && build.Status != model.BuildQueued {
+				err = fmt.Errorf("got status %v", build.Status)
+			}
+			return err
+		},
+	},
+	{
+		name: "build_logs/create",
+		write: func(ctx context.Context, db Database) error {
+			return db.CreateBuildLog(ctx, &model.BuildLog{Id: "log", BuildId: "build", Seq: 1})
+		},
+		check: func(ctx context.Context, db Database) error {
+			logs, err := db.ListBuildLogs(ctx, "build", 0)
+			if err == nil && len(logs) != 0 {
+				err = fmt.Errorf("got %d lines", len(logs))
+			}
+			return err
+		},
+	},
+	{
+		name: "releases/create",
+		write: func(ctx context.Context, db Database) error {
+			return db.CreateRelease(ctx, &model.Release{Id: "release", DeploymentId: "dep", Version: 1})
+		},
+		check: func(ctx context.Context, db Database) error {
+			_, err := db.GetRelease(ctx, "dep", 1)
+			return kept(err)
+		},
+	},
+	{
+		name: "releases/update",
+		seed: func(ctx context.Context, db Database) error {
+			return db.CreateRelease(ctx, &model.Release{Id: "release", DeploymentId: "dep", Version: 1})
+		},
+		write: func(ctx context.Context, db Database) error {
+			_, err := db.UpdateRelease(ctx, "release", func(release *model.Release) error {
+				release.PrunedAt = time.Now()
+				return nil
+			})
+			return err
+		},
+		check: func(ctx context.Context, db Database) error {
+			release, err := db.GetRelease(ctx, "dep", 1)
+			if err == nil && !release.PrunedAt.IsZero() {
+				err = errors.New("release pruned")
+			}
+			return err
+		},
+	},
+	{
+		name: "ports/create",
+		write: func(ctx context.Context, db Database) error {
+			return db.CreatePortReservation(ctx, &model.PortReservation{Id: "tcp/8080", Protocol: "tcp", HostPort: 8080, DeploymentId: "dep"})
+		},
+		check: func(ctx context.Context, db Database) error {
+			_, err := db.GetPortReservation(ctx, "tcp/8080")
+			return kept(err)
+		},
+	},
+	{
+		name: "ports/delete",
+		seed: func(ctx context.Context, db Database) error {
+			return db.CreatePortReservation(ctx, &model.PortReservation{Id: "tcp/8080", Protocol: "tcp", HostPort: 8080, DeploymentId: "dep"})
+		},
+		write: func(ctx context.Context, db Database) error {
+			return db.DeletePortReservations(ctx, "dep", nil)
+		},
+		check: func(ctx context.Context, db Database) error {
+			_, err := db.GetPortReservation(ctx, "tcp/8080")
+			return err
+		},
+	},
+	{
+		name: "domains/create",
+		write: func(ctx context.Context, db Database) error {
+			return db.CreateDomain(ctx, &model.Domain{Name: "example.com", DeploymentId: "dep"})
+		},
+		check: func(ctx context.Context, db Database) error {
+			_, err := db.GetDomain(ctx, "example.com")
+			return kept(err)
+		},
+	},
+	{
+		name: "domains/update",
+		seed: func(ctx context.Context, db Database) error {
+			return db.CreateDomain(ctx, &model.Domain{Name: "example.com", DeploymentId: "dep"})
+		},
+		write: func(ctx context.Context, db Database) error {
+			_, err := db.UpdateDomain(ctx, "example.com", func(domain *model.Domain) error {
+				domain.VerifiedAt = time.Now()
+				return nil
+			})
+			return err
+		},
+		check: func(ctx context.Context, db Database) error {
+			domain, err := db.GetDomain(ctx, "example.com")
+			if err == nil && !domain.VerifiedAt.IsZero() {
+				err = errors.New("domain verified")
+			}
+			return err
+		},
+	},
+	{
+		name: "domains/delete",
+		seed: func(ctx context.Context, db Database) error {
+			return db.CreateDomain(ctx, &model.Domain{Name: "example.com", DeploymentId: "dep"})
+		},
+		write: func(ctx context.Context, db Database) error {
+			return db.DeleteDomains(ctx, "dep")
+		},
+		check: func(ctx context.Context, db Database) error {
+			_, err := db.GetDomain(ctx, "example.com")
+			return err
+		},
+	},
+	{
+		name: "nodes/create",
+		write: func(ctx context.Context, db Database) error {
+			return db.CreateNode(ctx, &model.Node{Name: "edge-1", Endpoint: "tcp://10.0.0.2:2376"})
+		},
+		check: func(ctx context.Context, db Database) error {
+			_, err := db.GetNode(ctx, "edge-1")
+			return kept(err)
+		},
+	},
+	{
+		name: "nodes/update",
+		seed: func(ctx context.Context, db Database) error {
+			return db.CreateNode(ctx, &model.Node{Name: "edge-1", Endpoint: "tcp://10.0.0.2:2376"})
+		},
+		write: func(ctx context.Context, db Database) error {
+			_, err := db.UpdateNode(ctx, "edge-1", func(node *model.Node) error {
+				node.Capacity = 10
+				return nil
+			})
+			return err
+		},
+		check: func(ctx context.Context, db Database) error {
+			node, err := db.GetNode(ctx, "edge-1")
+			if err == nil && node.Capacity != 0 {
+				err = fmt.Errorf("got capacity %d", node.Capacity)
+			}
+			return err
+		},
+	},
+	{
+		name: "nodes/delete",
+		seed: func(ctx context.Context, db Database) error {
+			return db.CreateNode(ctx, &model.Node{Name: "edge-1", Endpoint: "tcp://10.0.0.2:2376"})
+		},
+		write: func(ctx context.Context, db Database) error {
+			return db.DeleteNode(ctx, "edge-1")
+		},
+		check: func(ctx context.Context, db Database) error {
+			_, err := db.GetNode(ctx, "edge-1")
+			return err
+		},
+	},
+}
+
+func TestWithTxRollback(t *testing.T) {
+	for backend, open := range kvBackends {
+		for _, tc := range rollbackCases {
+			t.Run(backend+"/"+tc.name, func(t *testing.T) {
+				db := open(t)
+				t.Cleanup(func() { _ = db.CloseConnection() })
+				ctx := context.Background()
+
+				if tc.seed != nil {
+					if err := tc.seed(ctx, db); err != nil {
+						t.Fatalf("seed: %v", err)
+					}
+				}
+				err := db.WithTx(ctx, func(ctx context.Context) error {
+					if err := tc.write(ctx, db); err != nil {
+						return fmt.Errorf("write: %w", err)
+					}
+					return errAbort
+				})
+				if !errors.Is(err, errAbort) {
+					t.Fatalf("got error %v, want the error of the callback", err)
+				}
+				if err = tc.check(ctx, db); err != nil {
+					t.Fatalf("write not rolled back: %v", err)
+				}
+			})
+		}
+	}
+}
+
+// TestWithTxCommit checks the cases write what the rollback is expected to undo
+func TestWithTxCommit(t *testing.T) {
+	for backend, open := range kvBackends {
+		for _, tc := range rollbackCases {
+			t.Run(backend+"/"+tc.name, func(t *testing.T) {
+				db := open(t)
+				t.Cleanup(func() { _ = db.CloseConnection() })
+				ctx := context.Background()
+
+				if tc.seed != nil {
+					if err := tc.seed(ctx, db); err != nil {
+						t.Fatalf("seed: %v", err)
+					}
+				}
+				if err := db.WithTx(ctx, func(ctx context.Context) error { return tc.write(ctx, db) }); err != nil {
+					t.Fatalf("write: %v", err)
+				}
+				if err := tc.check(ctx, db); err == nil {
+					t.Fatal("committed write not found")
+				}
+			})
+		}
+	}
+}
+
+func TestRoutePrefixUnique(t *testing.T) {
+	for backend, open := range kvBackends {
+		t.Run(backend, func(t *testing.T) {
+			db := open(t)
+			t.Cleanup(func() { _ = db.CloseConnection() })
+			ctx := context.Background()
+
+			for _, id := range []string{"dep", "other"} {
+				if err := db.CreateDeployment(ctx, &model.Deployment{Id: id, Name: id}); err != nil {
+					t.Fatal(err)
+				}
+			}
+			route := func(id string) error {
+				_, err := db.UpdateDeployment(ctx, id, func(dep *model.Deployment) error {
+					dep.Route = &model.Route{PathPrefix: "/app"}
+					return nil
+				})
+				return err
+			}
+			if err := route("dep"); err != nil {
+				t.Fatal(err)
+			}
+			// the owner keeps its route through other updates
+			if err := route("dep"); err != nil {
+				t.Fatalf("got %v updating the route of its owner", err)
+			}
+			if err := route("other"); !errors.Is(err, ErrDuplicate) {
+				t.Fatalf("got %v, want ErrDuplicate", err)
+			}
+
+			// the path prefix of a deleted deployment is free
+			_, err := db.UpdateDeployment(ctx, "dep", func(dep *model.Deployment) error {
+				dep.DeletedAt = time.Now()
+				return nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err = route("other"); err != nil {
+				t.Fatalf("got %v after the owner was deleted", err)
+			}
+		})
+	}
+}
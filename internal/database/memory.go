@@ -0,0 +1,132 @@
+package database
+
+import (
+	"bytes"
+	"errors"
+	"sort"
+	"sync"
+)
+
+var errReadOnly = errors.New("write in a read transaction")
+
+// memoryStore keeps the buckets in memory, nothing survives a restart. A write transaction holds the store until it
+// ends, the values it replaced are put back when it fails. Read transactions run alongside each other.
+type memoryStore struct {
+	mu      sync.RWMutex
+	buckets map[string]map[string][]byte
+}
+
+type memoryTx struct {
+	store    *memoryStore
+	writable bool
+	// undo holds the values before the first write of each key, nil when the key did not exist
+	undo map[string]map[string][]byte
+}
+
+type memoryBucket struct {
+	tx   *memoryTx
+	name string
+}
+
+func NewMemoryDatabase() Database {
+	s := &memoryStore{buckets: make(map[string]map[string][]byte, len(buckets))}
+	for _, name := range buckets {
+		s.buckets[string(name)] = map[string][]byte{}
+	}
+	return &kvDatabase{store: s}
+}
+
+func (s *memoryStore) update(fn func(tx storeTx) error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	tx := &memoryTx{store: s, writable: true, undo: map[string]map[string][]byte{}}
+	committed := false
+	defer func() {
+		if !committed {
+			tx.rollback()
+		}
+	}()
+	if err := fn(tx); err != nil {
+		return err
+	}
+	committed = true
+	return nil
+}
+
+func (s *memoryStore) view(fn func(tx storeTx) error) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return fn(&memoryTx{store: s})
+}
+
+func (s *memoryStore) close() error {
+	return nil
+}
+
+func (t *memoryTx) bucket(name []byte) bucket {
+	return &memoryBucket{tx: t, name: string(name)}
+}
+
+// remember stores the value of the key before the first write of the transaction
+func (t *memoryTx) remember(name string, key string) {
+	undo, ok := t.undo[name]
+	if !ok {
+		undo = map[string][]byte{}
+		t.undo[name] = undo
+	}
+	if _, ok = undo[key]; !ok {
+		undo[key] = t.store.buckets[name][key]
+	}
+}
+
+func (t *memoryTx) rollback() {
+	for name, undo := range t.undo {
+		b := t.store.buckets[name]
+		for key, value := range undo {
+			if value == nil {
+				delete(b, key)
+			} else {
+				b[key] = value
+			}
+		}
+	}
+}
+
+func (b *memoryBucket) Get(key []byte) []byte {
+	return b.tx.store.buckets[b.name][string(key)]
+}
+
+func (b *memoryBucket) Put(key []byte, value []byte) error {
+	if !b.tx.writable {
+		return errReadOnly
+	}
+	b.tx.remember(b.name, string(key))
+	b.tx.store.buckets[b.name][string(key)] = bytes.Clone(value)
+	return nil
+}
+
+func (b *memoryBucket) Delete(key []byte) error {
+	if !b.tx.writable {
+		return errReadOnly
+	}
+	b.tx.remember(b.name, string(key))
+	delete(b.tx.store.buckets[b.name], string(key))
+	return nil
+}
+
+func (b *memoryBucket) ForEach(start []byte, fn func(key []byte, value []byte) (bool, error)) error {
+	records := b.tx.store.buckets[b.name]
+	keys := make([]string, 0, len(records))
+	for key := range records {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys[sort.SearchStrings(keys, string(start)):] {
+		if next, err := fn([]byte(key), records[key]); err != nil || !next {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,589 @@
+package database
+
+import (
+	"GDHost/internal/model"
+	"context"
+	"errors"
+	"fmt"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.mongodb.org/mongo-driver/mongo/readpref"
+	"go.mongodb.org/mongo-driver/mongo/writeconcern"
+	"time"
+)
+
+// database stores the records in MongoDB, the transactions need a replica set
+type database struct {
+	client      *mongo.Client
+	deployments *mongo.Collection
+	templates   *mongo.Collection
+	builds      *mongo.Collection
+	buildLogs   *mongo.Collection
+	releases    *mongo.Collection
+	ports       *mongo.Collection
+	domains     *mongo.Collection
+	nodes       *mongo.Collection
+}
+
+func NewDatabaseConnection(host string) (Database, error) {
+	db := database{}
+	if err := db.connectDatabase(host); err != nil {
+		return nil, err
+	}
+	return &db, nil
+}
+
+func (d *database) connectDatabase(host string) error {
+	var err error
+	ctx := context.Background()
+	if d.client, err = mongo.Connect(ctx, options.Client().ApplyURI(host)); err != nil {
+		return fmt.Errorf("failed to connect to database: %w", err)
+	}
+	if err = d.client.Ping(ctx, readpref.Primary()); err != nil {
+		return fmt.Errorf("failed to ping to database: %w", err)
+	}
+	d.deployments = d.client.Database("gdhost").Collection("deployments")
+
+	indexModels := []mongo.IndexModel{
+		{
+			Keys: bson.M{"deleted_at": 1},
+		},
+		{
+			// serves DeploymentQuery.Node
+			Keys: bson.M{"node": 1},
+		},
+		{
+			// a path prefix routes to one deployment only
+			Keys: bson.M{"route.path_prefix": 1},
+			Options: options.Index().SetUnique(true).
+				SetPartialFilterExpression(bson.D{{"route.path_prefix", bson.M{"$exists": true}}, {"deleted_at", time.Time{}}}),
+		},
+	}
+	if _, err = d.deployments.Indexes().CreateMany(ctx, indexModels); err != nil {
+		return fmt.Errorf("failed to create index: %w", err)
+	}
+
+	d.templates = d.client.Database("gdhost").Collection("templates")
+
+	indexModel := mongo.IndexModel{
+		Keys:    bson.M{"name": 1},
+		Options: options.Index().SetUnique(true),
+	}
+	if _, err = d.templates.Indexes().CreateOne(ctx, indexModel); err != nil {
+		return fmt.Errorf("failed to create index: %w", err)
+	}
+
+	d.builds = d.client.Database("gdhost").Collection("builds")
+
+	indexModels = []mongo.IndexModel{
+		{
+			Keys: bson.D{{"status", 1}, {"created_at", 1}},
+		},
+		{
+			// only one queued or running build per deployment
+			Keys: bson.M{"deployment_id": 1},
+			Options: options.Index().SetUnique(true).
+				SetPartialFilterExpression(bson.M{"status": bson.M{"$lte": model.BuildRunning}}),
+		},
+	}
+	if _, err = d.builds.Indexes().CreateMany(ctx, indexModels); err != nil {
+		return fmt.Errorf("failed to create index: %w", err)
+	}
+
+	d.buildLogs = d.client.Database("gdhost").Collection("build_logs")
+
+	indexModel = mongo.IndexModel{
+		Keys: bson.D{{"build_id", 1}, {"seq", 1}},
+	}
+	if _, err = d.buildLogs.Indexes().CreateOne(ctx, indexModel); err != nil {
+		return fmt.Errorf("failed to create index: %w", err)
+	}
+
+	d.releases = d.client.Database("gdhost").Collection("releases")
+
+	indexModel = mongo.IndexModel{
+		Keys:    bson.D{{"deployment_id", 1}, {"version", 1}},
+		Options: options.Index().SetUnique(true),
+	}
+	if _, err = d.releases.Indexes().CreateOne(ctx, indexModel); err != nil {
+		return fmt.Errorf("failed to create index: %w", err)
+	}
+
+	// the _id of a reservation is protocol/port, so a host port can only be inserted once
+	d.ports = d.client.Database("gdhost").Collection("ports")
+
+	indexModels = []mongo.IndexModel{
+		{
+			Keys: bson.M{"deployment_id": 1},
+		},
+		{
+			Keys: bson.D{{"protocol", 1}, {"host_port", 1}},
+		},
+	}
+	if _, err = d.ports.Indexes().CreateMany(ctx, indexModels); err != nil {
+		return fmt.Errorf("failed to create index: %w", err)
+	}
+
+	// the _id of a domain is its name, so a name belongs to one deployment only
+	d.domains = d.client.Database("gdhost").Collection("domains")
+
+	indexModel = mongo.IndexModel{
+		Keys: bson.M{"deployment_id": 1},
+	}
+	if _, err = d.domains.Indexes().CreateOne(ctx, indexModel); err != nil {
+		return fmt.Errorf("failed to create index: %w", err)
+	}
+
+	// the _id of a node is its name
+	d.nodes = d.client.Database("gdhost").Collection("nodes")
+
+	return nil
+}
+
+func (d *database) CloseConnection() error {
+	return d.client.Disconnect(context.Background())
+}
+
+// mongoError converts the errors of the driver to the errors of Database
+func mongoError(err error) error {
+	switch {
+	case errors.Is(err, mongo.ErrNoDocuments):
+		return ErrNotFound
+	case mongo.IsDuplicateKeyError(err):
+		return ErrDuplicate
+	default:
+		return err
+	}
+}
+
+// WithTx joins the transaction of ctx when there is one
+func (d *database) WithTx(ctx context.Context, fn func(ctx context.Context) error) error {
+	if mongo.SessionFromContext(ctx) != nil {
+		return fn(ctx)
+	}
+	session, err := d.client.StartSession()
+	if err != nil {
+		return fmt.Errorf("failed to start session: %w", err)
+	}
+	defer session.EndSession(ctx)
+
+	txnOptions := options.Transaction().SetWriteConcern(writeconcern.Majority())
+	_, err = session.WithTransaction(ctx, func(sc mongo.SessionContext) (interface{}, error) {
+		return nil, fn(sc)
+	}, txnOptions)
+	return err
+}
+
+// updateAttempts bounds how often updateOne runs fn again after another writer changed the record
+const updateAttempts = 10
+
+var errUpdateConflict = errors.New("record changed concurrently")
+
+// updateOne changes the record matching the filter with fn. Only the fields fn changed are written with $set and
+// $unset, on the condition that they still hold the stored values, so concurrent writers of other fields do not undo
+// each other and fn runs again on the new record when a field it changed was written first. The update joins the
+// transaction of ctx, it does not start one.
+func updateOne[T any](ctx context.Context, coll *mongo.Collection, filter bson.D, fn func(*T) error) (*T, error) {
+	for i := 0; i < updateAttempts; i++ {
+		stored, err := coll.FindOne(ctx, filter).Raw()
+		if err != nil {
+			return nil, mongoError(err)
+		}
+		record := new(T)
+		if err = bson.Unmarshal(stored, record); err != nil {
+			return nil, fmt.Errorf("parse error: %w", err)
+		}
+		if err = fn(record); err != nil {
+			return nil, err
+		}
+		changed, err := bson.Marshal(record)
+		if err != nil {
+			return nil, fmt.Errorf("encode error: %w", err)
+		}
+
+		update, unchanged, err := changedFields(stored, changed)
+		if err != nil {
+			return nil, err
+		}
+		if len(update) == 0 {
+			return record, nil
+		}
+		res, err := coll.UpdateOne(ctx, bson.D{{"$and", bson.A{filter, unchanged}}}, update)
+		if err != nil {
+			return nil, mongoError(err)
+		}
+		if res.MatchedCount != 0 {
+			return record, nil
+		}
+	}
+	return nil, errUpdateConflict
+}
+
+// changedFields returns the update from the stored to the changed top level fields and the filter matching the
+// stored values of those fields
+func changedFields(stored bson.Raw, changed bson.Raw) (bson.D, bson.D, error) {
+	before, err := stored.Elements()
+	if err != nil {
+		return nil, nil, fmt.Errorf("parse error: %w", err)
+	}
+	after, err := changed.Elements()
+	if err != nil {
+		return nil, nil, fmt.Errorf("parse error: %w", err)
+	}
+	values := make(map[string]bson.RawValue, len(before))
+	for _, e := range before {
+		values[e.Key()] = e.Value()
+	}
+
+	var set, unset, filter bson.D
+	for _, e := range after {
+		key := e.Key()
+		prev, ok := values[key]
+		delete(values, key)
+		if ok && prev.Equal(e.Value()) {
+			continue
+		}
+		set = append(set, bson.E{key, e.Value()})
+		if ok {
+			filter = append(filter, bson.E{key, prev})
+		} else {
+			filter = append(filter, bson.E{key, bson.D{{"$exists", false}}})
+		}
+	}
+	for _, e := range before {
+		if prev, ok := values[e.Key()]; ok {
+			unset = append(unset, bson.E{e.Key(), ""})
+			filter = append(filter, bson.E{e.Key(), prev})
+		}
+	}
+
+	var update bson.D
+	if len(set) != 0 {
+		update = append(update, bson.E{"$set", set})
+	}
+	if len(unset) != 0 {
+		update = append(update, bson.E{"$unset", unset})
+	}
+	return update, filter, nil
+}
+
+// findAll decodes every record matching the filter
+func findAll[T any](ctx context.Context, coll *mongo.Collection, filter bson.D, opts *options.FindOptions) ([]T, error) {
+	records := []T{}
+	cursor, err := coll.Find(ctx, filter, opts)
+	if err != nil {
+		return nil, fmt.Errorf("find error: %w", err)
+	}
+	defer cursor.Close(ctx)
+	if err = cursor.All(ctx, &records); err != nil {
+		return nil, fmt.Errorf("parse error: %w", err)
+	}
+	return records, nil
+}
+
+func (d *database) CreateDeployment(ctx context.Context, deployment *model.Deployment) error {
+	_, err := d.deployments.InsertOne(ctx, deployment)
+	return mongoError(err)
+}
+
+func (d *database) GetDeployment(ctx context.Context, id string) (*model.Deployment, error) {
+	filter := bson.D{
+		{"_id", id},
+		{"deleted_at", time.Time{}},
+	}
+	deployment := &model.Deployment{}
+	if err := d.deployments.FindOne(ctx, filter).Decode(deployment); err != nil {
+		return nil, mongoError(err)
+	}
+	return deployment, nil
+}
+
+func (d *database) ListDeployments(ctx context.Context, query DeploymentQuery) ([]model.Deployment, error) {
+	filter := bson.D{{"deleted_at", time.Time{}}}
+	if query.Ids != nil {
+		filter = append(filter, bson.E{"_id", bson.D{{"$in", query.Ids}}})
+	}
+	if query.Name != "" {
+		filter = append(filter, bson.E{"name", query.Name})
+	}
+	if query.ContainerId != "" {
+		filter = append(filter, bson.E{"container_id", query.ContainerId})
+	}
+	if query.PathPrefix != "" {
+		filter = append(filter, bson.E{"route.path_prefix", query.PathPrefix})
+	}
+	if query.LinkedTo != "" {
+		filter = append(filter, bson.E{"links", query.LinkedTo})
+	}
+	if query.Proxied {
+		filter = append(filter, bson.E{"proxy_port", bson.D{{"$gt", 0}}})
+	}
+	if query.HealthChecked {
+		filter = append(filter,
+			bson.E{"health_check", bson.D{{"$exists", true}}},
+			bson.E{"container_id", bson.D{{"$exists", true}}},
+		)
+	}
+	if query.Node != "" {
+		filter = append(filter, bson.E{"node", query.Node})
+	}
+	if query.CrashLooping {
+		filter = append(filter, bson.E{"crash_loop", bson.D{{"$exists", true}}})
+	}
+	opts := options.Find().SetSort(bson.M{"created_at": 1}).SetSkip(int64(query.Skip))
+	if query.Limit > 0 {
+		opts.SetLimit(int64(query.Limit))
+	}
+	return findAll[model.Deployment](ctx, d.deployments, filter, opts)
+}
+
+func (d *database) UpdateDeployment(ctx context.Context, id string, fn func(dep *model.Deployment) error) (*model.Deployment, error) {
+	filter := bson.D{
+		{"_id", id},
+		{"deleted_at", time.Time{}},
+	}
+	return updateOne(ctx, d.deployments, filter, fn)
+}
+
+func (d *database) CreateTemplate(ctx context.Context, template *model.Template) error {
+	_, err := d.templates.InsertOne(ctx, template)
+	return mongoError(err)
+}
+
+func (d *database) GetTemplate(ctx context.Context, name string) (*model.Template, error) {
+	template := &model.Template{}
+	if err := d.templates.FindOne(ctx, bson.D{{"name", name}}).Decode(template); err != nil {
+		return nil, mongoError(err)
+	}
+	return template, nil
+}
+
+func (d *database) ListTemplates(ctx context.Context) ([]model.Template, error) {
+	return findAll[model.Template](ctx, d.templates, bson.D{}, options.Find().SetSort(bson.M{"name": 1}))
+}
+
+func (d *database) UpdateTemplate(ctx context.Context, name string, fn func(tmpl *model.Template) error) (*model.Template, error) {
+	return updateOne(ctx, d.templates, bson.D{{"name", name}}, fn)
+}
+
+func (d *database) DeleteTemplate(ctx context.Context, name string) error {
+	res, err := d.templates.DeleteOne(ctx, bson.D{{"name", name}})
+	if err != nil {
+		return err
+	}
+	if res.DeletedCount == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (d *database) CreateBuild(ctx context.Context, build *model.Build) error {
+	_, err := d.builds.InsertOne(ctx, build)
+	return mongoError(err)
+}
+
+func (d *database) GetBuild(ctx context.Context, id string) (*model.Build, error) {
+	build := &model.Build{}
+	if err := d.builds.FindOne(ctx, bson.D{{"_id", id}}).Decode(build); err != nil {
+		return nil, mongoError(err)
+	}
+	return build, nil
+}
+
+func (d *database) ClaimBuild(ctx context.Context) (*model.Build, error) {
+	filter := bson.D{{"status", model.BuildQueued}}
+	update := bson.D{
+		{"$set", bson.D{
+			{"updated_at", time.Now()},
+			{"started_at", time.Now()},
+			{"status", model.BuildRunning},
+		}},
+	}
+	opts := options.FindOneAndUpdate().SetSort(bson.M{"created_at": 1}).SetReturnDocument(options.After)
+	build := &model.Build{}
+	if err := d.builds.FindOneAndUpdate(ctx, filter, update, opts).Decode(build); err != nil {
+		return nil, mongoError(err)
+	}
+	return build, nil
+}
+
+func (d *database) FailRunningBuilds(ctx context.Context, reason string) error {
+	filter := bson.D{{"status", model.BuildRunning}}
+	update := bson.D{
+		{"$set", bson.D{
+			{"updated_at", time.Now()},
+			{"finished_at", time.Now()},
+			{"status", model.BuildFailed},
+			{"error", reason},
+		}},
+	}
+	_, err := d.builds.UpdateMany(ctx, filter, update)
+	return err
+}
+
+func (d *database) UpdateBuild(ctx context.Context, id string, fn func(build *model.Build) error) (*model.Build, error) {
+	return updateOne(ctx, d.builds, bson.D{{"_id", id}}, fn)
+}
+
+func (d *database) CreateBuildLog(ctx context.Context, log *model.BuildLog) error {
+	_, err := d.buildLogs.InsertOne(ctx, log)
+	return mongoError(err)
+}
+
+func (d *database) ListBuildLogs(ctx context.Context, buildId string, since int) ([]model.BuildLog, error) {
+	filter := bson.D{
+		{"build_id", buildId},
+		{"seq", bson.D{{"$gt", since}}},
+	}
+	return findAll[model.BuildLog](ctx, d.buildLogs, filter, options.Find().SetSort(bson.M{"seq": 1}))
+}
+
+func (d *database) CreateRelease(ctx context.Context, release *model.Release) error {
+	_, err := d.releases.InsertOne(ctx, release)
+	return mongoError(err)
+}
+
+func (d *database) GetRelease(ctx context.Context, deploymentId string, version int) (*model.Release, error) {
+	filter := bson.D{
+		{"deployment_id", deploymentId},
+		{"version", version},
+	}
+	release := &model.Release{}
+	if err := d.releases.FindOne(ctx, filter).Decode(release); err != nil {
+		return nil, mongoError(err)
+	}
+	return release, nil
+}
+
+func (d *database) ListReleases(ctx context.Context, deploymentId string) ([]model.Release, error) {
+	filter := bson.D{{"deployment_id", deploymentId}}
+	return findAll[model.Release](ctx, d.releases, filter, options.Find().SetSort(bson.M{"version": -1}))
+}
+
+func (d *database) UpdateRelease(ctx context.Context, id string, fn func(release *model.Release) error) (*model.Release, error) {
+	return updateOne(ctx, d.releases, bson.D{{"_id", id}}, fn)
+}
+
+func (d *database) CreatePortReservation(ctx context.Context, reservation *model.PortReservation) error {
+	_, err := d.ports.InsertOne(ctx, reservation)
+	return mongoError(err)
+}
+
+func (d *database) GetPortReservation(ctx context.Context, id string) (*model.PortReservation, error) {
+	reservation := &model.PortReservation{}
+	if err := d.ports.FindOne(ctx, bson.D{{"_id", id}}).Decode(reservation); err != nil {
+		return nil, mongoError(err)
+	}
+	return reservation, nil
+}
+
+func (d *database) ListPortReservations(ctx context.Context, query PortQuery) ([]model.PortReservation, error) {
+	filter := bson.D{}
+	if query.DeploymentId != "" {
+		filter = append(filter, bson.E{"deployment_id", query.DeploymentId})
+	}
+	if query.Protocol != "" {
+		filter = append(filter, bson.E{"protocol", query.Protocol})
+	}
+	if query.From != 0 || query.To != 0 {
+		ports := bson.D{}
+		if query.From != 0 {
+			ports = append(ports, bson.E{"$gte", query.From})
+		}
+		if query.To != 0 {
+			ports = append(ports, bson.E{"$lte", query.To})
+		}
+		filter = append(filter, bson.E{"host_port", ports})
+	}
+	return findAll[model.PortReservation](ctx, d.ports, filter, nil)
+}
+
+func (d *database) DeletePortReservations(ctx context.Context, deploymentId string, keep []string) error {
+	ids := bson.A{}
+	for _, id := range keep {
+		ids = append(ids, id)
+	}
+	filter := bson.D{
+		{"deployment_id", deploymentId},
+		{"_id", bson.D{{"$nin", ids}}},
+	}
+	_, err := d.ports.DeleteMany(ctx, filter)
+	return err
+}
+
+func (d *database) CreateDomain(ctx context.Context, domain *model.Domain) error {
+	_, err := d.domains.InsertOne(ctx, domain)
+	return mongoError(err)
+}
+
+func (d *database) GetDomain(ctx context.Context, name string) (*model.Domain, error) {
+	domain := &model.Domain{}
+	if err := d.domains.FindOne(ctx, bson.D{{"_id", name}}).Decode(domain); err != nil {
+		return nil, mongoError(err)
+	}
+	return domain, nil
+}
+
+func (d *database) ListDomains(ctx context.Context, query DomainQuery) ([]model.Domain, error) {
+	filter := bson.D{}
+	if query.DeploymentId != "" {
+		filter = append(filter, bson.E{"deployment_id", query.DeploymentId})
+	}
+	if query.Verified != nil {
+		filter = append(filter, bson.E{"verified_at", bson.D{{"$exists", *query.Verified}}})
+	}
+	return findAll[model.Domain](ctx, d.domains, filter, options.Find().SetSort(bson.M{"_id": 1}))
+}
+
+func (d *database) UpdateDomain(ctx context.Context, name string, fn func(domain *model.Domain) error) (*model.Domain, error) {
+	return updateOne(ctx, d.domains, bson.D{{"_id", name}}, fn)
+}
+
+func (d *database) DeleteDomain(ctx context.Context, name string) error {
+	res, err := d.domains.DeleteOne(ctx, bson.D{{"_id", name}})
+	if err != nil {
+		return err
+	}
+	if res.DeletedCount == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (d *database) DeleteDomains(ctx context.Context, deploymentId string) error {
+	_, err := d.domains.DeleteMany(ctx, bson.D{{"deployment_id", deploymentId}})
+	return err
+}
+
+func (d *database) CreateNode(ctx context.Context, node *model.Node) error {
+	_, err := d.nodes.InsertOne(ctx, node)
+	return mongoError(err)
+}
+
+func (d *database) GetNode(ctx context.Context, name string) (*model.Node, error) {
+	node := &model.Node{}
+	if err := d.nodes.FindOne(ctx, bson.D{{"_id", name}}).Decode(node); err != nil {
+		return nil, mongoError(err)
+	}
+	return node, nil
+}
+
+func (d *database) ListNodes(ctx context.Context) ([]model.Node, error) {
+	return findAll[model.Node](ctx, d.nodes, bson.D{}, options.Find().SetSort(bson.M{"_id": 1}))
+}
+
+func (d *database) UpdateNode(ctx context.Context, name string, fn func(node *model.Node) error) (*model.Node, error) {
+	return updateOne(ctx, d.nodes, bson.D{{"_id", name}}, fn)
+}
+
+func (d *database) DeleteNode(ctx context.Context, name string) error {
+	res, err := d.nodes.DeleteOne(ctx, bson.D{{"_id", name}})
+	if err != nil {
+		return err
+	}
+	if res.DeletedCount == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
@@ -0,0 +1,84 @@
+package database
+
+import (
+	"GDHost/internal/model"
+	"go.mongodb.org/mongo-driver/bson"
+	"reflect"
+	"testing"
+)
+
+func TestChangedFields(t *testing.T) {
+	stored := model.Deployment{Id: "dep", Name: "app", ContainerId: "c1", Links: []string{"db"}}
+	tests := []struct {
+		name   string
+		change func(dep *model.Deployment)
+		update bson.D
+		filter bson.D
+	}{
+		{
+			name:   "unchanged",
+			change: func(dep *model.Deployment) {},
+		},
+		{
+			name:   "set",
+			change: func(dep *model.Deployment) { dep.ContainerId = "c2" },
+			update: bson.D{{"$set", bson.D{{"container_id", "c2"}}}},
+			filter: bson.D{{"container_id", "c1"}},
+		},
+		{
+			name:   "added",
+			change: func(dep *model.Deployment) { dep.Node = "edge-1" },
+			update: bson.D{{"$set", bson.D{{"node", "edge-1"}}}},
+			filter: bson.D{{"node", bson.D{{"$exists", false}}}},
+		},
+		{
+			name:   "removed",
+			change: func(dep *model.Deployment) { dep.Links = nil },
+			update: bson.D{{"$unset", bson.D{{"links", ""}}}},
+			filter: bson.D{{"links", bson.A{"db"}}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			before, err := bson.Marshal(stored)
+			if err != nil {
+				t.Fatal(err)
+			}
+			dep := stored
+			dep.Links = append([]string(nil), stored.Links...)
+			tt.change(&dep)
+			after, err := bson.Marshal(dep)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			update, filter, err := changedFields(before, after)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(plain(t, update), plain(t, tt.update)) {
+				t.Errorf("got update %v, want %v", update, tt.update)
+			}
+			if !reflect.DeepEqual(plain(t, filter), plain(t, tt.filter)) {
+				t.Errorf("got filter %v, want %v", filter, tt.filter)
+			}
+		})
+	}
+}
+
+// plain decodes the document to compare the raw values of changedFields with literal values
+func plain(t *testing.T, doc bson.D) bson.M {
+	t.Helper()
+	if doc == nil {
+		return nil
+	}
+	b, err := bson.Marshal(doc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var m bson.M
+	if err = bson.Unmarshal(b, &m); err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
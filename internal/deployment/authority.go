@@ -0,0 +1,189 @@
+package deployment
+
+import (
+	"GDHost/internal/response"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"github.com/gin-contrib/requestid"
+	"github.com/gin-gonic/gin"
+	"math/big"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const (
+	caCertFile      = "ca.pem"
+	caKeyFile       = "ca-key.pem"
+	caValidity      = 10 * 365 * 24 * time.Hour
+	leafValidity    = 90 * 24 * time.Hour
+	leafRenewLeeway = 30 * 24 * time.Hour
+)
+
+// authority is the local certificate authority of GDHost. It issues the certificates of the deployment hostnames
+// on demand and keeps them in memory until they are close to expiry.
+type authority struct {
+	certPath string
+	cert     *x509.Certificate
+	key      *ecdsa.PrivateKey
+	mu       sync.Mutex
+	leaves   map[string]*tls.Certificate
+}
+
+// loadAuthority loads the CA from dir, or creates it on the first start
+func loadAuthority(dir string) (*authority, error) {
+	a := &authority{
+		certPath: filepath.Join(dir, caCertFile),
+		leaves:   make(map[string]*tls.Certificate),
+	}
+	keyPath := filepath.Join(dir, caKeyFile)
+
+	certPEM, err := os.ReadFile(a.certPath)
+	if errors.Is(err, os.ErrNotExist) {
+		if err = a.create(dir, keyPath); err != nil {
+			return nil, fmt.Errorf("failed to create certificate authority: %w", err)
+		}
+		return a, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read ca certificate: %w", err)
+	}
+	keyPEM, err := os.ReadFile(keyPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read ca key: %w", err)
+	}
+
+	block, _ := pem.Decode(certPEM)
+	if block == nil {
+		return nil, errors.New("invalid ca certificate")
+	}
+	if a.cert, err = x509.ParseCertificate(block.Bytes); err != nil {
+		return nil, fmt.Errorf("failed to parse ca certificate: %w", err)
+	}
+	block, _ = pem.Decode(keyPEM)
+	if block == nil {
+		return nil, errors.New("invalid ca key")
+	}
+	if a.key, err = x509.ParseECPrivateKey(block.Bytes); err != nil {
+		return nil, fmt.Errorf("failed to parse ca key: %w", err)
+	}
+	return a, nil
+}
+
+func (a *authority) create(dir string, keyPath string) error {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	serial, err := serialNumber()
+	if err != nil {
+		return err
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: "GDHost Local CA", Organization: []string{"GDHost"}},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(caValidity),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		MaxPathLenZero:        true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		return err
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return err
+	}
+
+	if err = os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	if err = os.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		return err
+	}
+	if err = os.WriteFile(a.certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644); err != nil {
+		return err
+	}
+
+	a.key = key
+	a.cert, err = x509.ParseCertificate(der)
+	return err
+}
+
+// certificate returns the certificate of the host, a new one is issued when there is none or it expires soon
+func (a *authority) certificate(host string) (*tls.Certificate, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if leaf, ok := a.leaves[host]; ok && time.Until(leaf.Leaf.NotAfter) > leafRenewLeeway {
+		return leaf, nil
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate key: %w", err)
+	}
+	serial, err := serialNumber()
+	if err != nil {
+		return nil, err
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: host},
+		DNSNames:     []string{host},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(leafValidity),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, a.cert, &key.PublicKey, a.key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to issue certificate: %w", err)
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse certificate: %w", err)
+	}
+
+	cert := &tls.Certificate{
+		Certificate: [][]byte{der, a.cert.Raw},
+		PrivateKey:  key,
+		Leaf:        leaf,
+	}
+	a.leaves[host] = cert
+	return cert, nil
+}
+
+func serialNumber() (*big.Int, error) {
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate serial number: %w", err)
+	}
+	return serial, nil
+}
+
+func (d *deployment) GetCACertificate(c *gin.Context) {
+	logger := d.logger.With().Str("request_id", requestid.Get(c)).Logger()
+
+	if d.ca == nil {
+		logger.Error().Msg("local ca is disabled")
+		response.StatusNotFound(c, "local ca is disabled")
+		return
+	}
+
+	c.Header("Content-Type", "application/x-pem-file")
+	c.File(d.ca.certPath)
+	logger.Info().Msg("ca certificate sent")
+	return
+}
@@ -0,0 +1,534 @@
+package deployment
+
+import (
+	"GDHost/internal/database"
+	"GDHost/internal/model"
+	"GDHost/internal/response"
+	"GDHost/internal/utility"
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/docker/docker/client"
+	"github.com/docker/docker/pkg/jsonmessage"
+	"github.com/gin-contrib/requestid"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/rs/zerolog"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	buildPollInterval   = 10 * time.Second
+	buildFollowInterval = time.Second
+)
+
+// startBuildWorkers marks the builds orphaned by a previous run as failed and starts the build workers
+func (d *deployment) startBuildWorkers(ctx context.Context, workers int) error {
+	if err := d.db.FailRunningBuilds(ctx, "build interrupted by server restart"); err != nil {
+		return fmt.Errorf("failed to fail orphaned builds: %w", err)
+	}
+
+	for i := 0; i < workers; i++ {
+		d.wg.Add(1)
+		go d.buildWorker(ctx)
+	}
+	return nil
+}
+
+// Close stops the build workers and the crash watcher and waits for them to exit, then closes the proxied host ports
+// and the engines of the nodes. Running builds are cancelled.
+func (d *deployment) Close() {
+	d.cancel()
+	d.wg.Wait()
+	d.nodesMu.Lock()
+	for name, n := range d.nodes {
+		delete(d.nodes, name)
+		d.closeNode(name, n.ContainerRuntime)
+	}
+	d.nodesMu.Unlock()
+	d.proxy.Close()
+	if d.httpProxy != nil {
+		_ = d.httpProxy.Close()
+	}
+	if d.httpsProxy != nil {
+		_ = d.httpsProxy.Close()
+	}
+}
+
+// notifyBuildWorkers wakes up an idle build worker
+func (d *deployment) notifyBuildWorkers() {
+	select {
+	case d.builds <- struct{}{}:
+	default:
+	}
+}
+
+// buildWorker runs queued builds one at a time until the context is cancelled
+func (d *deployment) buildWorker(ctx context.Context) {
+	defer d.wg.Done()
+
+	ticker := time.NewTicker(buildPollInterval)
+	defer ticker.Stop()
+
+	for {
+		for ctx.Err() == nil {
+			build, err := d.db.ClaimBuild(ctx)
+			if err != nil {
+				if !errors.Is(err, database.ErrNotFound) && !errors.Is(err, context.Canceled) {
+					d.logger.Error().Err(err).Msg("failed to claim build")
+				}
+				break
+			}
+			d.runBuild(ctx, build)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-d.builds:
+		case <-ticker.C:
+		}
+	}
+}
+
+// finishBuild records the result of the build on the build and on the deployment
+func (d *deployment) finishBuild(build *model.Build, buildErr error, logger zerolog.Logger) {
+	ctx := context.Background()
+	var buildError string
+	if buildErr != nil {
+		logger.Error().Err(buildErr).Msg("build failed")
+		buildError = buildErr.Error()
+	} else {
+		logger.Info().Msg("build succeeded")
+	}
+
+	_, err := d.db.UpdateBuild(ctx, build.Id, func(b *model.Build) error {
+		b.UpdatedAt = time.Now()
+		b.FinishedAt = time.Now()
+		if buildErr != nil {
+			b.Status = model.BuildFailed
+			b.Error = buildError
+			return nil
+		}
+		b.Status = model.BuildSucceeded
+		b.ImageId = build.ImageId
+		b.Release = build.Release
+		return nil
+	})
+	if err != nil {
+		logger.Error().Err(err).Msg("failed to update build")
+	}
+
+	// the stage of the deployment is left untouched, a failed build keeps the previous image
+	_, err = d.db.UpdateDeployment(ctx, build.DeploymentId, func(dep *model.Deployment) error {
+		dep.UpdatedAt = time.Now()
+		dep.LastBuildId = build.Id
+		dep.BuildError = buildError
+		return nil
+	})
+	if err != nil {
+		logger.Error().Err(err).Msg("failed to record build result on deployment")
+	}
+}
+
+// buildLogWriter stores the lines of a build output in order
+type buildLogWriter struct {
+	d       *deployment
+	ctx     context.Context
+	buildId string
+	seq     int
+	logger  zerolog.Logger
+}
+
+func (w *buildLogWriter) write(typ, line string) {
+	blog := model.BuildLog{
+		Id:      uuid.NewString(),
+		BuildId: w.buildId,
+		Seq:     w.seq,
+		Time:    time.Now(),
+		Type:    typ,
+		Line:    line,
+	}
+	w.seq++
+	if err := w.d.db.CreateBuildLog(w.ctx, &blog); err != nil {
+		w.logger.Error().Err(err).Msg("failed to store build log")
+	}
+}
+
+// podmanErrorPrefix starts the plain text error lines of podman
+const podmanErrorPrefix = "Error: "
+
+// buildMessage decodes a line of the build output. Docker writes a json message with an errorDetail per line,
+// podman writes messages with only stream or error set, which may end in the middle of a line, and some versions
+// plain text lines. A plain line is a stream line, or the build error when it starts with podmanErrorPrefix.
+func buildMessage(line []byte) jsonmessage.JSONMessage {
+	var msg jsonmessage.JSONMessage
+	if bytes.HasPrefix(bytes.TrimSpace(line), []byte("{")) && json.Unmarshal(line, &msg) == nil {
+		return msg
+	}
+	text := strings.TrimRight(string(line), "\r\n")
+	if strings.HasPrefix(text, podmanErrorPrefix) {
+		return jsonmessage.JSONMessage{ErrorMessage: strings.TrimPrefix(text, podmanErrorPrefix)}
+	}
+	return jsonmessage.JSONMessage{Stream: text + "\n"}
+}
+
+// storeBuildOutput decodes the build output of docker or podman line by line and stores every line of it.
+// Returns the error reported by the build in the output.
+func (d *deployment) storeBuildOutput(ctx context.Context, build *model.Build, r io.Reader, logger zerolog.Logger) error {
+	w := &buildLogWriter{d: d, ctx: ctx, buildId: build.Id, logger: logger}
+	br := bufio.NewReader(r)
+
+	var pending string
+	var buildErr error
+	for {
+		line, err := br.ReadBytes('\n')
+		if err != nil && !errors.Is(err, io.EOF) {
+			return fmt.Errorf("failed to read image build response: %w", err)
+		}
+		if len(bytes.TrimSpace(line)) == 0 {
+			if err != nil {
+				break
+			}
+			continue
+		}
+
+		msg := buildMessage(line)
+		switch {
+		case msg.Error != nil || msg.ErrorMessage != "":
+			errMsg := msg.ErrorMessage
+			if msg.Error != nil && msg.Error.Message != "" {
+				errMsg = msg.Error.Message
+			}
+			w.write(model.BuildLogError, errMsg)
+			buildErr = errors.New(errMsg)
+		case msg.Stream != "":
+			lines := strings.Split(pending+msg.Stream, "\n")
+			pending = lines[len(lines)-1]
+			for _, line := range lines[:len(lines)-1] {
+				w.write(model.BuildLogStream, strings.TrimRight(line, "\r"))
+			}
+		case msg.Aux != nil:
+			w.write(model.BuildLogAux, string(*msg.Aux))
+		case msg.Status != "" && msg.ProgressMessage == "":
+			if msg.ID != "" {
+				w.write(model.BuildLogStatus, msg.ID+": "+msg.Status)
+			} else {
+				w.write(model.BuildLogStatus, msg.Status)
+			}
+		}
+		if err != nil {
+			break
+		}
+	}
+	if pending != "" {
+		w.write(model.BuildLogStream, pending)
+	}
+	return buildErr
+}
+
+// runBuild builds the image of the deployment and stores the build output
+func (d *deployment) runBuild(ctx context.Context, build *model.Build) {
+	logger := d.logger.With().Str("build_id", build.Id).Str("deployment_id", build.DeploymentId).Logger()
+	logger.Info().Msg("build started")
+
+	dep, err := d.db.GetDeployment(ctx, build.DeploymentId)
+	if err != nil {
+		if errors.Is(err, database.ErrNotFound) {
+			d.finishBuild(build, errors.New("deployment not found"), logger)
+			return
+		}
+		d.finishBuild(build, fmt.Errorf("failed to find deployment: %w", err), logger)
+		return
+	}
+
+	if dep.Stage < model.DockerfileUpload {
+		d.finishBuild(build, errors.New("dockerfile has not been created/uploaded yet"), logger)
+		return
+	}
+
+	dest := filepath.Join(filepath.Dir(dep.Location), "application")
+
+	if err = utility.Unzip(dep.Location, dest); err != nil {
+		d.finishBuild(build, fmt.Errorf("failed to unzip the source file: %w", err), logger)
+		return
+	}
+	defer func() {
+		if err = utility.RemoveExceptDockerfile(dest); err != nil {
+			logger.Error().Err(err).Msg("failed to clean up extracted zip file")
+		}
+	}()
+
+	abfp, err := filepath.Abs(dest)
+	if err != nil {
+		d.finishBuild(build, fmt.Errorf("failed to get absolute file path: %w", err), logger)
+		return
+	}
+
+	checksum, err := utility.Checksum(dep.Location)
+	if err != nil {
+		d.finishBuild(build, fmt.Errorf("failed to get source checksum: %w", err), logger)
+		return
+	}
+
+	dockerfile, err := os.ReadFile(dep.Dockerfile)
+	if err != nil {
+		d.finishBuild(build, fmt.Errorf("failed to read dockerfile: %w", err), logger)
+		return
+	}
+
+	version, err := d.nextReleaseVersion(ctx, dep.Id)
+	if err != nil {
+		d.finishBuild(build, err, logger)
+		return
+	}
+	tag := releaseTag(dep.Name, version)
+
+	// the image is built on the node of the deployment, or on the local engine until it is placed
+	rt, err := d.runtime(ctx, placedNode(dep))
+	if err != nil {
+		d.finishBuild(build, err, logger)
+		return
+	}
+	ilogs, err := rt.BuildImage(ctx, []string{dep.Name, tag}, abfp, logger)
+	if err != nil {
+		d.finishBuild(build, err, logger)
+		return
+	}
+	defer func() {
+		if err2 := ilogs.Close(); err2 != nil {
+			logger.Error().Err(err2).Msg("failed to close build logs")
+		}
+	}()
+
+	if err = d.storeBuildOutput(ctx, build, ilogs, logger); err != nil {
+		d.finishBuild(build, err, logger)
+		return
+	}
+
+	if build.ImageId, err = rt.ImageId(ctx, tag); err != nil {
+		if client.IsErrNotFound(err) {
+			// podman ends the output of some failed builds without an error message
+			d.finishBuild(build, errors.New("the build finished without an image, see the build logs"), logger)
+			return
+		}
+		d.finishBuild(build, fmt.Errorf("failed to get image id: %w", err), logger)
+		return
+	}
+
+	release := model.Release{
+		Id:           uuid.NewString(),
+		DeploymentId: dep.Id,
+		CreatedAt:    time.Now(),
+		Version:      version,
+		Tag:          tag,
+		ImageId:      build.ImageId,
+		BuildId:      build.Id,
+		Checksum:     checksum,
+		Dockerfile:   string(dockerfile),
+	}
+	if err = d.db.CreateRelease(context.Background(), &release); err != nil {
+		d.finishBuild(build, fmt.Errorf("failed to create release: %w", err), logger)
+		return
+	}
+	build.Release = version
+
+	// the stage does not go back when the deployment already has a container
+	stage := dep.Stage
+	if stage < model.ImageCreated {
+		stage = model.ImageCreated
+	}
+	_, err = d.db.UpdateDeployment(context.Background(), dep.Id, func(stored *model.Deployment) error {
+		stored.UpdatedAt = time.Now()
+		stored.Stage = stage
+		stored.ImageId = build.ImageId
+		stored.Release = version
+		return nil
+	})
+	if err != nil {
+		d.finishBuild(build, fmt.Errorf("failed to update deployment: %w", err), logger)
+		return
+	}
+
+	// an image built before releases existed is only kept while the container uses it
+	if dep.ImageId != "" && dep.Release == 0 && dep.ContainerId == "" && dep.ImageId != build.ImageId {
+		if err = d.deleteImage(context.Background(), rt, dep.ImageId); err != nil {
+			logger.Error().Err(err).Str("image_id", dep.ImageId).Msg("failed to remove previous image")
+		}
+	}
+
+	d.pruneReleases(context.Background(), rt, dep, build.ImageId, logger)
+
+	d.finishBuild(build, nil, logger)
+}
+
+func (d *deployment) CreateBuild(c *gin.Context) {
+	logger := d.logger.With().Str("request_id", requestid.Get(c)).Logger()
+
+	depId := c.Param("id")
+	if depId == "" {
+		logger.Error().Msg("no deployment id in URL")
+		response.StatusBadRequest(c, "no deployment id in URL")
+		return
+	}
+
+	ctx := c.Request.Context()
+	dep, err := d.db.GetDeployment(ctx, depId)
+	if err != nil {
+		if errors.Is(err, database.ErrNotFound) {
+			logger.Error().Err(err).Str("deployment_id", depId).Msg("deployment not found")
+			response.StatusNotFound(c, "deployment not found")
+			return
+		}
+		logger.Error().Err(err).Str("deployment_id", depId).Msg("failed to find deployment")
+		response.StatusInternalServerError(c)
+		return
+	}
+
+	if dep.Stage < model.DockerfileUpload {
+		logger.Error().Str("deployment_id", depId).Msg("dockerfile has not been created/uploaded yet")
+		response.StatusBadRequest(c, "dockerfile has not been created/upload yet")
+		return
+	}
+
+	build := model.Build{
+		Id:           uuid.NewString(),
+		DeploymentId: depId,
+		CreatedAt:    time.Now(),
+		UpdatedAt:    time.Now(),
+		Status:       model.BuildQueued,
+	}
+	if err = d.db.CreateBuild(ctx, &build); err != nil {
+		if errors.Is(err, database.ErrDuplicate) {
+			logger.Error().Str("deployment_id", depId).Msg("build already queued or running")
+			response.StatusConflicted(c, "a build is already queued or running for the deployment")
+			return
+		}
+		logger.Error().Err(err).Str("deployment_id", depId).Msg("failed to create build")
+		response.StatusInternalServerError(c)
+		return
+	}
+	d.notifyBuildWorkers()
+
+	logger.Info().Str("deployment_id", depId).Str("build_id", build.Id).Msg("build queued")
+	response.StatusAccepted(c, build.Id)
+	return
+}
+
+func (d *deployment) GetBuild(c *gin.Context) {
+	logger := d.logger.With().Str("request_id", requestid.Get(c)).Logger()
+
+	buildId := c.Param("id")
+	if buildId == "" {
+		logger.Error().Msg("no build id")
+		response.StatusBadRequest(c, "no build id")
+		return
+	}
+
+	ctx := c.Request.Context()
+	build, err := d.db.GetBuild(ctx, buildId)
+	if err != nil {
+		if errors.Is(err, database.ErrNotFound) {
+			logger.Error().Err(err).Str("build_id", buildId).Msg("build not found")
+			response.StatusNotFound(c, "build not found")
+			return
+		}
+		logger.Error().Err(err).Str("build_id", buildId).Msg("failed to find build")
+		response.StatusInternalServerError(c)
+		return
+	}
+
+	logger.Info().Str("build_id", buildId).Msg("build sent")
+	response.StatusBuild(c, build)
+	return
+}
+
+func (d *deployment) GetBuildLogs(c *gin.Context) {
+	logger := d.logger.With().Str("request_id", requestid.Get(c)).Logger()
+
+	buildId := c.Param("id")
+	if buildId == "" {
+		logger.Error().Msg("no build id")
+		response.StatusBadRequest(c, "no build id")
+		return
+	}
+
+	since, err := strconv.Atoi(c.DefaultQuery("since", "-1"))
+	if err != nil {
+		logger.Error().Err(err).Msg("invalid since")
+		response.StatusBadRequest(c, "invalid since")
+		return
+	}
+	follow := c.Query("follow") == "true"
+
+	ctx := c.Request.Context()
+	build, err := d.db.GetBuild(ctx, buildId)
+	if err != nil {
+		if errors.Is(err, database.ErrNotFound) {
+			logger.Error().Err(err).Str("build_id", buildId).Msg("build not found")
+			response.StatusNotFound(c, "build not found")
+			return
+		}
+		logger.Error().Err(err).Str("build_id", buildId).Msg("failed to find build")
+		response.StatusInternalServerError(c)
+		return
+	}
+
+	if !follow {
+		blogs, err := d.db.ListBuildLogs(ctx, buildId, since)
+		if err != nil {
+			logger.Error().Err(err).Str("build_id", buildId).Msg("failed to find build logs")
+			response.StatusInternalServerError(c)
+			return
+		}
+
+		logger.Info().Str("build_id", buildId).Int("lines", len(blogs)).Msg("build logs sent")
+		response.StatusBuildLogs(c, &blogs)
+		return
+	}
+
+	for {
+		// status is read before the logs so that no line is missed after the build finishes
+		finished := build.Status > model.BuildRunning
+
+		blogs, err := d.db.ListBuildLogs(ctx, buildId, since)
+		if err != nil {
+			logger.Error().Err(err).Str("build_id", buildId).Msg("failed to find build logs")
+			return
+		}
+		for _, blog := range blogs {
+			response.EventBuildLog(c, &blog)
+			since = blog.Seq
+		}
+		c.Writer.Flush()
+
+		if finished {
+			break
+		}
+
+		select {
+		case <-ctx.Done():
+			logger.Info().Str("build_id", buildId).Msg("build log follower left")
+			return
+		case <-time.After(buildFollowInterval):
+		}
+
+		if build, err = d.db.GetBuild(ctx, buildId); err != nil {
+			logger.Error().Err(err).Str("build_id", buildId).Msg("failed to find build")
+			return
+		}
+	}
+
+	c.SSEvent("finished", build.Status.String())
+	c.Writer.Flush()
+	logger.Info().Str("build_id", buildId).Msg("build logs followed")
+	return
+}
@@ -1,32 +1,327 @@
 package deployment
 
 import (
+	"GDHost/internal/config"
+	"GDHost/internal/model"
 	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
 	"fmt"
 	"github.com/docker/docker/api/types"
 	ct "github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/events"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/docker/api/types/mount"
+	"github.com/docker/docker/api/types/network"
+	"github.com/docker/docker/api/types/volume"
 	"github.com/docker/docker/client"
 	"github.com/docker/docker/pkg/archive"
+	"github.com/docker/docker/pkg/jsonmessage"
 	"github.com/docker/go-connections/nat"
+	"github.com/docker/go-units"
 	"github.com/rs/zerolog"
 	"io"
+	"net/http"
+	"os"
+	"strconv"
 	"strings"
+	"time"
 )
 
-type container struct {
-	cli *client.Client
+// deploymentLabel labels the docker objects of a deployment with its id
+const deploymentLabel = "gdhost.deployment"
+
+// ContainerRuntime is the container engine the deployments run on. The docker engine and the docker api of podman
+// implement it, a fake engine can be injected into the deployment controller for testing.
+type ContainerRuntime interface {
+	NetworkName(depId string) string
+	EnsureNetwork(ctx context.Context, depId string) error
+	RemoveNetwork(ctx context.Context, depId string) error
+	ConnectNetwork(ctx context.Context, depId string, containerId string) error
+	DisconnectNetwork(ctx context.Context, depId string, containerId string) error
+	BuildImage(ctx context.Context, tags []string, path string, logger zerolog.Logger) (io.ReadCloser, error)
+	ImageId(ctx context.Context, name string) (string, error)
+	DeleteImage(ctx context.Context, imageId string) error
+	SaveImage(ctx context.Context, ref string) (io.ReadCloser, error)
+	LoadImage(ctx context.Context, image io.Reader) error
+	CreateContainer(ctx context.Context, spec ContainerSpec) (string, error)
+	StartContainer(ctx context.Context, containerId string) error
+	StopContainer(ctx context.Context, containerId string) error
+	RemoveContainer(ctx context.Context, containerId string) error
+	InspectContainer(ctx context.Context, containerId string) (types.ContainerJSON, error)
+	ContainerLogs(ctx context.Context, containerId string) (io.ReadCloser, error)
+	ContainerEvents(ctx context.Context) (<-chan events.Message, <-chan error)
+	UpdateRestartPolicy(ctx context.Context, containerId string, policy model.RestartPolicy) error
+	UpdateResources(ctx context.Context, containerId string, res model.Resources) error
+	CreateVolume(ctx context.Context, name string, depId string) error
+	RemoveVolume(ctx context.Context, name string) error
+	VolumeUsage(ctx context.Context) (map[string]*volume.UsageData, error)
+	Info() RuntimeInfo
+	Close() error
+}
+
+const (
+	engineDocker = "docker"
+	enginePodman = "podman"
+	// privilegedPortEnd is the lowest port a rootless engine can publish unless the host lowered
+	// net.ipv4.ip_unprivileged_port_start
+	privilegedPortEnd = 1024
+	detectTimeout     = 10 * time.Second
+)
+
+// RuntimeInfo describes the engine found at startup
+type RuntimeInfo struct {
+	// Engine is docker or podman, podman serves the docker api on its own socket
+	Engine     string
+	Version    string
+	APIVersion string
+	Host       string
+	Rootless   bool
+	// UnprivilegedPortStart is the lowest host port the engine can publish
+	UnprivilegedPortStart int
+}
+
+type dockerRuntime struct {
+	cli     *client.Client
+	network string
+	info    RuntimeInfo
+}
+
+// NewDockerRuntime connects to the docker or podman engine at the runtime host of the configuration, DOCKER_HOST when
+// it is empty, and detects which engine it is and whether it runs rootless. The networks of the deployments are named
+// after the docker network of the configuration.
+func NewDockerRuntime(conf *config.Config) (ContainerRuntime, error) {
+	opts := []client.Opt{client.FromEnv, client.WithAPIVersionNegotiation()}
+	if conf.RuntimeHost != "" {
+		opts = append(opts, client.WithHost(conf.RuntimeHost))
+	}
+	if conf.RuntimeTLSCACert != "" || conf.RuntimeTLSCert != "" {
+		opts = append(opts, client.WithTLSClientConfig(conf.RuntimeTLSCACert, conf.RuntimeTLSCert, conf.RuntimeTLSKey))
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), detectTimeout)
+	defer cancel()
+	c, err := newDockerRuntime(ctx, conf.DockerNetwork, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// NodeDialer connects to the engine of a registered node, the TLS key of the node is decrypted
+type NodeDialer func(ctx context.Context, node model.Node) (ContainerRuntime, error)
+
+// NewDockerDialer connects to the docker or podman engines of the nodes over tcp, with the TLS material of the node
+// when it has some, or over a unix socket of the host. The networks of the deployments are named after network.
+func NewDockerDialer(network string) NodeDialer {
+	return func(ctx context.Context, node model.Node) (ContainerRuntime, error) {
+		var opts []client.Opt
+		if node.TLSCACert != "" || node.TLSCert != "" {
+			tlsConfig, err := nodeTLSConfig(node)
+			if err != nil {
+				return nil, err
+			}
+			// the host configures the transport of the client, so it is set after it
+			opts = append(opts, client.WithHTTPClient(&http.Client{Transport: &http.Transport{TLSClientConfig: tlsConfig}}))
+		}
+		opts = append(opts, client.WithHost(node.Endpoint), client.WithAPIVersionNegotiation())
+		c, err := newDockerRuntime(ctx, network, opts...)
+		if err != nil {
+			return nil, err
+		}
+		return c, nil
+	}
+}
+
+// nodeTLSConfig verifies the engine of the node with its CA and authenticates with its certificate
+func nodeTLSConfig(node model.Node) (*tls.Config, error) {
+	conf := &tls.Config{MinVersion: tls.VersionTLS12}
+	if node.TLSCACert != "" {
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM([]byte(node.TLSCACert)) {
+			return nil, errors.New("no certificate in tls_ca_cert")
+		}
+		conf.RootCAs = pool
+	}
+	if node.TLSCert != "" {
+		cert, err := tls.X509KeyPair([]byte(node.TLSCert), []byte(node.TLSKey))
+		if err != nil {
+			return nil, fmt.Errorf("invalid tls_cert or tls_key: %w", err)
+		}
+		conf.Certificates = []tls.Certificate{cert}
+	}
+	return conf, nil
+}
+
+func newDockerRuntime(ctx context.Context, network string, opts ...client.Opt) (*dockerRuntime, error) {
+	cli, err := client.NewClientWithOpts(opts...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create the container runtime client: %w", err)
+	}
+
+	c := &dockerRuntime{
+		cli:     cli,
+		network: network,
+	}
+	if err = c.detect(ctx); err != nil {
+		_ = cli.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// detect asks the engine what it is. Podman answers the version request with a Podman Engine component
+// and lists rootless in the security options like rootless docker.
+func (c *dockerRuntime) detect(ctx context.Context) error {
+	host := c.cli.DaemonHost()
+	version, err := c.cli.ServerVersion(ctx)
+	if err != nil {
+		if strings.Contains(host, "podman") {
+			return fmt.Errorf("failed to reach the container runtime at %s, is the podman socket enabled "+
+				"(systemctl --user enable --now podman.socket)? %w", host, err)
+		}
+		return fmt.Errorf("failed to reach the container runtime at %s, check runtime_host or DOCKER_HOST: %w", host, err)
+	}
+
+	c.info = RuntimeInfo{
+		Engine:     engineDocker,
+		Version:    version.Version,
+		APIVersion: version.APIVersion,
+		Host:       host,
+	}
+	if strings.Contains(strings.ToLower(version.Platform.Name), enginePodman) {
+		c.info.Engine = enginePodman
+	}
+	for _, comp := range version.Components {
+		if strings.EqualFold(comp.Name, "Podman Engine") {
+			c.info.Engine = enginePodman
+			c.info.Version = comp.Version
+		}
+	}
+
+	info, err := c.cli.Info(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to get the container runtime info: %w", err)
+	}
+	for _, opt := range info.SecurityOptions {
+		if opt == "name=rootless" {
+			c.info.Rootless = true
+		}
+	}
+	if c.info.Rootless {
+		c.info.UnprivilegedPortStart = unprivilegedPortStart(host)
+	}
+	return nil
+}
+
+// unprivilegedPortStart reads the lowest unprivileged port of the host when the engine runs on it,
+// a remote engine is assumed to keep the default
+func unprivilegedPortStart(host string) int {
+	if !strings.HasPrefix(host, "unix://") {
+		return privilegedPortEnd
+	}
+	b, err := os.ReadFile("/proc/sys/net/ipv4/ip_unprivileged_port_start")
+	if err != nil {
+		return privilegedPortEnd
+	}
+	port, err := strconv.Atoi(strings.TrimSpace(string(b)))
+	if err != nil {
+		return privilegedPortEnd
+	}
+	return port
+}
+
+// Info returns the engine detected at startup
+func (c *dockerRuntime) Info() RuntimeInfo {
+	return c.info
+}
+
+// Close closes the docker client of the engine
+func (c *dockerRuntime) Close() error {
+	return c.cli.Close()
+}
+
+// publishable checks that a rootless engine can publish the host ports
+func publishable(info RuntimeInfo, ports []model.Port) error {
+	if !info.Rootless {
+		return nil
+	}
+	for _, p := range ports {
+		if p.HostPort != 0 && p.HostPort < info.UnprivilegedPortStart {
+			return fmt.Errorf("%w: host port %d is below %d, the rootless %s engine cannot publish it; "+
+				"use a higher port or lower net.ipv4.ip_unprivileged_port_start on the host",
+				errPortMapping, p.HostPort, info.UnprivilegedPortStart, info.Engine)
+		}
+	}
+	return nil
+}
+
+// NetworkName returns the docker network of a deployment. Its container and the containers of the deployments
+// linked to it are attached to it.
+func (c *dockerRuntime) NetworkName(depId string) string {
+	return c.network + "-" + depId
+}
+
+// EnsureNetwork creates the docker network of the deployment if it does not exist
+func (c *dockerRuntime) EnsureNetwork(ctx context.Context, depId string) error {
+	name := c.NetworkName(depId)
+	if _, err := c.cli.NetworkInspect(ctx, name, types.NetworkInspectOptions{}); err == nil || !client.IsErrNotFound(err) {
+		return err
+	}
+	opts := types.NetworkCreate{
+		Driver: "bridge",
+		Labels: map[string]string{
+			deploymentLabel: depId,
+		},
+	}
+	_, err := c.cli.NetworkCreate(ctx, name, opts)
+	return err
+}
+
+// RemoveNetwork disconnects the containers still attached to the network of the deployment and removes it
+func (c *dockerRuntime) RemoveNetwork(ctx context.Context, depId string) error {
+	name := c.NetworkName(depId)
+	inspect, err := c.cli.NetworkInspect(ctx, name, types.NetworkInspectOptions{})
+	if err != nil {
+		if client.IsErrNotFound(err) {
+			return nil
+		}
+		return err
+	}
+	for cid := range inspect.Containers {
+		if err = c.cli.NetworkDisconnect(ctx, name, cid, true); err != nil && !client.IsErrNotFound(err) {
+			return err
+		}
+	}
+	return c.cli.NetworkRemove(ctx, name)
 }
 
-// newContainerController() initializes a new container
-func newContainerController() (*container, error) {
-	cli, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
-	return &container{
-		cli: cli,
-	}, err
+// ConnectNetwork attaches the container to the network of the deployment, an attached container is left as it is
+func (c *dockerRuntime) ConnectNetwork(ctx context.Context, depId string, containerId string) error {
+	inspect, err := c.cli.ContainerInspect(ctx, containerId)
+	if err != nil {
+		return err
+	}
+	name := c.NetworkName(depId)
+	if inspect.NetworkSettings != nil {
+		if _, ok := inspect.NetworkSettings.Networks[name]; ok {
+			return nil
+		}
+	}
+	return c.cli.NetworkConnect(ctx, name, containerId, nil)
 }
 
-// deleteImage remove image from the docker
-func (c *container) deleteImage(ctx context.Context, imageId string) error {
+// DisconnectNetwork detaches the container from the network of the deployment
+func (c *dockerRuntime) DisconnectNetwork(ctx context.Context, depId string, containerId string) error {
+	err := c.cli.NetworkDisconnect(ctx, c.NetworkName(depId), containerId, true)
+	if err != nil && client.IsErrNotFound(err) {
+		return nil
+	}
+	return err
+}
+
+// DeleteImage remove image from the docker
+func (c *dockerRuntime) DeleteImage(ctx context.Context, imageId string) error {
 	opts := types.ImageRemoveOptions{
 		Force:         true,
 		PruneChildren: true,
@@ -35,9 +330,9 @@ func (c *container) deleteImage(ctx context.Context, imageId string) error {
 	return err
 }
 
-// buildImage build an image from the docker file with tar.
+// BuildImage build an image from the docker file with tar.
 // TODO: need to remove dangling images
-func (c *container) buildImage(ctx context.Context, name string, path string, logger zerolog.Logger) (io.ReadCloser, error) {
+func (c *dockerRuntime) BuildImage(ctx context.Context, tags []string, path string, logger zerolog.Logger) (io.ReadCloser, error) {
 	tar, err := archive.TarWithOptions(path, &archive.TarOptions{})
 	if err != nil {
 		return nil, fmt.Errorf("failed to archive tar: %w", err)
@@ -51,7 +346,7 @@ func (c *container) buildImage(ctx context.Context, name string, path string, lo
 	opts := types.ImageBuildOptions{
 		Context:     tar,
 		Dockerfile:  "Dockerfile",
-		Tags:        []string{name},
+		Tags:        tags,
 		Remove:      true,
 		ForceRemove: true,
 	}
@@ -63,64 +358,208 @@ func (c *container) buildImage(ctx context.Context, name string, path string, lo
 	return resp.Body, nil
 }
 
-// getImageId get the image ID from the docker
-func (c *container) getImageId(ctx context.Context, name string) (string, error) {
+// ImageId get the image ID from the docker
+func (c *dockerRuntime) ImageId(ctx context.Context, name string) (string, error) {
 	inspect, _, err := c.cli.ImageInspectWithRaw(ctx, name)
 	if err != nil {
 		return "", err
 	}
-	imageId := strings.Split(inspect.ID, ":")
+	// docker prefixes the id with the digest algorithm, some podman versions do not
+	return strings.TrimPrefix(inspect.ID, "sha256:"), nil
+}
 
-	return imageId[1], nil
+// SaveImage exports the image with its tags as a tar archive
+func (c *dockerRuntime) SaveImage(ctx context.Context, ref string) (io.ReadCloser, error) {
+	return c.cli.ImageSave(ctx, []string{ref})
 }
 
-// createContainer create a docker-container from an image.
-func (c *container) createContainer(ctx context.Context, name string, hport string, cport string) (string, error) {
-	port, err := nat.NewPort("tcp", cport)
+// LoadImage imports an image exported by SaveImage, the image keeps its id and tags
+func (c *dockerRuntime) LoadImage(ctx context.Context, image io.Reader) error {
+	resp, err := c.cli.ImageLoad(ctx, image, true)
 	if err != nil {
-		return "", fmt.Errorf("failed to parse container port: %w", err)
+		return err
+	}
+	defer resp.Body.Close()
+	return jsonmessage.DisplayJSONMessagesStream(resp.Body, io.Discard, 0, false, nil)
+}
+
+// ContainerSpec describes the docker-container created for a deployment
+type ContainerSpec struct {
+	DeploymentId  string
+	Name          string
+	Image         string
+	Ports         []model.Port
+	Env           []string
+	Resources     model.Resources
+	RestartPolicy model.RestartPolicy
+	HealthCheck   *model.HealthCheck
+	Volumes       []model.Volume
+	// Aliases are the names the container answers to on the network of the deployment,
+	// Links are the deployments whose networks the container joins
+	Aliases []string
+	Links   []string
+}
+
+// dockerResources converts the resources of a deployment to docker resources. Swap is disabled when memory is limited.
+func dockerResources(res model.Resources) ct.Resources {
+	r := ct.Resources{
+		Memory:            res.MemoryMB << 20,
+		MemorySwap:        res.MemoryMB << 20,
+		MemoryReservation: res.MemoryReservationMB << 20,
+		CPUShares:         res.CPUShares,
+	}
+	if res.CPUQuota != 0 {
+		r.CPUPeriod = cpuPeriod
+		r.CPUQuota = res.CPUQuota
+	}
+	if res.PidsLimit != 0 {
+		pids := res.PidsLimit
+		r.PidsLimit = &pids
+	}
+	for _, u := range res.Ulimits {
+		r.Ulimits = append(r.Ulimits, &units.Ulimit{Name: u.Name, Soft: u.Soft, Hard: u.Hard})
+	}
+	return r
+}
+
+// CreateContainer create a docker-container from the spec and publish the container ports on their host ports.
+// The container is attached to the network of the deployment and to the networks of the linked deployments,
+// the networks must exist.
+func (c *dockerRuntime) CreateContainer(ctx context.Context, spec ContainerSpec) (string, error) {
+	if err := publishable(c.info, spec.Ports); err != nil {
+		return "", err
+	}
+	exposed := nat.PortSet{}
+	bindings := nat.PortMap{}
+	for _, p := range spec.Ports {
+		port, err := nat.NewPort(p.Protocol, strconv.Itoa(p.ContainerPort))
+		if err != nil {
+			return "", fmt.Errorf("failed to parse container port: %w", err)
+		}
+		exposed[port] = struct{}{}
+		bindings[port] = append(bindings[port], nat.PortBinding{
+			HostIP:   p.HostIP,
+			HostPort: strconv.Itoa(p.HostPort),
+		})
 	}
 
 	containerConfig := &ct.Config{
-		Image: name,
-		ExposedPorts: nat.PortSet{
-			port: struct{}{},
+		Image:        spec.Image,
+		Env:          spec.Env,
+		Healthcheck:  dockerHealthcheck(spec.HealthCheck),
+		ExposedPorts: exposed,
+		Labels: map[string]string{
+			deploymentLabel: spec.DeploymentId,
 		},
 	}
+	var mounts []mount.Mount
+	for _, v := range spec.Volumes {
+		mounts = append(mounts, mount.Mount{
+			Type:     mount.TypeVolume,
+			Source:   v.Source,
+			Target:   v.Target,
+			ReadOnly: v.ReadOnly,
+		})
+	}
+
 	hostConfig := &ct.HostConfig{
-		PortBindings: nat.PortMap{
-			port: []nat.PortBinding{
-				{
-					HostIP:   "0.0.0.0",
-					HostPort: hport,
-				},
-			},
+		Resources:     dockerResources(spec.Resources),
+		RestartPolicy: dockerRestartPolicy(spec.RestartPolicy),
+		Mounts:        mounts,
+		PortBindings:  bindings,
+		NetworkMode:   ct.NetworkMode(c.NetworkName(spec.DeploymentId)),
+	}
+	networkConfig := &network.NetworkingConfig{
+		EndpointsConfig: map[string]*network.EndpointSettings{
+			c.NetworkName(spec.DeploymentId): {Aliases: spec.Aliases},
 		},
 	}
 
-	resp, err := c.cli.ContainerCreate(ctx, containerConfig, hostConfig, nil, nil, name)
+	resp, err := c.cli.ContainerCreate(ctx, containerConfig, hostConfig, networkConfig, nil, spec.Name)
 	if err != nil {
 		return "", fmt.Errorf("failed to create container: %w", err)
 	}
+	// older docker engines take a single network on create
+	for _, link := range spec.Links {
+		if err = c.cli.NetworkConnect(ctx, c.NetworkName(link), resp.ID, nil); err != nil {
+			_ = c.cli.ContainerRemove(ctx, resp.ID, ct.RemoveOptions{Force: true})
+			return "", fmt.Errorf("failed to connect container to network of %s: %w", link, err)
+		}
+	}
 	return resp.ID, nil
 
 }
 
-// stopContainer stops docker-container
-func (c *container) stopContainer(ctx context.Context, containerId string) error {
+// dockerHealthcheck converts a command health check to a docker healthcheck. Other checks are probed by GDHost.
+func dockerHealthcheck(hc *model.HealthCheck) *ct.HealthConfig {
+	if hc == nil || hc.Type != healthCheckCommand {
+		return nil
+	}
+	return &ct.HealthConfig{
+		Test:        []string{"CMD-SHELL", hc.Command},
+		Interval:    time.Duration(hc.Interval) * time.Second,
+		Timeout:     time.Duration(hc.Timeout) * time.Second,
+		StartPeriod: time.Duration(hc.StartPeriod) * time.Second,
+		Retries:     hc.Retries,
+	}
+}
+
+func dockerRestartPolicy(policy model.RestartPolicy) ct.RestartPolicy {
+	return ct.RestartPolicy{
+		Name:              ct.RestartPolicyMode(policy.Name),
+		MaximumRetryCount: policy.MaxRetries,
+	}
+}
+
+// UpdateRestartPolicy updates the restart policy of a docker-container in place
+func (c *dockerRuntime) UpdateRestartPolicy(ctx context.Context, containerId string, policy model.RestartPolicy) error {
+	_, err := c.cli.ContainerUpdate(ctx, containerId, ct.UpdateConfig{RestartPolicy: dockerRestartPolicy(policy)})
+	return err
+}
+
+// ContainerEvents streams the lifecycle events of the docker-containers
+func (c *dockerRuntime) ContainerEvents(ctx context.Context) (<-chan events.Message, <-chan error) {
+	opts := types.EventsOptions{
+		Filters: filters.NewArgs(
+			filters.Arg("type", string(events.ContainerEventType)),
+			filters.Arg("event", string(events.ActionStart)),
+			filters.Arg("event", string(events.ActionDie)),
+			filters.Arg("event", string(events.ActionStop)),
+			filters.Arg("event", string(events.ActionOOM)),
+			filters.Arg("event", string(events.ActionDestroy)),
+		),
+	}
+	return c.cli.Events(ctx, opts)
+}
+
+// UpdateResources updates the resources of a docker-container in place. Ulimits cannot be updated.
+func (c *dockerRuntime) UpdateResources(ctx context.Context, containerId string, res model.Resources) error {
+	r := dockerResources(res)
+	r.Ulimits = nil
+	// an unset pids limit leaves the current one, -1 removes it
+	if r.PidsLimit == nil {
+		unlimited := int64(-1)
+		r.PidsLimit = &unlimited
+	}
+	_, err := c.cli.ContainerUpdate(ctx, containerId, ct.UpdateConfig{Resources: r})
+	return err
+}
+
+// StopContainer stops docker-container
+func (c *dockerRuntime) StopContainer(ctx context.Context, containerId string) error {
 	err := c.cli.ContainerStop(ctx, containerId, ct.StopOptions{})
 	return err
 }
 
-// removeContainer removes docker-container
-func (c *container) removeContainer(ctx context.Context, containerId string) error {
+// RemoveContainer removes docker-container
+func (c *dockerRuntime) RemoveContainer(ctx context.Context, containerId string) error {
 	err := c.cli.ContainerRemove(ctx, containerId, ct.RemoveOptions{})
 	return err
 }
 
-// getContainerLogs retrieves docker-container-logs and follow.
+// ContainerLogs retrieves docker-container-logs and follow.
 // TODO: need to retrieve the first initialized logs too
-func (c *container) getContainerLogs(ctx context.Context, containerId string) (io.ReadCloser, error) {
+func (c *dockerRuntime) ContainerLogs(ctx context.Context, containerId string) (io.ReadCloser, error) {
 	opts := ct.LogsOptions{
 		ShowStdout: true,
 		Follow:     true,
@@ -132,17 +571,101 @@ func (c *container) getContainerLogs(ctx context.Context, containerId string) (i
 	return clogs, err
 }
 
-// startContainer starts a docker-container
-func (c *container) startContainer(ctx context.Context, containerId string) error {
+// StartContainer starts a docker-container
+func (c *dockerRuntime) StartContainer(ctx context.Context, containerId string) error {
 	err := c.cli.ContainerStart(ctx, containerId, ct.StartOptions{})
 	return err
 }
 
+// CreateVolume creates a docker volume labelled with the deployment
+func (c *dockerRuntime) CreateVolume(ctx context.Context, name string, depId string) error {
+	opts := volume.CreateOptions{
+		Name: name,
+		Labels: map[string]string{
+			deploymentLabel: depId,
+		},
+	}
+	_, err := c.cli.VolumeCreate(ctx, opts)
+	return err
+}
+
+// RemoveVolume removes a docker volume. Docker refuses to remove a volume used by a container.
+func (c *dockerRuntime) RemoveVolume(ctx context.Context, name string) error {
+	return c.cli.VolumeRemove(ctx, name, false)
+}
+
+// VolumeUsage returns the usage of the docker volumes by name
+func (c *dockerRuntime) VolumeUsage(ctx context.Context) (map[string]*volume.UsageData, error) {
+	du, err := c.cli.DiskUsage(ctx, types.DiskUsageOptions{Types: []types.DiskUsageObject{types.VolumeObject}})
+	if err != nil {
+		return nil, err
+	}
+	usage := make(map[string]*volume.UsageData, len(du.Volumes))
+	for _, v := range du.Volumes {
+		usage[v.Name] = v.UsageData
+	}
+	return usage, nil
+}
+
+// InspectContainer returns the docker-container details
+func (c *dockerRuntime) InspectContainer(ctx context.Context, containerId string) (types.ContainerJSON, error) {
+	return c.cli.ContainerInspect(ctx, containerId)
+}
+
 // isContainerRunning checks if a docker-container is running or not.
-func (c *container) isContainerRunning(ctx context.Context, containerId string) (bool, error) {
-	inspect, err := c.cli.ContainerInspect(ctx, containerId)
+func isContainerRunning(ctx context.Context, rt ContainerRuntime, containerId string) (bool, error) {
+	inspect, err := rt.InspectContainer(ctx, containerId)
 	if err != nil {
 		return false, err
 	}
 	return inspect.State.Running, nil
 }
+
+// removeContainer stops the container when it runs and removes it, a container which is gone is removed already
+func removeContainer(ctx context.Context, rt ContainerRuntime, containerId string) error {
+	running, err := isContainerRunning(ctx, rt, containerId)
+	if err != nil {
+		if client.IsErrNotFound(err) {
+			return nil
+		}
+		return fmt.Errorf("failed to get container stage: %w", err)
+	}
+	if running {
+		if err = rt.StopContainer(ctx, containerId); err != nil {
+			return fmt.Errorf("failed to stop container: %w", err)
+		}
+	}
+	// a stopped container is removed too, it would keep the volumes in use
+	if err = rt.RemoveContainer(ctx, containerId); err != nil {
+		return fmt.Errorf("failed to remove container: %w", err)
+	}
+	return nil
+}
+
+// containerIP returns the address of the docker-container of the deployment, see networkIP
+func containerIP(ctx context.Context, rt ContainerRuntime, depId string, containerId string) (string, error) {
+	inspect, err := rt.InspectContainer(ctx, containerId)
+	if err != nil {
+		return "", err
+	}
+	return networkIP(inspect, rt.NetworkName(depId)), nil
+}
+
+// networkIP returns the address of the container on the network of its deployment. The containers created
+// before the deployments had their own network are only attached to the shared network or the default bridge.
+func networkIP(inspect types.ContainerJSON, network string) string {
+	if inspect.NetworkSettings == nil {
+		return ""
+	}
+	if ep, ok := inspect.NetworkSettings.Networks[network]; ok && ep.IPAddress != "" {
+		return ep.IPAddress
+	}
+	if len(inspect.NetworkSettings.Networks) == 1 {
+		for _, ep := range inspect.NetworkSettings.Networks {
+			if ep.IPAddress != "" {
+				return ep.IPAddress
+			}
+		}
+	}
+	return inspect.NetworkSettings.IPAddress
+}
@@ -0,0 +1,337 @@
+package deployment
+
+import (
+	"GDHost/internal/database"
+	"GDHost/internal/model"
+	"GDHost/internal/response"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/docker/docker/client"
+	"github.com/gin-contrib/requestid"
+	"github.com/gin-gonic/gin"
+	"github.com/go-playground/validator/v10"
+	"github.com/google/uuid"
+	"github.com/rs/zerolog"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// the deploy request waits for the health check, so the whole deploy is cut off at deployTimeout to answer
+// within the write timeout of the server. The health timeout is cut off by it too.
+const (
+	healthInterval       = time.Second
+	healthRequestTimeout = 2 * time.Second
+	defaultHealthTimeout = 20
+	deployTimeout        = 20 * time.Second
+)
+
+type deployDeploymentReq struct {
+	Version       int    `json:"version,omitempty" validate:"omitempty,min=1"`
+	HostPort      int    `json:"host_port,omitempty" validate:"omitempty,min=1,max=65535"`
+	ContainerPort int    `json:"container_port,omitempty" validate:"omitempty,min=1,max=65535"`
+	HealthPath    string `json:"health_path,omitempty" validate:"omitempty,startswith=/"`
+	HealthTimeout int    `json:"health_timeout,omitempty" validate:"omitempty,min=1,max=20"`
+}
+
+// waitHealthy polls the address until it accepts connections, or answers the path with a non 5xx status,
+// and gives up after timeout
+func waitHealthy(ctx context.Context, addr string, path string, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	hc := &http.Client{Timeout: healthRequestTimeout}
+	ticker := time.NewTicker(healthInterval)
+	defer ticker.Stop()
+
+	var err error
+	for {
+		if _, err = checkHealth(ctx, hc, addr, path); err == nil {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("health check timed out: %w", err)
+		case <-ticker.C:
+		}
+	}
+}
+
+// discardContainer stops and removes a container which never received traffic
+func (d *deployment) discardContainer(rt ContainerRuntime, cid string, logger zerolog.Logger) {
+	ctx := context.Background()
+	if err := rt.StopContainer(ctx, cid); err != nil && !client.IsErrNotFound(err) {
+		logger.Error().Err(err).Str("container_id", cid).Msg("failed to stop container")
+	}
+	if err := rt.RemoveContainer(ctx, cid); err != nil && !client.IsErrNotFound(err) {
+		logger.Error().Err(err).Str("container_id", cid).Msg("failed to remove container")
+	}
+}
+
+// discardLater discards the container in the background, a failed deploy answers without waiting for it to stop
+func (d *deployment) discardLater(rt ContainerRuntime, cid string, logger zerolog.Logger) {
+	d.wg.Add(1)
+	go func() {
+		defer d.wg.Done()
+		d.discardContainer(rt, cid, logger)
+	}()
+}
+
+// restoreProxies serves the host ports of the deployments deployed behind the proxy again after a restart
+func (d *deployment) restoreProxies(ctx context.Context) error {
+	deps, err := d.db.ListDeployments(ctx, database.DeploymentQuery{Proxied: true})
+	if err != nil {
+		return fmt.Errorf("failed to find proxied deployments: %w", err)
+	}
+	for _, dep := range deps {
+		primary, _ := primaryPort(dep.PortMappings())
+		if err = d.proxy.serve(dep.Id, hostAddr(primary), loopbackAddr(dep.ProxyPort)); err != nil {
+			d.logger.Error().Err(err).Str("deployment_id", dep.Id).Msg("failed to restore proxy")
+		}
+	}
+	return nil
+}
+
+func (d *deployment) DeployDeployment(c *gin.Context) {
+	logger := d.logger.With().Str("request_id", requestid.Get(c)).Logger()
+
+	depId := c.Param("id")
+	if depId == "" {
+		logger.Error().Msg("no deployment id in URL")
+		response.StatusBadRequest(c, "no deployment id in URL")
+		return
+	}
+
+	var req deployDeploymentReq
+	if err := c.BindJSON(&req); err != nil {
+		logger.Error().Err(err).Msg("failed to bind request")
+		response.StatusBadRequest(c, "failed to bind request")
+		return
+	}
+	if err := validator.New().Struct(req); err != nil {
+		logger.Error().Err(err).Msg("request validation error")
+		response.StatusBadRequest(c, err.Error())
+		return
+	}
+	if req.HealthTimeout == 0 {
+		req.HealthTimeout = defaultHealthTimeout
+	}
+
+	ctx, cancel := context.WithTimeout(c.Request.Context(), deployTimeout)
+	defer cancel()
+	dep, err := d.db.GetDeployment(ctx, depId)
+	if err != nil {
+		if errors.Is(err, database.ErrNotFound) {
+			logger.Error().Err(err).Str("deployment_id", depId).Msg("deployment not found")
+			response.StatusNotFound(c, "deployment not found")
+			return
+		}
+		logger.Error().Err(err).Str("deployment_id", depId).Msg("failed to find deployment")
+		response.StatusInternalServerError(c)
+		return
+	}
+
+	// the proxy listens on the host of GDHost, so only the containers of the local engine are deployed behind it
+	if node := placedNode(dep); !isLocalNode(node) {
+		logger.Error().Str("deployment_id", depId).Str("node", node).Msg("zero-downtime deploy on a node")
+		response.StatusUnProcessed(c, "zero-downtime deploy runs on the local engine, deployment runs on node "+node+", use rollback")
+		return
+	}
+
+	if req.Version == 0 {
+		req.Version = dep.Release
+	}
+	if req.Version == 0 {
+		logger.Error().Str("deployment_id", depId).Msg("no release to deploy")
+		response.StatusUnProcessed(c, "deployment has no release, build an image first")
+		return
+	}
+
+	release, err := d.db.GetRelease(ctx, depId, req.Version)
+	if err == nil && !release.PrunedAt.IsZero() {
+		err = database.ErrNotFound
+	}
+	if err != nil {
+		if errors.Is(err, database.ErrNotFound) {
+			logger.Error().Err(err).Str("deployment_id", depId).Int("version", req.Version).Msg("release not found")
+			response.StatusNotFound(c, "release not found or pruned")
+			return
+		}
+		logger.Error().Err(err).Str("deployment_id", depId).Int("version", req.Version).Msg("failed to find release")
+		response.StatusInternalServerError(c)
+		return
+	}
+
+	ports, err := portMappings(nil, req.HostPort, req.ContainerPort, dep)
+	if err != nil {
+		logger.Error().Err(err).Str("deployment_id", depId).Msg("invalid port mappings")
+		response.StatusBadRequest(c, err.Error())
+		return
+	}
+	// the proxy forwards a single tcp port, other mappings can not be held by two containers at once
+	if len(ports) != 1 || ports[0].Protocol != protocolTCP {
+		logger.Error().Str("deployment_id", depId).Int("ports", len(ports)).Msg("ports can not be proxied")
+		response.StatusUnProcessed(c, "zero-downtime deploy supports a single tcp port mapping, use run for multiple or udp mappings")
+		return
+	}
+	primary := ports[0]
+
+	if dep.Resources, err = d.limits.apply(dep.Resources); err != nil {
+		logger.Error().Err(err).Str("deployment_id", depId).Msg("resource limit exceeded")
+		response.StatusUnProcessed(c, err.Error())
+		return
+	}
+
+	env, err := d.containerEnv(dep)
+	if err != nil {
+		logger.Error().Err(err).Str("deployment_id", depId).Msg("failed to prepare env")
+		response.StatusInternalServerError(c)
+		return
+	}
+
+	pport, err := freeLoopbackPort()
+	if err != nil {
+		logger.Error().Err(err).Str("deployment_id", depId).Msg("failed to find free port")
+		response.StatusInternalServerError(c)
+		return
+	}
+	if err = d.prepareNode(ctx, d.ctr, dep, release.Tag); err != nil {
+		logger.Error().Err(err).Str("deployment_id", depId).Msg("failed to prepare local engine")
+		response.StatusInternalServerError(c)
+		return
+	}
+
+	spec := ContainerSpec{
+		DeploymentId:  depId,
+		Name:          dep.Name + "-v" + strconv.Itoa(release.Version) + "-" + uuid.NewString()[:8],
+		Image:         release.Tag,
+		Ports:         []model.Port{{HostIP: "127.0.0.1", HostPort: pport, ContainerPort: primary.ContainerPort, Protocol: protocolTCP}},
+		Env:           env,
+		Resources:     dep.Resources,
+		RestartPolicy: withDefaultRestartPolicy(dep.RestartPolicy),
+		HealthCheck:   dep.HealthCheck,
+		Volumes:       dep.Volumes,
+		Aliases:       networkAliases(dep),
+		Links:         dep.Links,
+	}
+	cid, err := d.ctr.CreateContainer(ctx, spec)
+	if err != nil {
+		logger.Error().Err(err).Str("deployment_id", depId).Msg("failed to create container")
+		response.StatusInternalServerError(c)
+		return
+	}
+	if err = d.ctr.StartContainer(ctx, cid); err != nil {
+		logger.Error().Err(err).Str("deployment_id", depId).Msg("failed to start container")
+		d.discardLater(d.ctr, cid, logger)
+		response.StatusInternalServerError(c)
+		return
+	}
+
+	// the docker proxy accepts connections on the published port before the app listens, so check the container directly
+	// the declared http or tcp health check is used when the request has no health path
+	hport := primary.ContainerPort
+	if hc := dep.HealthCheck; req.HealthPath == "" && hc != nil && hc.Type != healthCheckCommand {
+		if hc.Type == healthCheckHTTP {
+			req.HealthPath = hc.Path
+		}
+		if hc.Port != 0 {
+			hport = hc.Port
+		}
+	}
+	addr := loopbackAddr(pport)
+	if ip, err := containerIP(ctx, d.ctr, depId, cid); err == nil && ip != "" {
+		addr = net.JoinHostPort(ip, strconv.Itoa(hport))
+	}
+
+	timeout := time.Duration(req.HealthTimeout) * time.Second
+	if err = waitHealthy(ctx, addr, req.HealthPath, timeout); err != nil {
+		logger.Error().Err(err).Str("deployment_id", depId).Int("version", release.Version).Msg("new container failed health check")
+		d.discardLater(d.ctr, cid, logger)
+		response.StatusUnProcessed(c, "new container failed health check, previous container kept: "+err.Error())
+		return
+	}
+
+	if ports, err = d.reservePorts(ctx, depId, localNode, ports); err != nil {
+		d.discardLater(d.ctr, cid, logger)
+		d.restorePorts(depId, dep, logger)
+		statusPortError(c, logger, depId, err)
+		return
+	}
+	primary = ports[0]
+
+	// the old container owns the host port until it is stopped, so the first switch to the proxy has a short gap
+	proxied := d.proxy.serving(depId)
+	direct := dep.ContainerId != "" && !proxied
+	// restore puts the traffic back on the old container and discards the new one
+	restore := func() {
+		d.discardLater(d.ctr, cid, logger)
+		d.restorePorts(depId, dep, logger)
+		old, ok := primaryPort(dep.PortMappings())
+		if proxied && ok {
+			if err := d.proxy.serve(depId, hostAddr(old), loopbackAddr(dep.ProxyPort)); err != nil {
+				logger.Error().Err(err).Str("deployment_id", depId).Msg("failed to restore proxy")
+			}
+		} else {
+			d.proxy.stop(depId)
+		}
+		if direct {
+			if err := d.ctr.StartContainer(context.Background(), dep.ContainerId); err != nil {
+				logger.Error().Err(err).Str("deployment_id", depId).Msg("failed to restart old container")
+			}
+		}
+	}
+
+	if direct {
+		if err = d.ctr.StopContainer(ctx, dep.ContainerId); err != nil && !client.IsErrNotFound(err) {
+			logger.Error().Err(err).Str("deployment_id", depId).Msg("failed to stop old container")
+			direct = false
+			restore()
+			response.StatusInternalServerError(c)
+			return
+		}
+	}
+
+	if err = d.proxy.serve(depId, hostAddr(primary), loopbackAddr(pport)); err != nil {
+		logger.Error().Err(err).Str("deployment_id", depId).Msg("failed to switch traffic")
+		restore()
+		response.StatusInternalServerError(c)
+		return
+	}
+
+	resources := dep.Resources
+	_, err = d.db.UpdateDeployment(ctx, depId, func(dep *model.Deployment) error {
+		dep.UpdatedAt = time.Now()
+		dep.Stage = model.ContainerCreated
+		dep.ContainerId = cid
+		dep.Node = localNode
+		dep.ImageId = release.ImageId
+		dep.Release = release.Version
+		dep.Resources = resources
+		dep.ProxyPort = pport
+		setPorts(dep, ports)
+		dep.RecreateRequired = false
+		dep.CrashLoop = nil
+		dep.Health = nil
+		return nil
+	})
+	if err != nil {
+		logger.Error().Err(err).Str("deployment_id", depId).Msg("failed to update deployment")
+		restore()
+		response.StatusInternalServerError(c)
+		return
+	}
+
+	// the deploy is recorded, so the old ports and container are released even when the deadline passed
+	if err = d.releasePorts(context.Background(), depId, ports); err != nil {
+		logger.Error().Err(err).Str("deployment_id", depId).Msg("failed to release previous ports")
+	}
+	if dep.ContainerId != "" {
+		d.discardLater(d.ctr, dep.ContainerId, logger)
+	}
+
+	logger.Info().Str("deployment_id", depId).Int("version", release.Version).Msg("deployment deployed")
+	response.StatusCommonOK(c, "deployment switched to "+release.Tag)
+	return
+}
@@ -1,11 +1,14 @@
 package deployment
 
 import (
+	"GDHost/internal/config"
 	"GDHost/internal/database"
 	"GDHost/internal/model"
 	"GDHost/internal/response"
 	"GDHost/internal/utility"
 	"context"
+	"crypto/tls"
+	"encoding/base64"
 	"errors"
 	"fmt"
 	"github.com/docker/docker/client"
@@ -14,21 +17,59 @@ import (
 	"github.com/go-playground/validator/v10"
 	"github.com/google/uuid"
 	"github.com/rs/zerolog"
-	"go.mongodb.org/mongo-driver/bson"
-	"go.mongodb.org/mongo-driver/mongo"
-	"go.mongodb.org/mongo-driver/mongo/options"
-	"io"
 	"io/fs"
+	"net/http"
 	"os"
 	"path/filepath"
 	"strconv"
+	"sync"
 	"time"
 )
 
 type Deployment interface {
 	GenerateGoDockerfile(c *gin.Context)
+	GenerateNodeDockerfile(c *gin.Context)
+	GeneratePythonDockerfile(c *gin.Context)
+	GenerateAutoDockerfile(c *gin.Context)
+	GenerateTemplateDockerfile(c *gin.Context)
+	DetectDeployment(c *gin.Context)
 	CreateDeployment(c *gin.Context)
-	CreateDeploymentImage(c *gin.Context)
+	CreateBuild(c *gin.Context)
+	GetBuild(c *gin.Context)
+	GetBuildLogs(c *gin.Context)
+	GetReleases(c *gin.Context)
+	GetRelease(c *gin.Context)
+	RollbackDeployment(c *gin.Context)
+	DeployDeployment(c *gin.Context)
+	GetEnv(c *gin.Context)
+	UpdateEnv(c *gin.Context)
+	GetSecrets(c *gin.Context)
+	SetSecret(c *gin.Context)
+	DeleteSecret(c *gin.Context)
+	UpdateResources(c *gin.Context)
+	UpdateRestartPolicy(c *gin.Context)
+	UpdateHealthCheck(c *gin.Context)
+	DeleteHealthCheck(c *gin.Context)
+	CreateVolume(c *gin.Context)
+	GetVolumes(c *gin.Context)
+	DeleteVolume(c *gin.Context)
+	UpdateRoute(c *gin.Context)
+	DeleteRoute(c *gin.Context)
+	CreateDomain(c *gin.Context)
+	GetDomains(c *gin.Context)
+	GetDomain(c *gin.Context)
+	VerifyDomain(c *gin.Context)
+	DeleteDomain(c *gin.Context)
+	CreateLink(c *gin.Context)
+	GetLinks(c *gin.Context)
+	DeleteLink(c *gin.Context)
+	GetCACertificate(c *gin.Context)
+	CreateNode(c *gin.Context)
+	GetNodes(c *gin.Context)
+	GetNode(c *gin.Context)
+	UpdateNode(c *gin.Context)
+	DeleteNode(c *gin.Context)
+	Close()
 	RunDeployment(c *gin.Context)
 	StopDeployment(c *gin.Context)
 	DeleteDeploymentContainer(c *gin.Context)
@@ -41,24 +82,119 @@ type Deployment interface {
 }
 
 type deployment struct {
-	location string
-	df       Dockerfile
-	db       database.Database
-	ctr      *container
-	logger   *zerolog.Logger
+	location   string
+	df         Dockerfile
+	db         database.Database
+	ctr        ContainerRuntime
+	local      *nodeRuntime
+	dial       NodeDialer
+	nodes      map[string]*nodeRuntime
+	failures   map[string]*nodeFailure
+	nodesMu    sync.Mutex
+	proxy      *proxy
+	logger     *zerolog.Logger
+	builds     chan struct{}
+	retention  int
+	secretKey  []byte
+	limits     resourceLimits
+	crash      crashLoopPolicy
+	ports      portRange
+	portFree   PortChecker
+	router     *router
+	httpPort   int
+	ca         *authority
+	tlsCert    *tls.Certificate
+	httpProxy  *http.Server
+	httpsProxy *http.Server
+	ctx        context.Context
+	cancel     context.CancelFunc
+	wg         sync.WaitGroup
 }
 
-// NewDeploymentController creates a new container controller and dockerfile controller and return Deployment
-func NewDeploymentController(location string, db database.Database, logger *zerolog.Logger) (Deployment, error) {
-	ctr, err := newContainerController()
-
-	return &deployment{
-		location: location,
-		df:       NewDockerfileController(location),
-		db:       db,
-		ctr:      ctr,
-		logger:   logger,
-	}, err
+// NewDeploymentController creates a dockerfile controller running the deployments on ctr and on the registered nodes
+// connected with dial, checks the host ports of the local engine with portFree, restores the port reservations,
+// the proxied host ports and the http routes, starts the http(s) proxy, the build workers, the crash watchers and
+// the health monitor and return Deployment
+func NewDeploymentController(conf *config.Config, db database.Database, ctr ContainerRuntime, dial NodeDialer,
+	portFree PortChecker, logger *zerolog.Logger) (Deployment, error) {
+	if info := ctr.Info(); info.Rootless && conf.PortRangeStart < info.UnprivilegedPortStart {
+		return nil, fmt.Errorf("port_range_start %d is below %d, the rootless %s engine cannot publish the ports of the range",
+			conf.PortRangeStart, info.UnprivilegedPortStart, info.Engine)
+	}
+
+	var err error
+	var key []byte
+	if conf.SecretKey != "" {
+		if key, err = base64.StdEncoding.DecodeString(conf.SecretKey); err != nil || len(key) != 32 {
+			return nil, errors.New("secret key must be 32 bytes encoded in base64")
+		}
+	}
+
+	d := &deployment{
+		location:  conf.Location,
+		df:        NewDockerfileController(conf.Location),
+		db:        db,
+		ctr:       ctr,
+		local:     &nodeRuntime{ContainerRuntime: ctr},
+		dial:      dial,
+		nodes:     map[string]*nodeRuntime{},
+		failures:  map[string]*nodeFailure{},
+		portFree:  portFree,
+		proxy:     newProxy(logger),
+		logger:    logger,
+		builds:    make(chan struct{}, conf.BuildWorkers),
+		retention: conf.ReleaseRetention,
+		secretKey: key,
+		limits:    newResourceLimits(conf),
+		crash: crashLoopPolicy{
+			restarts: conf.CrashLoopRestarts,
+			window:   time.Duration(conf.CrashLoopWindow) * time.Second,
+		},
+		ports: portRange{
+			start: conf.PortRangeStart,
+			end:   conf.PortRangeEnd,
+		},
+		router:   newRouter(conf.BaseDomain, logger),
+		httpPort: conf.HTTPProxyPort,
+	}
+	// the crash watchers of the nodes connected while the routes are restored run until Close
+	d.ctx, d.cancel = context.WithCancel(context.Background())
+	if err = d.restorePortReservations(context.Background()); err != nil {
+		return nil, err
+	}
+	if err = d.restoreProxies(context.Background()); err != nil {
+		return nil, err
+	}
+	if err = d.restoreRoutes(context.Background()); err != nil {
+		return nil, err
+	}
+	if conf.HTTPProxyPort != 0 {
+		if err = d.startHTTPProxy(conf.HTTPProxyPort); err != nil {
+			return nil, err
+		}
+	}
+	if conf.LocalCA {
+		if d.ca, err = loadAuthority(filepath.Join(conf.Location, "ca")); err != nil {
+			return nil, err
+		}
+	}
+	if conf.HTTPSProxyPort != 0 {
+		if err = d.startHTTPSProxy(conf.HTTPSProxyPort, conf.TLSCertFile, conf.TLSKeyFile); err != nil {
+			return nil, err
+		}
+	}
+
+	if err = d.startBuildWorkers(d.ctx, conf.BuildWorkers); err != nil {
+		d.cancel()
+		return nil, err
+	}
+	d.startCrashWatcher(d.ctx, ctr, localNode)
+	if err = d.connectNodes(d.ctx); err != nil {
+		d.cancel()
+		return nil, err
+	}
+	d.startHealthMonitor(d.ctx)
+	return d, nil
 }
 
 type CreateDeploymentReq struct {
@@ -79,6 +215,47 @@ const (
 	goDefaultCMD    = "./application"
 )
 
+// applyDefaults fills in the unset options of the request
+func (msg *CreateDeploymentReq) applyDefaults() {
+	if msg.OS == "" {
+		msg.OS = goDefaultOS
+	}
+	if msg.GOARCH == "" {
+		msg.GOARCH = goDefaultArch
+	}
+	if msg.OUTPUT == "" {
+		msg.OUTPUT = goDefaultOutput
+	}
+	if msg.CMD == "" {
+		msg.CMD = goDefaultCMD
+	}
+}
+
+// buildOption applies the defaults and returns the Go build option for the dockerfile at path
+func (msg *CreateDeploymentReq) buildOption(path string) BuildOption {
+	msg.applyDefaults()
+	option := BuildOption{
+		Lang:     Go,
+		Location: path,
+		GoBuildOption: GoBuildOption{
+			GoVersion: msg.Version,
+			Location:  "application",
+			DLocation: "application",
+			GOOS:      msg.OS,
+			GOARCH:    msg.GOARCH,
+			TAG:       msg.TAG,
+			OUTPUT:    msg.OUTPUT,
+			FLAGS:     msg.FLAGS,
+		},
+	}
+	if msg.CGO {
+		option.GoBuildOption.CGO = "CGO_ENABLED=1"
+	} else {
+		option.GoBuildOption.CGO = "CGO_ENABLED=0"
+	}
+	return option
+}
+
 func (d *deployment) CreateDeployment(c *gin.Context) {
 	logger := d.logger.With().Str("request_id", requestid.Get(c)).Logger()
 
@@ -105,40 +282,24 @@ func (d *deployment) CreateDeployment(c *gin.Context) {
 
 	ctx := c.Request.Context()
 
-	filter := bson.D{
-		{"name", name},
-		{"deleted_at", time.Time{}},
-	}
-
-	_, err = d.db.FindDeployment(ctx, &filter, nil)
+	named, err := d.db.ListDeployments(ctx, database.DeploymentQuery{Name: name, Limit: 1})
 	if err != nil {
-		if !errors.Is(err, mongo.ErrNoDocuments) {
-			logger.Error().Err(err).Msg("failed to find deployment")
-			response.StatusInternalServerError(c)
-			return
-		}
-	} else {
+		logger.Error().Err(err).Msg("failed to find deployment")
+		response.StatusInternalServerError(c)
+		return
+	}
+	if len(named) > 0 {
 		logger.Error().Msg("duplicated name")
 		response.StatusConflicted(c, "duplicated name")
 		return
 	}
 
-	session, txnOptions, err := d.db.CreateSession()
-	if err != nil {
-		logger.Error().Err(err).Msg("failed to create database session")
-		response.StatusInternalServerError(c)
-		return
-	}
-	defer session.EndSession(ctx)
 	depId := uuid.NewString()
 
 	path := filepath.Join(d.location, depId)
 	fpath := filepath.Join(d.location, depId, file.Filename)
 
-	callback := func(sc mongo.SessionContext) (interface{}, error) {
-
-		sc = mongo.NewSessionContext(ctx, session)
-
+	callback := func(sc context.Context) error {
 		dep := model.Deployment{
 			Id:        depId,
 			CreatedAt: time.Now(),
@@ -149,22 +310,22 @@ func (d *deployment) CreateDeployment(c *gin.Context) {
 			Stage:     model.FileUpload,
 		}
 
-		if err = d.db.CreateDeployment(sc, &dep); err != nil {
-			return nil, err
+		if err := d.db.CreateDeployment(sc, &dep); err != nil {
+			return err
 		}
 
-		if err = utility.CreateFile(filepath.Join(path, "application")); err != nil {
-			return nil, fmt.Errorf("failed to create deployment folder: %w", err)
+		if err := utility.CreateFile(filepath.Join(path, "application")); err != nil {
+			return fmt.Errorf("failed to create deployment folder: %w", err)
 		}
 
-		if err = c.SaveUploadedFile(file, fpath); err != nil {
-			return nil, fmt.Errorf("failed to save file in directory: %w", err)
+		if err := c.SaveUploadedFile(file, fpath); err != nil {
+			return fmt.Errorf("failed to save file in directory: %w", err)
 		}
 
-		return nil, nil
+		return nil
 	}
 
-	if _, err = session.WithTransaction(ctx, callback, txnOptions); err != nil {
+	if err = d.db.WithTx(ctx, callback); err != nil {
 		logger.Error().Err(err).Msg("failed to create deployment")
 		if err2 := utility.DeleteAll(path); err2 != nil {
 			if !errors.Is(err2, fs.ErrNotExist) {
@@ -203,16 +364,9 @@ func (d *deployment) GenerateGoDockerfile(c *gin.Context) {
 	}
 
 	ctx := c.Request.Context()
-	filter := bson.D{
-		{"_id", deId},
-		{"deleted_at", time.Time{}},
-	}
-	projection := bson.M{"_id": 1, "location": 1}
-	opts := options.FindOne().SetProjection(projection)
-
-	dep, err := d.db.FindDeployment(ctx, &filter, opts)
+	dep, err := d.db.GetDeployment(ctx, deId)
 	if err != nil {
-		if errors.Is(err, mongo.ErrNoDocuments) {
+		if errors.Is(err, database.ErrNotFound) {
 			logger.Error().Err(err).Str("deployment_id", deId).Msg("deployment not found")
 			response.StatusNotFound(c, "deployment not found")
 			return
@@ -222,75 +376,99 @@ func (d *deployment) GenerateGoDockerfile(c *gin.Context) {
 		return
 	}
 
-	switch {
-	case msg.OS == "":
-		msg.OS = goDefaultOS
-	case msg.GOARCH == "":
-		msg.GOARCH = goDefaultArch
-	case msg.OUTPUT == "":
-		msg.OUTPUT = goDefaultOutput
-	case msg.CMD == "":
-		msg.CMD = goDefaultCMD
+	option := msg.buildOption(filepath.Join(filepath.Dir(dep.Location), "application", "Dockerfile"))
+
+	if err = d.saveDockerfile(ctx, dep.Id, &option); err != nil {
+		logger.Error().Err(err).Msg("failed to create dockerfile")
+		response.StatusInternalServerError(c)
+		return
 	}
 
-	path := filepath.Join(filepath.Dir(dep.Location), "application", "Dockerfile")
+	logger.Info().Str("deployment_id", dep.Id).Msg("dockerfile created")
+	response.StatusCommonOK(c, "dockerfile created")
+	return
+}
 
-	option := BuildOption{
-		Lang:     Go,
-		Location: path,
-		GoBuildOption: GoBuildOption{
-			GoVersion: msg.Version,
-			Location:  "application",
-			DLocation: "application",
-			GOOS:      msg.OS,
-			GOARCH:    msg.GOARCH,
-			TAG:       msg.TAG,
-			OUTPUT:    msg.OUTPUT,
-			FLAGS:     msg.FLAGS,
-		},
+type CreateNodeDockerfileReq struct {
+	Version        string `json:"version" validate:"required"`
+	PackageManager string `json:"package_manager,omitempty" validate:"omitempty,oneof=npm yarn pnpm"`
+	BuildScript    string `json:"build_script,omitempty"`
+	Start          string `json:"start,omitempty"`
+	Production     bool   `json:"production,omitempty"`
+}
+
+const (
+	nodeDefaultPackageManager = "npm"
+	nodeDefaultStart          = "start"
+)
+
+// applyDefaults fills in the unset options of the request, the start command runs the start script
+// with the package manager
+func (msg *CreateNodeDockerfileReq) applyDefaults() {
+	if msg.PackageManager == "" {
+		msg.PackageManager = nodeDefaultPackageManager
 	}
-	if msg.CGO {
-		option.GoBuildOption.CGO = "CGO_ENABLED=1"
-	} else {
-		option.GoBuildOption.CGO = "CGO_ENABLED=0"
+	if msg.Start == "" {
+		msg.Start = NodeBuildOption{PackageManager: msg.PackageManager}.RunCommand() + " " + nodeDefaultStart
 	}
+}
 
-	update := bson.D{
-		{"$set",
-			bson.D{
-				{"updated_at", time.Now()},
-				{"dockerfile", path},
-				{"stage", model.DockerfileUpload},
-			},
+// buildOption applies the defaults and returns the Node build option for the dockerfile at path
+func (msg *CreateNodeDockerfileReq) buildOption(path string) BuildOption {
+	msg.applyDefaults()
+	return BuildOption{
+		Lang:     Node,
+		Location: path,
+		NodeBuildOption: NodeBuildOption{
+			NodeVersion:    msg.Version,
+			PackageManager: msg.PackageManager,
+			BuildScript:    msg.BuildScript,
+			StartCommand:   msg.Start,
+			Production:     msg.Production,
 		},
 	}
+}
 
-	session, txnOptions, err := d.db.CreateSession()
-	if err != nil {
-		logger.Error().Err(err).Msg("failed to create database session")
-		response.StatusInternalServerError(c)
+func (d *deployment) GenerateNodeDockerfile(c *gin.Context) {
+	logger := d.logger.With().Str("request_id", requestid.Get(c)).Logger()
+
+	depId := c.Param("id")
+	if depId == "" {
+		logger.Error().Msg("deployment not found")
+		response.StatusBadRequest(c, "deployment not found")
 		return
 	}
-	defer session.EndSession(ctx)
 
-	callback := func(sc mongo.SessionContext) (interface{}, error) {
-		if err = d.db.UpdateDeployment(sc, &filter, &update); err != nil {
-			return nil, fmt.Errorf("failed to update deployment: %w", err)
-		}
+	msg := CreateNodeDockerfileReq{}
+	if err := c.BindJSON(&msg); err != nil {
+		logger.Error().Err(err).Msg("bad request")
+		return
+	}
 
-		if err = d.df.createDockerfile(&option); err != nil {
-			return nil, fmt.Errorf("failed to create a dockerfile: %w", err)
+	validate := validator.New()
+	if err := validate.Struct(msg); err != nil {
+		logger.Error().Err(err).Msg("request validation error")
+		response.StatusBadRequest(c, err.Error())
+		return
+	}
+
+	ctx := c.Request.Context()
+	dep, err := d.db.GetDeployment(ctx, depId)
+	if err != nil {
+		if errors.Is(err, database.ErrNotFound) {
+			logger.Error().Err(err).Str("deployment_id", depId).Msg("deployment not found")
+			response.StatusNotFound(c, "deployment not found")
+			return
 		}
-		return nil, nil
+		logger.Error().Err(err).Str("deployment_id", depId).Msg("failed to find deployment")
+		response.StatusInternalServerError(c)
+		return
 	}
 
-	if _, err = session.WithTransaction(ctx, callback, txnOptions); err != nil {
+	option := msg.buildOption(filepath.Join(filepath.Dir(dep.Location), "application", "Dockerfile"))
+
+	if err = d.saveDockerfile(ctx, dep.Id, &option); err != nil {
 		logger.Error().Err(err).Msg("failed to create dockerfile")
-		if err = utility.DeleteFile(path); err != nil {
-			if !os.IsNotExist(err) {
-				logger.Error().Err(err).Msg("failed to clean up dockerfile")
-			}
-		}
 		response.StatusInternalServerError(c)
 		return
 	}
@@ -300,27 +478,76 @@ func (d *deployment) GenerateGoDockerfile(c *gin.Context) {
 	return
 }
 
-func (d *deployment) CreateDeploymentImage(c *gin.Context) {
+type CreatePythonDockerfileReq struct {
+	Version string `json:"version" validate:"required"`
+	Manager string `json:"manager,omitempty" validate:"omitempty,oneof=pip poetry uv"`
+	Server  string `json:"server,omitempty" validate:"omitempty,oneof=module gunicorn uvicorn"`
+	App     string `json:"app" validate:"required"`
+	Port    int    `json:"port,omitempty" validate:"omitempty,min=1,max=65535"`
+}
+
+const (
+	pythonDefaultManager = "pip"
+	pythonDefaultServer  = "module"
+	pythonDefaultPort    = 8000
+)
+
+// applyDefaults fills in the unset options of the request
+func (msg *CreatePythonDockerfileReq) applyDefaults() {
+	if msg.Manager == "" {
+		msg.Manager = pythonDefaultManager
+	}
+	if msg.Server == "" {
+		msg.Server = pythonDefaultServer
+	}
+	if msg.Port == 0 {
+		msg.Port = pythonDefaultPort
+	}
+}
+
+// buildOption applies the defaults and returns the Python build option for the dockerfile at path
+func (msg *CreatePythonDockerfileReq) buildOption(path string) BuildOption {
+	msg.applyDefaults()
+	return BuildOption{
+		Lang:     Python,
+		Location: path,
+		PythonBuildOption: PythonBuildOption{
+			PythonVersion: msg.Version,
+			Manager:       msg.Manager,
+			Server:        msg.Server,
+			App:           msg.App,
+			Port:          strconv.Itoa(msg.Port),
+		},
+	}
+}
+
+func (d *deployment) GeneratePythonDockerfile(c *gin.Context) {
 	logger := d.logger.With().Str("request_id", requestid.Get(c)).Logger()
 
 	depId := c.Param("id")
 	if depId == "" {
-		logger.Error().Msg("no deployment id in URL")
-		response.StatusBadRequest(c, "no deployment id in URL")
+		logger.Error().Msg("deployment not found")
+		response.StatusBadRequest(c, "deployment not found")
 		return
 	}
 
-	ctx := c.Request.Context()
-	filter := bson.D{
-		{"_id", depId},
-		{"deleted_at", time.Time{}},
+	msg := CreatePythonDockerfileReq{}
+	if err := c.BindJSON(&msg); err != nil {
+		logger.Error().Err(err).Msg("bad request")
+		return
 	}
 
-	projection := bson.M{"_id": 1, "name": 1, "location": 1, "dockerfile": 1, "stage": 1, "image_id": 1}
-	opts := options.FindOne().SetProjection(projection)
-	dep, err := d.db.FindDeployment(ctx, &filter, opts)
+	validate := validator.New()
+	if err := validate.Struct(msg); err != nil {
+		logger.Error().Err(err).Msg("request validation error")
+		response.StatusBadRequest(c, err.Error())
+		return
+	}
+
+	ctx := c.Request.Context()
+	dep, err := d.db.GetDeployment(ctx, depId)
 	if err != nil {
-		if errors.Is(err, mongo.ErrNoDocuments) {
+		if errors.Is(err, database.ErrNotFound) {
 			logger.Error().Err(err).Str("deployment_id", depId).Msg("deployment not found")
 			response.StatusNotFound(c, "deployment not found")
 			return
@@ -330,104 +557,238 @@ func (d *deployment) CreateDeploymentImage(c *gin.Context) {
 		return
 	}
 
-	if dep.Stage < model.DockerfileUpload {
-		logger.Error().Str("deployment_id", depId).Msg("dockerfile has not been created/uploaded yet")
-		response.StatusBadRequest(c, "dockerfile has not been created/upload yet")
+	option := msg.buildOption(filepath.Join(filepath.Dir(dep.Location), "application", "Dockerfile"))
+
+	if err = d.saveDockerfile(ctx, dep.Id, &option); err != nil {
+		logger.Error().Err(err).Msg("failed to create dockerfile")
+		response.StatusInternalServerError(c)
+		return
+	}
+
+	logger.Info().Str("deployment_id", dep.Id).Msg("dockerfile created")
+	response.StatusCommonOK(c, "dockerfile created")
+	return
+}
+
+type CreateTemplateDockerfileReq struct {
+	Template   string                 `json:"template" validate:"required"`
+	Parameters map[string]interface{} `json:"parameters,omitempty"`
+}
+
+func (d *deployment) GenerateTemplateDockerfile(c *gin.Context) {
+	logger := d.logger.With().Str("request_id", requestid.Get(c)).Logger()
+
+	depId := c.Param("id")
+	if depId == "" {
+		logger.Error().Msg("deployment not found")
+		response.StatusBadRequest(c, "deployment not found")
 		return
 	}
 
-	if dep.ImageId != "" {
-		if dep.ContainerId != "" {
-			logger.Error().Str("deployment_id", depId).Msg("found container, cannot delete old image")
-			response.StatusUnProcessed(c, "found container, cannot create new image without deleting the container")
+	msg := CreateTemplateDockerfileReq{}
+	if err := c.BindJSON(&msg); err != nil {
+		logger.Error().Err(err).Msg("bad request")
+		return
+	}
+
+	validate := validator.New()
+	if err := validate.Struct(msg); err != nil {
+		logger.Error().Err(err).Msg("request validation error")
+		response.StatusBadRequest(c, err.Error())
+		return
+	}
+
+	ctx := c.Request.Context()
+	tmpl, err := d.db.GetTemplate(ctx, msg.Template)
+	if err != nil {
+		if errors.Is(err, database.ErrNotFound) {
+			logger.Error().Err(err).Str("template", msg.Template).Msg("template not found")
+			response.StatusNotFound(c, "template not found")
 			return
 		}
+		logger.Error().Err(err).Str("template", msg.Template).Msg("failed to find template")
+		response.StatusInternalServerError(c)
+		return
+	}
 
-		if err = d.ctr.deleteImage(ctx, dep.ImageId); err != nil {
-			logger.Error().Err(err).Str("deployment_id", depId).Msg("failed to remove old image")
-			response.StatusInternalServerError(c)
+	params, err := renderParameters(tmpl.Parameters, msg.Parameters)
+	if err != nil {
+		logger.Error().Err(err).Str("template", msg.Template).Msg("invalid template parameters")
+		response.StatusBadRequest(c, err.Error())
+		return
+	}
+
+	dep, err := d.db.GetDeployment(ctx, depId)
+	if err != nil {
+		if errors.Is(err, database.ErrNotFound) {
+			logger.Error().Err(err).Str("deployment_id", depId).Msg("deployment not found")
+			response.StatusNotFound(c, "deployment not found")
 			return
 		}
+		logger.Error().Err(err).Str("deployment_id", depId).Msg("failed to find deployment")
+		response.StatusInternalServerError(c)
+		return
 	}
 
-	dest := filepath.Join(filepath.Dir(dep.Location), "application")
+	option := BuildOption{
+		Lang:     Custom,
+		Location: filepath.Join(filepath.Dir(dep.Location), "application", "Dockerfile"),
+		CustomBuildOption: CustomBuildOption{
+			Name:       tmpl.Name,
+			Data:       tmpl.Data,
+			Parameters: params,
+		},
+	}
 
-	if err = utility.Unzip(dep.Location, dest); err != nil {
-		logger.Error().Err(err).Str("deployment_id", depId).Msg("failed to unzip the source file")
+	if err = d.saveDockerfile(ctx, dep.Id, &option); err != nil {
+		logger.Error().Err(err).Msg("failed to create dockerfile")
 		response.StatusInternalServerError(c)
 		return
 	}
 
-	abfp, err := filepath.Abs(dest)
-	if err != nil {
-		logger.Error().Err(err).Str("deployment_id", depId).Msg("failed to get absolute file path")
+	logger.Info().Str("deployment_id", dep.Id).Str("template", tmpl.Name).Msg("dockerfile created")
+	response.StatusCommonOK(c, "dockerfile created")
+	return
+}
+
+func (d *deployment) DetectDeployment(c *gin.Context) {
+	logger := d.logger.With().Str("request_id", requestid.Get(c)).Logger()
+
+	depId := c.Param("id")
+	if depId == "" {
+		logger.Error().Msg("no deployment id")
+		response.StatusBadRequest(c, "no deployment id")
 		return
 	}
 
-	ilogs, err := d.ctr.buildImage(ctx, dep.Name, abfp, logger)
+	ctx := c.Request.Context()
+	dep, err := d.db.GetDeployment(ctx, depId)
 	if err != nil {
-		logger.Error().Err(err).Str("deployment_id", depId).Msg("failed to build image")
+		if errors.Is(err, database.ErrNotFound) {
+			logger.Error().Err(err).Str("deployment_id", depId).Msg("deployment not found")
+			response.StatusNotFound(c, "deployment not found")
+			return
+		}
+		logger.Error().Err(err).Str("deployment_id", depId).Msg("failed to find deployment")
 		response.StatusInternalServerError(c)
 		return
 	}
-	defer func() {
-		if err2 := ilogs.Close(); err2 != nil {
-			logger.Error().Err(err2).Msg("failed to close build logs")
+
+	det, err := detectSource(dep.Location)
+	if err != nil {
+		if errors.Is(err, errNotDetected) {
+			logger.Info().Str("deployment_id", depId).Msg("language not detected")
+			response.StatusUnProcessed(c, "could not detect the language of the source")
+			return
 		}
-	}()
+		logger.Error().Err(err).Str("deployment_id", depId).Msg("failed to detect language")
+		response.StatusInternalServerError(c)
+		return
+	}
 
-	buf := make([]byte, 1024)
+	logger.Info().Str("deployment_id", depId).Str("language", det.Language).Msg("detection sent")
+	response.StatusDetection(c, det)
+	return
+}
 
-	for {
-		n, err := ilogs.Read(buf)
-		if err != nil {
-			if errors.Is(err, io.EOF) {
-				c.SSEvent("message", "finished")
-				c.Writer.Flush()
-				break
-			}
-			logger.Error().Err(err).Str("deployment_id", depId).Msg("failed to read image build response")
-			response.StatusInternalServerError(c)
+func (d *deployment) GenerateAutoDockerfile(c *gin.Context) {
+	logger := d.logger.With().Str("request_id", requestid.Get(c)).Logger()
+
+	depId := c.Param("id")
+	if depId == "" {
+		logger.Error().Msg("deployment not found")
+		response.StatusBadRequest(c, "deployment not found")
+		return
+	}
+
+	ctx := c.Request.Context()
+	dep, err := d.db.GetDeployment(ctx, depId)
+	if err != nil {
+		if errors.Is(err, database.ErrNotFound) {
+			logger.Error().Err(err).Str("deployment_id", depId).Msg("deployment not found")
+			response.StatusNotFound(c, "deployment not found")
 			return
 		}
-		msg := string(buf[:n])
-		c.SSEvent("message", msg)
-		c.Writer.Flush()
+		logger.Error().Err(err).Str("deployment_id", depId).Msg("failed to find deployment")
+		response.StatusInternalServerError(c)
+		return
 	}
 
-	ctx = context.Background()
+	if dep.Stage != model.FileUpload || dep.Dockerfile != "" {
+		logger.Error().Str("deployment_id", depId).Msg("dockerfile already exists")
+		response.StatusUnProcessed(c, "dockerfile already exists, use a language generator or upload to replace it")
+		return
+	}
 
-	id, err := d.ctr.getImageId(ctx, dep.Name)
+	det, err := detectSource(dep.Location)
 	if err != nil {
-		logger.Error().Err(err).Str("deployment_id", depId).Msg("failed to get image id")
+		if errors.Is(err, errNotDetected) {
+			logger.Info().Str("deployment_id", depId).Msg("language not detected")
+			response.StatusUnProcessed(c, "could not detect the language of the source")
+			return
+		}
+		logger.Error().Err(err).Str("deployment_id", depId).Msg("failed to detect language")
+		response.StatusInternalServerError(c)
 		return
 	}
 
-	update := bson.D{
-		{"$set",
-			bson.D{
-				{"updated_at", time.Now()},
-				{"stage", model.ImageCreated},
-				{"image_id", id},
-			}},
+	if !det.Supported {
+		logger.Info().Str("deployment_id", depId).Str("language", det.Language).Msg("no dockerfile generator for language")
+		response.StatusUnProcessed(c, fmt.Sprintf("no dockerfile generator for '%s'", det.Language))
+		return
 	}
 
-	if err = d.db.UpdateDeployment(ctx, &filter, &update); err != nil {
-		logger.Error().Err(err).Str("deployment_id", depId).Msg("failed to update deployment")
+	option := det.Options.buildOption(filepath.Join(filepath.Dir(dep.Location), "application", "Dockerfile"))
+
+	if err = d.saveDockerfile(ctx, dep.Id, &option); err != nil {
+		logger.Error().Err(err).Msg("failed to create dockerfile")
+		response.StatusInternalServerError(c)
 		return
 	}
 
-	if err = utility.RemoveExceptDockerfile(dest); err != nil {
-		logger.Error().Err(err).Str("deployment_id", depId).Msg("failed to clean up extracted zip file")
+	logger.Info().Str("deployment_id", dep.Id).Str("language", det.Language).Msg("dockerfile created")
+	response.StatusDetection(c, det)
+	return
+}
+
+// saveDockerfile creates the dockerfile from the option and moves the deployment to DockerfileUpload stage.
+func (d *deployment) saveDockerfile(ctx context.Context, depId string, option *BuildOption) error {
+	callback := func(sc context.Context) error {
+		_, err := d.db.UpdateDeployment(sc, depId, func(dep *model.Deployment) error {
+			dep.UpdatedAt = time.Now()
+			dep.Dockerfile = option.Location
+			dep.Stage = model.DockerfileUpload
+			return nil
+		})
+		if err != nil {
+			return fmt.Errorf("failed to update deployment: %w", err)
+		}
+
+		if err = d.df.createDockerfile(option); err != nil {
+			return fmt.Errorf("failed to create a dockerfile: %w", err)
+		}
+		return nil
 	}
 
-	logger.Info().Str("deployment_id", depId).Msg("image created for deployment")
-	return
+	if err := d.db.WithTx(ctx, callback); err != nil {
+		if err2 := utility.DeleteFile(option.Location); err2 != nil {
+			if !os.IsNotExist(err2) {
+				d.logger.Error().Err(err2).Msg("failed to clean up dockerfile")
+			}
+		}
+		return err
+	}
+	return nil
 }
 
+// runDeploymentReq takes either the port mappings or the single tcp host_port and container_port
 type runDeploymentReq struct {
-	HostPort      int `json:"host_port,omitempty"`
-	ContainerPort int `json:"container_port,omitempty"`
+	Ports         []PortReq         `json:"ports,omitempty" validate:"dive"`
+	HostPort      int               `json:"host_port,omitempty" validate:"omitempty,min=1,max=65535"`
+	ContainerPort int               `json:"container_port,omitempty" validate:"omitempty,min=1,max=65535"`
+	Resources     *ResourcesReq     `json:"resources,omitempty"`
+	RestartPolicy *RestartPolicyReq `json:"restart_policy,omitempty"`
+	Placement     *PlacementReq     `json:"placement,omitempty"`
 }
 
 func (d *deployment) RunDeployment(c *gin.Context) {
@@ -445,17 +806,16 @@ func (d *deployment) RunDeployment(c *gin.Context) {
 		response.StatusBadRequest(c, "failed to bind request")
 		return
 	}
+	if err := validator.New().Struct(req); err != nil {
+		logger.Error().Err(err).Msg("request validation error")
+		response.StatusBadRequest(c, err.Error())
+		return
+	}
 
 	ctx := c.Request.Context()
-	filter := bson.D{
-		{"_id", depId},
-		{"deleted_at", time.Time{}},
-	}
-	projection := bson.M{"_id": 1, "stage": 1, "name": 1, "container_id": 1}
-	opts := options.FindOne().SetProjection(projection)
-	dep, err := d.db.FindDeployment(ctx, &filter, opts)
+	dep, err := d.db.GetDeployment(ctx, depId)
 	if err != nil {
-		if errors.Is(err, mongo.ErrNoDocuments) {
+		if errors.Is(err, database.ErrNotFound) {
 			logger.Error().Err(err).Str("deployment_id", depId).Msg("deployment not found")
 			response.StatusNotFound(c, "deployment not found")
 			return
@@ -470,50 +830,141 @@ func (d *deployment) RunDeployment(c *gin.Context) {
 		response.StatusInternalServerError(c)
 		return
 	}
+	// the limits and the restart policy of an existing container are changed with their own requests
+	if dep.ContainerId != "" && (req.Resources != nil || req.RestartPolicy != nil) {
+		logger.Error().Str("deployment_id", depId).Msg("resources or restart policy for an existing container")
+		response.StatusUnProcessed(c, "container exists, use PUT /deployments/"+depId+"/resources or /restart-policy")
+		return
+	}
+	// the node of an existing container is only changed by a new release
+	if dep.ContainerId != "" && req.Placement != nil {
+		logger.Error().Str("deployment_id", depId).Msg("placement for an existing container")
+		response.StatusUnProcessed(c, "container exists on node "+placedNode(dep)+", placement only applies to a new container")
+		return
+	}
 	cid := dep.ContainerId
+	node := placedNode(dep)
 
 	if dep.ContainerId == "" {
-		if req.HostPort == 0 {
-			logger.Error().Str("deployment_id", depId).Msg("host port missing in request")
-			response.StatusBadRequest(c, "host_port missing. host_port is required for the first time running")
+		// the ports are checked before the nodes are dialled by the placement
+		ports, err := portMappings(req.Ports, req.HostPort, req.ContainerPort, dep)
+		if err == nil {
+			err = checkHealthPort(dep.HealthCheck, ports)
+		}
+		if err != nil {
+			logger.Error().Err(err).Str("deployment_id", depId).Msg("invalid port mappings")
+			response.StatusBadRequest(c, err.Error())
+			return
+		}
+
+		var rt *nodeRuntime
+		if node, rt, err = d.place(ctx, dep, req.Placement); err != nil {
+			statusNodeError(c, logger, depId, err)
+			return
+		}
+		if err = publishable(rt.Info(), ports); err != nil {
+			logger.Error().Err(err).Str("deployment_id", depId).Str("node", node).Msg("invalid port mappings")
+			response.StatusBadRequest(c, err.Error())
+			return
+		}
+
+		if req.Resources != nil {
+			dep.Resources = req.Resources.resources()
+		}
+		if req.RestartPolicy != nil {
+			dep.RestartPolicy = req.RestartPolicy.restartPolicy()
+		}
+		dep.RestartPolicy = withDefaultRestartPolicy(dep.RestartPolicy)
+		dep.Resources, err = d.limits.apply(dep.Resources)
+		if err != nil {
+			logger.Error().Err(err).Str("deployment_id", depId).Msg("resource limit exceeded")
+			response.StatusUnProcessed(c, err.Error())
 			return
 		}
-		if req.ContainerPort == 0 {
-			logger.Error().Str("deployment_id", depId).Msg("container_port missing in request")
-			response.StatusBadRequest(c, "container_port missing, container_port is required for the first time running")
+
+		env, err := d.containerEnv(dep)
+		if err != nil {
+			logger.Error().Err(err).Str("deployment_id", depId).Msg("failed to prepare env")
+			response.StatusInternalServerError(c)
+			return
+		}
+
+		if ports, err = d.reservePorts(ctx, depId, node, ports); err != nil {
+			d.restorePorts(depId, dep, logger)
+			statusPortError(c, logger, depId, err)
 			return
 		}
 
-		hport := strconv.Itoa(req.HostPort)
-		cport := strconv.Itoa(req.ContainerPort)
+		if err = d.prepareNode(ctx, rt, dep, deploymentImage(dep)); err != nil {
+			logger.Error().Err(err).Str("deployment_id", depId).Str("node", node).Msg("failed to prepare node")
+			d.restorePorts(depId, dep, logger)
+			response.StatusInternalServerError(c)
+			return
+		}
 
-		cid, err = d.ctr.createContainer(ctx, dep.Name, hport, cport)
+		spec := ContainerSpec{
+			DeploymentId:  depId,
+			Name:          dep.Name,
+			Image:         dep.ImageId,
+			Ports:         ports,
+			Env:           env,
+			Resources:     dep.Resources,
+			RestartPolicy: dep.RestartPolicy,
+			HealthCheck:   dep.HealthCheck,
+			Volumes:       dep.Volumes,
+			Aliases:       networkAliases(dep),
+			Links:         dep.Links,
+		}
+		cid, err = rt.CreateContainer(ctx, spec)
 		if err != nil {
 			logger.Error().Err(err).Str("deployment_id", depId).Msg("failed to create container")
+			d.restorePorts(depId, dep, logger)
 			response.StatusInternalServerError(c)
 			return
 
 		}
-		update := bson.D{
-			{"$set", bson.D{
-				{"updated_at", time.Now()},
-				{"stage", model.ContainerCreated},
-				{"container_id", cid},
-			}},
-		}
-		if err = d.db.UpdateDeployment(ctx, &filter, &update); err != nil {
+		resources, restartPolicy := dep.Resources, dep.RestartPolicy
+		_, err = d.db.UpdateDeployment(ctx, depId, func(dep *model.Deployment) error {
+			dep.UpdatedAt = time.Now()
+			dep.Stage = model.ContainerCreated
+			dep.ContainerId = cid
+			dep.Node = node
+			dep.Resources = resources
+			dep.RestartPolicy = restartPolicy
+			setPorts(dep, ports)
+			dep.RecreateRequired = false
+			dep.Health = nil
+			return nil
+		})
+		if err != nil {
 			logger.Error().Err(err).Str("deployment_id", depId).Msg("failed to update deployment")
 			response.StatusInternalServerError(c)
 			return
 		}
+		if err = d.releasePorts(ctx, depId, ports); err != nil {
+			logger.Error().Err(err).Str("deployment_id", depId).Msg("failed to release previous ports")
+		}
 	}
 
-	if err = d.ctr.startContainer(ctx, cid); err != nil {
+	rt, err := d.runtime(ctx, node)
+	if err != nil {
+		statusNodeError(c, logger, depId, err)
+		return
+	}
+	if err = rt.StartContainer(ctx, cid); err != nil {
 		logger.Error().Err(err).Str("deployment_id", depId).Msg("failed to start container")
 		response.StatusInternalServerError(c)
 		return
 	}
-	logger.Info().Str("deployment_id", depId).Msg("container started")
+
+	_, err = d.db.UpdateDeployment(ctx, depId, func(dep *model.Deployment) error {
+		dep.CrashLoop = nil
+		return nil
+	})
+	if err != nil {
+		logger.Error().Err(err).Str("deployment_id", depId).Msg("failed to clear crash loop")
+	}
+	logger.Info().Str("deployment_id", depId).Str("node", node).Msg("container started")
 	response.StatusCommonOK(c, "deployment started")
 	return
 }
@@ -529,15 +980,9 @@ func (d *deployment) StopDeployment(c *gin.Context) {
 	}
 
 	ctx := c.Request.Context()
-	filter := bson.D{
-		{"_id", depId},
-		{"deleted_at", time.Time{}},
-	}
-	projection := bson.M{"_id": 1, "container_id": 1}
-	opts := options.FindOne().SetProjection(projection)
-	dep, err := d.db.FindDeployment(ctx, &filter, opts)
+	dep, err := d.db.GetDeployment(ctx, depId)
 	if err != nil {
-		if errors.Is(err, mongo.ErrNoDocuments) {
+		if errors.Is(err, database.ErrNotFound) {
 			logger.Error().Err(err).Str("deployment_id", depId).Msg("deployment not found")
 			response.StatusNotFound(c, "deployment not found")
 			return
@@ -547,7 +992,12 @@ func (d *deployment) StopDeployment(c *gin.Context) {
 		return
 	}
 
-	if err = d.ctr.stopContainer(ctx, dep.ContainerId); err != nil {
+	rt, err := d.runtime(ctx, placedNode(dep))
+	if err != nil {
+		statusNodeError(c, logger, depId, err)
+		return
+	}
+	if err = rt.StopContainer(ctx, dep.ContainerId); err != nil {
 		logger.Error().Err(err).Str("deployment_id", depId).Msg("failed to stop deployment")
 		response.StatusInternalServerError(c)
 		return
@@ -569,15 +1019,9 @@ func (d *deployment) DeleteDeploymentContainer(c *gin.Context) {
 	}
 
 	ctx := c.Request.Context()
-	filter := bson.D{
-		{"_id", depId},
-		{"deleted_at", time.Time{}},
-	}
-	projection := bson.M{"_id": 1, "container_id": 1}
-	opts := options.FindOne().SetProjection(projection)
-	dep, err := d.db.FindDeployment(ctx, &filter, opts)
+	dep, err := d.db.GetDeployment(ctx, depId)
 	if err != nil {
-		if errors.Is(err, mongo.ErrNoDocuments) {
+		if errors.Is(err, database.ErrNotFound) {
 			logger.Error().Err(err).Str("deployment_id", depId).Msg("deployment not found")
 			response.StatusNotFound(c, "deployment not found")
 			return
@@ -593,7 +1037,12 @@ func (d *deployment) DeleteDeploymentContainer(c *gin.Context) {
 		return
 	}
 
-	isRun, err := d.ctr.isContainerRunning(ctx, dep.ContainerId)
+	rt, err := d.runtime(ctx, placedNode(dep))
+	if err != nil {
+		statusNodeError(c, logger, depId, err)
+		return
+	}
+	isRun, err := isContainerRunning(ctx, rt, dep.ContainerId)
 	if err != nil {
 		logger.Error().Err(err).Str("deployment_id", depId).Msg("failed to inspect container")
 		response.StatusInternalServerError(c)
@@ -607,37 +1056,26 @@ func (d *deployment) DeleteDeploymentContainer(c *gin.Context) {
 		return
 	}
 
-	sess, tnxOption, err := d.db.CreateSession()
-	if err != nil {
-		logger.Error().Err(err).Str("deployment_id", depId).Msg("failed to create session")
-		response.StatusInternalServerError(c)
-		return
-	}
-	defer sess.EndSession(ctx)
-
-	callback := func(sc mongo.SessionContext) (interface{}, error) {
-
-		sc = mongo.NewSessionContext(ctx, sess)
-
-		update := bson.D{
-			{"$set", bson.D{
-				{"updated_at", time.Now()},
-			}},
-			{"$unset", bson.D{
-				{"container_id", ""},
-			}},
-		}
-		if err = d.db.UpdateDeployment(sc, &filter, &update); err != nil {
-			return nil, fmt.Errorf("failed to update deployment: %w", err)
+	callback := func(sc context.Context) error {
+		_, err := d.db.UpdateDeployment(sc, depId, func(dep *model.Deployment) error {
+			dep.UpdatedAt = time.Now()
+			dep.ContainerId = ""
+			dep.ProxyPort = 0
+			dep.Health = nil
+			return nil
+		})
+		if err != nil {
+			return fmt.Errorf("failed to update deployment: %w", err)
 		}
 
-		if err = d.ctr.removeContainer(sc, dep.ContainerId); err != nil {
-			return nil, fmt.Errorf("failed to remove container: %w", err)
+		if err = rt.RemoveContainer(sc, dep.ContainerId); err != nil {
+			return fmt.Errorf("failed to remove container: %w", err)
 		}
-		return nil, nil
+		d.proxy.stop(depId)
+		return nil
 	}
 
-	if _, err = sess.WithTransaction(ctx, callback, tnxOption); err != nil {
+	if err = d.db.WithTx(ctx, callback); err != nil {
 		logger.Error().Err(err).Str("deployment_id", depId).Msg("failed to remove deployment container")
 		response.StatusInternalServerError(c)
 		return
@@ -669,27 +1107,29 @@ func (d *deployment) GetDeployments(c *gin.Context) {
 		return
 	}
 
-	filter := bson.D{
-		{"deleted_at", time.Time{}},
+	crashLooping, err := strconv.ParseBool(c.DefaultQuery("crash_looping", "false"))
+	if err != nil {
+		logger.Error().Err(err).Msg("invalid crash_looping")
+		response.StatusBadRequest(c, "invalid crash_looping")
+		return
 	}
-	projection := bson.M{"_id": 1, "created_at": 1, "updated_at": 1, "name": 1, "stage": 1}
-	opts := options.Find().SetProjection(projection).SetLimit(int64(limit)).SetSkip(int64(page - 1))
 
-	deps, err := d.db.FindDeployments(ctx, &filter, opts)
+	query := database.DeploymentQuery{Skip: page - 1, Limit: limit, CrashLooping: crashLooping}
+	deps, err := d.db.ListDeployments(ctx, query)
 	if err != nil {
 		logger.Error().Err(err).Msg("failed to find deployments")
 		response.StatusInternalServerError(c)
 		return
 	}
 
-	if len(*deps) == 0 {
+	if len(deps) == 0 {
 		logger.Info().Msg("no deployments")
 		response.StatusNoContent(c)
 		return
 	}
 
-	logger.Info().Int("deployments", len(*deps)).Msg("deployments sent")
-	response.StatusDeployments(c, deps)
+	logger.Info().Int("deployments", len(deps)).Msg("deployments sent")
+	response.StatusDeployments(c, &deps)
 	return
 }
 
@@ -704,15 +1144,9 @@ func (d *deployment) GetDeployment(c *gin.Context) {
 	}
 
 	ctx := c.Request.Context()
-	filter := bson.D{
-		{"_id", depId},
-		{"deleted_at", time.Time{}},
-	}
-	projection := bson.M{"_id": 1, "created_at": 1, "updated_at": 1, "name": 1, "stage": 1}
-	opts := options.FindOne().SetProjection(projection)
-	dep, err := d.db.FindDeployment(ctx, &filter, opts)
+	dep, err := d.db.GetDeployment(ctx, depId)
 	if err != nil {
-		if errors.Is(err, mongo.ErrNoDocuments) {
+		if errors.Is(err, database.ErrNotFound) {
 			logger.Error().Err(err).Str("deployment_id", depId).Msg("deployment not found")
 			response.StatusNotFound(c, "deployment not found")
 			return
@@ -722,7 +1156,7 @@ func (d *deployment) GetDeployment(c *gin.Context) {
 		return
 	}
 	logger.Info().Str("deployment_id", depId).Msg("deployment sent")
-	response.StatusDeployment(c, dep)
+	response.StatusDeployment(c, dep, d.router.hostname(dep.Name))
 	return
 }
 
@@ -737,15 +1171,9 @@ func (d *deployment) GetLogs(c *gin.Context) {
 	}
 
 	ctx := c.Request.Context()
-	filter := bson.D{
-		{"_id", depId},
-		{"deleted_at", time.Time{}},
-	}
-	projection := bson.M{"_id": 1, "container_id": 1, "stage": 1}
-	opts := options.FindOne().SetProjection(projection)
-	dep, err := d.db.FindDeployment(ctx, &filter, opts)
+	dep, err := d.db.GetDeployment(ctx, depId)
 	if err != nil {
-		if errors.Is(err, mongo.ErrNoDocuments) {
+		if errors.Is(err, database.ErrNotFound) {
 			logger.Error().Err(err).Str("deployment_id", depId).Msg("deployment not found")
 			response.StatusNotFound(c, "deployment not found")
 			return
@@ -767,7 +1195,12 @@ func (d *deployment) GetLogs(c *gin.Context) {
 		return
 	}
 
-	clogs, err := d.ctr.getContainerLogs(ctx, dep.ContainerId)
+	rt, err := d.runtime(ctx, placedNode(dep))
+	if err != nil {
+		statusNodeError(c, logger, depId, err)
+		return
+	}
+	clogs, err := rt.ContainerLogs(ctx, dep.ContainerId)
 	if err != nil {
 		logger.Error().Err(err).Str("deployment_id", depId).Msg("failed to get container logs")
 		response.StatusInternalServerError(c)
@@ -809,16 +1242,18 @@ func (d *deployment) DeleteDeployment(c *gin.Context) {
 		return
 	}
 
-	ctx := c.Request.Context()
-	filter := bson.D{
-		{"_id", depId},
-		{"deleted_at", time.Time{}},
+	// volumes are kept unless they are purged explicitly
+	purge, err := strconv.ParseBool(c.DefaultQuery("purge_volumes", "false"))
+	if err != nil {
+		logger.Error().Err(err).Msg("invalid purge_volumes")
+		response.StatusBadRequest(c, "invalid purge_volumes")
+		return
 	}
-	projection := bson.M{"_id": 1, "container_id": 1, "stage": 1, "image_id": 1}
-	opts := options.FindOne().SetProjection(projection)
-	dep, err := d.db.FindDeployment(ctx, &filter, opts)
+
+	ctx := c.Request.Context()
+	dep, err := d.db.GetDeployment(ctx, depId)
 	if err != nil {
-		if errors.Is(err, mongo.ErrNoDocuments) {
+		if errors.Is(err, database.ErrNotFound) {
 			logger.Error().Err(err).Str("deployment_id", depId).Msg("deployment not found")
 			response.StatusNotFound(c, "deployment not found")
 			return
@@ -828,75 +1263,95 @@ func (d *deployment) DeleteDeployment(c *gin.Context) {
 		return
 	}
 
-	sess, txnOptions, err := d.db.CreateSession()
+	rt, err := d.runtime(ctx, placedNode(dep))
 	if err != nil {
-		logger.Error().Err(err).Str("deployment_id", depId).Msg("failed to create session")
-		response.StatusInternalServerError(c)
-		return
-	}
-	defer sess.EndSession(ctx)
-
-	callback := func(sc mongo.SessionContext) (interface{}, error) {
-
-		sc = mongo.NewSessionContext(ctx, sess)
-
-		update := bson.D{
-			{"$set", bson.D{
-				{"updated_at", time.Now()},
-				{"deleted_at", time.Now()},
-			}},
+		if !errors.Is(err, errNodeUnavailable) {
+			logger.Error().Err(err).Str("deployment_id", depId).Msg("failed to find node")
+			response.StatusInternalServerError(c)
+			return
 		}
+		// a node which is gone keeps the objects of the deployment
+		logger.Warn().Err(err).Str("deployment_id", depId).Msg("container, volumes and images left on the node")
+		rt = nil
+	}
 
-		if err = d.db.UpdateDeployment(sc, &filter, &update); err != nil {
-			logger.Error().Err(err).Str("deployment_id", depId).Msg("failed to delete deployment")
+	// a container which can not be removed keeps the deployment, everything else left on the engine is only removed
+	// once the delete committed since it can not be restored by a rollback
+	if dep.ContainerId != "" && rt != nil {
+		if err = removeContainer(ctx, rt, dep.ContainerId); err != nil {
+			logger.Error().Err(err).Str("deployment_id", depId).Str("container_id", dep.ContainerId).Msg("failed to remove container")
 			response.StatusInternalServerError(c)
-			return nil, err
+			return
 		}
+	}
 
-		path := filepath.Join(d.location, depId)
-		if err = utility.DeleteAll(path); err != nil {
-			if !errors.Is(err, fs.ErrNotExist) {
-				return nil, fmt.Errorf("failed to remove files: %w", err)
-			}
+	var releases []model.Release
+	callback := func(sc context.Context) error {
+		_, err := d.db.UpdateDeployment(sc, depId, func(dep *model.Deployment) error {
+			dep.UpdatedAt = time.Now()
+			dep.DeletedAt = time.Now()
+			return nil
+		})
+		if err != nil {
+			return fmt.Errorf("failed to delete deployment: %w", err)
 		}
-
-		if dep.ContainerId != "" {
-			running, err := d.ctr.isContainerRunning(sc, dep.ContainerId)
-			if err != nil {
-				if client.IsErrNotFound(err) {
-					logger.Warn().Str("deployment_id", depId).Str("container_id", dep.ContainerId).Msg("container not found")
-				}
-				return nil, fmt.Errorf("failed to get container stage: %w", err)
-			}
-			if running {
-				if err = d.ctr.stopContainer(sc, dep.ContainerId); err != nil {
-					return nil, fmt.Errorf("failed to stop container: %w", err)
-				}
-				if err = d.ctr.removeContainer(sc, dep.ContainerId); err != nil {
-					return nil, fmt.Errorf("failed to remove container: %w", err)
-				}
-			}
+		if err = d.releasePorts(sc, depId, nil); err != nil {
+			return fmt.Errorf("failed to release ports: %w", err)
 		}
-
-		if dep.Stage > model.ImageCreated {
-			if dep.ImageId == "" {
-				logger.Warn().Str("deployment_id", depId).Msg("image id is empty")
-			} else {
-				if err = d.ctr.deleteImage(sc, dep.ImageId); err != nil {
-					return nil, fmt.Errorf("failed to delete image: %w", err)
-				}
-			}
-
+		if err = d.db.DeleteDomains(sc, depId); err != nil {
+			return fmt.Errorf("failed to delete domains: %w", err)
+		}
+		if err = d.unlinkDeployment(sc, depId); err != nil {
+			return err
 		}
-		return nil, nil
+		if releases, err = d.db.ListReleases(sc, depId); err != nil {
+			return fmt.Errorf("failed to find releases: %w", err)
+		}
+		return nil
 	}
 
-	if _, err = sess.WithTransaction(ctx, callback, txnOptions); err != nil {
+	if err = d.db.WithTx(ctx, callback); err != nil {
 		logger.Error().Err(err).Str("deployment_id", depId).Msg("failed to delete deployment")
 		response.StatusInternalServerError(c)
 		return
 	}
 
+	d.proxy.stop(depId)
+	d.router.remove(depId)
+
+	if err = utility.DeleteAll(filepath.Join(d.location, depId)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		logger.Warn().Err(err).Str("deployment_id", depId).Msg("files left on the disk")
+	}
+	if dep.Stage > model.ImageCreated {
+		if dep.ImageId == "" {
+			logger.Warn().Str("deployment_id", depId).Msg("image id is empty")
+		} else if err = d.deleteImage(ctx, rt, dep.ImageId); err != nil {
+			logger.Warn().Err(err).Str("deployment_id", depId).Str("image", dep.ImageId).Msg("image left on the engine")
+		}
+	}
+	for _, release := range releases {
+		if !release.PrunedAt.IsZero() {
+			continue
+		}
+		if err = d.deleteImage(ctx, rt, release.Tag); err != nil {
+			logger.Warn().Err(err).Str("deployment_id", depId).Str("image", release.Tag).Msg("release image left on the engine")
+		}
+	}
+	if rt != nil {
+		if err = rt.RemoveNetwork(ctx, depId); err != nil {
+			logger.Warn().Err(err).Str("deployment_id", depId).Msg("network left on the engine")
+		}
+	}
+
+	// the data is only destroyed once the deployment is gone, a volume which is not removed is left on the engine
+	if purge && rt != nil {
+		for _, v := range dep.Volumes {
+			if err = rt.RemoveVolume(ctx, v.Source); err != nil && !client.IsErrNotFound(err) {
+				logger.Warn().Err(err).Str("deployment_id", depId).Str("volume", v.Source).Msg("volume left on the engine")
+			}
+		}
+	}
+
 	logger.Info().Str("deployment_id", depId).Str("deployment_id", depId).Msg("deployment deleted")
 	response.StatusCommonOK(c, "deployment deleted")
 	return
@@ -913,14 +1368,9 @@ func (d *deployment) UploadDockerfile(c *gin.Context) {
 	}
 
 	ctx := c.Request.Context()
-	filter := bson.D{
-		{"_id", depId},
-		{"deleted_at", time.Time{}},
-	}
-
-	_, err := d.db.FindDeployment(ctx, &filter, nil)
+	_, err := d.db.GetDeployment(ctx, depId)
 	if err != nil {
-		if errors.Is(err, mongo.ErrNoDocuments) {
+		if errors.Is(err, database.ErrNotFound) {
 			logger.Error().Err(err).Str("deployment_id", depId).Msg("deployment not found")
 			response.StatusInternalServerError(c)
 			return
@@ -943,32 +1393,24 @@ func (d *deployment) UploadDockerfile(c *gin.Context) {
 	}
 
 	path := filepath.Join(d.location, depId, "application", "Dockerfile")
-	sess, txnOptions, err := d.db.CreateSession()
-	if err != nil {
-		logger.Error().Err(err).Str("deployment_id", depId).Msg("failed to create session")
-		response.StatusInternalServerError(c)
-		return
-	}
-	defer sess.EndSession(ctx)
-	callback := func(sc mongo.SessionContext) (interface{}, error) {
-		update := bson.D{
-			{"$set", bson.D{
-				{"updated_at", time.Now()},
-				{"stage", model.DockerfileUpload},
-				{"dockerfile", path},
-			}},
-		}
-		if err = d.db.UpdateDeployment(sc, &filter, &update); err != nil {
-			return nil, fmt.Errorf("failed to update deployment: %w", err)
+	callback := func(sc context.Context) error {
+		_, err := d.db.UpdateDeployment(sc, depId, func(dep *model.Deployment) error {
+			dep.UpdatedAt = time.Now()
+			dep.Stage = model.DockerfileUpload
+			dep.Dockerfile = path
+			return nil
+		})
+		if err != nil {
+			return fmt.Errorf("failed to update deployment: %w", err)
 		}
 
 		if err = c.SaveUploadedFile(file, path); err != nil {
-			return nil, fmt.Errorf("failed to save dockerfile: %w", err)
+			return fmt.Errorf("failed to save dockerfile: %w", err)
 		}
 
-		return nil, nil
+		return nil
 	}
-	if _, err = sess.WithTransaction(ctx, callback, txnOptions); err != nil {
+	if err = d.db.WithTx(ctx, callback); err != nil {
 		logger.Error().Err(err).Str("deployment_id", depId).Msg("failed to upload dockerfile")
 		response.StatusInternalServerError(c)
 		return
@@ -990,15 +1432,9 @@ func (d *deployment) DownloadDockerfile(c *gin.Context) {
 	}
 
 	ctx := c.Request.Context()
-	filter := bson.D{
-		{"_id", depId},
-		{"deleted_at", time.Time{}},
-	}
-	projection := bson.M{"stage": 1, "dockerfile": 1}
-	opts := options.FindOne().SetProjection(projection)
-	dep, err := d.db.FindDeployment(ctx, &filter, opts)
+	dep, err := d.db.GetDeployment(ctx, depId)
 	if err != nil {
-		if errors.Is(err, mongo.ErrNoDocuments) {
+		if errors.Is(err, database.ErrNotFound) {
 			logger.Error().Err(err).Str("deployment_id", depId).Msg("deployment not found")
 			response.StatusNotFound(c, "deployment not found")
 			return
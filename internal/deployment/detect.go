@@ -0,0 +1,181 @@
+package deployment
+
+import (
+	"GDHost/internal/utility"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+const (
+	detectFileLimit      = 1 << 20
+	goDefaultVersion     = "1.22"
+	nodeDefaultVersion   = "20"
+	pythonDefaultVersion = "3.12"
+)
+
+var (
+	errNotDetected = errors.New("language not detected")
+
+	goVersionRegex = regexp.MustCompile(`(?m)^go\s+(\d+\.\d+(\.\d+)?)\s*$`)
+	versionRegex   = regexp.MustCompile(`\d+(\.\d+)*`)
+)
+
+// optionBuilder is a dockerfile generator request which can be turned into a BuildOption
+type optionBuilder interface {
+	applyDefaults()
+	buildOption(path string) BuildOption
+}
+
+// detection is the language detected from the uploaded source and the generator options which would be used
+type detection struct {
+	Language  string        `json:"language"`
+	Files     []string      `json:"files"`
+	Supported bool          `json:"supported"`
+	Options   optionBuilder `json:"options,omitempty"`
+}
+
+// detectSource inspects the root of the uploaded zip file and detects the language with default generator options
+func detectSource(src string) (*detection, error) {
+	files, err := utility.ReadZipRoot(src, detectFileLimit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read source: %w", err)
+	}
+
+	var det *detection
+	switch {
+	case hasFile(files, "go.mod"):
+		det = detectGo(files)
+	case hasFile(files, "package.json"):
+		det = detectNode(files)
+	case hasFile(files, "requirements.txt", "poetry.lock", "uv.lock"):
+		det = detectPython(files)
+	case hasFile(files, "pom.xml", "build.gradle", "build.gradle.kts"):
+		det = &detection{Language: "Java"}
+	case hasFile(files, "Cargo.toml"):
+		det = &detection{Language: "Rust"}
+	case hasFile(files, "index.html"):
+		det = &detection{Language: "Static"}
+	default:
+		return nil, errNotDetected
+	}
+
+	for _, name := range []string{"go.mod", "go.sum", "package.json", "package-lock.json", "yarn.lock", "pnpm-lock.yaml",
+		"requirements.txt", "poetry.lock", "uv.lock", "pyproject.toml", ".python-version", "pom.xml", "build.gradle",
+		"build.gradle.kts", "Cargo.toml", "index.html"} {
+		if hasFile(files, name) {
+			det.Files = append(det.Files, name)
+		}
+	}
+	sort.Strings(det.Files)
+
+	if det.Options != nil {
+		det.Supported = true
+		det.Options.applyDefaults()
+	}
+	return det, nil
+}
+
+// hasFile reports whether any of the names is in files
+func hasFile(files map[string][]byte, names ...string) bool {
+	for _, name := range names {
+		if _, ok := files[name]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+// detectGo reads the go version from go.mod
+func detectGo(files map[string][]byte) *detection {
+	req := &CreateDeploymentReq{Version: goDefaultVersion}
+	if m := goVersionRegex.FindSubmatch(files["go.mod"]); m != nil {
+		req.Version = string(m[1])
+	}
+	return &detection{Language: "Go", Options: req}
+}
+
+// detectNode reads the node version, scripts and entrypoint from package.json and the package manager from the lock file
+func detectNode(files map[string][]byte) *detection {
+	req := &CreateNodeDockerfileReq{
+		Version:        nodeDefaultVersion,
+		PackageManager: nodeDefaultPackageManager,
+		Production:     true,
+	}
+
+	switch {
+	case hasFile(files, "pnpm-lock.yaml"):
+		req.PackageManager = "pnpm"
+	case hasFile(files, "yarn.lock"):
+		req.PackageManager = "yarn"
+	}
+
+	var pkg struct {
+		Main    string            `json:"main"`
+		Scripts map[string]string `json:"scripts"`
+		Engines struct {
+			Node string `json:"node"`
+		} `json:"engines"`
+	}
+	if err := json.Unmarshal(files["package.json"], &pkg); err != nil {
+		return &detection{Language: "Node", Options: req}
+	}
+
+	if v := versionRegex.FindString(pkg.Engines.Node); v != "" {
+		req.Version = strings.Split(v, ".")[0]
+	}
+	if _, ok := pkg.Scripts["build"]; ok {
+		req.BuildScript = "build"
+	}
+	if _, ok := pkg.Scripts["start"]; !ok {
+		if pkg.Main != "" {
+			req.Start = "node " + pkg.Main
+		} else {
+			req.Start = "node index.js"
+		}
+	}
+	return &detection{Language: "Node", Options: req}
+}
+
+// detectPython reads the dependency manager from the lock file and the server from the dependencies
+func detectPython(files map[string][]byte) *detection {
+	req := &CreatePythonDockerfileReq{
+		Version: pythonDefaultVersion,
+		Manager: pythonDefaultManager,
+		Server:  pythonDefaultServer,
+		App:     "app",
+	}
+
+	switch {
+	case hasFile(files, "uv.lock"):
+		req.Manager = "uv"
+	case hasFile(files, "poetry.lock"):
+		req.Manager = "poetry"
+	}
+
+	if v := versionRegex.FindString(string(files[".python-version"])); v != "" {
+		parts := strings.Split(v, ".")
+		if len(parts) > 2 {
+			parts = parts[:2]
+		}
+		req.Version = strings.Join(parts, ".")
+	}
+
+	if hasFile(files, "main.py") {
+		req.App = "main"
+	}
+
+	deps := strings.ToLower(string(files["requirements.txt"]) + string(files["pyproject.toml"]))
+	switch {
+	case strings.Contains(deps, "uvicorn") || strings.Contains(deps, "fastapi"):
+		req.Server = "uvicorn"
+		req.App += ":app"
+	case strings.Contains(deps, "gunicorn") || strings.Contains(deps, "flask"):
+		req.Server = "gunicorn"
+		req.App += ":app"
+	}
+	return &detection{Language: "Python", Options: req}
+}
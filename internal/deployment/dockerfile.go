@@ -1,9 +1,12 @@
 package deployment
 
 import (
+	templates "GDHost/internal/template"
+	"encoding/json"
 	"fmt"
 	logs "github.com/rs/zerolog/log"
 	"os"
+	"strings"
 	"text/template"
 )
 
@@ -11,28 +14,40 @@ type Dockerfile interface {
 	createDockerfile(option *BuildOption) error
 }
 
+const goTemplateFile = "dockerfile-go.tmpl"
+
 type dockerfile struct {
-	location   string
-	goTemplate *template.Template
+	location       string
+	goTemplate     *template.Template
+	nodeTemplate   *template.Template
+	pythonTemplate *template.Template
 }
 
 func NewDockerfileController(location string) Dockerfile {
 	return &dockerfile{
-		location:   location,
-		goTemplate: template.Must(template.ParseFiles("internal/template/dockerfile-go.tmpl")),
+		location:       location,
+		goTemplate:     template.Must(template.ParseFS(templates.FS, goTemplateFile)),
+		nodeTemplate:   template.Must(template.ParseFS(templates.FS, "dockerfile-node.tmpl")),
+		pythonTemplate: template.Must(template.ParseFS(templates.FS, "dockerfile-python.tmpl")),
 	}
 }
 
 type BuildOption struct {
-	Lang          Language
-	Location      string
-	GoBuildOption GoBuildOption
+	Lang              Language
+	Location          string
+	GoBuildOption     GoBuildOption
+	NodeBuildOption   NodeBuildOption
+	PythonBuildOption PythonBuildOption
+	CustomBuildOption CustomBuildOption
 }
 
 type Language int
 
 const (
 	Go Language = iota
+	Node
+	Python
+	Custom
 )
 
 type GoBuildOption struct {
@@ -47,6 +62,121 @@ type GoBuildOption struct {
 	FLAGS     string
 }
 
+type NodeBuildOption struct {
+	NodeVersion    string
+	PackageManager string
+	BuildScript    string
+	StartCommand   string
+	Production     bool
+}
+
+// LockFile returns the lock file of the package manager
+func (o NodeBuildOption) LockFile() string {
+	switch o.PackageManager {
+	case "yarn":
+		return "yarn.lock"
+	case "pnpm":
+		return "pnpm-lock.yaml"
+	default:
+		return "package-lock.json"
+	}
+}
+
+// InstallCommand returns the command to install all dependencies from the lock file
+func (o NodeBuildOption) InstallCommand() string {
+	switch o.PackageManager {
+	case "yarn":
+		return "yarn install --frozen-lockfile"
+	case "pnpm":
+		return "pnpm install --frozen-lockfile"
+	default:
+		return "npm ci"
+	}
+}
+
+// RunCommand returns the command to run a package.json script
+func (o NodeBuildOption) RunCommand() string {
+	switch o.PackageManager {
+	case "yarn":
+		return "yarn run"
+	case "pnpm":
+		return "pnpm run"
+	default:
+		return "npm run"
+	}
+}
+
+// PruneCommand returns the command to remove development dependencies
+func (o NodeBuildOption) PruneCommand() string {
+	switch o.PackageManager {
+	case "yarn":
+		return "yarn install --production --frozen-lockfile --ignore-scripts"
+	case "pnpm":
+		return "pnpm prune --prod"
+	default:
+		return "npm prune --omit=dev"
+	}
+}
+
+// CMD returns the start command in exec form
+func (o NodeBuildOption) CMD() string {
+	cmd, _ := json.Marshal(strings.Fields(o.StartCommand))
+	return string(cmd)
+}
+
+type PythonBuildOption struct {
+	PythonVersion string
+	Manager       string
+	Server        string
+	App           string
+	Port          string
+}
+
+// DependencyFiles returns the files describing the dependencies of the dependency manager
+func (o PythonBuildOption) DependencyFiles() string {
+	switch o.Manager {
+	case "poetry":
+		return "pyproject.toml poetry.lock"
+	case "uv":
+		return "pyproject.toml uv.lock"
+	default:
+		return "requirements.txt"
+	}
+}
+
+// InstallCommand returns the command to install the dependencies into the virtual environment
+func (o PythonBuildOption) InstallCommand() string {
+	switch o.Manager {
+	case "poetry":
+		return "poetry export --without-hashes -f requirements.txt -o requirements.txt && /opt/venv/bin/pip install -r requirements.txt"
+	case "uv":
+		return "UV_PROJECT_ENVIRONMENT=/opt/venv uv sync --frozen --no-dev --no-install-project --inexact"
+	default:
+		return "/opt/venv/bin/pip install -r requirements.txt"
+	}
+}
+
+// CMD returns the entrypoint in exec form
+func (o PythonBuildOption) CMD() string {
+	var args []string
+	switch o.Server {
+	case "gunicorn":
+		args = []string{"gunicorn", "--bind", "0.0.0.0:" + o.Port, o.App}
+	case "uvicorn":
+		args = []string{"uvicorn", o.App, "--host", "0.0.0.0", "--port", o.Port}
+	default:
+		args = []string{"python", "-m", o.App}
+	}
+	cmd, _ := json.Marshal(args)
+	return string(cmd)
+}
+
+type CustomBuildOption struct {
+	Name       string
+	Data       string
+	Parameters map[string]interface{}
+}
+
 func (df *dockerfile) createDockerfile(option *BuildOption) error {
 	file, err := os.Create(option.Location)
 	if err != nil {
@@ -62,6 +192,23 @@ func (df *dockerfile) createDockerfile(option *BuildOption) error {
 		if err = df.goTemplate.Execute(file, option.GoBuildOption); err != nil {
 			return fmt.Errorf("failed to execute 'Go' template: %w", err)
 		}
+	case Node:
+		if err = df.nodeTemplate.Execute(file, option.NodeBuildOption); err != nil {
+			return fmt.Errorf("failed to execute 'Node' template: %w", err)
+		}
+	case Python:
+		if err = df.pythonTemplate.Execute(file, option.PythonBuildOption); err != nil {
+			return fmt.Errorf("failed to execute 'Python' template: %w", err)
+		}
+	case Custom:
+		var tmpl *template.Template
+		tmpl, err = template.New(option.CustomBuildOption.Name).Option("missingkey=error").Parse(option.CustomBuildOption.Data)
+		if err != nil {
+			return fmt.Errorf("failed to parse '%s' template: %w", option.CustomBuildOption.Name, err)
+		}
+		if err = tmpl.Execute(file, option.CustomBuildOption.Parameters); err != nil {
+			return fmt.Errorf("failed to execute '%s' template: %w", option.CustomBuildOption.Name, err)
+		}
 	default:
 		return fmt.Errorf("invalid language option")
 	}
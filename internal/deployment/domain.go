@@ -0,0 +1,311 @@
+package deployment
+
+import (
+	"GDHost/internal/database"
+	"GDHost/internal/model"
+	"GDHost/internal/response"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/gin-contrib/requestid"
+	"github.com/gin-gonic/gin"
+	"github.com/go-playground/validator/v10"
+	"github.com/google/uuid"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	verifyTimeout   = 10 * time.Second
+	verifyBodyLimit = 1024
+)
+
+type DomainReq struct {
+	Name string `json:"name" validate:"required,fqdn"`
+}
+
+// domainName returns the stored form of a domain, lower case without the trailing dot
+func domainName(name string) string {
+	return strings.TrimSuffix(strings.ToLower(name), ".")
+}
+
+// challengeURL is where the token of the domain is looked up on verification
+func (d *deployment) challengeURL(domain *model.Domain) string {
+	host := domain.Name
+	if d.httpPort != 80 {
+		host = net.JoinHostPort(host, strconv.Itoa(d.httpPort))
+	}
+	return "http://" + host + challengePath + domain.Token
+}
+
+// findDomain returns the domain when it belongs to the deployment
+func (d *deployment) findDomain(ctx context.Context, depId string, name string) (*model.Domain, error) {
+	domain, err := d.db.GetDomain(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	if domain.DeploymentId != depId {
+		return nil, database.ErrNotFound
+	}
+	return domain, nil
+}
+
+// fetchChallenge checks that the domain answers with its token, redirects are not followed
+func fetchChallenge(url string, token string) error {
+	cli := &http.Client{
+		Timeout: verifyTimeout,
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	resp, err := cli.Get(url)
+	if err != nil {
+		return fmt.Errorf("failed to get %s: %w", url, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s answered with status %d", url, resp.StatusCode)
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, verifyBodyLimit))
+	if err != nil {
+		return fmt.Errorf("failed to read %s: %w", url, err)
+	}
+	if string(bytes.TrimSpace(body)) != token {
+		return fmt.Errorf("%s did not answer with the token", url)
+	}
+	return nil
+}
+
+func (d *deployment) CreateDomain(c *gin.Context) {
+	logger := d.logger.With().Str("request_id", requestid.Get(c)).Logger()
+
+	depId := c.Param("id")
+	if depId == "" {
+		logger.Error().Msg("no deployment id")
+		response.StatusBadRequest(c, "no deployment id")
+		return
+	}
+
+	var req DomainReq
+	if err := c.BindJSON(&req); err != nil {
+		logger.Error().Err(err).Msg("failed to bind request")
+		response.StatusBadRequest(c, "failed to bind request")
+		return
+	}
+	if err := validator.New().Struct(req); err != nil {
+		logger.Error().Err(err).Msg("request validation error")
+		response.StatusBadRequest(c, err.Error())
+		return
+	}
+	name := domainName(req.Name)
+
+	if d.httpPort == 0 {
+		logger.Error().Str("deployment_id", depId).Msg("http proxy is disabled")
+		response.StatusUnProcessed(c, "custom domains are served by the http proxy, set http_proxy_port")
+		return
+	}
+	if d.router.domain != "" && (name == d.router.domain || strings.HasSuffix(name, "."+d.router.domain)) {
+		logger.Error().Str("deployment_id", depId).Str("name", name).Msg("domain under the base domain")
+		response.StatusUnProcessed(c, "hostnames under the base domain are assigned by deployment name")
+		return
+	}
+
+	ctx := c.Request.Context()
+	if _, err := d.db.GetDeployment(ctx, depId); err != nil {
+		if errors.Is(err, database.ErrNotFound) {
+			logger.Error().Err(err).Str("deployment_id", depId).Msg("deployment not found")
+			response.StatusNotFound(c, "deployment not found")
+			return
+		}
+		logger.Error().Err(err).Str("deployment_id", depId).Msg("failed to find deployment")
+		response.StatusInternalServerError(c)
+		return
+	}
+
+	domain := &model.Domain{
+		Name:         name,
+		DeploymentId: depId,
+		Token:        uuid.NewString(),
+		CreatedAt:    time.Now(),
+	}
+	if err := d.db.CreateDomain(ctx, domain); err != nil {
+		if errors.Is(err, database.ErrDuplicate) {
+			msg := "domain is already used"
+			if owner, err := d.db.GetDomain(ctx, name); err == nil {
+				msg = "domain is used by deployment " + owner.DeploymentId
+			}
+			logger.Error().Err(err).Str("deployment_id", depId).Str("name", name).Msg("domain already used")
+			response.StatusConflicted(c, msg)
+			return
+		}
+		logger.Error().Err(err).Str("deployment_id", depId).Msg("failed to create domain")
+		response.StatusInternalServerError(c)
+		return
+	}
+	d.router.setChallenge(name, depId, domain.Token)
+
+	logger.Info().Str("deployment_id", depId).Str("name", name).Msg("domain created")
+	response.StatusDomain(c, domain, d.challengeURL(domain))
+	return
+}
+
+func (d *deployment) GetDomains(c *gin.Context) {
+	logger := d.logger.With().Str("request_id", requestid.Get(c)).Logger()
+
+	depId := c.Param("id")
+	if depId == "" {
+		logger.Error().Msg("no deployment id")
+		response.StatusBadRequest(c, "no deployment id")
+		return
+	}
+
+	ctx := c.Request.Context()
+	if _, err := d.db.GetDeployment(ctx, depId); err != nil {
+		if errors.Is(err, database.ErrNotFound) {
+			logger.Error().Err(err).Str("deployment_id", depId).Msg("deployment not found")
+			response.StatusNotFound(c, "deployment not found")
+			return
+		}
+		logger.Error().Err(err).Str("deployment_id", depId).Msg("failed to find deployment")
+		response.StatusInternalServerError(c)
+		return
+	}
+
+	domains, err := d.db.ListDomains(ctx, database.DomainQuery{DeploymentId: depId})
+	if err != nil {
+		logger.Error().Err(err).Str("deployment_id", depId).Msg("failed to find domains")
+		response.StatusInternalServerError(c)
+		return
+	}
+	if len(domains) == 0 {
+		logger.Info().Str("deployment_id", depId).Msg("no domains")
+		response.StatusNoContent(c)
+		return
+	}
+
+	logger.Info().Str("deployment_id", depId).Int("domains", len(domains)).Msg("domains sent")
+	response.StatusDomains(c, &domains, d.challengeURL)
+	return
+}
+
+func (d *deployment) GetDomain(c *gin.Context) {
+	logger := d.logger.With().Str("request_id", requestid.Get(c)).Logger()
+
+	depId := c.Param("id")
+	name := domainName(c.Param("name"))
+	if depId == "" || name == "" {
+		logger.Error().Msg("no deployment id or domain name")
+		response.StatusBadRequest(c, "no deployment id or domain name")
+		return
+	}
+
+	ctx := c.Request.Context()
+	domain, err := d.findDomain(ctx, depId, name)
+	if err != nil {
+		if errors.Is(err, database.ErrNotFound) {
+			logger.Error().Err(err).Str("deployment_id", depId).Str("name", name).Msg("domain not found")
+			response.StatusNotFound(c, "domain not found")
+			return
+		}
+		logger.Error().Err(err).Str("deployment_id", depId).Msg("failed to find domain")
+		response.StatusInternalServerError(c)
+		return
+	}
+
+	logger.Info().Str("deployment_id", depId).Str("name", name).Msg("domain sent")
+	response.StatusDomain(c, domain, d.challengeURL(domain))
+	return
+}
+
+func (d *deployment) VerifyDomain(c *gin.Context) {
+	logger := d.logger.With().Str("request_id", requestid.Get(c)).Logger()
+
+	depId := c.Param("id")
+	name := domainName(c.Param("name"))
+	if depId == "" || name == "" {
+		logger.Error().Msg("no deployment id or domain name")
+		response.StatusBadRequest(c, "no deployment id or domain name")
+		return
+	}
+
+	ctx := c.Request.Context()
+	domain, err := d.findDomain(ctx, depId, name)
+	if err != nil {
+		if errors.Is(err, database.ErrNotFound) {
+			logger.Error().Err(err).Str("deployment_id", depId).Str("name", name).Msg("domain not found")
+			response.StatusNotFound(c, "domain not found")
+			return
+		}
+		logger.Error().Err(err).Str("deployment_id", depId).Msg("failed to find domain")
+		response.StatusInternalServerError(c)
+		return
+	}
+	if domain.Verified() {
+		logger.Info().Str("deployment_id", depId).Str("name", name).Msg("domain already verified")
+		response.StatusDomain(c, domain, "")
+		return
+	}
+
+	if err = fetchChallenge(d.challengeURL(domain), domain.Token); err != nil {
+		logger.Error().Err(err).Str("deployment_id", depId).Str("name", name).Msg("domain verification failed")
+		response.StatusUnProcessed(c, "domain verification failed: "+err.Error())
+		return
+	}
+
+	domain, err = d.db.UpdateDomain(ctx, name, func(domain *model.Domain) error {
+		domain.VerifiedAt = time.Now()
+		return nil
+	})
+	if err != nil {
+		logger.Error().Err(err).Str("deployment_id", depId).Msg("failed to update domain")
+		response.StatusInternalServerError(c)
+		return
+	}
+	d.router.removeChallenge(name)
+	d.refreshRoute(ctx, depId)
+
+	logger.Info().Str("deployment_id", depId).Str("name", name).Msg("domain verified")
+	response.StatusDomain(c, domain, "")
+	return
+}
+
+func (d *deployment) DeleteDomain(c *gin.Context) {
+	logger := d.logger.With().Str("request_id", requestid.Get(c)).Logger()
+
+	depId := c.Param("id")
+	name := domainName(c.Param("name"))
+	if depId == "" || name == "" {
+		logger.Error().Msg("no deployment id or domain name")
+		response.StatusBadRequest(c, "no deployment id or domain name")
+		return
+	}
+
+	ctx := c.Request.Context()
+	if _, err := d.findDomain(ctx, depId, name); err != nil {
+		if errors.Is(err, database.ErrNotFound) {
+			logger.Error().Err(err).Str("deployment_id", depId).Str("name", name).Msg("domain not found")
+			response.StatusNotFound(c, "domain not found")
+			return
+		}
+		logger.Error().Err(err).Str("deployment_id", depId).Msg("failed to find domain")
+		response.StatusInternalServerError(c)
+		return
+	}
+	if err := d.db.DeleteDomain(ctx, name); err != nil {
+		logger.Error().Err(err).Str("deployment_id", depId).Msg("failed to delete domain")
+		response.StatusInternalServerError(c)
+		return
+	}
+	d.router.removeChallenge(name)
+	d.refreshRoute(ctx, depId)
+
+	logger.Info().Str("deployment_id", depId).Str("name", name).Msg("domain deleted")
+	response.StatusCommonOK(c, "domain deleted")
+	return
+}
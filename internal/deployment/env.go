@@ -0,0 +1,273 @@
+package deployment
+
+import (
+	"GDHost/internal/database"
+	"GDHost/internal/model"
+	"GDHost/internal/response"
+	"GDHost/internal/utility"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/gin-contrib/requestid"
+	"github.com/gin-gonic/gin"
+	"github.com/go-playground/validator/v10"
+	"regexp"
+	"sort"
+	"time"
+)
+
+var envNameRegex = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+type updateEnvReq struct {
+	Env map[string]string `json:"env" validate:"dive,keys,env_name,endkeys"`
+}
+
+type setSecretReq struct {
+	Value string `json:"value" validate:"required"`
+}
+
+// newEnvValidator returns a validator which knows the env_name tag
+func newEnvValidator() *validator.Validate {
+	validate := validator.New()
+	_ = validate.RegisterValidation("env_name", func(fl validator.FieldLevel) bool {
+		return envNameRegex.MatchString(fl.Field().String())
+	})
+	return validate
+}
+
+// containerEnv returns the plain env vars followed by the decrypted secrets, so a secret overrides a plain env var
+// with the same name
+func (d *deployment) containerEnv(dep *model.Deployment) ([]string, error) {
+	env := make([]string, 0, len(dep.Env)+len(dep.Secrets))
+	for _, name := range sortedKeys(dep.Env) {
+		env = append(env, name+"="+dep.Env[name])
+	}
+
+	if len(dep.Secrets) > 0 && d.secretKey == nil {
+		return nil, errors.New("secret key is not configured")
+	}
+	for _, name := range sortedKeys(dep.Secrets) {
+		value, err := utility.Decrypt(d.secretKey, dep.Secrets[name])
+		if err != nil {
+			return nil, fmt.Errorf("failed to decrypt secret %s: %w", name, err)
+		}
+		env = append(env, name+"="+string(value))
+	}
+	return env, nil
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func (d *deployment) GetEnv(c *gin.Context) {
+	logger := d.logger.With().Str("request_id", requestid.Get(c)).Logger()
+
+	depId := c.Param("id")
+	if depId == "" {
+		logger.Error().Msg("no deployment id")
+		response.StatusBadRequest(c, "no deployment id")
+		return
+	}
+
+	ctx := c.Request.Context()
+	dep, err := d.db.GetDeployment(ctx, depId)
+	if err != nil {
+		if errors.Is(err, database.ErrNotFound) {
+			logger.Error().Err(err).Str("deployment_id", depId).Msg("deployment not found")
+			response.StatusNotFound(c, "deployment not found")
+			return
+		}
+		logger.Error().Err(err).Str("deployment_id", depId).Msg("failed to find deployment")
+		response.StatusInternalServerError(c)
+		return
+	}
+
+	logger.Info().Str("deployment_id", depId).Msg("env sent")
+	response.StatusEnv(c, dep)
+	return
+}
+
+func (d *deployment) UpdateEnv(c *gin.Context) {
+	logger := d.logger.With().Str("request_id", requestid.Get(c)).Logger()
+
+	depId := c.Param("id")
+	if depId == "" {
+		logger.Error().Msg("no deployment id")
+		response.StatusBadRequest(c, "no deployment id")
+		return
+	}
+
+	var req updateEnvReq
+	if err := c.BindJSON(&req); err != nil {
+		logger.Error().Err(err).Msg("failed to bind request")
+		response.StatusBadRequest(c, "failed to bind request")
+		return
+	}
+	if err := newEnvValidator().Struct(req); err != nil {
+		logger.Error().Err(err).Msg("request validation error")
+		response.StatusBadRequest(c, err.Error())
+		return
+	}
+
+	err := d.updateEnvironment(c.Request.Context(), depId, func(dep *model.Deployment) error {
+		dep.Env = req.Env
+		return nil
+	})
+	if err != nil {
+		if errors.Is(err, database.ErrNotFound) {
+			logger.Error().Err(err).Str("deployment_id", depId).Msg("deployment not found")
+			response.StatusNotFound(c, "deployment not found")
+			return
+		}
+		logger.Error().Err(err).Str("deployment_id", depId).Msg("failed to update env")
+		response.StatusInternalServerError(c)
+		return
+	}
+
+	logger.Info().Str("deployment_id", depId).Int("env", len(req.Env)).Msg("env updated")
+	response.StatusCommonOK(c, "env updated")
+	return
+}
+
+func (d *deployment) GetSecrets(c *gin.Context) {
+	logger := d.logger.With().Str("request_id", requestid.Get(c)).Logger()
+
+	depId := c.Param("id")
+	if depId == "" {
+		logger.Error().Msg("no deployment id")
+		response.StatusBadRequest(c, "no deployment id")
+		return
+	}
+
+	ctx := c.Request.Context()
+	dep, err := d.db.GetDeployment(ctx, depId)
+	if err != nil {
+		if errors.Is(err, database.ErrNotFound) {
+			logger.Error().Err(err).Str("deployment_id", depId).Msg("deployment not found")
+			response.StatusNotFound(c, "deployment not found")
+			return
+		}
+		logger.Error().Err(err).Str("deployment_id", depId).Msg("failed to find deployment")
+		response.StatusInternalServerError(c)
+		return
+	}
+
+	logger.Info().Str("deployment_id", depId).Msg("secret names sent")
+	response.StatusSecrets(c, sortedKeys(dep.Secrets))
+	return
+}
+
+func (d *deployment) SetSecret(c *gin.Context) {
+	logger := d.logger.With().Str("request_id", requestid.Get(c)).Logger()
+
+	depId := c.Param("id")
+	name := c.Param("name")
+	if depId == "" || !envNameRegex.MatchString(name) {
+		logger.Error().Str("name", name).Msg("invalid secret name")
+		response.StatusBadRequest(c, "invalid secret name")
+		return
+	}
+
+	if d.secretKey == nil {
+		logger.Error().Msg("secret key is not configured")
+		response.StatusUnProcessed(c, "secret key is not configured")
+		return
+	}
+
+	var req setSecretReq
+	if err := c.BindJSON(&req); err != nil {
+		logger.Error().Err(err).Msg("failed to bind request")
+		response.StatusBadRequest(c, "failed to bind request")
+		return
+	}
+	if err := validator.New().Struct(req); err != nil {
+		logger.Error().Err(err).Msg("request validation error")
+		response.StatusBadRequest(c, err.Error())
+		return
+	}
+
+	value, err := utility.Encrypt(d.secretKey, []byte(req.Value))
+	if err != nil {
+		logger.Error().Err(err).Msg("failed to encrypt secret")
+		response.StatusInternalServerError(c)
+		return
+	}
+
+	err = d.updateEnvironment(c.Request.Context(), depId, func(dep *model.Deployment) error {
+		if dep.Secrets == nil {
+			dep.Secrets = map[string]string{}
+		}
+		dep.Secrets[name] = value
+		return nil
+	})
+	if err != nil {
+		if errors.Is(err, database.ErrNotFound) {
+			logger.Error().Err(err).Str("deployment_id", depId).Msg("deployment not found")
+			response.StatusNotFound(c, "deployment not found")
+			return
+		}
+		logger.Error().Err(err).Str("deployment_id", depId).Msg("failed to set secret")
+		response.StatusInternalServerError(c)
+		return
+	}
+
+	logger.Info().Str("deployment_id", depId).Str("name", name).Msg("secret set")
+	response.StatusCommonOK(c, "secret set")
+	return
+}
+
+func (d *deployment) DeleteSecret(c *gin.Context) {
+	logger := d.logger.With().Str("request_id", requestid.Get(c)).Logger()
+
+	depId := c.Param("id")
+	name := c.Param("name")
+	if depId == "" || !envNameRegex.MatchString(name) {
+		logger.Error().Str("name", name).Msg("invalid secret name")
+		response.StatusBadRequest(c, "invalid secret name")
+		return
+	}
+
+	err := d.updateEnvironment(c.Request.Context(), depId, func(dep *model.Deployment) error {
+		if _, ok := dep.Secrets[name]; !ok {
+			return database.ErrNotFound
+		}
+		delete(dep.Secrets, name)
+		return nil
+	})
+	if err != nil {
+		if errors.Is(err, database.ErrNotFound) {
+			logger.Error().Err(err).Str("deployment_id", depId).Str("name", name).Msg("secret not found")
+			response.StatusNotFound(c, "secret not found")
+			return
+		}
+		logger.Error().Err(err).Str("deployment_id", depId).Msg("failed to delete secret")
+		response.StatusInternalServerError(c)
+		return
+	}
+
+	logger.Info().Str("deployment_id", depId).Str("name", name).Msg("secret deleted")
+	response.StatusCommonOK(c, "secret deleted")
+	return
+}
+
+// updateEnvironment applies an env or secret update and flags the deployment for a container recreate
+// when a container already exists. It returns database.ErrNotFound when the deployment does not exist.
+func (d *deployment) updateEnvironment(ctx context.Context, depId string, fn func(dep *model.Deployment) error) error {
+	_, err := d.db.UpdateDeployment(ctx, depId, func(dep *model.Deployment) error {
+		if err := fn(dep); err != nil {
+			return err
+		}
+		dep.UpdatedAt = time.Now()
+		if dep.ContainerId != "" {
+			dep.RecreateRequired = true
+		}
+		return nil
+	})
+	return err
+}
@@ -0,0 +1,760 @@
+// Package fakedocker is an in-memory container engine implementing deployment.ContainerRuntime. It keeps the
+// networks, images, containers and volumes in maps, streams build output the way the docker engine does, or podman
+// when SetInfo reports podman, and fails the calls it is told to fail, so the deployment handlers can be tested
+// without docker.
+package fakedocker
+
+import (
+	"GDHost/internal/deployment"
+	"GDHost/internal/model"
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/docker/docker/api/types"
+	ct "github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/events"
+	"github.com/docker/docker/api/types/network"
+	"github.com/docker/docker/api/types/volume"
+	"github.com/docker/docker/errdefs"
+	"github.com/docker/docker/pkg/jsonmessage"
+	"github.com/rs/zerolog"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type container struct {
+	id       string
+	spec     deployment.ContainerSpec
+	image    string
+	running  bool
+	exitCode int
+	started  time.Time
+	networks map[string]string
+	logs     string
+}
+
+// Engine is the fake engine, it is safe for concurrent use
+type Engine struct {
+	mu         sync.Mutex
+	network    string
+	networks   map[string]map[string]bool
+	images     map[string]string
+	containers map[string]*container
+	volumes    map[string]string
+	failures   map[string]error
+	buildError string
+	nextIP     int
+	watchers   map[chan events.Message]struct{}
+	info       deployment.RuntimeInfo
+	closed     int
+}
+
+var _ deployment.ContainerRuntime = (*Engine)(nil)
+
+// New creates an empty engine which names the networks of the deployments after network
+func New(network string) *Engine {
+	return &Engine{
+		network:    network,
+		networks:   map[string]map[string]bool{},
+		images:     map[string]string{},
+		containers: map[string]*container{},
+		volumes:    map[string]string{},
+		failures:   map[string]error{},
+		watchers:   map[chan events.Message]struct{}{},
+		info: deployment.RuntimeInfo{
+			Engine:     "docker",
+			Version:    "fake",
+			APIVersion: "1.44",
+			Host:       "fake://",
+		},
+	}
+}
+
+// SetInfo changes the engine reported to the deployment controller, e.g. to a rootless podman.
+// It must be set before the controller is created.
+func (e *Engine) SetInfo(info deployment.RuntimeInfo) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.info = info
+}
+
+// Fail makes every call of the ContainerRuntime method op return err, a nil err clears the failure
+func (e *Engine) Fail(op string, err error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if err == nil {
+		delete(e.failures, op)
+		return
+	}
+	e.failures[op] = err
+}
+
+// FailBuild makes the builds report message in the build output instead of tagging an image,
+// an empty message lets them succeed again
+func (e *Engine) FailBuild(message string) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.buildError = message
+}
+
+// Crash stops a running container with the exit code and emits the die event
+func (e *Engine) Crash(containerId string, exitCode int) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	c, ok := e.containers[containerId]
+	if !ok || !c.running {
+		return errdefs.NotFound(fmt.Errorf("no running container: %s", containerId))
+	}
+	c.running = false
+	c.exitCode = exitCode
+	e.emit(c, events.ActionDie, map[string]string{"exitCode": strconv.Itoa(exitCode)})
+	return nil
+}
+
+// SetLogs replaces the output returned by the logs of the container
+func (e *Engine) SetLogs(containerId string, logs string) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	c, ok := e.containers[containerId]
+	if !ok {
+		return errdefs.NotFound(fmt.Errorf("no such container: %s", containerId))
+	}
+	c.logs = logs
+	return nil
+}
+
+// HasImage reports whether the image id or tag exists
+func (e *Engine) HasImage(ref string) bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	_, ok := e.image(ref)
+	return ok
+}
+
+// HasContainer reports whether the container exists and whether it is running
+func (e *Engine) HasContainer(containerId string) (exists bool, running bool) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	c, ok := e.containers[containerId]
+	if !ok {
+		return false, false
+	}
+	return true, c.running
+}
+
+// Containers returns the ids of the containers of the deployment
+func (e *Engine) Containers(depId string) []string {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	var ids []string
+	for id, c := range e.containers {
+		if c.spec.DeploymentId == depId {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+// HasNetwork reports whether the network of the deployment exists
+func (e *Engine) HasNetwork(depId string) bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	_, ok := e.networks[e.NetworkName(depId)]
+	return ok
+}
+
+// HasVolume reports whether the volume exists
+func (e *Engine) HasVolume(name string) bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	_, ok := e.volumes[name]
+	return ok
+}
+
+// failure returns the error set for op by Fail, the lock must be held
+func (e *Engine) failure(op string) error {
+	return e.failures[op]
+}
+
+// image resolves an image id or tag to the image id, the lock must be held
+func (e *Engine) image(ref string) (string, bool) {
+	if id, ok := e.images[ref]; ok {
+		return id, true
+	}
+	for _, id := range e.images {
+		if id == ref {
+			return id, true
+		}
+	}
+	return "", false
+}
+
+// emit sends the event to the watchers without waiting for them, the lock must be held
+func (e *Engine) emit(c *container, action events.Action, attrs map[string]string) {
+	if attrs == nil {
+		attrs = map[string]string{}
+	}
+	attrs["name"] = c.spec.Name
+	msg := events.Message{
+		Type:     events.ContainerEventType,
+		Action:   action,
+		Actor:    events.Actor{ID: c.id, Attributes: attrs},
+		TimeNano: time.Now().UnixNano(),
+	}
+	for w := range e.watchers {
+		select {
+		case w <- msg:
+		default:
+		}
+	}
+}
+
+func randomId() string {
+	b := make([]byte, 32)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func (e *Engine) NetworkName(depId string) string {
+	return e.network + "-" + depId
+}
+
+func (e *Engine) EnsureNetwork(ctx context.Context, depId string) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if err := e.failure("EnsureNetwork"); err != nil {
+		return err
+	}
+	name := e.NetworkName(depId)
+	if _, ok := e.networks[name]; !ok {
+		e.networks[name] = map[string]bool{}
+	}
+	return nil
+}
+
+func (e *Engine) RemoveNetwork(ctx context.Context, depId string) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if err := e.failure("RemoveNetwork"); err != nil {
+		return err
+	}
+	name := e.NetworkName(depId)
+	for cid := range e.networks[name] {
+		if c, ok := e.containers[cid]; ok {
+			delete(c.networks, name)
+		}
+	}
+	delete(e.networks, name)
+	return nil
+}
+
+func (e *Engine) ConnectNetwork(ctx context.Context, depId string, containerId string) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if err := e.failure("ConnectNetwork"); err != nil {
+		return err
+	}
+	c, ok := e.containers[containerId]
+	if !ok {
+		return errdefs.NotFound(fmt.Errorf("no such container: %s", containerId))
+	}
+	return e.connect(c, e.NetworkName(depId))
+}
+
+// connect attaches the container to the network with the next free address, the lock must be held
+func (e *Engine) connect(c *container, name string) error {
+	members, ok := e.networks[name]
+	if !ok {
+		return errdefs.NotFound(fmt.Errorf("network %s not found", name))
+	}
+	if _, ok = c.networks[name]; ok {
+		return nil
+	}
+	e.nextIP++
+	members[c.id] = true
+	c.networks[name] = fmt.Sprintf("172.30.%d.%d", e.nextIP/250, e.nextIP%250+2)
+	return nil
+}
+
+func (e *Engine) DisconnectNetwork(ctx context.Context, depId string, containerId string) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if err := e.failure("DisconnectNetwork"); err != nil {
+		return err
+	}
+	name := e.NetworkName(depId)
+	delete(e.networks[name], containerId)
+	if c, ok := e.containers[containerId]; ok {
+		delete(c.networks, name)
+	}
+	return nil
+}
+
+// BuildImage streams a step for every instruction of the dockerfile in path and tags the image,
+// the stream ends with the error set by FailBuild instead
+func (e *Engine) BuildImage(ctx context.Context, tags []string, path string, logger zerolog.Logger) (io.ReadCloser, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if err := e.failure("BuildImage"); err != nil {
+		return nil, fmt.Errorf("failed to build image: %w", err)
+	}
+
+	f, err := os.Open(filepath.Join(path, "Dockerfile"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to build image: %w", errdefs.InvalidParameter(err))
+	}
+	defer func() {
+		if err2 := f.Close(); err2 != nil {
+			logger.Error().Err(err2).Msg("failed to close dockerfile")
+		}
+	}()
+
+	var steps []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line != "" && !strings.HasPrefix(line, "#") {
+			steps = append(steps, line)
+		}
+	}
+	if err = scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to build image: %w", err)
+	}
+
+	if e.info.Engine == "podman" {
+		return e.podmanBuild(tags, steps), nil
+	}
+
+	var out bytes.Buffer
+	enc := json.NewEncoder(&out)
+	for i, step := range steps {
+		_ = enc.Encode(jsonmessage.JSONMessage{Stream: fmt.Sprintf("Step %d/%d : %s\n", i+1, len(steps), step)})
+	}
+	if e.buildError != "" {
+		_ = enc.Encode(jsonmessage.JSONMessage{
+			Error:        &jsonmessage.JSONError{Code: 1, Message: e.buildError},
+			ErrorMessage: e.buildError,
+		})
+		return io.NopCloser(&out), nil
+	}
+
+	id := randomId()
+	aux := json.RawMessage(`{"ID":"sha256:` + id + `"}`)
+	_ = enc.Encode(jsonmessage.JSONMessage{Aux: &aux})
+	_ = enc.Encode(jsonmessage.JSONMessage{Stream: "Successfully built " + id[:12] + "\n"})
+	for _, tag := range tags {
+		e.images[tag] = id
+		_ = enc.Encode(jsonmessage.JSONMessage{Stream: "Successfully tagged " + tag + "\n"})
+	}
+	return io.NopCloser(&out), nil
+}
+
+// podmanBuild streams the output the podman compat api writes. The messages only have stream or error, a step is
+// split over two messages and the error set by FailBuild is a plain text line. The lock must be held.
+func (e *Engine) podmanBuild(tags []string, steps []string) io.ReadCloser {
+	type message struct {
+		Stream string `json:"stream,omitempty"`
+		Error  string `json:"error,omitempty"`
+	}
+	var out bytes.Buffer
+	enc := json.NewEncoder(&out)
+	for i, step := range steps {
+		_ = enc.Encode(message{Stream: fmt.Sprintf("STEP %d/%d: ", i+1, len(steps))})
+		_ = enc.Encode(message{Stream: step + "\n"})
+	}
+	if e.buildError != "" {
+		out.WriteString("Error: " + e.buildError + "\n")
+		return io.NopCloser(&out)
+	}
+
+	id := randomId()
+	_ = enc.Encode(message{Stream: "COMMIT " + tags[0] + "\n"})
+	_ = enc.Encode(message{Stream: "--> " + id[:12] + "\n"})
+	for _, tag := range tags {
+		e.images[tag] = id
+		_ = enc.Encode(message{Stream: "Successfully tagged localhost/" + tag + "\n"})
+	}
+	_ = enc.Encode(message{Stream: id + "\n"})
+	return io.NopCloser(&out)
+}
+
+func (e *Engine) ImageId(ctx context.Context, name string) (string, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if err := e.failure("ImageId"); err != nil {
+		return "", err
+	}
+	id, ok := e.image(name)
+	if !ok {
+		return "", errdefs.NotFound(fmt.Errorf("no such image: %s", name))
+	}
+	return id, nil
+}
+
+// DeleteImage removes every tag of the image, like a forced removal
+func (e *Engine) DeleteImage(ctx context.Context, imageId string) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if err := e.failure("DeleteImage"); err != nil {
+		return err
+	}
+	id, ok := e.image(imageId)
+	if !ok {
+		return errdefs.NotFound(fmt.Errorf("no such image: %s", imageId))
+	}
+	for tag, tagged := range e.images {
+		if tagged == id {
+			delete(e.images, tag)
+		}
+	}
+	return nil
+}
+
+// savedImage is the archive SaveImage exports
+type savedImage struct {
+	Id   string   `json:"id"`
+	Tags []string `json:"tags"`
+}
+
+// SaveImage exports the image with its tags as json instead of a tar archive
+func (e *Engine) SaveImage(ctx context.Context, ref string) (io.ReadCloser, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if err := e.failure("SaveImage"); err != nil {
+		return nil, err
+	}
+	id, ok := e.image(ref)
+	if !ok {
+		return nil, errdefs.NotFound(fmt.Errorf("no such image: %s", ref))
+	}
+	saved := savedImage{Id: id}
+	for tag, tagged := range e.images {
+		if tagged == id {
+			saved.Tags = append(saved.Tags, tag)
+		}
+	}
+	b, err := json.Marshal(saved)
+	if err != nil {
+		return nil, err
+	}
+	return io.NopCloser(bytes.NewReader(b)), nil
+}
+
+// LoadImage imports an image exported by SaveImage of any fake engine
+func (e *Engine) LoadImage(ctx context.Context, image io.Reader) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if err := e.failure("LoadImage"); err != nil {
+		return err
+	}
+	var saved savedImage
+	if err := json.NewDecoder(image).Decode(&saved); err != nil {
+		return errdefs.InvalidParameter(fmt.Errorf("invalid image archive: %w", err))
+	}
+	for _, tag := range saved.Tags {
+		e.images[tag] = saved.Id
+	}
+	if len(saved.Tags) == 0 {
+		e.images[saved.Id] = saved.Id
+	}
+	return nil
+}
+
+func (e *Engine) CreateContainer(ctx context.Context, spec deployment.ContainerSpec) (string, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if err := e.failure("CreateContainer"); err != nil {
+		return "", fmt.Errorf("failed to create container: %w", err)
+	}
+	if e.info.Rootless {
+		for _, p := range spec.Ports {
+			if p.HostPort < e.info.UnprivilegedPortStart {
+				return "", fmt.Errorf("failed to create container: rootlessport cannot expose privileged port %d", p.HostPort)
+			}
+		}
+	}
+	image, ok := e.image(spec.Image)
+	if !ok {
+		return "", fmt.Errorf("failed to create container: %w", errdefs.NotFound(fmt.Errorf("no such image: %s", spec.Image)))
+	}
+	for _, c := range e.containers {
+		if c.spec.Name == spec.Name {
+			return "", fmt.Errorf("failed to create container: %w",
+				errdefs.Conflict(fmt.Errorf("the container name %q is already in use", spec.Name)))
+		}
+	}
+
+	c := &container{
+		id:       randomId(),
+		spec:     spec,
+		image:    image,
+		networks: map[string]string{},
+	}
+	for _, depId := range append([]string{spec.DeploymentId}, spec.Links...) {
+		if err := e.connect(c, e.NetworkName(depId)); err != nil {
+			for name := range c.networks {
+				delete(e.networks[name], c.id)
+			}
+			return "", fmt.Errorf("failed to create container: %w", err)
+		}
+	}
+	e.containers[c.id] = c
+	return c.id, nil
+}
+
+func (e *Engine) StartContainer(ctx context.Context, containerId string) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if err := e.failure("StartContainer"); err != nil {
+		return err
+	}
+	c, ok := e.containers[containerId]
+	if !ok {
+		return errdefs.NotFound(fmt.Errorf("no such container: %s", containerId))
+	}
+	if c.running {
+		return nil
+	}
+	c.running = true
+	c.exitCode = 0
+	c.started = time.Now()
+	e.emit(c, events.ActionStart, nil)
+	return nil
+}
+
+func (e *Engine) StopContainer(ctx context.Context, containerId string) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if err := e.failure("StopContainer"); err != nil {
+		return err
+	}
+	c, ok := e.containers[containerId]
+	if !ok {
+		return errdefs.NotFound(fmt.Errorf("no such container: %s", containerId))
+	}
+	if !c.running {
+		return nil
+	}
+	c.running = false
+	c.exitCode = 143
+	e.emit(c, events.ActionDie, map[string]string{"exitCode": "143"})
+	e.emit(c, events.ActionStop, nil)
+	return nil
+}
+
+// RemoveContainer refuses to remove a running container, like the docker engine without force
+func (e *Engine) RemoveContainer(ctx context.Context, containerId string) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if err := e.failure("RemoveContainer"); err != nil {
+		return err
+	}
+	c, ok := e.containers[containerId]
+	if !ok {
+		return errdefs.NotFound(fmt.Errorf("no such container: %s", containerId))
+	}
+	if c.running {
+		return errdefs.Conflict(fmt.Errorf("cannot remove running container %s", containerId))
+	}
+	for name := range c.networks {
+		delete(e.networks[name], c.id)
+	}
+	delete(e.containers, containerId)
+	e.emit(c, events.ActionDestroy, nil)
+	return nil
+}
+
+func (e *Engine) InspectContainer(ctx context.Context, containerId string) (types.ContainerJSON, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if err := e.failure("InspectContainer"); err != nil {
+		return types.ContainerJSON{}, err
+	}
+	c, ok := e.containers[containerId]
+	if !ok {
+		return types.ContainerJSON{}, errdefs.NotFound(fmt.Errorf("no such container: %s", containerId))
+	}
+
+	state := &types.ContainerState{
+		Status:   "exited",
+		Running:  c.running,
+		ExitCode: c.exitCode,
+	}
+	if c.running {
+		state.Status = "running"
+		state.StartedAt = c.started.Format(time.RFC3339Nano)
+		if c.spec.HealthCheck != nil {
+			state.Health = &types.Health{Status: types.Healthy}
+		}
+	}
+	networks := make(map[string]*network.EndpointSettings, len(c.networks))
+	for name, ip := range c.networks {
+		networks[name] = &network.EndpointSettings{IPAddress: ip}
+	}
+	return types.ContainerJSON{
+		ContainerJSONBase: &types.ContainerJSONBase{
+			ID:    c.id,
+			Name:  "/" + c.spec.Name,
+			Image: "sha256:" + c.image,
+			State: state,
+		},
+		Config: &ct.Config{
+			Image: c.spec.Image,
+			Env:   c.spec.Env,
+			Labels: map[string]string{
+				"gdhost.deployment": c.spec.DeploymentId,
+			},
+		},
+		NetworkSettings: &types.NetworkSettings{Networks: networks},
+	}, nil
+}
+
+// ContainerLogs returns the output set by SetLogs, it does not follow
+func (e *Engine) ContainerLogs(ctx context.Context, containerId string) (io.ReadCloser, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if err := e.failure("ContainerLogs"); err != nil {
+		return nil, err
+	}
+	c, ok := e.containers[containerId]
+	if !ok {
+		return nil, errdefs.NotFound(fmt.Errorf("no such container: %s", containerId))
+	}
+	return io.NopCloser(strings.NewReader(c.logs)), nil
+}
+
+// ContainerEvents streams the events of the containers until the context is cancelled
+func (e *Engine) ContainerEvents(ctx context.Context) (<-chan events.Message, <-chan error) {
+	msgs := make(chan events.Message, 64)
+	errs := make(chan error, 1)
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if err := e.failure("ContainerEvents"); err != nil {
+		errs <- err
+		return msgs, errs
+	}
+	e.watchers[msgs] = struct{}{}
+	go func() {
+		<-ctx.Done()
+		e.mu.Lock()
+		delete(e.watchers, msgs)
+		e.mu.Unlock()
+		errs <- ctx.Err()
+	}()
+	return msgs, errs
+}
+
+func (e *Engine) UpdateRestartPolicy(ctx context.Context, containerId string, policy model.RestartPolicy) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if err := e.failure("UpdateRestartPolicy"); err != nil {
+		return err
+	}
+	c, ok := e.containers[containerId]
+	if !ok {
+		return errdefs.NotFound(fmt.Errorf("no such container: %s", containerId))
+	}
+	c.spec.RestartPolicy = policy
+	return nil
+}
+
+func (e *Engine) UpdateResources(ctx context.Context, containerId string, res model.Resources) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if err := e.failure("UpdateResources"); err != nil {
+		return err
+	}
+	c, ok := e.containers[containerId]
+	if !ok {
+		return errdefs.NotFound(fmt.Errorf("no such container: %s", containerId))
+	}
+	res.Ulimits = c.spec.Resources.Ulimits
+	c.spec.Resources = res
+	return nil
+}
+
+func (e *Engine) CreateVolume(ctx context.Context, name string, depId string) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if err := e.failure("CreateVolume"); err != nil {
+		return err
+	}
+	if _, ok := e.volumes[name]; !ok {
+		e.volumes[name] = depId
+	}
+	return nil
+}
+
+// RemoveVolume refuses to remove a volume mounted by a container
+func (e *Engine) RemoveVolume(ctx context.Context, name string) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if err := e.failure("RemoveVolume"); err != nil {
+		return err
+	}
+	if _, ok := e.volumes[name]; !ok {
+		return errdefs.NotFound(fmt.Errorf("get %s: no such volume", name))
+	}
+	for _, c := range e.containers {
+		for _, v := range c.spec.Volumes {
+			if v.Source == name {
+				return errdefs.Conflict(fmt.Errorf("remove %s: volume is in use - [%s]", name, c.id))
+			}
+		}
+	}
+	delete(e.volumes, name)
+	return nil
+}
+
+func (e *Engine) Info() deployment.RuntimeInfo {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.info
+}
+
+// Close counts the closes, the engine stays usable since a node dialled again gets the same engine
+func (e *Engine) Close() error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.closed++
+	return nil
+}
+
+// Closed returns the number of times the engine was closed
+func (e *Engine) Closed() int {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.closed
+}
+
+// VolumeUsage reports every volume as empty, the reference count is the number of containers mounting it
+func (e *Engine) VolumeUsage(ctx context.Context) (map[string]*volume.UsageData, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if err := e.failure("VolumeUsage"); err != nil {
+		return nil, err
+	}
+	usage := make(map[string]*volume.UsageData, len(e.volumes))
+	for name := range e.volumes {
+		data := &volume.UsageData{}
+		for _, c := range e.containers {
+			for _, v := range c.spec.Volumes {
+				if v.Source == name {
+					data.RefCount++
+				}
+			}
+		}
+		usage[name] = data
+	}
+	return usage, nil
+}
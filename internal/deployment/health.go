@@ -0,0 +1,371 @@
+package deployment
+
+import (
+	"GDHost/internal/database"
+	"GDHost/internal/model"
+	"GDHost/internal/response"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/docker/docker/api/types"
+	"github.com/gin-contrib/requestid"
+	"github.com/gin-gonic/gin"
+	"github.com/go-playground/validator/v10"
+	"net"
+	"net/http"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	healthCheckHTTP    = "http"
+	healthCheckCommand = "command"
+
+	healthMonitorInterval = time.Second
+	healthOutputLimit     = 512
+
+	defaultHealthInterval = 30
+	defaultHealthCheckTTL = 5
+	defaultHealthRetries  = 3
+)
+
+// errHealthPort is returned for an http or tcp health check without a port when the deployment has no tcp mapping
+var errHealthPort = errors.New("health check needs a port, the deployment has no tcp port mapping")
+
+type HealthCheckReq struct {
+	Type        string `json:"type" validate:"required,oneof=http tcp command"`
+	Path        string `json:"path,omitempty" validate:"required_if=Type http,omitempty,startswith=/"`
+	Port        int    `json:"port,omitempty" validate:"omitempty,min=1,max=65535"`
+	Command     string `json:"command,omitempty" validate:"required_if=Type command"`
+	Interval    int    `json:"interval,omitempty" validate:"omitempty,min=1,max=3600"`
+	Timeout     int    `json:"timeout,omitempty" validate:"omitempty,min=1,max=60"`
+	Retries     int    `json:"retries,omitempty" validate:"omitempty,min=1,max=100"`
+	StartPeriod int    `json:"start_period,omitempty" validate:"omitempty,min=0,max=3600"`
+}
+
+func (req *HealthCheckReq) healthCheck() *model.HealthCheck {
+	hc := &model.HealthCheck{
+		Type:        req.Type,
+		Path:        req.Path,
+		Port:        req.Port,
+		Command:     req.Command,
+		Interval:    req.Interval,
+		Timeout:     req.Timeout,
+		Retries:     req.Retries,
+		StartPeriod: req.StartPeriod,
+	}
+	if hc.Interval == 0 {
+		hc.Interval = defaultHealthInterval
+	}
+	if hc.Timeout == 0 {
+		hc.Timeout = defaultHealthCheckTTL
+	}
+	if hc.Retries == 0 {
+		hc.Retries = defaultHealthRetries
+	}
+	return hc
+}
+
+// checkHealthPort returns errHealthPort when the http or tcp health check has no port and the mappings no tcp port
+// to fall back to. A deployment without mappings was never run, its ports are checked on run.
+func checkHealthPort(hc *model.HealthCheck, ports []model.Port) error {
+	if hc == nil || hc.Type == healthCheckCommand || hc.Port != 0 || len(ports) == 0 {
+		return nil
+	}
+	if _, ok := primaryPort(ports); !ok {
+		return errHealthPort
+	}
+	return nil
+}
+
+// checkHealth connects to the address, or requests the path when given, and returns the probe output.
+// Any status below 500 is healthy.
+func checkHealth(ctx context.Context, hc *http.Client, addr string, path string) (string, error) {
+	if path == "" {
+		conn, err := net.DialTimeout("tcp", addr, hc.Timeout)
+		if err != nil {
+			return "", err
+		}
+		return "connected to " + addr, conn.Close()
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://"+addr+path, nil)
+	if err != nil {
+		return "", err
+	}
+	resp, err := hc.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= http.StatusInternalServerError {
+		return "", fmt.Errorf("unhealthy status: %s", resp.Status)
+	}
+	return "HTTP " + resp.Status, nil
+}
+
+// startHealthMonitor probes the health checks of the deployments with a container until the context is cancelled
+func (d *deployment) startHealthMonitor(ctx context.Context) {
+	d.wg.Add(1)
+	go func() {
+		defer d.wg.Done()
+
+		var mu sync.Mutex
+		next := make(map[string]time.Time)
+		ticker := time.NewTicker(healthMonitorInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				d.probeDeployments(ctx, &mu, next)
+			}
+		}
+	}()
+}
+
+// probeDeployments starts the probes which are due. A probe is not due again before it finished.
+func (d *deployment) probeDeployments(ctx context.Context, mu *sync.Mutex, next map[string]time.Time) {
+	deps, err := d.db.ListDeployments(ctx, database.DeploymentQuery{HealthChecked: true})
+	if err != nil {
+		d.logger.Error().Err(err).Msg("failed to find deployments to probe")
+		return
+	}
+
+	now := time.Now()
+	mu.Lock()
+	defer mu.Unlock()
+	for _, dep := range deps {
+		if now.Before(next[dep.Id]) {
+			continue
+		}
+		// far enough in the future until the probe finished and schedules the next one
+		next[dep.Id] = now.Add(time.Hour)
+
+		dep := dep
+		d.wg.Add(1)
+		go func() {
+			defer d.wg.Done()
+			d.probeDeployment(ctx, &dep)
+
+			mu.Lock()
+			next[dep.Id] = time.Now().Add(time.Duration(dep.HealthCheck.Interval) * time.Second)
+			mu.Unlock()
+		}()
+	}
+}
+
+// probeDeployment runs the health check of the deployment and stores the result
+func (d *deployment) probeDeployment(ctx context.Context, dep *model.Deployment) {
+	rt, err := d.runtime(ctx, placedNode(dep))
+	if err != nil {
+		d.logger.Error().Err(err).Str("deployment_id", dep.Id).Msg("failed to find node for health check")
+		return
+	}
+	inspect, err := rt.InspectContainer(ctx, dep.ContainerId)
+	if err != nil {
+		d.logger.Error().Err(err).Str("deployment_id", dep.Id).Msg("failed to inspect container for health check")
+		return
+	}
+
+	addr := func(port int) string {
+		return d.containerAddr(ctx, dep, inspect, port)
+	}
+	health := nextHealth(ctx, dep, inspect, addr, time.Now(), d.probe)
+	err = d.updateContainerDeployment(ctx, dep.ContainerId, func(dep *model.Deployment) error {
+		dep.Health = health
+		return nil
+	})
+	if err != nil {
+		d.logger.Error().Err(err).Str("deployment_id", dep.Id).Msg("failed to store health")
+	}
+}
+
+// probe runs an http or tcp health check against the container
+func (d *deployment) probe(ctx context.Context, hc *model.HealthCheck, addr string) (string, error) {
+	timeout := time.Duration(hc.Timeout) * time.Second
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	path := ""
+	if hc.Type == healthCheckHTTP {
+		path = hc.Path
+	}
+	return checkHealth(ctx, &http.Client{Timeout: timeout}, addr, path)
+}
+
+type prober func(ctx context.Context, hc *model.HealthCheck, addr string) (string, error)
+
+// nextHealth returns the health after the probe. Command checks report the health docker keeps,
+// failures of http and tcp checks only count after the start period. addr returns the address a container port
+// is probed at.
+func nextHealth(ctx context.Context, dep *model.Deployment, inspect types.ContainerJSON, addr func(port int) string,
+	now time.Time, probe prober) *model.Health {
+	hc := dep.HealthCheck
+	health := &model.Health{CheckedAt: now}
+	if inspect.State == nil || !inspect.State.Running {
+		health.Status = model.HealthUnhealthy
+		health.Output = "container is not running"
+		return health
+	}
+
+	if hc.Type == healthCheckCommand {
+		if inspect.State.Health == nil {
+			health.Status = model.HealthStarting
+			health.Output = "no docker healthcheck, recreate the container"
+			return health
+		}
+		switch inspect.State.Health.Status {
+		case types.Healthy:
+			health.Status = model.HealthHealthy
+		case types.Unhealthy:
+			health.Status = model.HealthUnhealthy
+		default:
+			health.Status = model.HealthStarting
+		}
+		health.Failures = inspect.State.Health.FailingStreak
+		if n := len(inspect.State.Health.Log); n > 0 {
+			health.Output = truncateOutput(inspect.State.Health.Log[n-1].Output)
+		}
+		return health
+	}
+
+	// the previous result belongs to an earlier run of the container when it is older than the start
+	startedAt, _ := time.Parse(time.RFC3339Nano, inspect.State.StartedAt)
+	prev := dep.Health
+	if prev == nil || prev.CheckedAt.Before(startedAt) {
+		prev = &model.Health{Status: model.HealthStarting}
+	}
+
+	port := hc.Port
+	if port == 0 {
+		port = dep.ContainerPort
+	}
+	// a deployment with udp mappings only has no port to probe, the check is rejected since then
+	if port == 0 {
+		health.Status = model.HealthUnhealthy
+		health.Output = errHealthPort.Error()
+		return health
+	}
+	output, err := probe(ctx, hc, addr(port))
+	if err == nil {
+		health.Status = model.HealthHealthy
+		health.Output = truncateOutput(output)
+		return health
+	}
+
+	health.Output = truncateOutput(err.Error())
+	if now.Before(startedAt.Add(time.Duration(hc.StartPeriod) * time.Second)) {
+		health.Status = model.HealthStarting
+		return health
+	}
+	health.Failures = prev.Failures + 1
+	health.Status = prev.Status
+	if health.Failures >= hc.Retries {
+		health.Status = model.HealthUnhealthy
+	}
+	return health
+}
+
+func truncateOutput(output string) string {
+	output = strings.TrimSpace(output)
+	if len(output) > healthOutputLimit {
+		return output[:healthOutputLimit]
+	}
+	return output
+}
+
+func (d *deployment) UpdateHealthCheck(c *gin.Context) {
+	logger := d.logger.With().Str("request_id", requestid.Get(c)).Logger()
+
+	depId := c.Param("id")
+	if depId == "" {
+		logger.Error().Msg("no deployment id")
+		response.StatusBadRequest(c, "no deployment id")
+		return
+	}
+
+	var req HealthCheckReq
+	if err := c.BindJSON(&req); err != nil {
+		logger.Error().Err(err).Msg("failed to bind request")
+		response.StatusBadRequest(c, "failed to bind request")
+		return
+	}
+	if err := validator.New().Struct(req); err != nil {
+		logger.Error().Err(err).Msg("request validation error")
+		response.StatusBadRequest(c, err.Error())
+		return
+	}
+
+	hc := req.healthCheck()
+	if err := d.updateHealthCheck(c.Request.Context(), depId, hc); err != nil {
+		if errors.Is(err, database.ErrNotFound) {
+			logger.Error().Err(err).Str("deployment_id", depId).Msg("deployment not found")
+			response.StatusNotFound(c, "deployment not found")
+			return
+		}
+		if errors.Is(err, errHealthPort) {
+			logger.Error().Err(err).Str("deployment_id", depId).Msg("no port to probe")
+			response.StatusBadRequest(c, err.Error())
+			return
+		}
+		logger.Error().Err(err).Str("deployment_id", depId).Msg("failed to update health check")
+		response.StatusInternalServerError(c)
+		return
+	}
+
+	logger.Info().Str("deployment_id", depId).Str("type", hc.Type).Msg("health check updated")
+	response.StatusCommonOK(c, "health check updated")
+	return
+}
+
+func (d *deployment) DeleteHealthCheck(c *gin.Context) {
+	logger := d.logger.With().Str("request_id", requestid.Get(c)).Logger()
+
+	depId := c.Param("id")
+	if depId == "" {
+		logger.Error().Msg("no deployment id")
+		response.StatusBadRequest(c, "no deployment id")
+		return
+	}
+
+	if err := d.updateHealthCheck(c.Request.Context(), depId, nil); err != nil {
+		if errors.Is(err, database.ErrNotFound) {
+			logger.Error().Err(err).Str("deployment_id", depId).Msg("health check not found")
+			response.StatusNotFound(c, "health check not found")
+			return
+		}
+		logger.Error().Err(err).Str("deployment_id", depId).Msg("failed to delete health check")
+		response.StatusInternalServerError(c)
+		return
+	}
+
+	logger.Info().Str("deployment_id", depId).Msg("health check deleted")
+	response.StatusCommonOK(c, "health check deleted")
+	return
+}
+
+// updateHealthCheck sets the health check, nil deletes it, and flags the deployment for a container recreate when
+// the docker healthcheck of an existing container changes. It returns database.ErrNotFound when the deployment does
+// not exist or there is no health check to delete.
+func (d *deployment) updateHealthCheck(ctx context.Context, depId string, hc *model.HealthCheck) error {
+	_, err := d.db.UpdateDeployment(ctx, depId, func(dep *model.Deployment) error {
+		if hc == nil && dep.HealthCheck == nil {
+			return database.ErrNotFound
+		}
+		if err := checkHealthPort(hc, dep.PortMappings()); err != nil {
+			return err
+		}
+		if dep.ContainerId != "" && !reflect.DeepEqual(dockerHealthcheck(dep.HealthCheck), dockerHealthcheck(hc)) {
+			dep.RecreateRequired = true
+		}
+		dep.UpdatedAt = time.Now()
+		dep.HealthCheck = hc
+		dep.Health = nil
+		return nil
+	})
+	return err
+}
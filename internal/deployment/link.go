@@ -0,0 +1,253 @@
+package deployment
+
+import (
+	"GDHost/internal/database"
+	"GDHost/internal/model"
+	"GDHost/internal/response"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/gin-contrib/requestid"
+	"github.com/gin-gonic/gin"
+	"github.com/go-playground/validator/v10"
+	"slices"
+	"time"
+)
+
+type LinkReq struct {
+	DeploymentId string `json:"deployment_id" validate:"required"`
+}
+
+// networkAliases are the names a deployment is reached by from the deployments linked to it.
+// The id always works, the name only when it is a valid hostname.
+func networkAliases(dep *model.Deployment) []string {
+	aliases := []string{dep.Id}
+	if hostnameRegex.MatchString(dep.Name) {
+		aliases = append(aliases, dep.Name)
+	}
+	return aliases
+}
+
+// removeLink returns the links without the deployment id
+func removeLink(links []string, depId string) []string {
+	return slices.DeleteFunc(links, func(link string) bool {
+		return link == depId
+	})
+}
+
+// prepareNetworks creates the network of the deployment and the networks of the deployments it is linked to
+func prepareNetworks(ctx context.Context, rt ContainerRuntime, dep *model.Deployment) error {
+	if err := rt.EnsureNetwork(ctx, dep.Id); err != nil {
+		return fmt.Errorf("failed to create network: %w", err)
+	}
+	for _, link := range dep.Links {
+		if err := rt.EnsureNetwork(ctx, link); err != nil {
+			return fmt.Errorf("failed to create network of %s: %w", link, err)
+		}
+	}
+	return nil
+}
+
+// unlinkDeployment removes the deleted deployment from the links of the others, its network is removed once
+// the delete committed
+func (d *deployment) unlinkDeployment(ctx context.Context, depId string) error {
+	linked, err := d.db.ListDeployments(ctx, database.DeploymentQuery{LinkedTo: depId})
+	if err != nil {
+		return fmt.Errorf("failed to find linked deployments: %w", err)
+	}
+	for _, dep := range linked {
+		_, err = d.db.UpdateDeployment(ctx, dep.Id, func(dep *model.Deployment) error {
+			dep.Links = removeLink(dep.Links, depId)
+			return nil
+		})
+		if err != nil && !errors.Is(err, database.ErrNotFound) {
+			return fmt.Errorf("failed to remove link of %s: %w", dep.Id, err)
+		}
+	}
+	return nil
+}
+
+func (d *deployment) CreateLink(c *gin.Context) {
+	logger := d.logger.With().Str("request_id", requestid.Get(c)).Logger()
+
+	depId := c.Param("id")
+	if depId == "" {
+		logger.Error().Msg("no deployment id")
+		response.StatusBadRequest(c, "no deployment id")
+		return
+	}
+
+	var req LinkReq
+	if err := c.BindJSON(&req); err != nil {
+		logger.Error().Err(err).Msg("failed to bind request")
+		response.StatusBadRequest(c, "failed to bind request")
+		return
+	}
+	if err := validator.New().Struct(req); err != nil {
+		logger.Error().Err(err).Msg("request validation error")
+		response.StatusBadRequest(c, err.Error())
+		return
+	}
+	if req.DeploymentId == depId {
+		logger.Error().Str("deployment_id", depId).Msg("deployment linked to itself")
+		response.StatusBadRequest(c, "a deployment can not be linked to itself")
+		return
+	}
+
+	ctx := c.Request.Context()
+	linked, err := d.db.GetDeployment(ctx, req.DeploymentId)
+	if err != nil {
+		if errors.Is(err, database.ErrNotFound) {
+			logger.Error().Err(err).Str("deployment_id", depId).Str("link", req.DeploymentId).Msg("linked deployment not found")
+			response.StatusUnProcessed(c, "linked deployment not found")
+			return
+		}
+		logger.Error().Err(err).Str("deployment_id", depId).Msg("failed to find linked deployment")
+		response.StatusInternalServerError(c)
+		return
+	}
+
+	// linked deployments share a network, which only exists on one engine
+	dep, err := d.db.UpdateDeployment(ctx, depId, func(dep *model.Deployment) error {
+		if node, other := placedNode(dep), placedNode(linked); node != "" && other != "" && node != other {
+			return fmt.Errorf("%w: the deployment runs on node %s and the linked deployment on node %s", errNoNode, node, other)
+		}
+		dep.UpdatedAt = time.Now()
+		if !slices.Contains(dep.Links, req.DeploymentId) {
+			dep.Links = append(dep.Links, req.DeploymentId)
+		}
+		return nil
+	})
+	if err != nil {
+		if errors.Is(err, database.ErrNotFound) {
+			logger.Error().Err(err).Str("deployment_id", depId).Msg("deployment not found")
+			response.StatusNotFound(c, "deployment not found")
+			return
+		}
+		if errors.Is(err, errNoNode) {
+			logger.Error().Err(err).Str("deployment_id", depId).Str("link", req.DeploymentId).Msg("deployments on different nodes")
+			response.StatusUnProcessed(c, err.Error())
+			return
+		}
+		logger.Error().Err(err).Str("deployment_id", depId).Msg("failed to update deployment")
+		response.StatusInternalServerError(c)
+		return
+	}
+
+	// the running container joins the network right away, a new container joins it on create
+	if dep.ContainerId != "" {
+		rt, err := d.runtime(ctx, placedNode(dep))
+		if err != nil {
+			statusNodeError(c, logger, depId, err)
+			return
+		}
+		if err = rt.EnsureNetwork(ctx, req.DeploymentId); err != nil {
+			logger.Error().Err(err).Str("deployment_id", depId).Str("link", req.DeploymentId).Msg("failed to create network")
+			response.StatusInternalServerError(c)
+			return
+		}
+		if err = rt.ConnectNetwork(ctx, req.DeploymentId, dep.ContainerId); err != nil {
+			logger.Error().Err(err).Str("deployment_id", depId).Str("link", req.DeploymentId).Msg("failed to connect container")
+			response.StatusInternalServerError(c)
+			return
+		}
+	}
+
+	logger.Info().Str("deployment_id", depId).Str("link", req.DeploymentId).Msg("deployment linked")
+	response.StatusCommonOK(c, "deployment linked")
+	return
+}
+
+func (d *deployment) GetLinks(c *gin.Context) {
+	logger := d.logger.With().Str("request_id", requestid.Get(c)).Logger()
+
+	depId := c.Param("id")
+	if depId == "" {
+		logger.Error().Msg("no deployment id")
+		response.StatusBadRequest(c, "no deployment id")
+		return
+	}
+
+	ctx := c.Request.Context()
+	dep, err := d.db.GetDeployment(ctx, depId)
+	if err != nil {
+		if errors.Is(err, database.ErrNotFound) {
+			logger.Error().Err(err).Str("deployment_id", depId).Msg("deployment not found")
+			response.StatusNotFound(c, "deployment not found")
+			return
+		}
+		logger.Error().Err(err).Str("deployment_id", depId).Msg("failed to find deployment")
+		response.StatusInternalServerError(c)
+		return
+	}
+
+	if len(dep.Links) == 0 {
+		logger.Info().Str("deployment_id", depId).Msg("no links")
+		response.StatusNoContent(c)
+		return
+	}
+
+	links, err := d.db.ListDeployments(ctx, database.DeploymentQuery{Ids: dep.Links})
+	if err != nil {
+		logger.Error().Err(err).Str("deployment_id", depId).Msg("failed to find linked deployments")
+		response.StatusInternalServerError(c)
+		return
+	}
+	aliases := make(map[string][]string, len(links))
+	for i := range links {
+		aliases[links[i].Id] = networkAliases(&links[i])
+	}
+
+	logger.Info().Str("deployment_id", depId).Int("links", len(links)).Msg("links sent")
+	response.StatusLinks(c, &links, aliases)
+	return
+}
+
+func (d *deployment) DeleteLink(c *gin.Context) {
+	logger := d.logger.With().Str("request_id", requestid.Get(c)).Logger()
+
+	depId := c.Param("id")
+	link := c.Param("link")
+	if depId == "" || link == "" {
+		logger.Error().Msg("no deployment id or link")
+		response.StatusBadRequest(c, "no deployment id or link")
+		return
+	}
+
+	ctx := c.Request.Context()
+	dep, err := d.db.UpdateDeployment(ctx, depId, func(dep *model.Deployment) error {
+		if !slices.Contains(dep.Links, link) {
+			return database.ErrNotFound
+		}
+		dep.UpdatedAt = time.Now()
+		dep.Links = removeLink(dep.Links, link)
+		return nil
+	})
+	if err != nil {
+		if errors.Is(err, database.ErrNotFound) {
+			logger.Error().Err(err).Str("deployment_id", depId).Str("link", link).Msg("link not found")
+			response.StatusNotFound(c, "link not found")
+			return
+		}
+		logger.Error().Err(err).Str("deployment_id", depId).Msg("failed to update deployment")
+		response.StatusInternalServerError(c)
+		return
+	}
+
+	if dep.ContainerId != "" {
+		rt, err := d.runtime(ctx, placedNode(dep))
+		if err != nil {
+			statusNodeError(c, logger, depId, err)
+			return
+		}
+		if err = rt.DisconnectNetwork(ctx, link, dep.ContainerId); err != nil {
+			logger.Error().Err(err).Str("deployment_id", depId).Str("link", link).Msg("failed to disconnect container")
+			response.StatusInternalServerError(c)
+			return
+		}
+	}
+
+	logger.Info().Str("deployment_id", depId).Str("link", link).Msg("link deleted")
+	response.StatusCommonOK(c, "link deleted")
+	return
+}
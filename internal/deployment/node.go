@@ -0,0 +1,858 @@
+package deployment
+
+import (
+	"GDHost/internal/database"
+	"GDHost/internal/model"
+	"GDHost/internal/response"
+	"GDHost/internal/utility"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/client"
+	"github.com/gin-contrib/requestid"
+	"github.com/gin-gonic/gin"
+	"github.com/go-playground/validator/v10"
+	"github.com/rs/zerolog"
+	"net"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// localNode is the name of the engine GDHost is configured with, the deployments placed before
+// the nodes existed run on it
+const localNode = "local"
+
+const (
+	placementLeastLoaded = "least-loaded"
+	placementLabels      = "labels"
+	placementPinned      = "pinned"
+)
+
+// a node which failed to connect is not dialled again for nodeRetryMin, doubled on every failure up to nodeRetryMax
+const (
+	nodeRetryMin = 5 * time.Second
+	nodeRetryMax = time.Minute
+)
+
+// nodeCloseGrace is how long a dropped engine stays open, the requests which got it before it was dropped finish
+// within the write timeout of the server
+const nodeCloseGrace = time.Minute
+
+var (
+	errNodeUnavailable = errors.New("node is unavailable")
+	errNoNode          = errors.New("no node fits the placement")
+)
+
+// nodeRuntime is the connected engine of a node
+type nodeRuntime struct {
+	ContainerRuntime
+	// address is where the published ports of the node are reached, empty for the local engine
+	address string
+	cancel  context.CancelFunc
+}
+
+// nodeFailure is the last failed connection to a node, its error is returned until retryAt
+type nodeFailure struct {
+	err     error
+	retryAt time.Time
+	backoff time.Duration
+}
+
+// UpdateNodeReq replaces the node. The stored TLS key is kept when the request has the stored certificate
+// without a key.
+type UpdateNodeReq struct {
+	Endpoint  string            `json:"endpoint" validate:"required,uri"`
+	Address   string            `json:"address,omitempty" validate:"omitempty,hostname_rfc1123|ip"`
+	TLSCACert string            `json:"tls_ca_cert,omitempty"`
+	TLSCert   string            `json:"tls_cert,omitempty" validate:"required_with=TLSKey"`
+	TLSKey    string            `json:"tls_key,omitempty"`
+	Labels    map[string]string `json:"labels,omitempty"`
+	Capacity  int               `json:"capacity,omitempty" validate:"min=0"`
+}
+
+type NodeReq struct {
+	Name string `json:"name" validate:"required,hostname_rfc1123,ne=local"`
+	UpdateNodeReq
+}
+
+// PlacementReq chooses the node a new container of the deployment is created on. Least-loaded picks the node
+// running the fewest containers, labels the least loaded node having all the labels and pinned the named node.
+type PlacementReq struct {
+	Policy string            `json:"policy" validate:"required,oneof=least-loaded labels pinned"`
+	Node   string            `json:"node,omitempty" validate:"required_if=Policy pinned"`
+	Labels map[string]string `json:"labels,omitempty" validate:"required_if=Policy labels"`
+}
+
+func isLocalNode(name string) bool {
+	return name == "" || name == localNode
+}
+
+// placedNode returns the node the deployment is placed on, empty when it has never been placed.
+// A container created before the nodes existed runs on the local engine.
+func placedNode(dep *model.Deployment) string {
+	if dep.Node == "" && dep.ContainerId != "" {
+		return localNode
+	}
+	return dep.Node
+}
+
+// nodeAddress returns the address of the node, the host of a tcp endpoint when it has none
+// and the loopback address for a unix socket of the host
+func nodeAddress(endpoint string, address string) (string, error) {
+	if address != "" {
+		return address, nil
+	}
+	u, err := client.ParseHostURL(endpoint)
+	if err != nil {
+		return "", err
+	}
+	switch u.Scheme {
+	case "tcp":
+		return u.Hostname(), nil
+	case "unix":
+		return "127.0.0.1", nil
+	}
+	return "", fmt.Errorf("unsupported endpoint scheme %q, use tcp:// or unix://", u.Scheme)
+}
+
+// node returns the engine of the node, the local engine for the local node. The engines of the registered nodes
+// are connected on first use and kept until the node is updated or deleted.
+func (d *deployment) node(ctx context.Context, name string) (*nodeRuntime, error) {
+	if isLocalNode(name) {
+		return d.local, nil
+	}
+	d.nodesMu.Lock()
+	n, ok := d.nodes[name]
+	failure := d.failures[name]
+	d.nodesMu.Unlock()
+	if ok {
+		return n, nil
+	}
+	if failure != nil && time.Now().Before(failure.retryAt) {
+		return nil, failure.err
+	}
+
+	node, err := d.db.GetNode(ctx, name)
+	if err != nil {
+		if errors.Is(err, database.ErrNotFound) {
+			return nil, fmt.Errorf("%w: node %s is not registered", errNodeUnavailable, name)
+		}
+		return nil, fmt.Errorf("failed to find node: %w", err)
+	}
+	rt, err := d.connectNode(ctx, node)
+	if err != nil {
+		if errors.Is(err, errNodeUnavailable) {
+			d.failNode(name, err)
+		}
+		return nil, err
+	}
+	return d.addNode(node, rt), nil
+}
+
+// failNode remembers the failed connection to the node, the retry is delayed twice as long as the last one
+func (d *deployment) failNode(name string, err error) {
+	d.nodesMu.Lock()
+	defer d.nodesMu.Unlock()
+	f, ok := d.failures[name]
+	if ok {
+		f.backoff = min(2*f.backoff, nodeRetryMax)
+	} else {
+		f = &nodeFailure{backoff: nodeRetryMin}
+		d.failures[name] = f
+	}
+	f.err = err
+	f.retryAt = time.Now().Add(f.backoff)
+}
+
+// connectAll connects the nodes concurrently, so the nodes which are down cost a single dial timeout.
+// Their failures are remembered, see node.
+func (d *deployment) connectAll(ctx context.Context, names []string) {
+	var wg sync.WaitGroup
+	for _, name := range names {
+		if isLocalNode(name) {
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, _ = d.node(ctx, name)
+		}()
+	}
+	wg.Wait()
+}
+
+// runtime returns the engine of the node, see node
+func (d *deployment) runtime(ctx context.Context, name string) (ContainerRuntime, error) {
+	n, err := d.node(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	return n.ContainerRuntime, nil
+}
+
+// connectNode dials the engine of the stored node, its TLS key is decrypted first
+func (d *deployment) connectNode(ctx context.Context, node *model.Node) (ContainerRuntime, error) {
+	dialed := *node
+	if node.TLSKey != "" {
+		if d.secretKey == nil {
+			return nil, fmt.Errorf("%w: node %s has a tls key and no secret key is configured", errNodeUnavailable, node.Name)
+		}
+		key, err := utility.Decrypt(d.secretKey, node.TLSKey)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decrypt tls key of node %s: %w", node.Name, err)
+		}
+		dialed.TLSKey = string(key)
+	}
+	return d.dialNode(ctx, dialed)
+}
+
+func (d *deployment) dialNode(ctx context.Context, node model.Node) (ContainerRuntime, error) {
+	ctx, cancel := context.WithTimeout(ctx, detectTimeout)
+	defer cancel()
+	rt, err := d.dial(ctx, node)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s: %w", errNodeUnavailable, node.Name, err)
+	}
+	return rt, nil
+}
+
+// addNode keeps the engine of the node and follows its container events, an engine connected concurrently wins
+func (d *deployment) addNode(node *model.Node, rt ContainerRuntime) *nodeRuntime {
+	d.nodesMu.Lock()
+	defer d.nodesMu.Unlock()
+	delete(d.failures, node.Name)
+	if n, ok := d.nodes[node.Name]; ok {
+		d.closeNode(node.Name, rt)
+		return n
+	}
+	ctx, cancel := context.WithCancel(d.ctx)
+	n := &nodeRuntime{ContainerRuntime: rt, address: node.Address, cancel: cancel}
+	d.nodes[node.Name] = n
+	d.startCrashWatcher(ctx, rt, node.Name)
+	return n
+}
+
+// dropNode stops following the engine of the node and forgets its failure, it is connected again on next use.
+// The engine is closed after nodeCloseGrace since running requests may still use it.
+func (d *deployment) dropNode(name string) {
+	d.nodesMu.Lock()
+	defer d.nodesMu.Unlock()
+	delete(d.failures, name)
+	if n, ok := d.nodes[name]; ok {
+		n.cancel()
+		delete(d.nodes, name)
+		d.closeNodeLater(name, n.ContainerRuntime)
+	}
+}
+
+// closeNodeLater closes the engine after nodeCloseGrace, or when GDHost stops
+func (d *deployment) closeNodeLater(name string, rt ContainerRuntime) {
+	d.wg.Add(1)
+	go func() {
+		defer d.wg.Done()
+		timer := time.NewTimer(nodeCloseGrace)
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+		case <-d.ctx.Done():
+		}
+		d.closeNode(name, rt)
+	}()
+}
+
+// closeNode closes the engine of a node which is not kept
+func (d *deployment) closeNode(name string, rt ContainerRuntime) {
+	if err := rt.Close(); err != nil {
+		d.logger.Warn().Err(err).Str("node", name).Msg("failed to close the engine of the node")
+	}
+}
+
+// connectNodes connects the registered nodes at start up so their crash watchers run,
+// an unavailable node is connected again on next use
+func (d *deployment) connectNodes(ctx context.Context) error {
+	nodes, err := d.db.ListNodes(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to find nodes: %w", err)
+	}
+	for _, node := range nodes {
+		name := node.Name
+		d.wg.Add(1)
+		go func() {
+			defer d.wg.Done()
+			if _, err := d.node(ctx, name); err != nil {
+				d.logger.Error().Err(err).Str("node", name).Msg("failed to connect node")
+			}
+		}()
+	}
+	return nil
+}
+
+// nodeLoad counts the containers of the deployments on each node, without the skipped deployment
+func (d *deployment) nodeLoad(ctx context.Context, skip string) (map[string]int, error) {
+	deps, err := d.db.ListDeployments(ctx, database.DeploymentQuery{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to find deployments: %w", err)
+	}
+	load := map[string]int{}
+	for i := range deps {
+		if deps[i].ContainerId != "" && deps[i].Id != skip {
+			load[placedNode(&deps[i])]++
+		}
+	}
+	return load, nil
+}
+
+// linkedNode returns the node of the placed deployments linked with the deployment in either direction,
+// they share their networks so they run on the same engine
+func (d *deployment) linkedNode(ctx context.Context, dep *model.Deployment) (string, error) {
+	linked, err := d.db.ListDeployments(ctx, database.DeploymentQuery{LinkedTo: dep.Id})
+	if err != nil {
+		return "", fmt.Errorf("failed to find linked deployments: %w", err)
+	}
+	if len(dep.Links) != 0 {
+		links, err := d.db.ListDeployments(ctx, database.DeploymentQuery{Ids: dep.Links})
+		if err != nil {
+			return "", fmt.Errorf("failed to find linked deployments: %w", err)
+		}
+		linked = append(linked, links...)
+	}
+
+	node := ""
+	for i := range linked {
+		n := placedNode(&linked[i])
+		if n == "" || n == node {
+			continue
+		}
+		if node != "" {
+			return "", fmt.Errorf("%w: the linked deployments run on nodes %s and %s", errNoNode, node, n)
+		}
+		node = n
+	}
+	return node, nil
+}
+
+func hasLabels(labels map[string]string, selector map[string]string) bool {
+	for k, v := range selector {
+		if labels[k] != v {
+			return false
+		}
+	}
+	return true
+}
+
+// place returns the node a new container of the deployment is created on. A placed deployment stays on its node
+// unless the request places it again, a deployment linked to placed deployments joins their node. Full nodes and
+// unavailable nodes are skipped, the local engine has no labels and no capacity.
+func (d *deployment) place(ctx context.Context, dep *model.Deployment, req *PlacementReq) (string, *nodeRuntime, error) {
+	if req == nil {
+		if node := placedNode(dep); node != "" {
+			n, err := d.node(ctx, node)
+			return node, n, err
+		}
+		req = &PlacementReq{Policy: placementLeastLoaded}
+	}
+
+	nodes, err := d.db.ListNodes(ctx)
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to find nodes: %w", err)
+	}
+	candidates := append([]model.Node{{Name: localNode}}, nodes...)
+	switch req.Policy {
+	case placementPinned:
+		candidates = slices.DeleteFunc(candidates, func(n model.Node) bool {
+			return n.Name != req.Node
+		})
+		if len(candidates) == 0 {
+			return "", nil, fmt.Errorf("%w: node %s is not registered", errNoNode, req.Node)
+		}
+	case placementLabels:
+		candidates = slices.DeleteFunc(candidates, func(n model.Node) bool {
+			return !hasLabels(n.Labels, req.Labels)
+		})
+		if len(candidates) == 0 {
+			return "", nil, fmt.Errorf("%w: no node has the labels", errNoNode)
+		}
+	}
+
+	linked, err := d.linkedNode(ctx, dep)
+	if err != nil {
+		return "", nil, err
+	}
+	if linked != "" {
+		candidates = slices.DeleteFunc(candidates, func(n model.Node) bool {
+			return n.Name != linked
+		})
+		if len(candidates) == 0 {
+			return "", nil, fmt.Errorf("%w: the linked deployments run on node %s", errNoNode, linked)
+		}
+	}
+
+	load, err := d.nodeLoad(ctx, dep.Id)
+	if err != nil {
+		return "", nil, err
+	}
+	names := make([]string, 0, len(candidates))
+	for _, n := range candidates {
+		names = append(names, n.Name)
+	}
+	d.connectAll(ctx, names)
+
+	var best *model.Node
+	var bestRuntime *nodeRuntime
+	reason := ""
+	for i := range candidates {
+		n := &candidates[i]
+		if n.Capacity > 0 && load[n.Name] >= n.Capacity {
+			reason = fmt.Sprintf("node %s is full with %d containers", n.Name, load[n.Name])
+			continue
+		}
+		if best != nil && load[n.Name] >= load[best.Name] {
+			continue
+		}
+		rt, err := d.node(ctx, n.Name)
+		if err != nil {
+			d.logger.Warn().Err(err).Str("node", n.Name).Msg("node skipped by placement")
+			reason = err.Error()
+			continue
+		}
+		best, bestRuntime = n, rt
+	}
+	if best == nil {
+		return "", nil, fmt.Errorf("%w: %s", errNoNode, reason)
+	}
+	return best.Name, bestRuntime, nil
+}
+
+// prepareNode readies the engine for a container of the deployment from the image: the image is copied to it
+// when it was built elsewhere, the volumes and the networks are created. The data of the volumes stays on the
+// node the deployment ran on before.
+func (d *deployment) prepareNode(ctx context.Context, rt ContainerRuntime, dep *model.Deployment, image string) error {
+	if err := d.ensureImage(ctx, rt, dep, image); err != nil {
+		return err
+	}
+	for _, v := range dep.Volumes {
+		if err := rt.CreateVolume(ctx, v.Source, dep.Id); err != nil {
+			return fmt.Errorf("failed to create volume %s: %w", v.Name, err)
+		}
+	}
+	return prepareNetworks(ctx, rt, dep)
+}
+
+// ensureImage copies the image to the engine when it does not have it, from the node the deployment was placed
+// on before or from the local engine the releases are built on until the deployment is placed
+func (d *deployment) ensureImage(ctx context.Context, rt ContainerRuntime, dep *model.Deployment, image string) error {
+	if _, err := rt.ImageId(ctx, image); err == nil || !client.IsErrNotFound(err) {
+		return err
+	}
+
+	sources := []ContainerRuntime{d.ctr}
+	if node := placedNode(dep); !isLocalNode(node) {
+		if src, err := d.runtime(ctx, node); err == nil {
+			sources = append([]ContainerRuntime{src}, sources...)
+		}
+	}
+	for _, src := range sources {
+		if src == rt {
+			continue
+		}
+		if _, err := src.ImageId(ctx, image); err != nil {
+			continue
+		}
+		r, err := src.SaveImage(ctx, image)
+		if err != nil {
+			return fmt.Errorf("failed to export image %s: %w", image, err)
+		}
+		err = rt.LoadImage(ctx, r)
+		_ = r.Close()
+		if err != nil {
+			return fmt.Errorf("failed to copy image %s: %w", image, err)
+		}
+		return nil
+	}
+	return fmt.Errorf("image %s is on none of the engines, build it again", image)
+}
+
+// deploymentImage is the reference the image of the deployment is copied by, its release tag when it has one
+func deploymentImage(dep *model.Deployment) string {
+	if dep.Release != 0 {
+		return releaseTag(dep.Name, dep.Release)
+	}
+	return dep.ImageId
+}
+
+// deleteImage removes the image from the local engine, where the releases are built until the deployment is
+// placed, and from the engine of the deployment when it is another one. A missing image is not an error.
+func (d *deployment) deleteImage(ctx context.Context, rt ContainerRuntime, ref string) error {
+	if err := d.ctr.DeleteImage(ctx, ref); err != nil && !client.IsErrNotFound(err) {
+		return err
+	}
+	if rt == nil || rt == d.ctr {
+		return nil
+	}
+	if err := rt.DeleteImage(ctx, ref); err != nil && !client.IsErrNotFound(err) {
+		return err
+	}
+	return nil
+}
+
+// containerAddr returns the address GDHost reaches a port of the container at: the address of the container on the
+// network of the deployment on the local engine, the node address and the published host port on a node
+func (d *deployment) containerAddr(ctx context.Context, dep *model.Deployment, inspect types.ContainerJSON, port int) string {
+	node := placedNode(dep)
+	if isLocalNode(node) {
+		ip := networkIP(inspect, d.ctr.NetworkName(dep.Id))
+		if ip == "" {
+			return ""
+		}
+		return net.JoinHostPort(ip, strconv.Itoa(port))
+	}
+	n, err := d.node(ctx, node)
+	if err != nil {
+		return ""
+	}
+	for _, p := range dep.PortMappings() {
+		if p.Protocol == protocolTCP && p.ContainerPort == port {
+			return net.JoinHostPort(n.address, strconv.Itoa(p.HostPort))
+		}
+	}
+	return ""
+}
+
+// statusNodeError responds to a failed placement or an unreachable node
+func statusNodeError(c *gin.Context, logger zerolog.Logger, depId string, err error) {
+	switch {
+	case errors.Is(err, errNoNode), errors.Is(err, errNodeUnavailable):
+		logger.Error().Err(err).Str("deployment_id", depId).Msg("no node for deployment")
+		response.StatusUnProcessed(c, err.Error())
+	default:
+		logger.Error().Err(err).Str("deployment_id", depId).Msg("failed to find node")
+		response.StatusInternalServerError(c)
+	}
+}
+
+// nodeState is what the controller knows about the engine of the node, it is connected when it is not yet
+func (d *deployment) nodeState(ctx context.Context, name string, load map[string]int) response.NodeState {
+	state := response.NodeState{Containers: load[name]}
+	n, err := d.node(ctx, name)
+	if err != nil {
+		state.Error = err.Error()
+		return state
+	}
+	info := n.Info()
+	state.Available = true
+	state.Engine = info.Engine
+	state.Version = info.Version
+	state.Rootless = info.Rootless
+	return state
+}
+
+// newNode builds the node of the request, the TLS key is left in plain text
+func newNode(name string, req *UpdateNodeReq) (*model.Node, error) {
+	address, err := nodeAddress(req.Endpoint, req.Address)
+	if err != nil {
+		return nil, err
+	}
+	return &model.Node{
+		Name:      name,
+		Endpoint:  req.Endpoint,
+		Address:   address,
+		TLSCACert: req.TLSCACert,
+		TLSCert:   req.TLSCert,
+		TLSKey:    req.TLSKey,
+		Labels:    req.Labels,
+		Capacity:  req.Capacity,
+	}, nil
+}
+
+func (d *deployment) CreateNode(c *gin.Context) {
+	logger := d.logger.With().Str("request_id", requestid.Get(c)).Logger()
+
+	var req NodeReq
+	if err := c.BindJSON(&req); err != nil {
+		logger.Error().Err(err).Msg("failed to bind request")
+		response.StatusBadRequest(c, "failed to bind request")
+		return
+	}
+	if err := validator.New().Struct(req); err != nil {
+		logger.Error().Err(err).Msg("request validation error")
+		response.StatusBadRequest(c, err.Error())
+		return
+	}
+	if req.TLSCert != "" && req.TLSKey == "" {
+		logger.Error().Str("node", req.Name).Msg("tls certificate without key")
+		response.StatusBadRequest(c, "tls_key is required with tls_cert")
+		return
+	}
+	if req.TLSKey != "" && d.secretKey == nil {
+		logger.Error().Str("node", req.Name).Msg("secret key is not configured")
+		response.StatusUnProcessed(c, "secret key is not configured")
+		return
+	}
+
+	node, err := newNode(req.Name, &req.UpdateNodeReq)
+	if err != nil {
+		logger.Error().Err(err).Str("node", req.Name).Msg("invalid endpoint")
+		response.StatusBadRequest(c, err.Error())
+		return
+	}
+
+	ctx := c.Request.Context()
+	rt, err := d.dialNode(ctx, *node)
+	if err != nil {
+		logger.Error().Err(err).Str("node", req.Name).Msg("failed to connect node")
+		response.StatusUnProcessed(c, err.Error())
+		return
+	}
+
+	if node.TLSKey != "" {
+		if node.TLSKey, err = utility.Encrypt(d.secretKey, []byte(node.TLSKey)); err != nil {
+			logger.Error().Err(err).Str("node", req.Name).Msg("failed to encrypt tls key")
+			d.closeNode(req.Name, rt)
+			response.StatusInternalServerError(c)
+			return
+		}
+	}
+	node.CreatedAt = time.Now()
+	node.UpdatedAt = node.CreatedAt
+	if err = d.db.CreateNode(ctx, node); err != nil {
+		if errors.Is(err, database.ErrDuplicate) {
+			logger.Error().Err(err).Str("node", req.Name).Msg("node already exists")
+			d.closeNode(req.Name, rt)
+			response.StatusConflicted(c, "node already exists")
+			return
+		}
+		logger.Error().Err(err).Str("node", req.Name).Msg("failed to create node")
+		d.closeNode(req.Name, rt)
+		response.StatusInternalServerError(c)
+		return
+	}
+	d.addNode(node, rt)
+
+	logger.Info().Str("node", node.Name).Str("endpoint", node.Endpoint).Msg("node registered")
+	response.StatusNode(c, node, d.nodeState(ctx, node.Name, nil))
+	return
+}
+
+func (d *deployment) GetNodes(c *gin.Context) {
+	logger := d.logger.With().Str("request_id", requestid.Get(c)).Logger()
+
+	ctx := c.Request.Context()
+	nodes, err := d.db.ListNodes(ctx)
+	if err != nil {
+		logger.Error().Err(err).Msg("failed to find nodes")
+		response.StatusInternalServerError(c)
+		return
+	}
+	load, err := d.nodeLoad(ctx, "")
+	if err != nil {
+		logger.Error().Err(err).Msg("failed to count node containers")
+		response.StatusInternalServerError(c)
+		return
+	}
+
+	// the local engine is listed first, it is configured and not registered
+	nodes = append([]model.Node{{Name: localNode, Endpoint: d.ctr.Info().Host}}, nodes...)
+	names := make([]string, 0, len(nodes))
+	for _, node := range nodes {
+		names = append(names, node.Name)
+	}
+	d.connectAll(ctx, names)
+	states := make(map[string]response.NodeState, len(nodes))
+	for _, node := range nodes {
+		states[node.Name] = d.nodeState(ctx, node.Name, load)
+	}
+
+	logger.Info().Int("nodes", len(nodes)).Msg("nodes sent")
+	response.StatusNodes(c, &nodes, states)
+	return
+}
+
+func (d *deployment) GetNode(c *gin.Context) {
+	logger := d.logger.With().Str("request_id", requestid.Get(c)).Logger()
+
+	name := c.Param("name")
+	if name == "" {
+		logger.Error().Msg("no node name")
+		response.StatusBadRequest(c, "no node name")
+		return
+	}
+
+	ctx := c.Request.Context()
+	node := &model.Node{Name: localNode, Endpoint: d.ctr.Info().Host}
+	if name != localNode {
+		var err error
+		if node, err = d.db.GetNode(ctx, name); err != nil {
+			if errors.Is(err, database.ErrNotFound) {
+				logger.Error().Err(err).Str("node", name).Msg("node not found")
+				response.StatusNotFound(c, "node not found")
+				return
+			}
+			logger.Error().Err(err).Str("node", name).Msg("failed to find node")
+			response.StatusInternalServerError(c)
+			return
+		}
+	}
+	load, err := d.nodeLoad(ctx, "")
+	if err != nil {
+		logger.Error().Err(err).Msg("failed to count node containers")
+		response.StatusInternalServerError(c)
+		return
+	}
+
+	logger.Info().Str("node", name).Msg("node sent")
+	response.StatusNode(c, node, d.nodeState(ctx, name, load))
+	return
+}
+
+func (d *deployment) UpdateNode(c *gin.Context) {
+	logger := d.logger.With().Str("request_id", requestid.Get(c)).Logger()
+
+	name := c.Param("name")
+	if name == "" {
+		logger.Error().Msg("no node name")
+		response.StatusBadRequest(c, "no node name")
+		return
+	}
+	if name == localNode {
+		logger.Error().Msg("local node is configured")
+		response.StatusUnProcessed(c, "the local engine is set in the configuration")
+		return
+	}
+
+	var req UpdateNodeReq
+	if err := c.BindJSON(&req); err != nil {
+		logger.Error().Err(err).Msg("failed to bind request")
+		response.StatusBadRequest(c, "failed to bind request")
+		return
+	}
+	if err := validator.New().Struct(req); err != nil {
+		logger.Error().Err(err).Msg("request validation error")
+		response.StatusBadRequest(c, err.Error())
+		return
+	}
+	if req.TLSKey != "" && d.secretKey == nil {
+		logger.Error().Str("node", name).Msg("secret key is not configured")
+		response.StatusUnProcessed(c, "secret key is not configured")
+		return
+	}
+
+	ctx := c.Request.Context()
+	stored, err := d.db.GetNode(ctx, name)
+	if err != nil {
+		if errors.Is(err, database.ErrNotFound) {
+			logger.Error().Err(err).Str("node", name).Msg("node not found")
+			response.StatusNotFound(c, "node not found")
+			return
+		}
+		logger.Error().Err(err).Str("node", name).Msg("failed to find node")
+		response.StatusInternalServerError(c)
+		return
+	}
+	if req.TLSCert != "" && req.TLSKey == "" {
+		if req.TLSCert != stored.TLSCert || stored.TLSKey == "" {
+			logger.Error().Str("node", name).Msg("tls certificate without key")
+			response.StatusBadRequest(c, "tls_key is required with a new tls_cert")
+			return
+		}
+		if key, err := utility.Decrypt(d.secretKey, stored.TLSKey); err == nil {
+			req.TLSKey = string(key)
+		} else {
+			logger.Error().Err(err).Str("node", name).Msg("failed to decrypt tls key")
+			response.StatusInternalServerError(c)
+			return
+		}
+	}
+
+	node, err := newNode(name, &req)
+	if err != nil {
+		logger.Error().Err(err).Str("node", name).Msg("invalid endpoint")
+		response.StatusBadRequest(c, err.Error())
+		return
+	}
+	rt, err := d.dialNode(ctx, *node)
+	if err != nil {
+		logger.Error().Err(err).Str("node", name).Msg("failed to connect node")
+		response.StatusUnProcessed(c, err.Error())
+		return
+	}
+	if node.TLSKey != "" {
+		if node.TLSKey, err = utility.Encrypt(d.secretKey, []byte(node.TLSKey)); err != nil {
+			logger.Error().Err(err).Str("node", name).Msg("failed to encrypt tls key")
+			d.closeNode(name, rt)
+			response.StatusInternalServerError(c)
+			return
+		}
+	}
+
+	node, err = d.db.UpdateNode(ctx, name, func(stored *model.Node) error {
+		node.CreatedAt = stored.CreatedAt
+		node.UpdatedAt = time.Now()
+		*stored = *node
+		return nil
+	})
+	if err != nil {
+		d.closeNode(name, rt)
+		if errors.Is(err, database.ErrNotFound) {
+			logger.Error().Err(err).Str("node", name).Msg("node not found")
+			response.StatusNotFound(c, "node not found")
+			return
+		}
+		logger.Error().Err(err).Str("node", name).Msg("failed to update node")
+		response.StatusInternalServerError(c)
+		return
+	}
+	d.dropNode(name)
+	d.addNode(node, rt)
+
+	logger.Info().Str("node", name).Str("endpoint", node.Endpoint).Msg("node updated")
+	response.StatusNode(c, node, d.nodeState(ctx, name, nil))
+	return
+}
+
+func (d *deployment) DeleteNode(c *gin.Context) {
+	logger := d.logger.With().Str("request_id", requestid.Get(c)).Logger()
+
+	name := c.Param("name")
+	if name == "" {
+		logger.Error().Msg("no node name")
+		response.StatusBadRequest(c, "no node name")
+		return
+	}
+	if name == localNode {
+		logger.Error().Msg("local node is configured")
+		response.StatusUnProcessed(c, "the local engine is set in the configuration")
+		return
+	}
+
+	ctx := c.Request.Context()
+	placed, err := d.db.ListDeployments(ctx, database.DeploymentQuery{Node: name, Limit: 1})
+	if err != nil {
+		logger.Error().Err(err).Str("node", name).Msg("failed to find deployments of node")
+		response.StatusInternalServerError(c)
+		return
+	}
+	if len(placed) != 0 {
+		logger.Error().Str("node", name).Str("deployment_id", placed[0].Id).Msg("node has deployments")
+		response.StatusConflicted(c, "node has deployments, delete them or remove their containers and run them on another node first")
+		return
+	}
+
+	if err = d.db.DeleteNode(ctx, name); err != nil {
+		if errors.Is(err, database.ErrNotFound) {
+			logger.Error().Err(err).Str("node", name).Msg("node not found")
+			response.StatusNotFound(c, "node not found")
+			return
+		}
+		logger.Error().Err(err).Str("node", name).Msg("failed to delete node")
+		response.StatusInternalServerError(c)
+		return
+	}
+	d.dropNode(name)
+
+	logger.Info().Str("node", name).Msg("node deleted")
+	response.StatusCommonOK(c, "node deleted")
+	return
+}
@@ -0,0 +1,305 @@
+package deployment
+
+import (
+	"GDHost/internal/database"
+	"GDHost/internal/model"
+	"GDHost/internal/response"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"github.com/rs/zerolog"
+	"net"
+	"strconv"
+	"time"
+)
+
+const protocolTCP = "tcp"
+
+var (
+	errPortMapping = errors.New("invalid port mapping")
+	errNoFreePort  = errors.New("no free host port in the port range")
+)
+
+// portRange is the configured range host ports are allocated from
+type portRange struct {
+	start int
+	end   int
+}
+
+// portConflictError is a host port reserved by another deployment, or bound on the host outside GDHost when Owner is empty
+type portConflictError struct {
+	Port  model.Port
+	Owner string
+}
+
+func (e *portConflictError) Error() string {
+	if e.Owner == "" {
+		return fmt.Sprintf("host port %d/%s is already bound on the host", e.Port.HostPort, e.Port.Protocol)
+	}
+	return fmt.Sprintf("host port %d/%s is used by deployment %s", e.Port.HostPort, e.Port.Protocol, e.Owner)
+}
+
+type PortReq struct {
+	HostIP        string `json:"host_ip,omitempty" validate:"omitempty,ip"`
+	HostPort      int    `json:"host_port,omitempty" validate:"omitempty,min=1,max=65535"`
+	ContainerPort int    `json:"container_port" validate:"required,min=1,max=65535"`
+	Protocol      string `json:"protocol,omitempty" validate:"omitempty,oneof=tcp udp"`
+}
+
+func (req *PortReq) port() model.Port {
+	port := model.Port{
+		HostIP:        req.HostIP,
+		HostPort:      req.HostPort,
+		ContainerPort: req.ContainerPort,
+		Protocol:      req.Protocol,
+	}
+	if port.Protocol == "" {
+		port.Protocol = protocolTCP
+	}
+	return port
+}
+
+// portMappings resolves the port mappings of a new container. The ports of the request are used as they are,
+// host_port and container_port are a single tcp mapping completed from the primary port of the deployment,
+// and without both the deployment keeps its mappings. A zero host port is allocated when it is reserved.
+func portMappings(ports []PortReq, hostPort, containerPort int, dep *model.Deployment) ([]model.Port, error) {
+	if len(ports) != 0 && (hostPort != 0 || containerPort != 0) {
+		return nil, fmt.Errorf("%w: use either ports or host_port and container_port", errPortMapping)
+	}
+
+	var mappings []model.Port
+	switch {
+	case len(ports) != 0:
+		for i := range ports {
+			mappings = append(mappings, ports[i].port())
+		}
+	case hostPort != 0 || containerPort != 0:
+		primary, _ := primaryPort(dep.PortMappings())
+		if hostPort == 0 {
+			hostPort = primary.HostPort
+		}
+		if containerPort == 0 {
+			containerPort = primary.ContainerPort
+		}
+		if containerPort == 0 {
+			return nil, fmt.Errorf("%w: container_port is required when the deployment has never been run", errPortMapping)
+		}
+		mappings = []model.Port{{HostIP: primary.HostIP, HostPort: hostPort, ContainerPort: containerPort, Protocol: protocolTCP}}
+	default:
+		mappings = dep.PortMappings()
+	}
+
+	if len(mappings) == 0 {
+		return nil, fmt.Errorf("%w: ports are required when the deployment has never been run", errPortMapping)
+	}
+	for i := range mappings {
+		for j := i + 1; j < len(mappings); j++ {
+			if portsOverlap(mappings[i], mappings[j]) {
+				return nil, fmt.Errorf("%w: host port %d/%s is mapped twice", errPortMapping, mappings[i].HostPort, mappings[i].Protocol)
+			}
+		}
+	}
+	return mappings, nil
+}
+
+// portsOverlap reports whether both mappings bind the same host port, an unspecified address binds every interface
+func portsOverlap(a, b model.Port) bool {
+	if a.HostPort == 0 || a.HostPort != b.HostPort || a.Protocol != b.Protocol {
+		return false
+	}
+	return unspecifiedIP(a.HostIP) || unspecifiedIP(b.HostIP) || net.ParseIP(a.HostIP).Equal(net.ParseIP(b.HostIP))
+}
+
+func unspecifiedIP(ip string) bool {
+	return ip == "" || net.ParseIP(ip).IsUnspecified()
+}
+
+// primaryPort returns the first tcp mapping, which is health checked and served by the proxy
+func primaryPort(ports []model.Port) (model.Port, bool) {
+	for _, p := range ports {
+		if p.Protocol == protocolTCP {
+			return p, true
+		}
+	}
+	return model.Port{}, false
+}
+
+// setPorts stores the mappings on the deployment with their primary port
+func setPorts(dep *model.Deployment, ports []model.Port) {
+	primary, _ := primaryPort(ports)
+	dep.Ports = ports
+	dep.HostPort = primary.HostPort
+	dep.ContainerPort = primary.ContainerPort
+}
+
+// reservationId leaves out the host ip, a reservation holds the port on every interface. A mapping bound to 0.0.0.0
+// overlaps the mappings of every address, which a key per address could not reject, so 127.0.0.1:8080 and
+// 10.0.0.2:8080 are not given to two deployments either.
+func reservationId(protocol string, port int) string {
+	return protocol + "/" + strconv.Itoa(port)
+}
+
+// PortChecker reports whether the host port of the mapping can be bound on the host of GDHost right now
+type PortChecker func(port model.Port) bool
+
+// HostPortFree is the PortChecker binding the host port
+func HostPortFree(port model.Port) bool {
+	if port.Protocol == protocolTCP {
+		ln, err := net.Listen("tcp", hostAddr(port))
+		if err != nil {
+			return false
+		}
+		_ = ln.Close()
+		return true
+	}
+	pc, err := net.ListenPacket("udp", hostAddr(port))
+	if err != nil {
+		return false
+	}
+	_ = pc.Close()
+	return true
+}
+
+// nodePortFree reports whether the host port can be bound on the node. The ports of the local engine are checked
+// on the host, the engine of another node reports a port taken outside GDHost when the container starts.
+func (d *deployment) nodePortFree(node string, port model.Port) bool {
+	return !isLocalNode(node) || d.portFree(port)
+}
+
+// reservePorts reserves the host ports of the mappings for the deployment on the node and allocates the zero host ports
+// from the range. The reservations are shared by the nodes. On failure the reservations already made are left to releasePorts.
+func (d *deployment) reservePorts(ctx context.Context, depId string, node string, ports []model.Port) ([]model.Port, error) {
+	reserved := make([]model.Port, 0, len(ports))
+	for _, p := range ports {
+		var err error
+		if p.HostPort == 0 {
+			p.HostPort, err = d.allocatePort(ctx, depId, node, p)
+		} else {
+			err = d.reservePort(ctx, depId, node, p)
+		}
+		if err != nil {
+			return nil, err
+		}
+		reserved = append(reserved, p)
+	}
+	return reserved, nil
+}
+
+// reservePort reserves a requested host port. A port the deployment already holds is not checked on the host,
+// its own container or proxy binds it.
+func (d *deployment) reservePort(ctx context.Context, depId string, node string, port model.Port) error {
+	id := reservationId(port.Protocol, port.HostPort)
+	owner, err := d.db.GetPortReservation(ctx, id)
+	if err == nil {
+		if owner.DeploymentId == depId {
+			return nil
+		}
+		return &portConflictError{Port: port, Owner: owner.DeploymentId}
+	}
+	if !errors.Is(err, database.ErrNotFound) {
+		return fmt.Errorf("failed to find port reservation: %w", err)
+	}
+
+	if !d.nodePortFree(node, port) {
+		return &portConflictError{Port: port}
+	}
+	if err = d.createReservation(ctx, depId, port); err != nil {
+		if errors.Is(err, database.ErrDuplicate) {
+			// a concurrent request reserved the port first
+			conflict := &portConflictError{Port: port}
+			if owner, err = d.db.GetPortReservation(ctx, id); err == nil {
+				conflict.Owner = owner.DeploymentId
+			}
+			return conflict
+		}
+		return fmt.Errorf("failed to reserve port: %w", err)
+	}
+	return nil
+}
+
+// allocatePort reserves the first free host port of the range
+func (d *deployment) allocatePort(ctx context.Context, depId string, node string, port model.Port) (int, error) {
+	query := database.PortQuery{Protocol: port.Protocol, From: d.ports.start, To: d.ports.end}
+	reservations, err := d.db.ListPortReservations(ctx, query)
+	if err != nil {
+		return 0, fmt.Errorf("failed to find port reservations: %w", err)
+	}
+	taken := make(map[int]bool, len(reservations))
+	for _, r := range reservations {
+		taken[r.HostPort] = true
+	}
+
+	for p := d.ports.start; p <= d.ports.end; p++ {
+		port.HostPort = p
+		if taken[p] || !d.nodePortFree(node, port) {
+			continue
+		}
+		if err = d.createReservation(ctx, depId, port); err != nil {
+			if errors.Is(err, database.ErrDuplicate) {
+				continue
+			}
+			return 0, fmt.Errorf("failed to reserve port: %w", err)
+		}
+		return p, nil
+	}
+	return 0, errNoFreePort
+}
+
+func (d *deployment) createReservation(ctx context.Context, depId string, port model.Port) error {
+	return d.db.CreatePortReservation(ctx, &model.PortReservation{
+		Id:           reservationId(port.Protocol, port.HostPort),
+		Protocol:     port.Protocol,
+		HostPort:     port.HostPort,
+		DeploymentId: depId,
+		CreatedAt:    time.Now(),
+	})
+}
+
+// releasePorts frees the host ports reserved by the deployment which are not in keep
+func (d *deployment) releasePorts(ctx context.Context, depId string, keep []model.Port) error {
+	ids := make([]string, 0, len(keep))
+	for _, p := range keep {
+		ids = append(ids, reservationId(p.Protocol, p.HostPort))
+	}
+	return d.db.DeletePortReservations(ctx, depId, ids)
+}
+
+// restorePorts frees the ports reserved for a container which was not created, the deployment keeps its previous mappings
+func (d *deployment) restorePorts(depId string, dep *model.Deployment, logger zerolog.Logger) {
+	if err := d.releasePorts(context.Background(), depId, dep.PortMappings()); err != nil {
+		logger.Error().Err(err).Str("deployment_id", depId).Msg("failed to release ports")
+	}
+}
+
+// restorePortReservations reserves the host ports of the deployments run before the ports were reserved
+func (d *deployment) restorePortReservations(ctx context.Context) error {
+	deps, err := d.db.ListDeployments(ctx, database.DeploymentQuery{})
+	if err != nil {
+		return fmt.Errorf("failed to find deployments: %w", err)
+	}
+	for _, dep := range deps {
+		for _, p := range dep.PortMappings() {
+			if err = d.createReservation(ctx, dep.Id, p); err != nil && !errors.Is(err, database.ErrDuplicate) {
+				return fmt.Errorf("failed to reserve port: %w", err)
+			}
+		}
+	}
+	return nil
+}
+
+// statusPortError responds to a failed port reservation, a port taken by another deployment or on the host is a conflict
+func statusPortError(c *gin.Context, logger zerolog.Logger, depId string, err error) {
+	var conflict *portConflictError
+	switch {
+	case errors.As(err, &conflict):
+		logger.Error().Err(err).Str("deployment_id", depId).Msg("host port is taken")
+		response.StatusPortTaken(c, conflict.Error(), conflict.Owner)
+	case errors.Is(err, errNoFreePort):
+		logger.Error().Err(err).Str("deployment_id", depId).Msg("no free host port")
+		response.StatusUnProcessed(c, err.Error())
+	default:
+		logger.Error().Err(err).Str("deployment_id", depId).Msg("failed to reserve ports")
+		response.StatusInternalServerError(c)
+	}
+}
@@ -0,0 +1,161 @@
+package deployment
+
+import (
+	"GDHost/internal/model"
+	"errors"
+	"fmt"
+	"github.com/rs/zerolog"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const proxyDialTimeout = 5 * time.Second
+
+// proxy forwards the host port of a deployment to the loopback port of its current container.
+// Switching the target only affects new connections so the container can be swapped without closing the host port.
+type proxy struct {
+	mu         sync.Mutex
+	forwarders map[string]*forwarder
+	logger     *zerolog.Logger
+}
+
+type forwarder struct {
+	addr   string
+	ln     net.Listener
+	target atomic.Value
+}
+
+func newProxy(logger *zerolog.Logger) *proxy {
+	return &proxy{
+		forwarders: make(map[string]*forwarder),
+		logger:     logger,
+	}
+}
+
+// serve listens on the host address for the deployment and forwards the connections to target.
+// If the deployment is already served on the same address, only the target is switched.
+func (p *proxy) serve(depId string, addr string, target string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if f, ok := p.forwarders[depId]; ok {
+		if f.addr == addr {
+			f.target.Store(target)
+			return nil
+		}
+		_ = f.ln.Close()
+		delete(p.forwarders, depId)
+	}
+
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("failed to listen on host port: %w", err)
+	}
+	f := &forwarder{addr: addr, ln: ln}
+	f.target.Store(target)
+	p.forwarders[depId] = f
+
+	logger := p.logger.With().Str("deployment_id", depId).Str("addr", addr).Logger()
+	go f.accept(logger)
+	return nil
+}
+
+// serving reports whether the host port of the deployment is served by the proxy
+func (p *proxy) serving(depId string) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	_, ok := p.forwarders[depId]
+	return ok
+}
+
+// stop closes the host port of the deployment. Open connections are left to finish.
+func (p *proxy) stop(depId string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if f, ok := p.forwarders[depId]; ok {
+		_ = f.ln.Close()
+		delete(p.forwarders, depId)
+	}
+}
+
+// Close closes every host port served by the proxy
+func (p *proxy) Close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for depId, f := range p.forwarders {
+		_ = f.ln.Close()
+		delete(p.forwarders, depId)
+	}
+}
+
+func (f *forwarder) accept(logger zerolog.Logger) {
+	for {
+		conn, err := f.ln.Accept()
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				logger.Error().Err(err).Msg("proxy stopped accepting connections")
+			}
+			return
+		}
+		go f.forward(conn, logger)
+	}
+}
+
+func (f *forwarder) forward(conn net.Conn, logger zerolog.Logger) {
+	defer conn.Close()
+
+	target := f.target.Load().(string)
+	upstream, err := net.DialTimeout("tcp", target, proxyDialTimeout)
+	if err != nil {
+		logger.Error().Err(err).Str("target", target).Msg("failed to connect to container")
+		return
+	}
+	defer upstream.Close()
+
+	done := make(chan struct{}, 2)
+	go func() {
+		_, _ = io.Copy(upstream, conn)
+		closeWrite(upstream)
+		done <- struct{}{}
+	}()
+	go func() {
+		_, _ = io.Copy(conn, upstream)
+		closeWrite(conn)
+		done <- struct{}{}
+	}()
+	<-done
+	<-done
+}
+
+// closeWrite half-closes a tcp connection so the other side sees EOF
+func closeWrite(conn net.Conn) {
+	if tc, ok := conn.(*net.TCPConn); ok {
+		_ = tc.CloseWrite()
+	}
+}
+
+// freeLoopbackPort asks the kernel for an unused loopback port
+func freeLoopbackPort() (int, error) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return 0, err
+	}
+	defer ln.Close()
+	return ln.Addr().(*net.TCPAddr).Port, nil
+}
+
+// hostAddr returns the address the proxy listens on for the port mapping
+func hostAddr(port model.Port) string {
+	return net.JoinHostPort(port.HostIP, strconv.Itoa(port.HostPort))
+}
+
+// loopbackAddr returns the loopback address of a published container port
+func loopbackAddr(port int) string {
+	return net.JoinHostPort("127.0.0.1", strconv.Itoa(port))
+}
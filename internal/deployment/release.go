@@ -0,0 +1,348 @@
+package deployment
+
+import (
+	"GDHost/internal/database"
+	"GDHost/internal/model"
+	"GDHost/internal/response"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/docker/docker/client"
+	"github.com/gin-contrib/requestid"
+	"github.com/gin-gonic/gin"
+	"github.com/go-playground/validator/v10"
+	"github.com/google/uuid"
+	"github.com/rs/zerolog"
+	"strconv"
+	"time"
+)
+
+// releaseTag returns the image tag of a release
+func releaseTag(name string, version int) string {
+	return name + ":v" + strconv.Itoa(version)
+}
+
+// nextReleaseVersion returns the version following the latest release of the deployment
+func (d *deployment) nextReleaseVersion(ctx context.Context, depId string) (int, error) {
+	releases, err := d.db.ListReleases(ctx, depId)
+	if err != nil {
+		return 0, fmt.Errorf("failed to find latest release: %w", err)
+	}
+	if len(releases) == 0 {
+		return 1, nil
+	}
+	return releases[0].Version + 1, nil
+}
+
+// pruneReleases removes the image tags of the releases beyond the retention count.
+// The image of the current release and the image used by the container are never removed.
+// Removing by tag keeps an image alive while another release still references it.
+func (d *deployment) pruneReleases(ctx context.Context, rt ContainerRuntime, dep *model.Deployment, current string,
+	logger zerolog.Logger) {
+	releases, err := d.db.ListReleases(ctx, dep.Id)
+	if err != nil {
+		logger.Error().Err(err).Msg("failed to find releases to prune")
+		return
+	}
+
+	retained := 0
+	for _, release := range releases {
+		if !release.PrunedAt.IsZero() {
+			continue
+		}
+		if retained++; retained <= d.retention {
+			continue
+		}
+		if release.ImageId == current || (dep.ContainerId != "" && release.ImageId == dep.ImageId) {
+			continue
+		}
+		if err = d.deleteImage(ctx, rt, release.Tag); err != nil {
+			logger.Error().Err(err).Str("tag", release.Tag).Msg("failed to remove release image")
+			continue
+		}
+
+		_, err = d.db.UpdateRelease(ctx, release.Id, func(release *model.Release) error {
+			release.PrunedAt = time.Now()
+			return nil
+		})
+		if err != nil {
+			logger.Error().Err(err).Str("tag", release.Tag).Msg("failed to mark release as pruned")
+			continue
+		}
+		logger.Info().Str("tag", release.Tag).Msg("release pruned")
+	}
+}
+
+func (d *deployment) GetReleases(c *gin.Context) {
+	logger := d.logger.With().Str("request_id", requestid.Get(c)).Logger()
+
+	depId := c.Param("id")
+	if depId == "" {
+		logger.Error().Msg("no deployment id")
+		response.StatusBadRequest(c, "no deployment id")
+		return
+	}
+
+	ctx := c.Request.Context()
+	if _, err := d.db.GetDeployment(ctx, depId); err != nil {
+		if errors.Is(err, database.ErrNotFound) {
+			logger.Error().Err(err).Str("deployment_id", depId).Msg("deployment not found")
+			response.StatusNotFound(c, "deployment not found")
+			return
+		}
+		logger.Error().Err(err).Str("deployment_id", depId).Msg("failed to find deployment")
+		response.StatusInternalServerError(c)
+		return
+	}
+
+	releases, err := d.db.ListReleases(ctx, depId)
+	if err != nil {
+		logger.Error().Err(err).Str("deployment_id", depId).Msg("failed to find releases")
+		response.StatusInternalServerError(c)
+		return
+	}
+
+	if len(releases) == 0 {
+		logger.Info().Str("deployment_id", depId).Msg("no releases")
+		response.StatusNoContent(c)
+		return
+	}
+
+	logger.Info().Str("deployment_id", depId).Int("releases", len(releases)).Msg("releases sent")
+	response.StatusReleases(c, &releases)
+	return
+}
+
+func (d *deployment) GetRelease(c *gin.Context) {
+	logger := d.logger.With().Str("request_id", requestid.Get(c)).Logger()
+
+	depId := c.Param("id")
+	version, err := strconv.Atoi(c.Param("version"))
+	if depId == "" || err != nil {
+		logger.Error().Err(err).Msg("invalid release")
+		response.StatusBadRequest(c, "invalid release")
+		return
+	}
+
+	ctx := c.Request.Context()
+	release, err := d.db.GetRelease(ctx, depId, version)
+	if err != nil {
+		if errors.Is(err, database.ErrNotFound) {
+			logger.Error().Err(err).Str("deployment_id", depId).Int("version", version).Msg("release not found")
+			response.StatusNotFound(c, "release not found")
+			return
+		}
+		logger.Error().Err(err).Str("deployment_id", depId).Int("version", version).Msg("failed to find release")
+		response.StatusInternalServerError(c)
+		return
+	}
+
+	logger.Info().Str("deployment_id", depId).Int("version", version).Msg("release sent")
+	response.StatusRelease(c, release)
+	return
+}
+
+type rollbackDeploymentReq struct {
+	Version       int       `json:"version" validate:"required,min=1"`
+	Ports         []PortReq `json:"ports,omitempty" validate:"dive"`
+	HostPort      int       `json:"host_port,omitempty" validate:"omitempty,min=1,max=65535"`
+	ContainerPort int       `json:"container_port,omitempty" validate:"omitempty,min=1,max=65535"`
+}
+
+func (d *deployment) RollbackDeployment(c *gin.Context) {
+	logger := d.logger.With().Str("request_id", requestid.Get(c)).Logger()
+
+	depId := c.Param("id")
+	if depId == "" {
+		logger.Error().Msg("no deployment id in URL")
+		response.StatusBadRequest(c, "no deployment id in URL")
+		return
+	}
+
+	var req rollbackDeploymentReq
+	if err := c.BindJSON(&req); err != nil {
+		logger.Error().Err(err).Msg("failed to bind request")
+		response.StatusBadRequest(c, "failed to bind request")
+		return
+	}
+	if err := validator.New().Struct(req); err != nil {
+		logger.Error().Err(err).Msg("request validation error")
+		response.StatusBadRequest(c, err.Error())
+		return
+	}
+
+	ctx := c.Request.Context()
+	dep, err := d.db.GetDeployment(ctx, depId)
+	if err != nil {
+		if errors.Is(err, database.ErrNotFound) {
+			logger.Error().Err(err).Str("deployment_id", depId).Msg("deployment not found")
+			response.StatusNotFound(c, "deployment not found")
+			return
+		}
+		logger.Error().Err(err).Str("deployment_id", depId).Msg("failed to find deployment")
+		response.StatusInternalServerError(c)
+		return
+	}
+
+	release, err := d.db.GetRelease(ctx, depId, req.Version)
+	if err == nil && !release.PrunedAt.IsZero() {
+		err = database.ErrNotFound
+	}
+	if err != nil {
+		if errors.Is(err, database.ErrNotFound) {
+			logger.Error().Err(err).Str("deployment_id", depId).Int("version", req.Version).Msg("release not found")
+			response.StatusNotFound(c, "release not found or pruned")
+			return
+		}
+		logger.Error().Err(err).Str("deployment_id", depId).Int("version", req.Version).Msg("failed to find release")
+		response.StatusInternalServerError(c)
+		return
+	}
+
+	// the deployment is rolled back on its node, an unplaced deployment is placed like on run
+	node, rt, err := d.place(ctx, dep, nil)
+	if err != nil {
+		statusNodeError(c, logger, depId, err)
+		return
+	}
+
+	ports, err := portMappings(req.Ports, req.HostPort, req.ContainerPort, dep)
+	if err == nil {
+		err = checkHealthPort(dep.HealthCheck, ports)
+	}
+	if err == nil {
+		err = publishable(rt.Info(), ports)
+	}
+	if err != nil {
+		logger.Error().Err(err).Str("deployment_id", depId).Msg("invalid port mappings")
+		response.StatusBadRequest(c, err.Error())
+		return
+	}
+
+	if dep.Resources, err = d.limits.apply(dep.Resources); err != nil {
+		logger.Error().Err(err).Str("deployment_id", depId).Msg("resource limit exceeded")
+		response.StatusUnProcessed(c, err.Error())
+		return
+	}
+
+	env, err := d.containerEnv(dep)
+	if err != nil {
+		logger.Error().Err(err).Str("deployment_id", depId).Msg("failed to prepare env")
+		response.StatusInternalServerError(c)
+		return
+	}
+
+	if ports, err = d.reservePorts(ctx, depId, node, ports); err != nil {
+		d.restorePorts(depId, dep, logger)
+		statusPortError(c, logger, depId, err)
+		return
+	}
+
+	if err = d.prepareNode(ctx, rt, dep, release.Tag); err != nil {
+		logger.Error().Err(err).Str("deployment_id", depId).Str("node", node).Msg("failed to prepare node")
+		d.restorePorts(depId, dep, logger)
+		response.StatusInternalServerError(c)
+		return
+	}
+
+	spec := ContainerSpec{
+		DeploymentId:  depId,
+		Name:          dep.Name + "-v" + strconv.Itoa(release.Version) + "-" + uuid.NewString()[:8],
+		Image:         release.Tag,
+		Ports:         ports,
+		Env:           env,
+		Resources:     dep.Resources,
+		RestartPolicy: withDefaultRestartPolicy(dep.RestartPolicy),
+		HealthCheck:   dep.HealthCheck,
+		Volumes:       dep.Volumes,
+		Aliases:       networkAliases(dep),
+		Links:         dep.Links,
+	}
+	cid, err := rt.CreateContainer(ctx, spec)
+	if err != nil {
+		logger.Error().Err(err).Str("deployment_id", depId).Msg("failed to create container")
+		d.restorePorts(depId, dep, logger)
+		response.StatusInternalServerError(c)
+		return
+	}
+
+	// the old container and the proxy hold the host ports until the new container is started,
+	// they are brought back when it fails
+	running := false
+	if dep.ContainerId != "" {
+		if running, err = isContainerRunning(ctx, rt, dep.ContainerId); err != nil && !client.IsErrNotFound(err) {
+			logger.Error().Err(err).Str("deployment_id", depId).Msg("failed to inspect container")
+			d.discardContainer(rt, cid, logger)
+			d.restorePorts(depId, dep, logger)
+			response.StatusInternalServerError(c)
+			return
+		}
+	}
+	proxied := d.proxy.serving(depId)
+	restore := func() {
+		d.discardContainer(rt, cid, logger)
+		d.restorePorts(depId, dep, logger)
+		if running {
+			if err := rt.StartContainer(context.Background(), dep.ContainerId); err != nil {
+				logger.Error().Err(err).Str("deployment_id", depId).Msg("failed to restart old container")
+			}
+		}
+		if primary, ok := primaryPort(dep.PortMappings()); proxied && ok {
+			if err := d.proxy.serve(depId, hostAddr(primary), loopbackAddr(dep.ProxyPort)); err != nil {
+				logger.Error().Err(err).Str("deployment_id", depId).Msg("failed to restore proxy")
+			}
+		}
+	}
+
+	if running {
+		if err = rt.StopContainer(ctx, dep.ContainerId); err != nil && !client.IsErrNotFound(err) {
+			logger.Error().Err(err).Str("deployment_id", depId).Msg("failed to stop old container")
+			running = false
+			restore()
+			response.StatusInternalServerError(c)
+			return
+		}
+	}
+	// a rolled back container publishes the host ports itself
+	d.proxy.stop(depId)
+
+	if err = rt.StartContainer(ctx, cid); err != nil {
+		logger.Error().Err(err).Str("deployment_id", depId).Msg("failed to start container")
+		restore()
+		response.StatusInternalServerError(c)
+		return
+	}
+
+	resources := dep.Resources
+	_, err = d.db.UpdateDeployment(ctx, depId, func(dep *model.Deployment) error {
+		dep.UpdatedAt = time.Now()
+		dep.Stage = model.ContainerCreated
+		dep.ContainerId = cid
+		dep.Node = node
+		dep.ImageId = release.ImageId
+		dep.Release = release.Version
+		dep.Resources = resources
+		setPorts(dep, ports)
+		dep.ProxyPort = 0
+		dep.RecreateRequired = false
+		dep.CrashLoop = nil
+		dep.Health = nil
+		return nil
+	})
+	if err != nil {
+		logger.Error().Err(err).Str("deployment_id", depId).Msg("failed to update deployment")
+		restore()
+		response.StatusInternalServerError(c)
+		return
+	}
+	if err = d.releasePorts(ctx, depId, ports); err != nil {
+		logger.Error().Err(err).Str("deployment_id", depId).Msg("failed to release previous ports")
+	}
+	if dep.ContainerId != "" {
+		d.discardContainer(rt, dep.ContainerId, logger)
+	}
+
+	logger.Info().Str("deployment_id", depId).Int("version", release.Version).Msg("deployment rolled back")
+	response.StatusCommonOK(c, "deployment rolled back to "+release.Tag)
+	return
+}
@@ -0,0 +1,186 @@
+package deployment
+
+import (
+	"GDHost/internal/config"
+	"GDHost/internal/database"
+	"GDHost/internal/model"
+	"GDHost/internal/response"
+	"errors"
+	"fmt"
+	"github.com/docker/docker/client"
+	"github.com/gin-contrib/requestid"
+	"github.com/gin-gonic/gin"
+	"github.com/go-playground/validator/v10"
+	"reflect"
+	"time"
+)
+
+// cpuPeriod is the CFS period the cpu quota is relative to, 100000 quota is one CPU
+const cpuPeriod = 100000
+
+var errResourceLimit = errors.New("resource limit exceeded")
+
+// resourceLimits are the configured defaults and maximums of the container resources
+type resourceLimits struct {
+	defaults model.Resources
+	max      model.Resources
+}
+
+func newResourceLimits(conf *config.Config) resourceLimits {
+	return resourceLimits{
+		defaults: model.Resources{
+			MemoryMB:  conf.DefaultMemoryMB,
+			CPUQuota:  conf.DefaultCPUQuota,
+			PidsLimit: conf.DefaultPidsLimit,
+		},
+		max: model.Resources{
+			MemoryMB:  conf.MaxMemoryMB,
+			CPUQuota:  conf.MaxCPUQuota,
+			PidsLimit: conf.MaxPidsLimit,
+		},
+	}
+}
+
+// apply fills the unset limits with the defaults, a limit without a default stays unlimited,
+// and rejects the limits above the maximum
+func (l resourceLimits) apply(res model.Resources) (model.Resources, error) {
+	var err error
+	if res.MemoryMB, err = capLimit("memory_mb", res.MemoryMB, l.defaults.MemoryMB, l.max.MemoryMB); err != nil {
+		return res, err
+	}
+	if res.CPUQuota, err = capLimit("cpu_quota", res.CPUQuota, l.defaults.CPUQuota, l.max.CPUQuota); err != nil {
+		return res, err
+	}
+	if res.PidsLimit, err = capLimit("pids_limit", res.PidsLimit, l.defaults.PidsLimit, l.max.PidsLimit); err != nil {
+		return res, err
+	}
+	if res.MemoryMB != 0 && res.MemoryReservationMB > res.MemoryMB {
+		return res, fmt.Errorf("%w: memory_reservation_mb is above memory_mb", errResourceLimit)
+	}
+	return res, nil
+}
+
+func capLimit(name string, value, def, max int64) (int64, error) {
+	if value == 0 {
+		value = def
+	}
+	if max != 0 && value > max {
+		return value, fmt.Errorf("%w: %s is above the maximum %d", errResourceLimit, name, max)
+	}
+	return value, nil
+}
+
+type UlimitReq struct {
+	Name string `json:"name" validate:"required,oneof=core cpu data fsize locks memlock msgqueue nice nofile nproc rss rtprio rttime sigpending stack"`
+	Soft int64  `json:"soft" validate:"min=0"`
+	Hard int64  `json:"hard" validate:"min=0,gtefield=Soft"`
+}
+
+type ResourcesReq struct {
+	MemoryMB            int64       `json:"memory_mb,omitempty" validate:"omitempty,min=6"`
+	MemoryReservationMB int64       `json:"memory_reservation_mb,omitempty" validate:"omitempty,min=6"`
+	CPUQuota            int64       `json:"cpu_quota,omitempty" validate:"omitempty,min=1000"`
+	CPUShares           int64       `json:"cpu_shares,omitempty" validate:"omitempty,min=2,max=262144"`
+	PidsLimit           int64       `json:"pids_limit,omitempty" validate:"omitempty,min=1"`
+	Ulimits             []UlimitReq `json:"ulimits,omitempty" validate:"dive"`
+}
+
+func (req *ResourcesReq) resources() model.Resources {
+	res := model.Resources{
+		MemoryMB:            req.MemoryMB,
+		MemoryReservationMB: req.MemoryReservationMB,
+		CPUQuota:            req.CPUQuota,
+		CPUShares:           req.CPUShares,
+		PidsLimit:           req.PidsLimit,
+	}
+	for _, u := range req.Ulimits {
+		res.Ulimits = append(res.Ulimits, model.Ulimit{Name: u.Name, Soft: u.Soft, Hard: u.Hard})
+	}
+	return res
+}
+
+// clearedLimits reports whether a limit of old is removed by res. The engine ignores the zero limits of an update,
+// so the container keeps the memory and cpu limits until it is recreated. The pids limit is cleared in place.
+func clearedLimits(old model.Resources, res model.Resources) bool {
+	return old.MemoryMB != 0 && res.MemoryMB == 0 ||
+		old.MemoryReservationMB != 0 && res.MemoryReservationMB == 0 ||
+		old.CPUQuota != 0 && res.CPUQuota == 0 ||
+		old.CPUShares != 0 && res.CPUShares == 0
+}
+
+func (d *deployment) UpdateResources(c *gin.Context) {
+	logger := d.logger.With().Str("request_id", requestid.Get(c)).Logger()
+
+	depId := c.Param("id")
+	if depId == "" {
+		logger.Error().Msg("no deployment id")
+		response.StatusBadRequest(c, "no deployment id")
+		return
+	}
+
+	var req ResourcesReq
+	if err := c.BindJSON(&req); err != nil {
+		logger.Error().Err(err).Msg("failed to bind request")
+		response.StatusBadRequest(c, "failed to bind request")
+		return
+	}
+	if err := validator.New().Struct(req); err != nil {
+		logger.Error().Err(err).Msg("request validation error")
+		response.StatusBadRequest(c, err.Error())
+		return
+	}
+
+	res, err := d.limits.apply(req.resources())
+	if err != nil {
+		logger.Error().Err(err).Msg("resource limit exceeded")
+		response.StatusUnProcessed(c, err.Error())
+		return
+	}
+
+	ctx := c.Request.Context()
+	dep, err := d.db.GetDeployment(ctx, depId)
+	if err != nil {
+		if errors.Is(err, database.ErrNotFound) {
+			logger.Error().Err(err).Str("deployment_id", depId).Msg("deployment not found")
+			response.StatusNotFound(c, "deployment not found")
+			return
+		}
+		logger.Error().Err(err).Str("deployment_id", depId).Msg("failed to find deployment")
+		response.StatusInternalServerError(c)
+		return
+	}
+
+	// the limits of a running container are updated in place, ulimits only apply to a new container
+	recreate := false
+	if dep.ContainerId != "" {
+		rt, err := d.runtime(ctx, placedNode(dep))
+		if err != nil {
+			statusNodeError(c, logger, depId, err)
+			return
+		}
+		if err = rt.UpdateResources(ctx, dep.ContainerId, res); err != nil && !client.IsErrNotFound(err) {
+			logger.Error().Err(err).Str("deployment_id", depId).Msg("failed to update container resources")
+			response.StatusInternalServerError(c)
+			return
+		}
+		recreate = !reflect.DeepEqual(dep.Resources.Ulimits, res.Ulimits) || clearedLimits(dep.Resources, res)
+	}
+
+	_, err = d.db.UpdateDeployment(ctx, depId, func(dep *model.Deployment) error {
+		dep.UpdatedAt = time.Now()
+		dep.Resources = res
+		if recreate {
+			dep.RecreateRequired = true
+		}
+		return nil
+	})
+	if err != nil {
+		logger.Error().Err(err).Str("deployment_id", depId).Msg("failed to update deployment")
+		response.StatusInternalServerError(c)
+		return
+	}
+
+	logger.Info().Str("deployment_id", depId).Msg("resources updated")
+	response.StatusCommonOK(c, "resources updated")
+	return
+}
@@ -0,0 +1,489 @@
+package deployment
+
+import (
+	"GDHost/internal/database"
+	"GDHost/internal/model"
+	"GDHost/internal/response"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"github.com/docker/docker/api/types/events"
+	"github.com/gin-contrib/requestid"
+	"github.com/gin-gonic/gin"
+	"github.com/go-playground/validator/v10"
+	"github.com/rs/zerolog"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const stoppedPage = `<!DOCTYPE html>
+<html>
+<head><title>503 Service Unavailable</title></head>
+<body>
+<h1>Service Unavailable</h1>
+<p>The deployment is stopped. Start it again to serve this address.</p>
+</body>
+</html>
+`
+
+// challengePath is where the router serves the verification token of a custom domain
+const challengePath = "/.well-known/gdhost-challenge/"
+
+// hostnameRegex is a DNS label, deployments with other names are only routed by path prefix
+var hostnameRegex = regexp.MustCompile(`^[a-z0-9]([a-z0-9-]{0,61}[a-z0-9])?$`)
+
+// route is where the http proxy sends the requests of a deployment. A route without target is a stopped deployment.
+type route struct {
+	host    string
+	domains []string
+	prefix  string
+	strip   bool
+	target  *url.URL
+	proxy   *httputil.ReverseProxy
+}
+
+// challenge is the token served on a custom domain until it is verified
+type challenge struct {
+	depId string
+	token string
+}
+
+// router routes the requests by host and path prefix to the containers of the deployments
+type router struct {
+	mu         sync.RWMutex
+	domain     string
+	routes     map[string]*route
+	hosts      map[string]*route
+	prefixes   []*route
+	challenges map[string]challenge
+	logger     *zerolog.Logger
+}
+
+func newRouter(domain string, logger *zerolog.Logger) *router {
+	return &router{
+		domain:     strings.ToLower(domain),
+		routes:     make(map[string]*route),
+		hosts:      make(map[string]*route),
+		challenges: make(map[string]challenge),
+		logger:     logger,
+	}
+}
+
+// hostname returns the host of the deployment, or empty when its name is not a DNS label
+func (r *router) hostname(name string) string {
+	name = strings.ToLower(name)
+	if r.domain == "" || !hostnameRegex.MatchString(name) {
+		return ""
+	}
+	return name + "." + r.domain
+}
+
+// set replaces the route of the deployment
+func (r *router) set(depId string, rt *route) {
+	if rt.target != nil {
+		rt.proxy = r.reverseProxy(rt)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.routes[depId] = rt
+	r.index()
+}
+
+// remove drops the route and the challenges of a deleted deployment
+func (r *router) remove(depId string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.routes, depId)
+	for host, ch := range r.challenges {
+		if ch.depId == depId {
+			delete(r.challenges, host)
+		}
+	}
+	r.index()
+}
+
+// setChallenge serves the token on the custom domain until removeChallenge
+func (r *router) setChallenge(host string, depId string, token string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.challenges[host] = challenge{depId: depId, token: token}
+}
+
+func (r *router) removeChallenge(host string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.challenges, host)
+}
+
+// challengeToken returns the token of the custom domain, or empty when it is not being verified
+func (r *router) challengeToken(host string) string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.challenges[host].token
+}
+
+// index rebuilds the lookup by host and the path prefixes, the longest prefix first
+func (r *router) index() {
+	r.hosts = make(map[string]*route, len(r.routes))
+	r.prefixes = r.prefixes[:0]
+	for _, rt := range r.routes {
+		if rt.host != "" {
+			r.hosts[rt.host] = rt
+		}
+		for _, host := range rt.domains {
+			r.hosts[host] = rt
+		}
+		if rt.prefix != "" {
+			r.prefixes = append(r.prefixes, rt)
+		}
+	}
+	sort.Slice(r.prefixes, func(i, j int) bool {
+		return len(r.prefixes[i].prefix) > len(r.prefixes[j].prefix)
+	})
+}
+
+// serves reports whether the host is the base domain, the hostname or a verified domain of a deployment
+func (r *router) serves(host string) bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	_, ok := r.hosts[host]
+	return ok || (host != "" && host == r.domain)
+}
+
+// match returns the route of the deployment host, or of the longest path prefix on the base domain
+func (r *router) match(host string, p string) *route {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	if rt, ok := r.hosts[host]; ok {
+		return rt
+	}
+	if host != r.domain {
+		return nil
+	}
+	for _, rt := range r.prefixes {
+		if hasPathPrefix(p, rt.prefix) {
+			return rt
+		}
+	}
+	return nil
+}
+
+// hasPathPrefix matches whole path segments, /api matches /api and /api/v1 but not /apis
+func hasPathPrefix(p string, prefix string) bool {
+	if prefix == "/" {
+		return true
+	}
+	return p == prefix || strings.HasPrefix(p, prefix+"/")
+}
+
+func (r *router) reverseProxy(rt *route) *httputil.ReverseProxy {
+	return &httputil.ReverseProxy{
+		Rewrite: func(pr *httputil.ProxyRequest) {
+			if rt.strip && rt.prefix != "/" && requestHost(pr.In) == r.domain {
+				pr.Out.URL.Path = strings.TrimPrefix(pr.Out.URL.Path, rt.prefix)
+				pr.Out.URL.RawPath = ""
+			}
+			pr.SetURL(rt.target)
+			pr.SetXForwarded()
+			pr.Out.Host = pr.In.Host
+		},
+		ErrorHandler: func(w http.ResponseWriter, req *http.Request, err error) {
+			r.logger.Error().Err(err).Str("host", req.Host).Str("target", rt.target.Host).Msg("failed to proxy request")
+			http.Error(w, "bad gateway", http.StatusBadGateway)
+		},
+	}
+}
+
+// requestHost returns the host of the request without the port
+func requestHost(req *http.Request) string {
+	host := strings.ToLower(req.Host)
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return host
+}
+
+func (r *router) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	host := requestHost(req)
+	if strings.HasPrefix(req.URL.Path, challengePath) {
+		token := r.challengeToken(host)
+		if token == "" || req.URL.Path != challengePath+token {
+			http.NotFound(w, req)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		_, _ = w.Write([]byte(token))
+		return
+	}
+
+	rt := r.match(host, req.URL.Path)
+	if rt == nil {
+		http.NotFound(w, req)
+		return
+	}
+	if rt.proxy == nil {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Header().Set("Retry-After", "30")
+		w.WriteHeader(http.StatusServiceUnavailable)
+		_, _ = w.Write([]byte(stoppedPage))
+		return
+	}
+	rt.proxy.ServeHTTP(w, req)
+}
+
+// startHTTPProxy listens on the port and serves the router until Close
+func (d *deployment) startHTTPProxy(port int) error {
+	ln, err := net.Listen("tcp", ":"+strconv.Itoa(port))
+	if err != nil {
+		return fmt.Errorf("failed to listen on http proxy port: %w", err)
+	}
+	d.httpProxy = d.serveRouter(ln)
+	return nil
+}
+
+// startHTTPSProxy serves the router over tls. The hostnames of the deployments get a certificate of the local CA,
+// other hosts the configured certificate.
+func (d *deployment) startHTTPSProxy(port int, certFile string, keyFile string) error {
+	if certFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return fmt.Errorf("failed to load tls certificate: %w", err)
+		}
+		d.tlsCert = &cert
+	}
+	if d.ca == nil && d.tlsCert == nil {
+		return errors.New("https proxy needs local_ca or tls_cert_file")
+	}
+
+	ln, err := net.Listen("tcp", ":"+strconv.Itoa(port))
+	if err != nil {
+		return fmt.Errorf("failed to listen on https proxy port: %w", err)
+	}
+	cfg := &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: d.getCertificate,
+	}
+	d.httpsProxy = d.serveRouter(tls.NewListener(ln, cfg))
+	return nil
+}
+
+func (d *deployment) serveRouter(ln net.Listener) *http.Server {
+	srv := &http.Server{
+		Handler:           d.router,
+		ReadHeaderTimeout: 30 * time.Second,
+	}
+	go func() {
+		if err := srv.Serve(ln); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			d.logger.Error().Err(err).Str("addr", ln.Addr().String()).Msg("proxy server stopped")
+		}
+	}()
+	return srv
+}
+
+func (d *deployment) getCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	host := strings.ToLower(hello.ServerName)
+	if d.ca != nil && d.router.serves(host) {
+		return d.ca.certificate(host)
+	}
+	if d.tlsCert != nil {
+		return d.tlsCert, nil
+	}
+	return nil, fmt.Errorf("no certificate for host %q", host)
+}
+
+// refreshRoute updates the route of the deployment from its record and the state of its container
+func (d *deployment) refreshRoute(ctx context.Context, depId string) {
+	dep, err := d.db.GetDeployment(ctx, depId)
+	if err != nil {
+		if errors.Is(err, database.ErrNotFound) {
+			d.router.remove(depId)
+			return
+		}
+		d.logger.Error().Err(err).Str("deployment_id", depId).Msg("failed to find deployment for route")
+		return
+	}
+
+	rt := &route{host: d.router.hostname(dep.Name)}
+	verified := true
+	domains, err := d.db.ListDomains(ctx, database.DomainQuery{DeploymentId: depId, Verified: &verified})
+	if err != nil {
+		d.logger.Error().Err(err).Str("deployment_id", depId).Msg("failed to find domains for route")
+		return
+	}
+	for _, domain := range domains {
+		rt.domains = append(rt.domains, domain.Name)
+	}
+	if dep.Route != nil {
+		rt.prefix = dep.Route.PathPrefix
+		rt.strip = dep.Route.StripPrefix
+	}
+	primary, ok := primaryPort(dep.PortMappings())
+	if dep.ContainerId != "" && ok {
+		if ctr, err := d.runtime(ctx, placedNode(dep)); err == nil {
+			inspect, err := ctr.InspectContainer(ctx, dep.ContainerId)
+			if err == nil && inspect.State != nil && inspect.State.Running {
+				if addr := d.containerAddr(ctx, dep, inspect, primary.ContainerPort); addr != "" {
+					rt.target = &url.URL{Scheme: "http", Host: addr}
+				}
+			}
+		} else {
+			d.logger.Error().Err(err).Str("deployment_id", depId).Msg("failed to find node for route")
+		}
+	}
+	d.router.set(depId, rt)
+}
+
+// restoreRoutes builds the routes of every deployment and the challenges of the unverified domains at start up
+func (d *deployment) restoreRoutes(ctx context.Context) error {
+	deps, err := d.db.ListDeployments(ctx, database.DeploymentQuery{})
+	if err != nil {
+		return fmt.Errorf("failed to find deployments: %w", err)
+	}
+	for _, dep := range deps {
+		d.refreshRoute(ctx, dep.Id)
+	}
+
+	pending := false
+	domains, err := d.db.ListDomains(ctx, database.DomainQuery{Verified: &pending})
+	if err != nil {
+		return fmt.Errorf("failed to find domains: %w", err)
+	}
+	for _, domain := range domains {
+		d.router.setChallenge(domain.Name, domain.DeploymentId, domain.Token)
+	}
+	return nil
+}
+
+// routeEvent refreshes the route of the deployment whose container started or stopped.
+// Containers created before they were labelled are looked up by id.
+func (d *deployment) routeEvent(ctx context.Context, msg events.Message) {
+	depId := msg.Actor.Attributes[deploymentLabel]
+	if depId == "" {
+		deps, err := d.db.ListDeployments(ctx, database.DeploymentQuery{ContainerId: msg.Actor.ID, Limit: 1})
+		if err != nil || len(deps) == 0 {
+			return
+		}
+		depId = deps[0].Id
+	}
+	d.refreshRoute(ctx, depId)
+}
+
+type RouteReq struct {
+	PathPrefix  string `json:"path_prefix" validate:"required,startswith=/"`
+	StripPrefix bool   `json:"strip_prefix,omitempty"`
+}
+
+func (d *deployment) UpdateRoute(c *gin.Context) {
+	logger := d.logger.With().Str("request_id", requestid.Get(c)).Logger()
+
+	depId := c.Param("id")
+	if depId == "" {
+		logger.Error().Msg("no deployment id")
+		response.StatusBadRequest(c, "no deployment id")
+		return
+	}
+
+	var req RouteReq
+	if err := c.BindJSON(&req); err != nil {
+		logger.Error().Err(err).Msg("failed to bind request")
+		response.StatusBadRequest(c, "failed to bind request")
+		return
+	}
+	if err := validator.New().Struct(req); err != nil {
+		logger.Error().Err(err).Msg("request validation error")
+		response.StatusBadRequest(c, err.Error())
+		return
+	}
+	req.PathPrefix = path.Clean(req.PathPrefix)
+
+	ctx := c.Request.Context()
+	owners, err := d.db.ListDeployments(ctx, database.DeploymentQuery{PathPrefix: req.PathPrefix})
+	if err != nil {
+		logger.Error().Err(err).Str("deployment_id", depId).Msg("failed to find deployment")
+		response.StatusInternalServerError(c)
+		return
+	}
+	for _, owner := range owners {
+		if owner.Id != depId {
+			logger.Error().Str("deployment_id", depId).Str("owner", owner.Id).Msg("path prefix already used")
+			response.StatusConflicted(c, "path prefix is used by deployment "+owner.Id)
+			return
+		}
+	}
+
+	// the database rejects a path prefix claimed by another deployment since the lookup
+	_, err = d.db.UpdateDeployment(ctx, depId, func(dep *model.Deployment) error {
+		dep.UpdatedAt = time.Now()
+		dep.Route = &model.Route{
+			PathPrefix:  req.PathPrefix,
+			StripPrefix: req.StripPrefix,
+		}
+		return nil
+	})
+	if err != nil {
+		if errors.Is(err, database.ErrDuplicate) {
+			logger.Error().Err(err).Str("deployment_id", depId).Msg("path prefix already used")
+			response.StatusConflicted(c, "path prefix is used by another deployment")
+			return
+		}
+		if errors.Is(err, database.ErrNotFound) {
+			logger.Error().Err(err).Str("deployment_id", depId).Msg("deployment not found")
+			response.StatusNotFound(c, "deployment not found")
+			return
+		}
+		logger.Error().Err(err).Str("deployment_id", depId).Msg("failed to update deployment")
+		response.StatusInternalServerError(c)
+		return
+	}
+	d.refreshRoute(ctx, depId)
+
+	logger.Info().Str("deployment_id", depId).Str("path_prefix", req.PathPrefix).Msg("route updated")
+	response.StatusCommonOK(c, "route updated")
+	return
+}
+
+func (d *deployment) DeleteRoute(c *gin.Context) {
+	logger := d.logger.With().Str("request_id", requestid.Get(c)).Logger()
+
+	depId := c.Param("id")
+	if depId == "" {
+		logger.Error().Msg("no deployment id")
+		response.StatusBadRequest(c, "no deployment id")
+		return
+	}
+
+	ctx := c.Request.Context()
+	_, err := d.db.UpdateDeployment(ctx, depId, func(dep *model.Deployment) error {
+		dep.UpdatedAt = time.Now()
+		dep.Route = nil
+		return nil
+	})
+	if err != nil {
+		if errors.Is(err, database.ErrNotFound) {
+			logger.Error().Err(err).Str("deployment_id", depId).Msg("deployment not found")
+			response.StatusNotFound(c, "deployment not found")
+			return
+		}
+		logger.Error().Err(err).Str("deployment_id", depId).Msg("failed to update deployment")
+		response.StatusInternalServerError(c)
+		return
+	}
+	d.refreshRoute(ctx, depId)
+
+	logger.Info().Str("deployment_id", depId).Msg("route deleted")
+	response.StatusCommonOK(c, "route deleted")
+	return
+}
@@ -0,0 +1,468 @@
+package deployment
+
+import (
+	"GDHost/internal/database"
+	"GDHost/internal/model"
+	"GDHost/internal/response"
+	templates "GDHost/internal/template"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/gin-contrib/requestid"
+	"github.com/gin-gonic/gin"
+	"github.com/go-playground/validator/v10"
+	"github.com/google/uuid"
+	"github.com/rs/zerolog"
+	"math"
+	"regexp"
+	"strconv"
+	"text/template"
+	"time"
+)
+
+type TemplateRegistry interface {
+	CreateTemplate(c *gin.Context)
+	GetTemplates(c *gin.Context)
+	GetTemplate(c *gin.Context)
+	UpdateTemplate(c *gin.Context)
+	DeleteTemplate(c *gin.Context)
+}
+
+type templateRegistry struct {
+	db     database.Database
+	logger *zerolog.Logger
+}
+
+var (
+	templateNameRegex  = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]*$`)
+	templateParamRegex = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+)
+
+// NewTemplateRegistry seeds the built-in templates into the database and returns TemplateRegistry
+func NewTemplateRegistry(db database.Database, logger *zerolog.Logger) (TemplateRegistry, error) {
+	tr := &templateRegistry{
+		db:     db,
+		logger: logger,
+	}
+	return tr, tr.seed(context.Background())
+}
+
+// builtInTemplates returns the embedded templates which are seeded into the database
+func builtInTemplates() ([]model.Template, error) {
+	goData, err := templates.FS.ReadFile(goTemplateFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read built-in 'go' template: %w", err)
+	}
+	return []model.Template{
+		{
+			Name:        "go",
+			Description: "Multi-stage Go build on alpine",
+			Data:        string(goData),
+			Parameters: []model.TemplateParameter{
+				{Name: "GoVersion", Type: "string", Required: true, Description: "Go version of the build image"},
+				{Name: "GOOS", Type: "string", Default: goDefaultOS},
+				{Name: "GOARCH", Type: "string", Default: goDefaultArch},
+				{Name: "CGO", Type: "string", Default: "CGO_ENABLED=0", Enum: []string{"CGO_ENABLED=0", "CGO_ENABLED=1"}},
+				{Name: "TAG", Type: "string", Description: "Build tags"},
+				{Name: "OUTPUT", Type: "string", Default: goDefaultOutput, Description: "Name of the binary"},
+				{Name: "FLAGS", Type: "string", Description: "Extra build flags"},
+			},
+			BuiltIn: true,
+		},
+	}, nil
+}
+
+// seed inserts the built-in templates or refreshes them when they already exist
+func (tr *templateRegistry) seed(ctx context.Context) error {
+	builtIns, err := builtInTemplates()
+	if err != nil {
+		return err
+	}
+
+	for _, tmpl := range builtIns {
+		_, err = tr.db.GetTemplate(ctx, tmpl.Name)
+		if err != nil {
+			if !errors.Is(err, database.ErrNotFound) {
+				return fmt.Errorf("failed to find template: %w", err)
+			}
+			tmpl.Id = uuid.NewString()
+			tmpl.CreatedAt = time.Now()
+			tmpl.UpdatedAt = time.Now()
+			if err = tr.db.CreateTemplate(ctx, &tmpl); err != nil {
+				return fmt.Errorf("failed to seed '%s' template: %w", tmpl.Name, err)
+			}
+			continue
+		}
+
+		builtIn := tmpl
+		_, err = tr.db.UpdateTemplate(ctx, tmpl.Name, func(tmpl *model.Template) error {
+			tmpl.UpdatedAt = time.Now()
+			tmpl.Description = builtIn.Description
+			tmpl.Data = builtIn.Data
+			tmpl.Parameters = builtIn.Parameters
+			tmpl.BuiltIn = true
+			return nil
+		})
+		if err != nil {
+			return fmt.Errorf("failed to refresh '%s' template: %w", tmpl.Name, err)
+		}
+	}
+	return nil
+}
+
+type TemplateParameterReq struct {
+	Name        string   `json:"name" validate:"required"`
+	Type        string   `json:"type" validate:"required,oneof=string int bool"`
+	Required    bool     `json:"required,omitempty"`
+	Default     string   `json:"default,omitempty"`
+	Enum        []string `json:"enum,omitempty"`
+	Description string   `json:"description,omitempty"`
+}
+
+type CreateTemplateReq struct {
+	Name        string                 `json:"name" validate:"required,max=64"`
+	Description string                 `json:"description,omitempty"`
+	Data        string                 `json:"data" validate:"required"`
+	Parameters  []TemplateParameterReq `json:"parameters" validate:"dive"`
+}
+
+// validate checks the template syntax and the parameter schema
+func (msg *CreateTemplateReq) validate() error {
+	if err := validator.New().Struct(msg); err != nil {
+		return err
+	}
+	if !templateNameRegex.MatchString(msg.Name) {
+		return fmt.Errorf("name must contain only lower case letters, digits, '-' and '_'")
+	}
+	if _, err := template.New(msg.Name).Parse(msg.Data); err != nil {
+		return fmt.Errorf("invalid template: %w", err)
+	}
+
+	names := make(map[string]struct{})
+	for _, param := range msg.Parameters {
+		if !templateParamRegex.MatchString(param.Name) {
+			return fmt.Errorf("invalid parameter name '%s'", param.Name)
+		}
+		if _, ok := names[param.Name]; ok {
+			return fmt.Errorf("duplicated parameter '%s'", param.Name)
+		}
+		names[param.Name] = struct{}{}
+
+		for _, value := range param.Enum {
+			if _, err := parseTemplateValue(param.Type, value); err != nil {
+				return fmt.Errorf("invalid enum value of parameter '%s': %w", param.Name, err)
+			}
+		}
+		if param.Default != "" {
+			if _, err := parseTemplateValue(param.Type, param.Default); err != nil {
+				return fmt.Errorf("invalid default value of parameter '%s': %w", param.Name, err)
+			}
+		}
+	}
+	return nil
+}
+
+// parameters converts the request parameters into the model
+func (msg *CreateTemplateReq) parameters() []model.TemplateParameter {
+	params := make([]model.TemplateParameter, 0, len(msg.Parameters))
+	for _, param := range msg.Parameters {
+		params = append(params, model.TemplateParameter{
+			Name:        param.Name,
+			Type:        param.Type,
+			Required:    param.Required,
+			Default:     param.Default,
+			Enum:        param.Enum,
+			Description: param.Description,
+		})
+	}
+	return params
+}
+
+// parseTemplateValue parses a string value of the parameter type
+func parseTemplateValue(typ, value string) (interface{}, error) {
+	switch typ {
+	case "int":
+		return strconv.Atoi(value)
+	case "bool":
+		return strconv.ParseBool(value)
+	default:
+		return value, nil
+	}
+}
+
+// zeroTemplateValue returns the zero value of the parameter type
+func zeroTemplateValue(typ string) interface{} {
+	switch typ {
+	case "int":
+		return 0
+	case "bool":
+		return false
+	default:
+		return ""
+	}
+}
+
+// templateValue checks that a JSON value is of the parameter type and returns it as a string
+func templateValue(typ string, value interface{}) (string, error) {
+	switch v := value.(type) {
+	case string:
+		if typ == "string" {
+			return v, nil
+		}
+	case bool:
+		if typ == "bool" {
+			return strconv.FormatBool(v), nil
+		}
+	case float64:
+		if typ == "int" && v == math.Trunc(v) {
+			return strconv.Itoa(int(v)), nil
+		}
+	}
+	return "", fmt.Errorf("must be of type '%s'", typ)
+}
+
+// renderParameters validates the parameters against the template schema and fills in the defaults
+func renderParameters(schema []model.TemplateParameter, params map[string]interface{}) (map[string]interface{}, error) {
+	known := make(map[string]struct{}, len(schema))
+	for _, param := range schema {
+		known[param.Name] = struct{}{}
+	}
+	for name := range params {
+		if _, ok := known[name]; !ok {
+			return nil, fmt.Errorf("unknown parameter '%s'", name)
+		}
+	}
+
+	values := make(map[string]interface{}, len(schema))
+	for _, param := range schema {
+		raw := param.Default
+		if value, ok := params[param.Name]; ok && value != nil {
+			var err error
+			if raw, err = templateValue(param.Type, value); err != nil {
+				return nil, fmt.Errorf("parameter '%s' %w", param.Name, err)
+			}
+		} else if param.Required {
+			return nil, fmt.Errorf("parameter '%s' is required", param.Name)
+		}
+
+		if raw == "" {
+			values[param.Name] = zeroTemplateValue(param.Type)
+			continue
+		}
+
+		if len(param.Enum) > 0 {
+			found := false
+			for _, e := range param.Enum {
+				if e == raw {
+					found = true
+					break
+				}
+			}
+			if !found {
+				return nil, fmt.Errorf("parameter '%s' must be one of %v", param.Name, param.Enum)
+			}
+		}
+
+		value, err := parseTemplateValue(param.Type, raw)
+		if err != nil {
+			return nil, fmt.Errorf("parameter '%s' %w", param.Name, err)
+		}
+		values[param.Name] = value
+	}
+	return values, nil
+}
+
+func (tr *templateRegistry) CreateTemplate(c *gin.Context) {
+	logger := tr.logger.With().Str("request_id", requestid.Get(c)).Logger()
+
+	msg := CreateTemplateReq{}
+	if err := c.BindJSON(&msg); err != nil {
+		logger.Error().Err(err).Msg("bad request")
+		return
+	}
+
+	if err := msg.validate(); err != nil {
+		logger.Error().Err(err).Msg("request validation error")
+		response.StatusBadRequest(c, err.Error())
+		return
+	}
+
+	ctx := c.Request.Context()
+	_, err := tr.db.GetTemplate(ctx, msg.Name)
+	if err != nil {
+		if !errors.Is(err, database.ErrNotFound) {
+			logger.Error().Err(err).Msg("failed to find template")
+			response.StatusInternalServerError(c)
+			return
+		}
+	} else {
+		logger.Error().Str("template", msg.Name).Msg("duplicated name")
+		response.StatusConflicted(c, "duplicated name")
+		return
+	}
+
+	tmpl := model.Template{
+		Id:          uuid.NewString(),
+		CreatedAt:   time.Now(),
+		UpdatedAt:   time.Now(),
+		Name:        msg.Name,
+		Description: msg.Description,
+		Data:        msg.Data,
+		Parameters:  msg.parameters(),
+	}
+	if err = tr.db.CreateTemplate(ctx, &tmpl); err != nil {
+		if errors.Is(err, database.ErrDuplicate) {
+			logger.Error().Str("template", msg.Name).Msg("duplicated name")
+			response.StatusConflicted(c, "duplicated name")
+			return
+		}
+		logger.Error().Err(err).Msg("failed to create template")
+		response.StatusInternalServerError(c)
+		return
+	}
+
+	logger.Info().Str("template", tmpl.Name).Msg("template created")
+	response.StatusCommonOK(c, tmpl.Id)
+	return
+}
+
+func (tr *templateRegistry) GetTemplates(c *gin.Context) {
+	logger := tr.logger.With().Str("request_id", requestid.Get(c)).Logger()
+
+	ctx := c.Request.Context()
+	tmpls, err := tr.db.ListTemplates(ctx)
+	if err != nil {
+		logger.Error().Err(err).Msg("failed to find templates")
+		response.StatusInternalServerError(c)
+		return
+	}
+
+	if len(tmpls) == 0 {
+		logger.Info().Msg("no templates")
+		response.StatusNoContent(c)
+		return
+	}
+
+	logger.Info().Int("templates", len(tmpls)).Msg("templates sent")
+	response.StatusTemplates(c, &tmpls)
+	return
+}
+
+func (tr *templateRegistry) GetTemplate(c *gin.Context) {
+	logger := tr.logger.With().Str("request_id", requestid.Get(c)).Logger()
+
+	name := c.Param("name")
+	ctx := c.Request.Context()
+	tmpl, err := tr.db.GetTemplate(ctx, name)
+	if err != nil {
+		if errors.Is(err, database.ErrNotFound) {
+			logger.Error().Err(err).Str("template", name).Msg("template not found")
+			response.StatusNotFound(c, "template not found")
+			return
+		}
+		logger.Error().Err(err).Str("template", name).Msg("failed to find template")
+		response.StatusInternalServerError(c)
+		return
+	}
+
+	logger.Info().Str("template", name).Msg("template sent")
+	response.StatusTemplate(c, tmpl)
+	return
+}
+
+func (tr *templateRegistry) UpdateTemplate(c *gin.Context) {
+	logger := tr.logger.With().Str("request_id", requestid.Get(c)).Logger()
+
+	name := c.Param("name")
+
+	msg := CreateTemplateReq{}
+	if err := c.BindJSON(&msg); err != nil {
+		logger.Error().Err(err).Msg("bad request")
+		return
+	}
+	if msg.Name == "" {
+		msg.Name = name
+	}
+
+	if err := msg.validate(); err != nil {
+		logger.Error().Err(err).Msg("request validation error")
+		response.StatusBadRequest(c, err.Error())
+		return
+	}
+
+	ctx := c.Request.Context()
+	tmpl, err := tr.db.GetTemplate(ctx, name)
+	if err != nil {
+		if errors.Is(err, database.ErrNotFound) {
+			logger.Error().Err(err).Str("template", name).Msg("template not found")
+			response.StatusNotFound(c, "template not found")
+			return
+		}
+		logger.Error().Err(err).Str("template", name).Msg("failed to find template")
+		response.StatusInternalServerError(c)
+		return
+	}
+
+	if tmpl.BuiltIn {
+		logger.Error().Str("template", name).Msg("built-in template cannot be modified")
+		response.StatusUnProcessed(c, "built-in template cannot be modified")
+		return
+	}
+
+	_, err = tr.db.UpdateTemplate(ctx, name, func(tmpl *model.Template) error {
+		tmpl.UpdatedAt = time.Now()
+		tmpl.Name = msg.Name
+		tmpl.Description = msg.Description
+		tmpl.Data = msg.Data
+		tmpl.Parameters = msg.parameters()
+		return nil
+	})
+	if err != nil {
+		if errors.Is(err, database.ErrDuplicate) {
+			logger.Error().Str("template", msg.Name).Msg("duplicated name")
+			response.StatusConflicted(c, "duplicated name")
+			return
+		}
+		logger.Error().Err(err).Str("template", name).Msg("failed to update template")
+		response.StatusInternalServerError(c)
+		return
+	}
+
+	logger.Info().Str("template", msg.Name).Msg("template updated")
+	response.StatusCommonOK(c, "template updated")
+	return
+}
+
+func (tr *templateRegistry) DeleteTemplate(c *gin.Context) {
+	logger := tr.logger.With().Str("request_id", requestid.Get(c)).Logger()
+
+	name := c.Param("name")
+	ctx := c.Request.Context()
+	tmpl, err := tr.db.GetTemplate(ctx, name)
+	if err != nil {
+		if errors.Is(err, database.ErrNotFound) {
+			logger.Error().Err(err).Str("template", name).Msg("template not found")
+			response.StatusNotFound(c, "template not found")
+			return
+		}
+		logger.Error().Err(err).Str("template", name).Msg("failed to find template")
+		response.StatusInternalServerError(c)
+		return
+	}
+
+	if tmpl.BuiltIn {
+		logger.Error().Str("template", name).Msg("built-in template cannot be deleted")
+		response.StatusUnProcessed(c, "built-in template cannot be deleted")
+		return
+	}
+
+	if err = tr.db.DeleteTemplate(ctx, name); err != nil {
+		logger.Error().Err(err).Str("template", name).Msg("failed to delete template")
+		response.StatusInternalServerError(c)
+		return
+	}
+
+	logger.Info().Str("template", name).Msg("template deleted")
+	response.StatusCommonOK(c, "template deleted")
+	return
+}
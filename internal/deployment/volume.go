@@ -0,0 +1,243 @@
+package deployment
+
+import (
+	"GDHost/internal/database"
+	"GDHost/internal/model"
+	"GDHost/internal/response"
+	"errors"
+	"github.com/docker/docker/client"
+	"github.com/docker/docker/errdefs"
+	"github.com/gin-contrib/requestid"
+	"github.com/gin-gonic/gin"
+	"github.com/go-playground/validator/v10"
+	"path"
+	"regexp"
+	"slices"
+	"time"
+)
+
+var volumeNameRegex = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_.-]*$`)
+
+type CreateVolumeReq struct {
+	Name     string `json:"name" validate:"required,max=64"`
+	Target   string `json:"target" validate:"required,startswith=/,ne=/"`
+	ReadOnly bool   `json:"read_only,omitempty"`
+}
+
+// volumeSource returns the docker volume name of a deployment volume
+func volumeSource(depId string, name string) string {
+	return "gdhost-" + depId + "-" + name
+}
+
+func (d *deployment) CreateVolume(c *gin.Context) {
+	logger := d.logger.With().Str("request_id", requestid.Get(c)).Logger()
+
+	depId := c.Param("id")
+	if depId == "" {
+		logger.Error().Msg("no deployment id")
+		response.StatusBadRequest(c, "no deployment id")
+		return
+	}
+
+	var req CreateVolumeReq
+	if err := c.BindJSON(&req); err != nil {
+		logger.Error().Err(err).Msg("failed to bind request")
+		response.StatusBadRequest(c, "failed to bind request")
+		return
+	}
+	if err := validator.New().Struct(req); err != nil {
+		logger.Error().Err(err).Msg("request validation error")
+		response.StatusBadRequest(c, err.Error())
+		return
+	}
+	if !volumeNameRegex.MatchString(req.Name) {
+		logger.Error().Str("name", req.Name).Msg("invalid volume name")
+		response.StatusBadRequest(c, "volume name may only contain letters, digits, '_', '.' and '-'")
+		return
+	}
+	req.Target = path.Clean(req.Target)
+
+	ctx := c.Request.Context()
+	dep, err := d.db.GetDeployment(ctx, depId)
+	if err != nil {
+		if errors.Is(err, database.ErrNotFound) {
+			logger.Error().Err(err).Str("deployment_id", depId).Msg("deployment not found")
+			response.StatusNotFound(c, "deployment not found")
+			return
+		}
+		logger.Error().Err(err).Str("deployment_id", depId).Msg("failed to find deployment")
+		response.StatusInternalServerError(c)
+		return
+	}
+	for _, v := range dep.Volumes {
+		if v.Name == req.Name || v.Target == req.Target {
+			logger.Error().Str("deployment_id", depId).Str("name", req.Name).Msg("volume already exists")
+			response.StatusConflicted(c, "volume name or target already used by "+v.Name)
+			return
+		}
+	}
+
+	vol := model.Volume{
+		Name:      req.Name,
+		Source:    volumeSource(depId, req.Name),
+		Target:    req.Target,
+		ReadOnly:  req.ReadOnly,
+		CreatedAt: time.Now(),
+	}
+	// the volume is created on the node of the deployment, or on the local engine until it is placed
+	rt, err := d.runtime(ctx, placedNode(dep))
+	if err != nil {
+		statusNodeError(c, logger, depId, err)
+		return
+	}
+	if err = rt.CreateVolume(ctx, vol.Source, depId); err != nil {
+		logger.Error().Err(err).Str("deployment_id", depId).Msg("failed to create volume")
+		response.StatusInternalServerError(c)
+		return
+	}
+
+	// the guards keep names and targets unique when two requests race
+	_, err = d.db.UpdateDeployment(ctx, depId, func(dep *model.Deployment) error {
+		for _, v := range dep.Volumes {
+			if v.Name == vol.Name || v.Target == vol.Target {
+				return database.ErrDuplicate
+			}
+		}
+		dep.UpdatedAt = time.Now()
+		dep.Volumes = append(dep.Volumes, vol)
+		if dep.ContainerId != "" {
+			dep.RecreateRequired = true
+		}
+		return nil
+	})
+	if err != nil {
+		if errors.Is(err, database.ErrDuplicate) {
+			logger.Error().Err(err).Str("deployment_id", depId).Str("name", req.Name).Msg("volume already exists")
+			response.StatusConflicted(c, "volume name or target already used")
+			return
+		}
+		logger.Error().Err(err).Str("deployment_id", depId).Msg("failed to add volume")
+		if err = rt.RemoveVolume(ctx, vol.Source); err != nil {
+			logger.Error().Err(err).Str("volume", vol.Source).Msg("failed to remove volume")
+		}
+		response.StatusInternalServerError(c)
+		return
+	}
+
+	logger.Info().Str("deployment_id", depId).Str("name", vol.Name).Str("target", vol.Target).Msg("volume created")
+	response.StatusCommonOK(c, "volume created")
+	return
+}
+
+func (d *deployment) GetVolumes(c *gin.Context) {
+	logger := d.logger.With().Str("request_id", requestid.Get(c)).Logger()
+
+	depId := c.Param("id")
+	if depId == "" {
+		logger.Error().Msg("no deployment id")
+		response.StatusBadRequest(c, "no deployment id")
+		return
+	}
+
+	ctx := c.Request.Context()
+	dep, err := d.db.GetDeployment(ctx, depId)
+	if err != nil {
+		if errors.Is(err, database.ErrNotFound) {
+			logger.Error().Err(err).Str("deployment_id", depId).Msg("deployment not found")
+			response.StatusNotFound(c, "deployment not found")
+			return
+		}
+		logger.Error().Err(err).Str("deployment_id", depId).Msg("failed to find deployment")
+		response.StatusInternalServerError(c)
+		return
+	}
+
+	if len(dep.Volumes) == 0 {
+		logger.Info().Str("deployment_id", depId).Msg("no volumes")
+		response.StatusNoContent(c)
+		return
+	}
+
+	rt, err := d.runtime(ctx, placedNode(dep))
+	if err != nil {
+		statusNodeError(c, logger, depId, err)
+		return
+	}
+	usage, err := rt.VolumeUsage(ctx)
+	if err != nil {
+		logger.Error().Err(err).Str("deployment_id", depId).Msg("failed to get volume usage")
+		response.StatusInternalServerError(c)
+		return
+	}
+
+	logger.Info().Str("deployment_id", depId).Int("volumes", len(dep.Volumes)).Msg("volumes sent")
+	response.StatusVolumes(c, dep.Volumes, usage)
+	return
+}
+
+func (d *deployment) DeleteVolume(c *gin.Context) {
+	logger := d.logger.With().Str("request_id", requestid.Get(c)).Logger()
+
+	depId := c.Param("id")
+	name := c.Param("name")
+	if depId == "" || name == "" {
+		logger.Error().Msg("no deployment id or volume name")
+		response.StatusBadRequest(c, "no deployment id or volume name")
+		return
+	}
+
+	ctx := c.Request.Context()
+	dep, err := d.db.GetDeployment(ctx, depId)
+	if err != nil && !errors.Is(err, database.ErrNotFound) {
+		logger.Error().Err(err).Str("deployment_id", depId).Msg("failed to find deployment")
+		response.StatusInternalServerError(c)
+		return
+	}
+
+	var vol *model.Volume
+	if err == nil {
+		for i := range dep.Volumes {
+			if dep.Volumes[i].Name == name {
+				vol = &dep.Volumes[i]
+			}
+		}
+	}
+	if vol == nil {
+		logger.Error().Str("deployment_id", depId).Str("name", name).Msg("volume not found")
+		response.StatusNotFound(c, "volume not found")
+		return
+	}
+
+	rt, err := d.runtime(ctx, placedNode(dep))
+	if err != nil {
+		statusNodeError(c, logger, depId, err)
+		return
+	}
+	if err = rt.RemoveVolume(ctx, vol.Source); err != nil && !client.IsErrNotFound(err) {
+		if errdefs.IsConflict(err) {
+			logger.Error().Err(err).Str("deployment_id", depId).Str("name", name).Msg("volume is in use")
+			response.StatusConflicted(c, "volume is in use, remove the deployment container first")
+			return
+		}
+		logger.Error().Err(err).Str("deployment_id", depId).Msg("failed to remove volume")
+		response.StatusInternalServerError(c)
+		return
+	}
+
+	_, err = d.db.UpdateDeployment(ctx, depId, func(dep *model.Deployment) error {
+		dep.UpdatedAt = time.Now()
+		dep.Volumes = slices.DeleteFunc(dep.Volumes, func(v model.Volume) bool {
+			return v.Name == name
+		})
+		return nil
+	})
+	if err != nil {
+		logger.Error().Err(err).Str("deployment_id", depId).Msg("failed to update deployment")
+		response.StatusInternalServerError(c)
+		return
+	}
+
+	logger.Info().Str("deployment_id", depId).Str("name", name).Msg("volume deleted")
+	response.StatusCommonOK(c, "volume deleted")
+	return
+}
@@ -0,0 +1,241 @@
+package deployment
+
+import (
+	"GDHost/internal/database"
+	"GDHost/internal/model"
+	"GDHost/internal/response"
+	"context"
+	"errors"
+	"github.com/docker/docker/api/types/events"
+	"github.com/docker/docker/client"
+	"github.com/gin-contrib/requestid"
+	"github.com/gin-gonic/gin"
+	"github.com/go-playground/validator/v10"
+	"strconv"
+	"time"
+)
+
+const (
+	defaultRestartPolicy = "unless-stopped"
+	eventsRetryInterval  = 5 * time.Second
+)
+
+// errContainerReplaced skips an update meant for a container the deployment no longer runs
+var errContainerReplaced = errors.New("container replaced")
+
+// crashLoopPolicy is the number of restarts within the window which makes a deployment crash looping
+type crashLoopPolicy struct {
+	restarts int
+	window   time.Duration
+}
+
+// containerRestarts is what the crash watcher knows about a container from its events
+type containerRestarts struct {
+	died     bool
+	exitCode int
+	oom      bool
+	starts   []time.Time
+}
+
+type RestartPolicyReq struct {
+	Name       string `json:"name" validate:"required,oneof=no on-failure unless-stopped always"`
+	MaxRetries int    `json:"max_retries,omitempty" validate:"min=0,excluded_unless=Name on-failure"`
+}
+
+func (req *RestartPolicyReq) restartPolicy() model.RestartPolicy {
+	return model.RestartPolicy{
+		Name:       req.Name,
+		MaxRetries: req.MaxRetries,
+	}
+}
+
+// withDefaultRestartPolicy returns the policy, or the default policy when the deployment has none
+func withDefaultRestartPolicy(policy model.RestartPolicy) model.RestartPolicy {
+	if policy.Name == "" {
+		policy.Name = defaultRestartPolicy
+	}
+	return policy
+}
+
+// startCrashWatcher follows the container events of the engine of the node until the context is cancelled
+func (d *deployment) startCrashWatcher(ctx context.Context, rt ContainerRuntime, node string) {
+	d.wg.Add(1)
+	go func() {
+		defer d.wg.Done()
+
+		restarts := make(map[string]*containerRestarts)
+		for {
+			msgs, errs := rt.ContainerEvents(ctx)
+			if err := d.watchEvents(ctx, msgs, errs, restarts); err != nil {
+				d.logger.Error().Err(err).Str("node", node).Msg("docker events interrupted")
+			}
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(eventsRetryInterval):
+			}
+		}
+	}()
+}
+
+// watchEvents handles the events until the stream fails or the context is cancelled.
+// A start which directly follows a die, without a stop in between, is a restart by the restart policy.
+func (d *deployment) watchEvents(ctx context.Context, msgs <-chan events.Message, errs <-chan error, restarts map[string]*containerRestarts) error {
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case err := <-errs:
+			return err
+		case msg := <-msgs:
+			cid := msg.Actor.ID
+			state, ok := restarts[cid]
+			if !ok {
+				state = &containerRestarts{}
+				restarts[cid] = state
+			}
+
+			switch msg.Action {
+			case events.ActionOOM:
+				state.oom = true
+			case events.ActionDie:
+				state.died = true
+				state.exitCode, _ = strconv.Atoi(msg.Actor.Attributes["exitCode"])
+			case events.ActionStop:
+				state.died = false
+				state.oom = false
+			case events.ActionStart:
+				if state.died {
+					d.recordRestart(ctx, cid, state)
+				}
+				state.died = false
+				state.oom = false
+			case events.ActionDestroy:
+				delete(restarts, cid)
+			}
+			if msg.Action != events.ActionOOM {
+				d.routeEvent(ctx, msg)
+			}
+		}
+	}
+}
+
+// recordRestart counts a restart and marks the deployment of the container as crash looping above the threshold
+func (d *deployment) recordRestart(ctx context.Context, cid string, state *containerRestarts) {
+	now := time.Now()
+	starts := state.starts[:0]
+	for _, t := range state.starts {
+		if now.Sub(t) < d.crash.window {
+			starts = append(starts, t)
+		}
+	}
+	state.starts = append(starts, now)
+
+	if len(state.starts) < d.crash.restarts {
+		return
+	}
+
+	err := d.updateContainerDeployment(ctx, cid, func(dep *model.Deployment) error {
+		dep.CrashLoop = &model.CrashLoop{
+			Restarts:   len(state.starts),
+			ExitCode:   state.exitCode,
+			OOMKilled:  state.oom,
+			DetectedAt: now,
+		}
+		return nil
+	})
+	if err != nil {
+		d.logger.Error().Err(err).Str("container_id", cid).Msg("failed to mark deployment as crash looping")
+		return
+	}
+	d.logger.Warn().Str("container_id", cid).Int("restarts", len(state.starts)).Int("exit_code", state.exitCode).
+		Bool("oom_killed", state.oom).Msg("container is crash looping")
+}
+
+func (d *deployment) UpdateRestartPolicy(c *gin.Context) {
+	logger := d.logger.With().Str("request_id", requestid.Get(c)).Logger()
+
+	depId := c.Param("id")
+	if depId == "" {
+		logger.Error().Msg("no deployment id")
+		response.StatusBadRequest(c, "no deployment id")
+		return
+	}
+
+	var req RestartPolicyReq
+	if err := c.BindJSON(&req); err != nil {
+		logger.Error().Err(err).Msg("failed to bind request")
+		response.StatusBadRequest(c, "failed to bind request")
+		return
+	}
+	if err := validator.New().Struct(req); err != nil {
+		logger.Error().Err(err).Msg("request validation error")
+		response.StatusBadRequest(c, err.Error())
+		return
+	}
+
+	ctx := c.Request.Context()
+	dep, err := d.db.GetDeployment(ctx, depId)
+	if err != nil {
+		if errors.Is(err, database.ErrNotFound) {
+			logger.Error().Err(err).Str("deployment_id", depId).Msg("deployment not found")
+			response.StatusNotFound(c, "deployment not found")
+			return
+		}
+		logger.Error().Err(err).Str("deployment_id", depId).Msg("failed to find deployment")
+		response.StatusInternalServerError(c)
+		return
+	}
+
+	policy := req.restartPolicy()
+	if dep.ContainerId != "" {
+		rt, err := d.runtime(ctx, placedNode(dep))
+		if err != nil {
+			statusNodeError(c, logger, depId, err)
+			return
+		}
+		if err = rt.UpdateRestartPolicy(ctx, dep.ContainerId, policy); err != nil && !client.IsErrNotFound(err) {
+			logger.Error().Err(err).Str("deployment_id", depId).Msg("failed to update container restart policy")
+			response.StatusInternalServerError(c)
+			return
+		}
+	}
+
+	_, err = d.db.UpdateDeployment(ctx, depId, func(dep *model.Deployment) error {
+		dep.UpdatedAt = time.Now()
+		dep.RestartPolicy = policy
+		return nil
+	})
+	if err != nil {
+		logger.Error().Err(err).Str("deployment_id", depId).Msg("failed to update deployment")
+		response.StatusInternalServerError(c)
+		return
+	}
+
+	logger.Info().Str("deployment_id", depId).Str("restart_policy", policy.Name).Msg("restart policy updated")
+	response.StatusCommonOK(c, "restart policy updated")
+	return
+}
+
+// updateContainerDeployment applies fn to the deployment running the container, nothing is updated when no
+// deployment runs it
+func (d *deployment) updateContainerDeployment(ctx context.Context, cid string, fn func(dep *model.Deployment) error) error {
+	deps, err := d.db.ListDeployments(ctx, database.DeploymentQuery{ContainerId: cid, Limit: 1})
+	if err != nil {
+		return err
+	}
+	if len(deps) == 0 {
+		return nil
+	}
+	_, err = d.db.UpdateDeployment(ctx, deps[0].Id, func(dep *model.Deployment) error {
+		if dep.ContainerId != cid {
+			return errContainerReplaced
+		}
+		return fn(dep)
+	})
+	if errors.Is(err, errContainerReplaced) || errors.Is(err, database.ErrNotFound) {
+		return nil
+	}
+	return err
+}
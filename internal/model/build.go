@@ -0,0 +1,59 @@
+package model
+
+import "time"
+
+type Build struct {
+	Id           string      `bson:"_id"`
+	DeploymentId string      `bson:"deployment_id"`
+	CreatedAt    time.Time   `bson:"created_at"`
+	UpdatedAt    time.Time   `bson:"updated_at"`
+	StartedAt    time.Time   `bson:"started_at,omitempty"`
+	FinishedAt   time.Time   `bson:"finished_at,omitempty"`
+	Status       buildStatus `bson:"status"`
+	ImageId      string      `bson:"image_id,omitempty"`
+	Release      int         `bson:"release,omitempty"`
+	Error        string      `bson:"error,omitempty"`
+}
+
+type buildStatus int
+
+// Queued and Running must stay below the finished statuses, the database relies on it
+// to allow only one active build per deployment.
+const (
+	BuildQueued buildStatus = iota
+	BuildRunning
+	BuildSucceeded
+	BuildFailed
+)
+
+func (s buildStatus) String() string {
+	switch s {
+	case BuildQueued:
+		return "Queued"
+	case BuildRunning:
+		return "Running"
+	case BuildSucceeded:
+		return "Succeeded"
+	case BuildFailed:
+		return "Failed"
+	default:
+		return "Unknown"
+	}
+}
+
+type BuildLog struct {
+	Id      string    `bson:"_id"`
+	BuildId string    `bson:"build_id"`
+	Seq     int       `bson:"seq"`
+	Time    time.Time `bson:"time"`
+	Type    string    `bson:"type"`
+	Line    string    `bson:"line"`
+}
+
+// Types of BuildLog, following the messages of the docker build output
+const (
+	BuildLogStream = "stream"
+	BuildLogStatus = "status"
+	BuildLogAux    = "aux"
+	BuildLogError  = "error"
+)
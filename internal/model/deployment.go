@@ -13,6 +13,92 @@ type Deployment struct {
 	ImageId     string    `bson:"image_id,omitempty"`
 	Stage       stage     `bson:"stage"`
 	ContainerId string    `bson:"container_id,omitempty"`
+	LastBuildId string    `bson:"last_build_id,omitempty"`
+	BuildError  string    `bson:"build_error,omitempty"`
+	Release     int       `bson:"release,omitempty"`
+	// HostPort and ContainerPort are the first tcp mapping of Ports, it is the one health checked and proxied
+	HostPort      int    `bson:"host_port,omitempty"`
+	ContainerPort int    `bson:"container_port,omitempty"`
+	Ports         []Port `bson:"ports,omitempty"`
+	ProxyPort     int    `bson:"proxy_port,omitempty"`
+	// Env is passed to the container as it is. Secrets are encrypted with the configured secret key.
+	Env              map[string]string `bson:"env,omitempty"`
+	Secrets          map[string]string `bson:"secrets,omitempty"`
+	RecreateRequired bool              `bson:"recreate_required,omitempty"`
+	Resources        Resources         `bson:"resources,omitempty"`
+	RestartPolicy    RestartPolicy     `bson:"restart_policy,omitempty"`
+	CrashLoop        *CrashLoop        `bson:"crash_loop,omitempty"`
+	HealthCheck      *HealthCheck      `bson:"health_check,omitempty"`
+	Health           *Health           `bson:"health,omitempty"`
+	Volumes          []Volume          `bson:"volumes,omitempty"`
+	Route            *Route            `bson:"route,omitempty"`
+	// Links are the deployments the container reaches by name on their networks
+	Links []string `bson:"links,omitempty"`
+	// Node is the engine the deployment is placed on, empty is the local engine
+	Node string `bson:"node,omitempty"`
+}
+
+// Route also serves the deployment on the base domain under PathPrefix, besides its own hostname
+type Route struct {
+	PathPrefix  string `bson:"path_prefix"`
+	StripPrefix bool   `bson:"strip_prefix,omitempty"`
+}
+
+// Port publishes the container port on the host port. An empty HostIP binds every interface.
+type Port struct {
+	HostIP        string `bson:"host_ip,omitempty"`
+	HostPort      int    `bson:"host_port"`
+	ContainerPort int    `bson:"container_port"`
+	Protocol      string `bson:"protocol"`
+}
+
+// PortMappings returns the port mappings of the deployment.
+// Deployments run before the mappings were stored only have the single tcp host_port and container_port.
+func (d *Deployment) PortMappings() []Port {
+	if len(d.Ports) != 0 || d.HostPort == 0 || d.ContainerPort == 0 {
+		return d.Ports
+	}
+	return []Port{{HostPort: d.HostPort, ContainerPort: d.ContainerPort, Protocol: "tcp"}}
+}
+
+// Volume is a docker volume owned by the deployment and mounted at Target
+type Volume struct {
+	Name      string    `bson:"name"`
+	Source    string    `bson:"source"`
+	Target    string    `bson:"target"`
+	ReadOnly  bool      `bson:"read_only,omitempty"`
+	CreatedAt time.Time `bson:"created_at"`
+}
+
+type RestartPolicy struct {
+	Name       string `bson:"name,omitempty"`
+	MaxRetries int    `bson:"max_retries,omitempty"`
+}
+
+// CrashLoop is set by the crash watcher when the container keeps restarting and cleared when a container is started
+// again by run, deploy or rollback. It is kept next to the Stage, which tracks how far the deployment was set up,
+// so a crash looping deployment is found with DeploymentQuery.CrashLooping instead of a stage.
+type CrashLoop struct {
+	Restarts   int       `bson:"restarts"`
+	ExitCode   int       `bson:"exit_code"`
+	OOMKilled  bool      `bson:"oom_killed"`
+	DetectedAt time.Time `bson:"detected_at"`
+}
+
+// Resources are the limits applied to the container of a deployment. Zero means unlimited.
+type Resources struct {
+	MemoryMB            int64    `bson:"memory_mb,omitempty"`
+	MemoryReservationMB int64    `bson:"memory_reservation_mb,omitempty"`
+	CPUQuota            int64    `bson:"cpu_quota,omitempty"`
+	CPUShares           int64    `bson:"cpu_shares,omitempty"`
+	PidsLimit           int64    `bson:"pids_limit,omitempty"`
+	Ulimits             []Ulimit `bson:"ulimits,omitempty"`
+}
+
+type Ulimit struct {
+	Name string `bson:"name"`
+	Soft int64  `bson:"soft"`
+	Hard int64  `bson:"hard"`
 }
 
 type stage int
@@ -46,6 +132,48 @@ func (s stage) String() string {
 
 }
 
+// HealthCheck is an http, tcp or command check of the container. Durations are in seconds.
+// Command checks run inside the container by docker, http and tcp checks are probed by GDHost.
+type HealthCheck struct {
+	Type        string `bson:"type"`
+	Path        string `bson:"path,omitempty"`
+	Port        int    `bson:"port,omitempty"`
+	Command     string `bson:"command,omitempty"`
+	Interval    int    `bson:"interval"`
+	Timeout     int    `bson:"timeout"`
+	Retries     int    `bson:"retries"`
+	StartPeriod int    `bson:"start_period,omitempty"`
+}
+
+// Health is the result of the last probe of the health check
+type Health struct {
+	Status    healthStatus `bson:"status"`
+	Output    string       `bson:"output,omitempty"`
+	Failures  int          `bson:"failures"`
+	CheckedAt time.Time    `bson:"checked_at"`
+}
+
+type healthStatus int
+
+const (
+	HealthStarting healthStatus = iota
+	HealthHealthy
+	HealthUnhealthy
+)
+
+func (s healthStatus) String() string {
+	switch s {
+	case HealthStarting:
+		return "starting"
+	case HealthHealthy:
+		return "healthy"
+	case HealthUnhealthy:
+		return "unhealthy"
+	default:
+		return "unknown"
+	}
+}
+
 type Dockerfile struct {
 	Id   string `bson:"_id"`
 	Data string `bson:"data"`
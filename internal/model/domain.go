@@ -0,0 +1,16 @@
+package model
+
+import "time"
+
+// Domain is a custom hostname of a deployment. It is routed once the token served by GDHost was verified on it.
+type Domain struct {
+	Name         string    `bson:"_id"`
+	DeploymentId string    `bson:"deployment_id"`
+	Token        string    `bson:"token"`
+	CreatedAt    time.Time `bson:"created_at"`
+	VerifiedAt   time.Time `bson:"verified_at,omitempty"`
+}
+
+func (d *Domain) Verified() bool {
+	return !d.VerifiedAt.IsZero()
+}
@@ -0,0 +1,20 @@
+package model
+
+import "time"
+
+// Node is a docker engine the deployments can be placed on besides the local engine of GDHost.
+// The TLS key is encrypted with the configured secret key.
+type Node struct {
+	Name     string `bson:"_id"`
+	Endpoint string `bson:"endpoint"`
+	// Address is where the published ports of the containers on the node are reached
+	Address   string            `bson:"address"`
+	TLSCACert string            `bson:"tls_ca_cert,omitempty"`
+	TLSCert   string            `bson:"tls_cert,omitempty"`
+	TLSKey    string            `bson:"tls_key,omitempty"`
+	Labels    map[string]string `bson:"labels,omitempty"`
+	// Capacity is the number of containers the node runs at most, 0 is unlimited
+	Capacity  int       `bson:"capacity,omitempty"`
+	CreatedAt time.Time `bson:"created_at"`
+	UpdatedAt time.Time `bson:"updated_at"`
+}
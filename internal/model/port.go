@@ -0,0 +1,12 @@
+package model
+
+import "time"
+
+// PortReservation holds a host port for a deployment on every interface, the id is protocol/port
+type PortReservation struct {
+	Id           string    `bson:"_id"`
+	Protocol     string    `bson:"protocol"`
+	HostPort     int       `bson:"host_port"`
+	DeploymentId string    `bson:"deployment_id"`
+	CreatedAt    time.Time `bson:"created_at"`
+}
@@ -0,0 +1,16 @@
+package model
+
+import "time"
+
+type Release struct {
+	Id           string    `bson:"_id"`
+	DeploymentId string    `bson:"deployment_id"`
+	CreatedAt    time.Time `bson:"created_at"`
+	Version      int       `bson:"version"`
+	Tag          string    `bson:"tag"`
+	ImageId      string    `bson:"image_id"`
+	BuildId      string    `bson:"build_id"`
+	Checksum     string    `bson:"checksum"`
+	Dockerfile   string    `bson:"dockerfile"`
+	PrunedAt     time.Time `bson:"pruned_at,omitempty"`
+}
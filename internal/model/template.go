@@ -0,0 +1,23 @@
+package model
+
+import "time"
+
+type Template struct {
+	Id          string              `bson:"_id"`
+	CreatedAt   time.Time           `bson:"created_at"`
+	UpdatedAt   time.Time           `bson:"updated_at"`
+	Name        string              `bson:"name"`
+	Description string              `bson:"description,omitempty"`
+	Data        string              `bson:"data"`
+	Parameters  []TemplateParameter `bson:"parameters"`
+	BuiltIn     bool                `bson:"built_in"`
+}
+
+type TemplateParameter struct {
+	Name        string   `bson:"name"`
+	Type        string   `bson:"type"`
+	Required    bool     `bson:"required"`
+	Default     string   `bson:"default,omitempty"`
+	Enum        []string `bson:"enum,omitempty"`
+	Description string   `bson:"description,omitempty"`
+}
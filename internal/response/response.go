@@ -2,6 +2,7 @@ package response
 
 import (
 	"GDHost/internal/model"
+	"github.com/docker/docker/api/types/volume"
 	"github.com/gin-gonic/gin"
 	"net/http"
 	"time"
@@ -21,13 +22,68 @@ func StatusBadRequest(c *gin.Context, payload string) {
 	})
 }
 
-func StatusDeployment(c *gin.Context, dep *model.Deployment) {
+// StatusDeployment shows the http proxy host of the deployment when it has one
+func StatusDeployment(c *gin.Context, dep *model.Deployment, host string) {
 	payload := map[string]interface{}{
-		"ID":         dep.Id,
-		"created_at": dep.CreatedAt,
-		"updated_at": dep.UpdatedAt,
-		"name":       dep.Name,
-		"stage":      dep.Stage.String(),
+		"ID":                dep.Id,
+		"created_at":        dep.CreatedAt,
+		"updated_at":        dep.UpdatedAt,
+		"name":              dep.Name,
+		"stage":             dep.Stage.String(),
+		"last_build_id":     dep.LastBuildId,
+		"build_error":       dep.BuildError,
+		"release":           dep.Release,
+		"host_port":         dep.HostPort,
+		"ports":             portsPayload(dep.PortMappings()),
+		"proxied":           dep.ProxyPort != 0,
+		"recreate_required": dep.RecreateRequired,
+		"resources":         resourcesPayload(dep.Resources),
+		"restart_policy": map[string]interface{}{
+			"name":        dep.RestartPolicy.Name,
+			"max_retries": dep.RestartPolicy.MaxRetries,
+		},
+		"crash_looping": dep.CrashLoop != nil,
+		"health":        healthStatus(dep),
+	}
+	if dep.Health != nil {
+		payload["health_output"] = dep.Health.Output
+		payload["health_failures"] = dep.Health.Failures
+		payload["health_checked_at"] = dep.Health.CheckedAt
+	}
+	if hc := dep.HealthCheck; hc != nil {
+		payload["health_check"] = map[string]interface{}{
+			"type":         hc.Type,
+			"path":         hc.Path,
+			"port":         hc.Port,
+			"command":      hc.Command,
+			"interval":     hc.Interval,
+			"timeout":      hc.Timeout,
+			"retries":      hc.Retries,
+			"start_period": hc.StartPeriod,
+		}
+	}
+	if host != "" {
+		payload["http_host"] = host
+	}
+	if len(dep.Links) != 0 {
+		payload["links"] = dep.Links
+	}
+	if dep.Node != "" {
+		payload["node"] = dep.Node
+	}
+	if dep.Route != nil {
+		payload["route"] = map[string]interface{}{
+			"path_prefix":  dep.Route.PathPrefix,
+			"strip_prefix": dep.Route.StripPrefix,
+		}
+	}
+	if dep.CrashLoop != nil {
+		payload["crash_loop"] = map[string]interface{}{
+			"restarts":    dep.CrashLoop.Restarts,
+			"exit_code":   dep.CrashLoop.ExitCode,
+			"oom_killed":  dep.CrashLoop.OOMKilled,
+			"detected_at": dep.CrashLoop.DetectedAt,
+		}
 	}
 	c.JSON(http.StatusOK, gin.H{
 		"deployment": payload,
@@ -64,11 +120,13 @@ func StatusDeployments(c *gin.Context, deps *[]model.Deployment) {
 	var payload []map[string]interface{}
 	for _, dep := range *deps {
 		depMap := map[string]interface{}{
-			"ID":         dep.Id,
-			"created_at": dep.CreatedAt,
-			"updated_at": dep.UpdatedAt,
-			"name":       dep.Name,
-			"stage":      dep.Stage.String(),
+			"ID":            dep.Id,
+			"created_at":    dep.CreatedAt,
+			"updated_at":    dep.UpdatedAt,
+			"name":          dep.Name,
+			"stage":         dep.Stage.String(),
+			"health":        healthStatus(&dep),
+			"crash_looping": dep.CrashLoop != nil,
 		}
 		payload = append(payload, depMap)
 	}
@@ -89,6 +147,347 @@ func StatusUnProcessed(c *gin.Context, payload string) {
 func StatusConflicted(c *gin.Context, payload string) {
 	c.JSON(http.StatusConflict, gin.H{
 		"message": payload,
-		"ts":      time.Now,
+		"ts":      time.Now(),
+	})
+}
+
+// StatusPortTaken has no deployment id when the port is bound on the host outside GDHost
+func StatusPortTaken(c *gin.Context, payload string, depId string) {
+	body := gin.H{
+		"message": payload,
+		"ts":      time.Now(),
+	}
+	if depId != "" {
+		body["deployment_id"] = depId
+	}
+	c.JSON(http.StatusConflict, body)
+}
+
+func StatusDetection(c *gin.Context, detection interface{}) {
+	c.JSON(http.StatusOK, gin.H{
+		"detection": detection,
+		"ts":        time.Now(),
+	})
+}
+
+func StatusTemplate(c *gin.Context, tmpl *model.Template) {
+	c.JSON(http.StatusOK, gin.H{
+		"template": templatePayload(tmpl, true),
+		"ts":       time.Now(),
+	})
+}
+
+func StatusTemplates(c *gin.Context, tmpls *[]model.Template) {
+	var payload []map[string]interface{}
+	for _, tmpl := range *tmpls {
+		payload = append(payload, templatePayload(&tmpl, false))
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"templates": payload,
+		"ts":        time.Now(),
+	})
+}
+
+func templatePayload(tmpl *model.Template, data bool) map[string]interface{} {
+	var params []map[string]interface{}
+	for _, param := range tmpl.Parameters {
+		params = append(params, map[string]interface{}{
+			"name":        param.Name,
+			"type":        param.Type,
+			"required":    param.Required,
+			"default":     param.Default,
+			"enum":        param.Enum,
+			"description": param.Description,
+		})
+	}
+	payload := map[string]interface{}{
+		"ID":          tmpl.Id,
+		"created_at":  tmpl.CreatedAt,
+		"updated_at":  tmpl.UpdatedAt,
+		"name":        tmpl.Name,
+		"description": tmpl.Description,
+		"parameters":  params,
+		"built_in":    tmpl.BuiltIn,
+	}
+	if data {
+		payload["data"] = tmpl.Data
+	}
+	return payload
+}
+
+func StatusBuild(c *gin.Context, build *model.Build) {
+	payload := map[string]interface{}{
+		"ID":            build.Id,
+		"deployment_id": build.DeploymentId,
+		"created_at":    build.CreatedAt,
+		"updated_at":    build.UpdatedAt,
+		"started_at":    build.StartedAt,
+		"finished_at":   build.FinishedAt,
+		"status":        build.Status.String(),
+		"image_id":      build.ImageId,
+		"release":       build.Release,
+		"error":         build.Error,
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"build": payload,
+		"ts":    time.Now(),
+	})
+}
+
+func StatusBuildLogs(c *gin.Context, logs *[]model.BuildLog) {
+	payload := make([]map[string]interface{}, 0, len(*logs))
+	for _, log := range *logs {
+		payload = append(payload, buildLogPayload(&log))
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"logs": payload,
+		"ts":   time.Now(),
+	})
+}
+
+func EventBuildLog(c *gin.Context, log *model.BuildLog) {
+	c.SSEvent("log", buildLogPayload(log))
+}
+
+func buildLogPayload(log *model.BuildLog) map[string]interface{} {
+	return map[string]interface{}{
+		"seq":  log.Seq,
+		"time": log.Time,
+		"type": log.Type,
+		"line": log.Line,
+	}
+}
+
+func StatusRelease(c *gin.Context, release *model.Release) {
+	c.JSON(http.StatusOK, gin.H{
+		"release": releasePayload(release, true),
+		"ts":      time.Now(),
+	})
+}
+
+func StatusReleases(c *gin.Context, releases *[]model.Release) {
+	var payload []map[string]interface{}
+	for _, release := range *releases {
+		payload = append(payload, releasePayload(&release, false))
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"releases": payload,
+		"ts":       time.Now(),
+	})
+}
+
+func releasePayload(release *model.Release, dockerfile bool) map[string]interface{} {
+	payload := map[string]interface{}{
+		"ID":         release.Id,
+		"created_at": release.CreatedAt,
+		"version":    release.Version,
+		"tag":        release.Tag,
+		"image_id":   release.ImageId,
+		"build_id":   release.BuildId,
+		"checksum":   release.Checksum,
+		"retained":   release.PrunedAt.IsZero(),
+	}
+	if dockerfile {
+		payload["dockerfile"] = release.Dockerfile
+	}
+	return payload
+}
+
+func StatusEnv(c *gin.Context, dep *model.Deployment) {
+	env := dep.Env
+	if env == nil {
+		env = map[string]string{}
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"env":               env,
+		"recreate_required": dep.RecreateRequired,
+		"ts":                time.Now(),
+	})
+}
+
+func StatusSecrets(c *gin.Context, names []string) {
+	c.JSON(http.StatusOK, gin.H{
+		"secrets": names,
+		"ts":      time.Now(),
+	})
+}
+
+func resourcesPayload(res model.Resources) map[string]interface{} {
+	ulimits := make([]map[string]interface{}, 0, len(res.Ulimits))
+	for _, u := range res.Ulimits {
+		ulimits = append(ulimits, map[string]interface{}{
+			"name": u.Name,
+			"soft": u.Soft,
+			"hard": u.Hard,
+		})
+	}
+	return map[string]interface{}{
+		"memory_mb":             res.MemoryMB,
+		"memory_reservation_mb": res.MemoryReservationMB,
+		"cpu_quota":             res.CPUQuota,
+		"cpu_shares":            res.CPUShares,
+		"pids_limit":            res.PidsLimit,
+		"ulimits":               ulimits,
+	}
+}
+
+// portsPayload lists where the container is published, an empty host ip binds every interface
+func portsPayload(ports []model.Port) []map[string]interface{} {
+	payload := make([]map[string]interface{}, 0, len(ports))
+	for _, p := range ports {
+		hostIP := p.HostIP
+		if hostIP == "" {
+			hostIP = "0.0.0.0"
+		}
+		payload = append(payload, map[string]interface{}{
+			"host_ip":        hostIP,
+			"host_port":      p.HostPort,
+			"container_port": p.ContainerPort,
+			"protocol":       p.Protocol,
+		})
+	}
+	return payload
+}
+
+// healthStatus returns none without a health check and starting until the first probe
+func healthStatus(dep *model.Deployment) string {
+	if dep.HealthCheck == nil {
+		return "none"
+	}
+	if dep.Health == nil {
+		return model.HealthStarting.String()
+	}
+	return dep.Health.Status.String()
+}
+
+func StatusVolumes(c *gin.Context, vols []model.Volume, usage map[string]*volume.UsageData) {
+	payload := make([]map[string]interface{}, 0, len(vols))
+	for _, v := range vols {
+		size, refs := int64(-1), int64(-1)
+		if u := usage[v.Source]; u != nil {
+			size, refs = u.Size, u.RefCount
+		}
+		payload = append(payload, map[string]interface{}{
+			"name":       v.Name,
+			"source":     v.Source,
+			"target":     v.Target,
+			"read_only":  v.ReadOnly,
+			"created_at": v.CreatedAt,
+			"size":       size,
+			"ref_count":  refs,
+		})
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"volumes": payload,
+		"ts":      time.Now(),
+	})
+}
+
+// domainPayload has the token and the url it is checked on until the domain is verified
+func domainPayload(domain *model.Domain, challengeURL string) map[string]interface{} {
+	payload := map[string]interface{}{
+		"name":          domain.Name,
+		"deployment_id": domain.DeploymentId,
+		"created_at":    domain.CreatedAt,
+		"status":        "active",
+	}
+	if !domain.Verified() {
+		payload["status"] = "pending"
+		payload["token"] = domain.Token
+		payload["verification_url"] = challengeURL
+		return payload
+	}
+	payload["verified_at"] = domain.VerifiedAt
+	return payload
+}
+
+func StatusDomain(c *gin.Context, domain *model.Domain, challengeURL string) {
+	c.JSON(http.StatusOK, gin.H{
+		"domain": domainPayload(domain, challengeURL),
+		"ts":     time.Now(),
+	})
+}
+
+func StatusDomains(c *gin.Context, domains *[]model.Domain, challengeURL func(*model.Domain) string) {
+	payload := make([]map[string]interface{}, 0, len(*domains))
+	for i := range *domains {
+		payload = append(payload, domainPayload(&(*domains)[i], challengeURL(&(*domains)[i])))
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"domains": payload,
+		"ts":      time.Now(),
+	})
+}
+
+// StatusLinks lists the linked deployments with the names they are reached by
+func StatusLinks(c *gin.Context, links *[]model.Deployment, aliases map[string][]string) {
+	payload := make([]map[string]interface{}, 0, len(*links))
+	for _, dep := range *links {
+		payload = append(payload, map[string]interface{}{
+			"deployment_id": dep.Id,
+			"name":          dep.Name,
+			"aliases":       aliases[dep.Id],
+		})
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"links": payload,
+		"ts":    time.Now(),
+	})
+}
+
+// NodeState is what GDHost knows about the engine of a node
+type NodeState struct {
+	Available  bool
+	Error      string
+	Engine     string
+	Version    string
+	Rootless   bool
+	Containers int
+}
+
+// nodePayload never has the TLS key of the node
+func nodePayload(node *model.Node, state NodeState) map[string]interface{} {
+	payload := map[string]interface{}{
+		"name":       node.Name,
+		"endpoint":   node.Endpoint,
+		"address":    node.Address,
+		"labels":     node.Labels,
+		"capacity":   node.Capacity,
+		"containers": state.Containers,
+		"tls":        node.TLSCert != "" || node.TLSCACert != "",
+		"available":  state.Available,
+	}
+	if !node.CreatedAt.IsZero() {
+		payload["created_at"] = node.CreatedAt
+		payload["updated_at"] = node.UpdatedAt
+	}
+	if state.Available {
+		payload["engine"] = state.Engine
+		payload["version"] = state.Version
+		payload["rootless"] = state.Rootless
+	} else {
+		payload["error"] = state.Error
+	}
+	return payload
+}
+
+func StatusNode(c *gin.Context, node *model.Node, state NodeState) {
+	c.JSON(http.StatusOK, gin.H{
+		"node": nodePayload(node, state),
+		"ts":   time.Now(),
+	})
+}
+
+func StatusNodes(c *gin.Context, nodes *[]model.Node, states map[string]NodeState) {
+	payload := make([]map[string]interface{}, 0, len(*nodes))
+	for i := range *nodes {
+		payload = append(payload, nodePayload(&(*nodes)[i], states[(*nodes)[i].Name]))
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"nodes": payload,
+		"ts":    time.Now(),
 	})
 }
@@ -0,0 +1,8 @@
+package template
+
+import "embed"
+
+// FS contains the built-in dockerfile templates
+//
+//go:embed *.tmpl
+var FS embed.FS
@@ -2,6 +2,8 @@ package utility
 
 import (
 	"archive/zip"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
 	logs "github.com/rs/zerolog/log"
 	"io"
@@ -22,6 +24,25 @@ func DeleteAll(path string) error {
 	return os.RemoveAll(path)
 }
 
+// Checksum returns the hex encoded sha256 checksum of the file
+func Checksum(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", fmt.Errorf("failed to open file: %w", err)
+	}
+	defer func() {
+		if err = f.Close(); err != nil {
+			logs.Error().Err(err).Msg("failed to close file")
+		}
+	}()
+
+	h := sha256.New()
+	if _, err = io.Copy(h, f); err != nil {
+		return "", fmt.Errorf("failed to read file: %w", err)
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
 func RemoveExceptDockerfile(path string) error {
 	files, err := os.ReadDir(path)
 	if err != nil {
@@ -105,3 +126,41 @@ func Unzip(src, dest string) error {
 	}
 	return nil
 }
+
+// ReadZipRoot reads the files at the root of the zip archive. Files bigger than limit are listed without content.
+func ReadZipRoot(src string, limit uint64) (map[string][]byte, error) {
+	r, err := zip.OpenReader(src)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open zip reader: %w", err)
+	}
+	defer func() {
+		if err = r.Close(); err != nil {
+			logs.Error().Err(err).Msg("failed to close zip reader")
+		}
+	}()
+
+	files := make(map[string][]byte)
+	for _, f := range r.File {
+		if f.FileInfo().IsDir() || strings.Contains(strings.TrimSuffix(f.Name, "/"), "/") {
+			continue
+		}
+		if f.UncompressedSize64 > limit {
+			files[f.Name] = nil
+			continue
+		}
+
+		rc, err := f.Open()
+		if err != nil {
+			return nil, fmt.Errorf("failed to open file: %w", err)
+		}
+		data, err := io.ReadAll(rc)
+		if err2 := rc.Close(); err2 != nil {
+			logs.Error().Err(err2).Msg("failed to close file")
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read file: %w", err)
+		}
+		files[f.Name] = data
+	}
+	return files, nil
+}
@@ -4,6 +4,7 @@ import (
 	"GDHost/api"
 	"GDHost/internal/config"
 	"GDHost/internal/database"
+	"GDHost/internal/deployment"
 	"GDHost/internal/logger"
 	"context"
 	"errors"
@@ -29,6 +30,7 @@ type app struct {
 
 func main() {
 	flag.String("conf", `configuration.json`, "Configuration file path")
+	flag.Bool("demo", false, "Keep the records in memory, no database is needed")
 	pflag.CommandLine.AddGoFlagSet(flag.CommandLine)
 	pflag.Parse()
 	_ = viper.BindPFlags(pflag.CommandLine)
@@ -42,14 +44,33 @@ func main() {
 
 	a.logger = logger.InitLog(a.conf.LogLevel)
 
-	if a.db, err = database.NewDatabaseConnection(a.conf.DatabaseHost); err != nil {
+	switch a.conf.DatabaseDriver {
+	case database.DriverBolt:
+		a.db, err = database.NewBoltDatabase(a.conf.DatabasePath)
+	case database.DriverMemory:
+		a.db = database.NewMemoryDatabase()
+	default:
+		a.db, err = database.NewDatabaseConnection(a.conf.DatabaseHost)
+	}
+	if err != nil {
 		a.logger.Fatal().Err(err).Msg("database error")
 	}
-	a.logger.Info().Msg("database connected")
+	a.logger.Info().Str("driver", a.conf.DatabaseDriver).Msg("database connected")
+	if a.conf.Demo {
+		a.logger.Warn().Msg("demo mode, the records are lost when the server stops")
+	}
+
+	ctr, err := deployment.NewDockerRuntime(a.conf)
+	if err != nil {
+		a.logger.Fatal().Err(err).Msg("container runtime error")
+	}
+	info := ctr.Info()
+	a.logger.Info().Str("engine", info.Engine).Str("version", info.Version).Str("host", info.Host).
+		Bool("rootless", info.Rootless).Msg("container runtime detected")
 
 	host := ":" + strconv.Itoa(a.conf.Port)
-	a.server = api.NewServer(a.conf.APIPath, host, a.conf.Location, a.logger)
-	if err = a.server.SetUpRouter(a.db); err != nil {
+	a.server = api.NewServer(host, a.conf, a.logger)
+	if err = a.server.SetUpRouter(a.db, ctr, deployment.NewDockerDialer(a.conf.DockerNetwork), deployment.HostPortFree); err != nil {
 		a.logger.Fatal().Err(err).Msg("failed to set up the router")
 	}
 